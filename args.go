@@ -0,0 +1,94 @@
+package fmtd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrInvalidBuildArg is returned when a build argument has no name.
+var ErrInvalidBuildArg = errors.New("invalid build argument")
+
+// Sources of build arguments' values, from highest to lowest precedence.
+const (
+	ArgFromCLI     = "command line"
+	ArgFromEnv     = "environment"
+	ArgFromConfig  = ConfigFilename
+	ArgFromDefault = "default"
+)
+
+// WithBuildArg overrides the value of a preset build argument (e.g. GOFMT_IMAGE).
+// This takes precedence over ARG_ environment variables, which take precedence
+// over the configuration file's args.
+func WithBuildArg(name, value string) Option {
+	return func(o *options) error {
+		if name == "" || strings.ContainsAny(name, "= \t\n") {
+			return fmt.Errorf("%w: %q", ErrInvalidBuildArg, name)
+		}
+		if o.cliArgs == nil {
+			o.cliArgs = make(map[string]string)
+		}
+		o.cliArgs[name] = value
+		return nil
+	}
+}
+
+// WithEnviron has ARG_ variables be read from environ instead of os.Environ(),
+// and Docker and local formatters be run with environ as their environment
+// (which should then hold e.g. PATH, HOME and DOCKER_HOST).
+func WithEnviron(environ []string) Option {
+	return func(o *options) error {
+		o.environ = environ
+		return nil
+	}
+}
+
+// resolveBuildArgs settles the value of every build argument, picking
+// in order from the command line, ARG_ variables (see WithEnviron),
+// the configuration file then fmtd's presets.
+// Only values not coming from presets are kept in o.buildArgs.
+func (o *options) resolveBuildArgs() (sources map[string]string) {
+	environ := o.environ
+	if environ == nil {
+		environ = os.Environ()
+	}
+	sources = make(map[string]string)
+	o.buildArgs = make(map[string]string)
+	set := func(source string, args map[string]string) {
+		for name, value := range args {
+			if _, ok := sources[name]; !ok {
+				sources[name] = source
+				o.buildArgs[name] = value
+			}
+		}
+	}
+
+	set(ArgFromCLI, o.cliArgs)
+	env := make(map[string]string)
+	for _, kv := range environ {
+		if strings.HasPrefix(kv, "ARG_") {
+			if i := strings.IndexByte(kv, '='); i != -1 {
+				env[kv[len("ARG_"):i]] = kv[i+1:]
+			}
+		}
+	}
+	set(ArgFromEnv, env)
+	if o.config != nil {
+		set(ArgFromConfig, o.config.Args)
+	}
+	for _, arg := range allPresets() {
+		if _, ok := sources[arg.name]; !ok {
+			sources[arg.name] = ArgFromDefault
+		}
+	}
+	return
+}
+
+// printBuildArgs writes the effective value of every overridden build argument
+// along with where it comes from.
+func (o *options) printBuildArgs(sources map[string]string) {
+	for _, name := range o.buildArgNames() {
+		fmt.Fprintf(o.verbose, "fmtd: ARG_%s=%s (%s)\n", name, o.buildArgs[name], sources[name])
+	}
+}
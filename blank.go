@@ -0,0 +1,49 @@
+package fmtd
+
+import (
+	"bufio"
+	"io"
+	"unicode"
+)
+
+// dropBlank separates the paths of files some formatter handles that are empty
+// or hold only whitespace from the others. These are left as they are, as already
+// formatted: some formatters fail on empty input or make something of nothing.
+func (o *options) dropBlank(paths []string) (blanks, rest []string, err error) {
+	for _, path := range paths {
+		if o.ruleFor(path) != nil {
+			var isBlank bool
+			if isBlank, err = o.blank(path); err != nil {
+				return
+			}
+			if isBlank {
+				blanks = append(blanks, path)
+				continue
+			}
+		}
+		rest = append(rest, path)
+	}
+	return
+}
+
+// blank tells whether the file at path is empty or holds only whitespace.
+func (o *options) blank(path string) (bool, error) {
+	f, err := o.open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		c, _, err := r.ReadRune()
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if !unicode.IsSpace(c) {
+			return false, nil
+		}
+	}
+}
@@ -4,11 +4,15 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
 type options struct {
@@ -19,9 +23,17 @@ type options struct {
 	args           []string
 	dockerfiler    func(map[interface{}]interface{}) []byte
 	stdoutf        string
+	sidecars       map[string]io.Writer
 	dirA, dirB     string
 	ifiles         []inputfile
+	cleanups       []func()
 	ofilefunc      OutputFileFunc
+	retries        int
+	backoff        time.Duration
+	selectionErrs  SelectionErrors
+	preflight      bool
+	stderrPrefix   string
+	contextDir     string
 
 	foundFilenamesByTraversingDirs bool
 }
@@ -29,26 +41,43 @@ type options struct {
 // New calls `DOCKER_BUILDKIT=1 docker build ...` with given Dockerfile
 func New(opts ...Option) (err error) {
 	o := &options{
-		ctx:         context.Background(),
-		stdout:      os.Stdout,
-		stderr:      os.Stderr,
-		env:         os.Environ(),
-		exe:         "",
-		args:        []string{"build", "--output=-"},
-		dockerfiler: nil,
-		stdoutf:     "stdout",
-		dirA:        "a",
-		dirB:        "b",
-		ifiles:      nil,
-		ofilefunc:   nil,
+		ctx:           context.Background(),
+		stdout:        os.Stdout,
+		stderr:        os.Stderr,
+		env:           os.Environ(),
+		exe:           "",
+		args:          []string{"build", "--output=-"},
+		dockerfiler:   nil,
+		stdoutf:       "stdout",
+		sidecars:      nil,
+		dirA:          "a",
+		dirB:          "b",
+		ifiles:        nil,
+		cleanups:      nil,
+		ofilefunc:     nil,
+		retries:       0,
+		backoff:       0,
+		selectionErrs: nil,
+		preflight:     true,
+		stderrPrefix:  "",
+		contextDir:    "",
 	}
 
+	defer func() {
+		for _, cleanup := range o.cleanups {
+			cleanup()
+		}
+	}()
 	for _, opt := range opts {
 		if err = opt(o); err != nil {
 			return
 		}
 	}
 
+	if _, ok := o.sidecars[o.stdoutf]; ok {
+		return ErrSidecarFileSet
+	}
+
 	if o.exe == "" {
 		exe, err := exec.LookPath("docker")
 		if err != nil {
@@ -57,61 +86,113 @@ func New(opts ...Option) (err error) {
 		o.exe = exe
 	}
 
+	if o.contextDir != "" && len(o.ifiles) != 0 {
+		return ErrContextDirWithInputFiles
+	}
+
+	if o.preflight {
+		if err := o.ensureBuildkit(); err != nil {
+			return err
+		}
+	}
+
+	sizes := make(map[string]int64, len(o.ifiles))
+	for _, ifile := range o.ifiles {
+		sizes[ifile.filename] = int64(len(ifile.data))
+		if ifile.r != nil || ifile.tar != nil {
+			sizes[ifile.filename] = ifile.size
+		}
+	}
+
 	dockerfile := o.dockerfiler(map[interface{}]interface{}{
 		"foundFilenamesByTraversingDirs": o.foundFilenamesByTraversingDirs,
+		"inputFileSizes":                 sizes,
 	})
 	if len(dockerfile) == 0 {
 		return ErrNoDockerfile
 	}
 
-	var stdin bytes.Buffer
-	tw := tar.NewWriter(&stdin)
-	{
-		hdr := &tar.Header{
-			Name: "Dockerfile",
-			Mode: 0200,
-			Size: int64(len(dockerfile)),
-		}
-		if err := tw.WriteHeader(hdr); err != nil {
-			return err
-		}
-		if _, err := tw.Write(dockerfile); err != nil {
-			return err
+	seen := make(map[string]struct{}, len(o.ifiles))
+	for _, ifile := range o.ifiles {
+		name := filepath.Join(o.dirA, ifile.filename)
+		if _, ok := seen[name]; ok {
+			return fmt.Errorf("%w: %q", ErrDuplicateInputFile, ifile.filename)
 		}
+		seen[name] = struct{}{}
+	}
+
+	if o.contextDir != "" {
+		o.args = append(o.args, "--file=-", o.contextDir)
+	} else {
+		o.args = append(o.args, "-")
 	}
+	// The context is streamed to Docker: that of input files given as readers cannot be sent again
+	replayable := true
 	for _, ifile := range o.ifiles {
-		hdr := &tar.Header{
-			Name: filepath.Join(o.dirA, ifile.filename),
-			Mode: 0600,
-			Size: int64(len(ifile.data)),
+		if ifile.r != nil {
+			replayable = false
 		}
-		if err := tw.WriteHeader(hdr); err != nil {
-			return err
+	}
+	var tarbuf bytes.Buffer
+	for attempt := 0; ; attempt++ {
+		tarbuf.Reset()
+		var errbuf bytes.Buffer
+		cmd := exec.CommandContext(o.ctx, o.exe, o.args...)
+		cmd.Env = append(o.env, "DOCKER_BUILDKIT=1")
+		var stdin *io.PipeReader
+		written := make(chan error, 1)
+		if o.contextDir != "" {
+			cmd.Stdin = bytes.NewReader(dockerfile)
+			written <- nil
+		} else {
+			var w *io.PipeWriter
+			stdin, w = io.Pipe()
+			go func() {
+				err := o.writeContext(w, dockerfile)
+				_ = w.CloseWithError(err)
+				written <- err
+			}()
+			cmd.Stdin = stdin
 		}
-		if _, err := tw.Write(ifile.data); err != nil {
+		cmd.Stdout = &tarbuf
+		stderr := o.stderr
+		var pw *prefixWriter
+		if o.stderrPrefix != "" {
+			pw = &prefixWriter{w: o.stderr, prefix: []byte(o.stderrPrefix)}
+			stderr = pw
+		}
+		cmd.Stderr = io.MultiWriter(stderr, &errbuf)
+		err := cmd.Run()
+		if stdin != nil {
+			_ = stdin.Close() // unblocks writing, should Docker not read the whole context
+		}
+		if werr := <-written; werr != nil && werr != io.ErrClosedPipe {
+			return werr
+		}
+		if pw != nil {
+			if ferr := pw.Flush(); ferr != nil && err == nil {
+				err = ferr
+			}
+		}
+		if err == nil {
+			break
+		}
+		if err.Error() != "exit status 1" {
 			return err
 		}
-	}
-	if err := tw.Close(); err != nil {
-		return err
-	}
-
-	o.args = append(o.args, "-")
-	cmd := exec.CommandContext(o.ctx, o.exe, o.args...)
-	cmd.Env = append(o.env, "DOCKER_BUILDKIT=1")
-	cmd.Stdin = &stdin
-	var tarbuf bytes.Buffer
-	cmd.Stdout = &tarbuf
-	cmd.Stderr = o.stderr
-	if err := cmd.Run(); err != nil {
-		if err.Error() == "exit status 1" {
+		if attempt >= o.retries || !replayable || !isTransient(errbuf.Bytes()) {
 			return ErrDockerBuildFailure
 		}
-		return err
+		select {
+		case <-o.ctx.Done():
+			return o.ctx.Err()
+		case <-time.After(o.backoff << attempt):
+		}
 	}
 
 	tr := tar.NewReader(&tarbuf)
 	var stdoutf bytes.Buffer
+	var gotStdoutf bool
 	for {
 		hdr, err := tr.Next()
 		if err == io.EOF {
@@ -124,11 +205,18 @@ func New(opts ...Option) (err error) {
 			continue
 		}
 		if hdr.Name == o.stdoutf {
+			gotStdoutf = true
 			if _, err := io.Copy(&stdoutf, tr); err != nil { // show later
 				return err
 			}
 			continue
 		}
+		if w, ok := o.sidecars[hdr.Name]; ok {
+			if _, err := io.Copy(w, tr); err != nil {
+				return err
+			}
+			continue
+		}
 		if f := o.ofilefunc; f != nil {
 			filename := strings.TrimPrefix(hdr.Name, o.dirB+"/")
 			if err := o.ofilefunc(filename, tr); err != nil {
@@ -137,9 +225,149 @@ func New(opts ...Option) (err error) {
 		}
 	}
 
+	if !gotStdoutf {
+		return fmt.Errorf("%w: %q", ErrMissingStdoutFile, o.stdoutf)
+	}
+
 	if _, err := io.Copy(o.stdout, &stdoutf); err != nil {
 		return err
 	}
 
+	if len(o.selectionErrs) != 0 {
+		return o.selectionErrs
+	}
 	return nil
 }
+
+// writeContext writes the build context, made of the Dockerfile and input files, to w.
+func (o *options) writeContext(w io.Writer, dockerfile []byte) error {
+	tw := tar.NewWriter(w)
+	{
+		hdr := &tar.Header{
+			Name: "Dockerfile",
+			Mode: 0200,
+			Size: int64(len(dockerfile)),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(dockerfile); err != nil {
+			return err
+		}
+	}
+	rewound := make(map[*inputTar]bool)
+	for _, ifile := range o.ifiles {
+		r := ifile.r
+		if it := ifile.tar; it != nil {
+			if !rewound[it] {
+				if err := it.rewind(); err != nil {
+					return err
+				}
+				rewound[it] = true
+			}
+			var err error
+			if r, err = it.next(); err != nil {
+				return err
+			}
+		}
+		hdr := &tar.Header{
+			Name: filepath.Join(o.dirA, ifile.filename),
+			Mode: 0600,
+			Size: int64(len(ifile.data)),
+		}
+		if ifile.mode != 0 {
+			hdr.Mode = int64(ifile.mode)
+		}
+		if r != nil {
+			hdr.Size = ifile.size
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if r != nil {
+			if _, err := io.CopyN(tw, r, ifile.size); err != nil {
+				if err == io.EOF {
+					return io.ErrUnexpectedEOF
+				}
+				return err
+			}
+			continue
+		}
+		if _, err := tw.Write(ifile.data); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// buildkitFound holds the Docker executables (and environments)
+// ensureBuildkit found able to build with BuildKit, so it checks each once.
+var buildkitFound sync.Map
+
+// ensureBuildkit checks Docker can build with BuildKit: that it knows of buildx,
+// or else that its daemon is at least 18.09, the first to ship BuildKit
+// (enabled there by DOCKER_BUILDKIT=1, which build is run with).
+// Only docker running and failing these checks makes ErrBuildkitUnavailable:
+// other errors (e.g. a canceled context) are returned as they are.
+func (o *options) ensureBuildkit() error {
+	key := o.exe + "\x00" + strings.Join(o.env, "\x00")
+	if _, ok := buildkitFound.Load(key); ok {
+		return nil
+	}
+
+	out, err := o.output("buildx", "version")
+	if err == nil {
+		buildkitFound.Store(key, struct{}{})
+		return nil
+	}
+	if !ranAndFailed(err) || o.ctx.Err() != nil {
+		return err
+	}
+
+	if out, err = o.output("version", "--format", "{{.Server.Version}}"); err != nil {
+		if !ranAndFailed(err) || o.ctx.Err() != nil {
+			return err
+		}
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%w (%s)", ErrBuildkitUnavailable, msg)
+		}
+		return ErrBuildkitUnavailable
+	}
+	version := strings.TrimSpace(string(out))
+	var major, minor int
+	if _, err := fmt.Sscanf(version, "%d.%d", &major, &minor); err != nil || major < 18 || (major == 18 && minor < 9) {
+		return fmt.Errorf("%w (Docker %s)", ErrBuildkitUnavailable, version)
+	}
+	buildkitFound.Store(key, struct{}{})
+	return nil
+}
+
+// output runs docker with args, returning its stdout and stderr.
+func (o *options) output(args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(o.ctx, o.exe, args...)
+	cmd.Env = o.env
+	return cmd.CombinedOutput()
+}
+
+// ranAndFailed tells whether err comes from a command exiting with a non-zero status.
+func ranAndFailed(err error) bool {
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr)
+}
+
+// transientErrors are substrings of docker output hinting at a
+// network or registry hiccup rather than a genuine build failure.
+var transientErrors = [][]byte{
+	[]byte("TLS handshake timeout"),
+	[]byte("i/o timeout"),
+	[]byte("TOOMANYREQUESTS"),
+}
+
+func isTransient(stderr []byte) bool {
+	for _, e := range transientErrors {
+		if bytes.Contains(stderr, e) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,1087 @@
+package buildx_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/fenollp/fmtd/buildx"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeExecutable writes an executable shell script standing in for docker.
+// $STATE is a directory the script may use to keep state across calls.
+// The script is not run for `docker buildx version`, which succeeds.
+func fakeExecutable(t *testing.T, script string) (exe, state string) {
+	return fakeExecutableWith(t, supportsBuildkit, script)
+}
+
+const supportsBuildkit = `
+if [ "$1 $2" = 'buildx version' ]; then
+  echo 'github.com/docker/buildx v0.12.1 30feaa1'
+  exit 0
+fi
+`
+
+func fakeExecutableWith(t *testing.T, preamble, script string) (exe, state string) {
+	state = t.TempDir()
+	exe = filepath.Join(state, "docker")
+	script = "#!/bin/sh\nSTATE=" + state + "\n" + preamble + script
+	err := os.WriteFile(exe, []byte(script), 0700)
+	require.NoError(t, err)
+	replyWith(t, state, map[string]string{"stdout": ""})
+	return
+}
+
+func attempts(t *testing.T, state string) string {
+	data, err := os.ReadFile(filepath.Join(state, "count"))
+	require.NoError(t, err)
+	return strings.TrimSpace(string(data))
+}
+
+func someDockerfile(map[interface{}]interface{}) []byte {
+	return []byte("FROM scratch\n")
+}
+
+const failOnceWith = `
+cat >/dev/null
+n=$(cat "$STATE"/count 2>/dev/null || echo 0)
+n=$((n+1))
+echo $n >"$STATE"/count
+if [ $n -eq 1 ]; then
+  echo "$FAILURE" >&2
+  exit 1
+fi
+cat "$STATE"/output.tar
+`
+
+func TestRetriesTransientFailures(t *testing.T) {
+	exe, state := fakeExecutable(t, failOnceWith)
+
+	var stderr bytes.Buffer
+	err := buildx.New(
+		buildx.WithExecutable(exe),
+		buildx.WithEnviron([]string{"FAILURE=net/http: TLS handshake timeout"}),
+		buildx.WithStderr(&stderr),
+		buildx.WithDockerfile(someDockerfile),
+		buildx.WithRetries(3, time.Millisecond),
+	)
+	require.NoError(t, err)
+	require.Equal(t, "2", attempts(t, state))
+	require.Contains(t, stderr.String(), "TLS handshake timeout")
+}
+
+func TestDoesNotRetryGenuineFailures(t *testing.T) {
+	exe, state := fakeExecutable(t, failOnceWith)
+
+	var stderr bytes.Buffer
+	err := buildx.New(
+		buildx.WithExecutable(exe),
+		buildx.WithEnviron([]string{"FAILURE=gofmt: expected 'package', found bla"}),
+		buildx.WithStderr(&stderr),
+		buildx.WithDockerfile(someDockerfile),
+		buildx.WithRetries(3, time.Millisecond),
+	)
+	require.EqualError(t, err, buildx.ErrDockerBuildFailure.Error())
+	require.Equal(t, "1", attempts(t, state))
+}
+
+func TestRetriesAreBounded(t *testing.T) {
+	exe, state := fakeExecutable(t, `
+cat >/dev/null
+n=$(cat "$STATE"/count 2>/dev/null || echo 0)
+echo $((n+1)) >"$STATE"/count
+echo 'toomanyrequests: TOOMANYREQUESTS: rate limit' >&2
+exit 1
+`)
+
+	err := buildx.New(
+		buildx.WithExecutable(exe),
+		buildx.WithStderr(&bytes.Buffer{}),
+		buildx.WithDockerfile(someDockerfile),
+		buildx.WithRetries(2, time.Millisecond),
+	)
+	require.EqualError(t, err, buildx.ErrDockerBuildFailure.Error())
+	require.Equal(t, "3", attempts(t, state))
+}
+
+const captureContext = `
+cat >"$STATE"/context.tar
+cat "$STATE"/output.tar
+`
+
+// contextEntries lists the names of the entries of the build context
+// captured by a fake executable running captureContext.
+func contextEntries(t *testing.T, state string) []string {
+	names, _ := readContext(t, state)
+	return names
+}
+
+// contextFile returns the contents of an entry of the captured build context.
+func contextFile(t *testing.T, state, name string) string {
+	_, contents := readContext(t, state)
+	data, ok := contents[name]
+	require.True(t, ok, name)
+	return data
+}
+
+// contextModes maps the entries of the captured build context to their mode.
+func contextModes(t *testing.T, state string) map[string]int64 {
+	f, err := os.Open(filepath.Join(state, "context.tar"))
+	require.NoError(t, err)
+	defer f.Close()
+	modes := make(map[string]int64)
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		modes[hdr.Name] = hdr.Mode
+	}
+	return modes
+}
+
+func readContext(t *testing.T, state string) ([]string, map[string]string) {
+	f, err := os.Open(filepath.Join(state, "context.tar"))
+	require.NoError(t, err)
+	defer f.Close()
+	var names []string
+	contents := make(map[string]string)
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+		contents[hdr.Name] = string(data)
+	}
+	return names, contents
+}
+
+func TestAbsolutePathsUnderPWDAreTarredRelative(t *testing.T) {
+	exe, state := fakeExecutable(t, captureContext)
+
+	pwd := t.TempDir()
+	err := os.MkdirAll(filepath.Join(pwd, "sub"), 0700)
+	require.NoError(t, err)
+	abs := filepath.Join(pwd, "sub", "x.go")
+	err = os.WriteFile(abs, []byte("package x"), 0600)
+	require.NoError(t, err)
+
+	err = buildx.New(
+		buildx.WithExecutable(exe),
+		buildx.WithDockerfile(someDockerfile),
+		buildx.WithInputFiles(
+			buildx.WithPWD(pwd),
+			buildx.WithFilenames([]string{abs}),
+			buildx.WithEnsureUnderPWD(true),
+		),
+	)
+	require.NoError(t, err)
+	require.Equal(t, []string{"Dockerfile", "a/sub/x.go"}, contextEntries(t, state))
+}
+
+func TestInputFileFromReader(t *testing.T) {
+	exe, state := fakeExecutable(t, captureContext)
+
+	contents := "{ }"
+	err := buildx.New(
+		buildx.WithExecutable(exe),
+		buildx.WithDockerfile(someDockerfile),
+		buildx.WithInputFileFromReader("some.json", strings.NewReader(contents), int64(len(contents))),
+	)
+	require.NoError(t, err)
+	require.Equal(t, []string{"Dockerfile", "a/some.json"}, contextEntries(t, state))
+	require.Equal(t, contents, contextFile(t, state, "a/some.json"))
+}
+
+// startedReader reads r once the fake executable created $STATE/started.
+type startedReader struct {
+	state string
+	r     io.Reader
+}
+
+func (sr *startedReader) Read(p []byte) (int, error) {
+	for i := 0; i < 500; i++ {
+		if _, err := os.Stat(filepath.Join(sr.state, "started")); err == nil {
+			return sr.r.Read(p)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return 0, errors.New("read before the build started")
+}
+
+func TestInputFileFromReaderIsStreamed(t *testing.T) {
+	exe, state := fakeExecutable(t, "touch \"$STATE\"/started\n"+captureContext)
+
+	contents := "{ }"
+	err := buildx.New(
+		buildx.WithExecutable(exe),
+		buildx.WithDockerfile(someDockerfile),
+		buildx.WithInputFileFromReader("some.json", &startedReader{state: state, r: strings.NewReader(contents)}, int64(len(contents))),
+	)
+	require.NoError(t, err)
+	require.Equal(t, contents, contextFile(t, state, "a/some.json"))
+}
+
+func TestInputFileFromReaderIsNotRetried(t *testing.T) {
+	exe, state := fakeExecutable(t, failOnceWith)
+
+	err := buildx.New(
+		buildx.WithExecutable(exe),
+		buildx.WithEnviron([]string{"FAILURE=net/http: TLS handshake timeout"}),
+		buildx.WithStderr(&bytes.Buffer{}),
+		buildx.WithDockerfile(someDockerfile),
+		buildx.WithInputFileFromReader("some.json", strings.NewReader("{ }"), 3),
+		buildx.WithRetries(3, time.Millisecond),
+	)
+	require.EqualError(t, err, buildx.ErrDockerBuildFailure.Error())
+	require.Equal(t, "1", attempts(t, state))
+}
+
+func TestInputFilesFromTar(t *testing.T) {
+	tarOf := func(hdrs ...*tar.Header) *bytes.Buffer {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, hdr := range hdrs {
+			require.NoError(t, tw.WriteHeader(hdr))
+			_, err := tw.Write([]byte(strings.Repeat("x", int(hdr.Size))))
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+		return &buf
+	}
+
+	exe, state := fakeExecutable(t, captureContext)
+	err := buildx.New(
+		buildx.WithExecutable(exe),
+		buildx.WithDockerfile(someDockerfile),
+		buildx.WithInputFile("some.json", []byte("{ }")),
+		buildx.WithInputFilesFromTar(tarOf(
+			&tar.Header{Name: "sub/", Typeflag: tar.TypeDir, Mode: 0755},
+			&tar.Header{Name: "sub/run.sh", Typeflag: tar.TypeReg, Mode: 0755, Size: 3},
+			&tar.Header{Name: "./other.go", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+			&tar.Header{Name: "link.go", Typeflag: tar.TypeSymlink, Linkname: "other.go"},
+		)),
+	)
+	require.NoError(t, err)
+	require.Equal(t, []string{"Dockerfile", "a/some.json", "a/sub/run.sh", "a/other.go"}, contextEntries(t, state))
+	require.Equal(t, "xxx", contextFile(t, state, "a/sub/run.sh"))
+	require.Equal(t, map[string]int64{"Dockerfile": 0200, "a/some.json": 0600, "a/sub/run.sh": 0755, "a/other.go": 0644}, contextModes(t, state))
+
+	for _, name := range []string{"../escape.go", "sub/../../escape.go", "/etc/passwd"} {
+		err = buildx.New(
+			buildx.WithExecutable(exe),
+			buildx.WithDockerfile(someDockerfile),
+			buildx.WithInputFilesFromTar(tarOf(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: 1})),
+		)
+		require.True(t, errors.Is(err, buildx.ErrInputTarEscape), name)
+		require.Contains(t, err.Error(), name)
+	}
+
+	// Seekable tar streams are read again when retrying
+	exe, state = fakeExecutable(t, `
+cat >"$STATE"/context.tar
+n=$(cat "$STATE"/count 2>/dev/null || echo 0)
+n=$((n+1))
+echo $n >"$STATE"/count
+if [ $n -eq 1 ]; then
+  echo 'i/o timeout' >&2
+  exit 1
+fi
+cat "$STATE"/output.tar
+`)
+	err = buildx.New(
+		buildx.WithExecutable(exe),
+		buildx.WithStderr(&bytes.Buffer{}),
+		buildx.WithDockerfile(someDockerfile),
+		buildx.WithInputFilesFromTar(bytes.NewReader(tarOf(
+			&tar.Header{Name: "sub/run.sh", Typeflag: tar.TypeReg, Mode: 0755, Size: 3},
+			&tar.Header{Name: "other.go", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+		).Bytes())),
+		buildx.WithRetries(1, time.Millisecond),
+	)
+	require.NoError(t, err)
+	require.Equal(t, "2", attempts(t, state))
+	require.Equal(t, []string{"Dockerfile", "a/sub/run.sh", "a/other.go"}, contextEntries(t, state))
+	require.Equal(t, "xxx", contextFile(t, state, "a/sub/run.sh"))
+	require.Equal(t, "x", contextFile(t, state, "a/other.go"))
+}
+
+func TestInputFileFromShortReader(t *testing.T) {
+	exe, _ := fakeExecutable(t, captureContext)
+
+	err := buildx.New(
+		buildx.WithExecutable(exe),
+		buildx.WithDockerfile(someDockerfile),
+		buildx.WithInputFileFromReader("some.json", strings.NewReader("{ }"), 42),
+	)
+	require.EqualError(t, err, io.ErrUnexpectedEOF.Error())
+}
+
+func TestDuplicateInputFiles(t *testing.T) {
+	exe, state := fakeExecutable(t, captureContext)
+
+	err := buildx.New(
+		buildx.WithExecutable(exe),
+		buildx.WithDockerfile(someDockerfile),
+		buildx.WithInputFile("a.go", []byte("package a")),
+		buildx.WithInputFile("./a.go", []byte("package a")),
+	)
+	require.EqualError(t, err, `duplicate input file: "./a.go"`)
+	require.True(t, errors.Is(err, buildx.ErrDuplicateInputFile))
+	require.NoFileExists(t, filepath.Join(state, "context.tar"))
+}
+
+// replyWith has a fake executable running replyWithOutput reply with given files.
+func replyWith(t *testing.T, state string, files map[string]string) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(files[name]))})
+		require.NoError(t, err)
+		_, err = tw.Write([]byte(files[name]))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	err := os.WriteFile(filepath.Join(state, "output.tar"), buf.Bytes(), 0600)
+	require.NoError(t, err)
+}
+
+const replyWithOutput = `
+cat >"$STATE"/context.tar
+cat "$STATE"/output.tar
+`
+
+func TestSidecarFiles(t *testing.T) {
+	exe, state := fakeExecutable(t, replyWithOutput)
+	replyWith(t, state, map[string]string{
+		"stdout":   "! some.xyz\n",
+		"errors":   "E some.go\n",
+		"timings":  "T 42 some.json\n",
+		"b/x.json": "{}\n",
+	})
+
+	var stdout, errs, timings bytes.Buffer
+	var outputs []string
+	err := buildx.New(
+		buildx.WithExecutable(exe),
+		buildx.WithDockerfile(someDockerfile),
+		buildx.WithStdout(&stdout),
+		buildx.WithSidecarFile("errors", &errs),
+		buildx.WithSidecarFile("timings", &timings),
+		buildx.WithOutputFileFunc(func(filename string, r io.Reader) error {
+			outputs = append(outputs, filename)
+			return nil
+		}),
+	)
+	require.NoError(t, err)
+	require.Equal(t, "! some.xyz\n", stdout.String())
+	require.Equal(t, "E some.go\n", errs.String())
+	require.Equal(t, "T 42 some.json\n", timings.String())
+	require.Equal(t, []string{"x.json"}, outputs)
+}
+
+func TestMissingStdoutFile(t *testing.T) {
+	exe, state := fakeExecutable(t, replyWithOutput)
+	replyWith(t, state, map[string]string{"b/x.json": "{}\n"})
+
+	err := buildx.New(
+		buildx.WithExecutable(exe),
+		buildx.WithDockerfile(func(map[interface{}]interface{}) []byte {
+			return []byte("FROM scratch\nCOPY b /b/\n")
+		}),
+		buildx.WithOutputFileFunc(func(string, io.Reader) error { return nil }),
+	)
+	require.True(t, errors.Is(err, buildx.ErrMissingStdoutFile))
+	require.EqualError(t, err, `build output lacks the stdout file: "stdout"`)
+}
+
+func TestSidecarFileCapturedOnce(t *testing.T) {
+	err := buildx.New(
+		buildx.WithSidecarFile("errors", &bytes.Buffer{}),
+		buildx.WithSidecarFile("errors", &bytes.Buffer{}),
+	)
+	require.EqualError(t, err, buildx.ErrSidecarFileSet.Error())
+
+	err = buildx.New(
+		buildx.WithSidecarFile("out", &bytes.Buffer{}),
+		buildx.WithStdoutFile("out"),
+	)
+	require.EqualError(t, err, buildx.ErrSidecarFileSet.Error())
+}
+
+func TestInputDir(t *testing.T) {
+	exe, state := fakeExecutable(t, captureContext)
+
+	dir := t.TempDir()
+	for fn, contents := range map[string]string{
+		"a.go":         "package a",
+		"notes.txt":    "bla",
+		"sub/b.go":     "package b",
+		"sub/sub/c.go": "package c",
+	} {
+		err := os.MkdirAll(filepath.Join(dir, filepath.Dir(fn)), 0700)
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(dir, fn), []byte(contents), 0600)
+		require.NoError(t, err)
+	}
+
+	err := buildx.New(
+		buildx.WithExecutable(exe),
+		buildx.WithDockerfile(someDockerfile),
+		buildx.WithInputDir(dir, "src", func(path string) bool { return strings.HasSuffix(path, ".go") }),
+	)
+	require.NoError(t, err)
+	require.Equal(t, []string{"Dockerfile", "a/src/a.go", "a/src/sub/b.go", "a/src/sub/sub/c.go"}, contextEntries(t, state))
+	require.Equal(t, "package c", contextFile(t, state, "a/src/sub/sub/c.go"))
+
+	err = buildx.New(
+		buildx.WithExecutable(exe),
+		buildx.WithDockerfile(someDockerfile),
+		buildx.WithInputDir(filepath.Join(dir, "sub"), "", nil),
+	)
+	require.NoError(t, err)
+	require.Equal(t, []string{"Dockerfile", "a/b.go", "a/sub/c.go"}, contextEntries(t, state))
+
+	err = buildx.New(
+		buildx.WithExecutable(exe),
+		buildx.WithDockerfile(someDockerfile),
+		buildx.WithInputDir(filepath.Join(dir, "nope"), "", nil),
+	)
+	require.True(t, errors.Is(err, fs.ErrNotExist))
+}
+
+func TestEmptyDirSelectsNothing(t *testing.T) {
+	pwd := t.TempDir()
+	err := os.MkdirAll(filepath.Join(pwd, "empty"), 0700)
+	require.NoError(t, err)
+	err = os.MkdirAll(filepath.Join(pwd, "hidden", ".git"), 0700)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(pwd, "hidden", ".git", "HEAD"), []byte("ref"), 0600)
+	require.NoError(t, err)
+
+	for _, filenames := range [][]string{nil, {filepath.Join(pwd, "empty")}, {filepath.Join(pwd, "hidden")}} {
+		paths, _, err := buildx.SelectInputFiles(
+			buildx.WithPWD(pwd),
+			buildx.WithFilenames(filenames),
+			buildx.WithUseCurrentDirWhenNoPathsGiven(),
+			buildx.WithTraverseDirectories(true),
+			buildx.WithEnsureUnderPWD(true),
+			buildx.WithEnsureWritable(true),
+		)
+		require.NoError(t, err, filenames)
+		require.Empty(t, paths, filenames)
+	}
+}
+
+func TestFileContents(t *testing.T) {
+	exe, state := fakeExecutable(t, captureContext)
+
+	pwd := t.TempDir()
+	onDisk := filepath.Join(pwd, "src", "a.go")
+	err := os.MkdirAll(filepath.Dir(onDisk), 0700)
+	require.NoError(t, err)
+	err = os.WriteFile(onDisk, []byte("package saved"), 0400)
+	require.NoError(t, err)
+	missing := filepath.Join(pwd, "src", "new.go")
+	ignored := filepath.Join(pwd, "vendor", "v.go")
+	err = os.WriteFile(filepath.Join(pwd, ".ignore"), []byte("vendor/\n"), 0600)
+	require.NoError(t, err)
+
+	var skipped []string
+	err = buildx.New(
+		buildx.WithExecutable(exe),
+		buildx.WithDockerfile(someDockerfile),
+		buildx.WithInputFiles(
+			buildx.WithPWD(pwd),
+			buildx.WithFilenames([]string{onDisk, missing, ignored}),
+			buildx.WithEnsureWritable(true),
+			buildx.WithIgnoreFile(".ignore"),
+			buildx.WithSkippedFunc(func(fn, reason string) { skipped = append(skipped, fn+" "+reason) }),
+			buildx.WithFileContents(onDisk, []byte("package unsaved")),
+			buildx.WithFileContents(missing, []byte("package created")),
+			buildx.WithFileContents(ignored, []byte("package vendored")),
+		),
+	)
+	require.NoError(t, err)
+	require.Equal(t, []string{"Dockerfile", "a/src/a.go", "a/src/new.go"}, contextEntries(t, state))
+	require.Equal(t, "package unsaved", contextFile(t, state, "a/src/a.go"))
+	require.Equal(t, "package created", contextFile(t, state, "a/src/new.go"))
+	require.Equal(t, []string{"vendor/v.go matches .ignore:1"}, skipped)
+}
+
+func TestCollectSelectionErrors(t *testing.T) {
+	exe, state := fakeExecutable(t, captureContext)
+
+	pwd := t.TempDir()
+	good := filepath.Join(pwd, "good.go")
+	err := os.WriteFile(good, []byte("package good"), 0600)
+	require.NoError(t, err)
+	missing := filepath.Join(pwd, "missing.go")
+	dir := filepath.Join(pwd, "dir")
+	err = os.Mkdir(dir, 0700)
+	require.NoError(t, err)
+
+	filenames := []string{missing, good, dir}
+	err = buildx.New(
+		buildx.WithExecutable(exe),
+		buildx.WithDockerfile(someDockerfile),
+		buildx.WithInputFiles(
+			buildx.WithPWD(pwd),
+			buildx.WithFilenames(filenames),
+		),
+	)
+	require.True(t, errors.Is(err, fs.ErrNotExist))
+	require.NoFileExists(t, filepath.Join(state, "context.tar"))
+
+	err = buildx.New(
+		buildx.WithExecutable(exe),
+		buildx.WithDockerfile(someDockerfile),
+		buildx.WithInputFiles(
+			buildx.WithPWD(pwd),
+			buildx.WithFilenames(filenames),
+			buildx.WithCollectSelectionErrors(true),
+		),
+	)
+	require.EqualError(t, err, "no such file or directory; is a directory")
+	var errs buildx.SelectionErrors
+	require.True(t, errors.As(err, &errs))
+	require.Len(t, errs, 2)
+	require.True(t, errors.Is(errs[0], fs.ErrNotExist))
+	require.Equal(t, []string{"Dockerfile", "a/good.go"}, contextEntries(t, state))
+
+	paths, _, err := buildx.SelectInputFiles(
+		buildx.WithPWD(pwd),
+		buildx.WithFilenames(filenames),
+		buildx.WithCollectSelectionErrors(true),
+	)
+	require.Equal(t, []string{good}, paths)
+	require.True(t, errors.As(err, &errs))
+	require.Len(t, errs, 2)
+}
+
+func TestBuildkitPreflight(t *testing.T) {
+	// A Docker without buildx whose daemon is the given version
+	daemon := func(version string) string {
+		return `
+if [ "$1" = 'buildx' ]; then
+  echo "docker: 'buildx' is not a docker command." >&2
+  exit 1
+fi
+if [ "$1" = 'version' ]; then
+  ` + version + `
+fi
+`
+	}
+
+	exe, state := fakeExecutableWith(t, daemon(`echo 17.06.0-ce && exit 0`), captureContext)
+	err := buildx.New(
+		buildx.WithExecutable(exe),
+		buildx.WithDockerfile(someDockerfile),
+	)
+	require.True(t, errors.Is(err, buildx.ErrBuildkitUnavailable))
+	require.Contains(t, err.Error(), "(Docker 17.06.0-ce)")
+	require.NoFileExists(t, filepath.Join(state, "context.tar"))
+
+	err = buildx.New(
+		buildx.WithExecutable(exe),
+		buildx.WithDockerfile(someDockerfile),
+		buildx.WithBuildkitPreflight(false),
+	)
+	require.NoError(t, err)
+	require.FileExists(t, filepath.Join(state, "context.tar"))
+
+	exe, state = fakeExecutableWith(t, daemon(`echo 'Cannot connect to the Docker daemon.' && exit 1`), captureContext)
+	err = buildx.New(
+		buildx.WithExecutable(exe),
+		buildx.WithDockerfile(someDockerfile),
+	)
+	require.True(t, errors.Is(err, buildx.ErrBuildkitUnavailable))
+	require.Contains(t, err.Error(), "(Cannot connect to the Docker daemon.)")
+	require.NoFileExists(t, filepath.Join(state, "context.tar"))
+
+	// DOCKER_BUILDKIT=1 docker build works from 18.09 on, without buildx
+	exe, state = fakeExecutableWith(t, daemon(`echo 20.10.24 >>"$STATE"/versions && echo 20.10.24 && exit 0`), captureContext)
+	for i := 0; i < 2; i++ {
+		err = buildx.New(
+			buildx.WithExecutable(exe),
+			buildx.WithDockerfile(someDockerfile),
+		)
+		require.NoError(t, err)
+		require.FileExists(t, filepath.Join(state, "context.tar"))
+	}
+	// Checked only once
+	versions, err := os.ReadFile(filepath.Join(state, "versions"))
+	require.NoError(t, err)
+	require.Equal(t, "20.10.24\n", string(versions))
+}
+
+func TestBuildkitPreflightErrors(t *testing.T) {
+	err := buildx.New(
+		buildx.WithExecutable(filepath.Join(t.TempDir(), "docker")),
+		buildx.WithDockerfile(someDockerfile),
+	)
+	require.Error(t, err)
+	require.False(t, errors.Is(err, buildx.ErrBuildkitUnavailable))
+
+	exe, _ := fakeExecutable(t, captureContext)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = buildx.New(
+		buildx.WithContext(ctx),
+		buildx.WithExecutable(exe),
+		buildx.WithDockerfile(someDockerfile),
+	)
+	require.True(t, errors.Is(err, context.Canceled))
+	require.False(t, errors.Is(err, buildx.ErrBuildkitUnavailable))
+}
+
+func TestOverwriteFileContents(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "some.json")
+	err := os.WriteFile(fn, []byte("{ }"), 0640)
+	require.NoError(t, err)
+
+	err = buildx.OverwriteFileContents(fn, strings.NewReader("{}\n"))
+	require.NoError(t, err)
+	data, err := os.ReadFile(fn)
+	require.NoError(t, err)
+	require.Equal(t, "{}\n", string(data))
+	fi, err := os.Stat(fn)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0640), fi.Mode().Perm())
+
+	failing := io.MultiReader(strings.NewReader("{"), iotest.ErrReader(errors.New("disk on fire")))
+	err = buildx.OverwriteFileContents(fn, failing)
+	require.EqualError(t, err, "disk on fire")
+	data, err = os.ReadFile(fn)
+	require.NoError(t, err)
+	require.Equal(t, "{}\n", string(data))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "some.json", entries[0].Name())
+}
+
+func TestExtraBuildFlags(t *testing.T) {
+	exe, state := fakeExecutable(t, `
+echo "$@" >"$STATE"/args
+cat >/dev/null
+cat "$STATE"/output.tar
+`)
+
+	err := buildx.New(
+		buildx.WithExecutable(exe),
+		buildx.WithDockerfile(someDockerfile),
+		buildx.WithBuildArg("A=1"),
+		buildx.WithExtraBuildFlags("--no-cache"),
+		buildx.WithExtraBuildFlags("--add-host=registry:10.0.0.1", "--pull"),
+	)
+	require.NoError(t, err)
+	args, err := os.ReadFile(filepath.Join(state, "args"))
+	require.NoError(t, err)
+	require.Equal(t, "build --output=- --build-arg=A=1 --no-cache --add-host=registry:10.0.0.1 --pull -\n", string(args))
+}
+
+func TestHardLinksSentOnce(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("hard links are not deduplicated on " + runtime.GOOS)
+	}
+	exe, state := fakeExecutable(t, captureContext)
+
+	pwd := t.TempDir()
+	err := os.WriteFile(filepath.Join(pwd, "a.json"), []byte("{ }"), 0600)
+	require.NoError(t, err)
+	err = os.Link(filepath.Join(pwd, "a.json"), filepath.Join(pwd, "b.json"))
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(pwd, "c.json"), []byte("{ }"), 0600)
+	require.NoError(t, err)
+
+	var skipped []string
+	err = buildx.New(
+		buildx.WithExecutable(exe),
+		buildx.WithDockerfile(someDockerfile),
+		buildx.WithInputFiles(
+			buildx.WithPWD(pwd),
+			buildx.WithFilenames([]string{filepath.Join(pwd, "b.json"), pwd}),
+			buildx.WithTraverseDirectories(true),
+			buildx.WithSkippedFunc(func(fn, reason string) { skipped = append(skipped, fn+": "+reason) }),
+		),
+	)
+	require.NoError(t, err)
+	require.Equal(t, []string{"Dockerfile", "a/a.json", "a/c.json"}, contextEntries(t, state))
+	require.Equal(t, []string{"b.json: hard link to a.json"}, skipped)
+}
+
+func TestIgnoreFile(t *testing.T) {
+	pwd := t.TempDir()
+	for _, fn := range []string{
+		"a.go", "a.pb.go", "sub/b.pb.go",
+		"third_party/x.go", "third_party/ours/y.go",
+		"docs/c.json", "docs/v1/api/d.json", "docs/e.md",
+	} {
+		err := os.MkdirAll(filepath.Join(pwd, filepath.Dir(fn)), 0700)
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(pwd, fn), nil, 0600)
+		require.NoError(t, err)
+	}
+	ignore := `# generated
+*.pb.go
+!sub/b.pb.go
+
+third_party/
+!/third_party/ours
+docs/**/*.json
+`
+	err := os.WriteFile(filepath.Join(pwd, ".fmtignore"), []byte(ignore), 0600)
+	require.NoError(t, err)
+
+	skipped := make(map[string]string)
+	selectFiles := func(filenames ...string) []string {
+		paths, _, err := buildx.SelectInputFiles(
+			buildx.WithPWD(pwd),
+			buildx.WithFilenames(filenames),
+			buildx.WithUseCurrentDirWhenNoPathsGiven(),
+			buildx.WithIgnoreFile(".fmtignore"),
+			buildx.WithSkippedFunc(func(fn, reason string) { skipped[fn] = reason }),
+		)
+		require.NoError(t, err)
+		for i := range paths {
+			paths[i], err = filepath.Rel(pwd, paths[i])
+			require.NoError(t, err)
+		}
+		return paths
+	}
+
+	require.Equal(t, []string{"a.go", "docs/e.md", "sub/b.pb.go", "third_party/ours/y.go"}, selectFiles())
+	require.Equal(t, map[string]string{
+		"a.pb.go":            "matches .fmtignore:2",
+		"third_party/x.go":   "matches .fmtignore:5",
+		"docs/c.json":        "matches .fmtignore:7",
+		"docs/v1/api/d.json": "matches .fmtignore:7",
+	}, skipped)
+
+	// Explicit arguments too
+	require.Equal(t, []string{"a.go"}, selectFiles(filepath.Join(pwd, "a.go"), filepath.Join(pwd, "a.pb.go")))
+
+	// Paths not on disk
+	ignored, err := buildx.IgnoreFunc(strings.NewReader(ignore))
+	require.NoError(t, err)
+	for fn, line := range map[string]int{
+		"a.go": 0, "a.pb.go": 2, "sub/b.pb.go": 0,
+		"third_party/x.go": 5, "third_party/ours/y.go": 0,
+		"docs/c.json": 7, "docs/v1/api/d.json": 7, "docs/e.md": 0,
+	} {
+		require.Equal(t, line, ignored(fn), fn)
+	}
+
+	err = os.WriteFile(filepath.Join(pwd, ".fmtignore"), []byte("ok\n[\n"), 0600)
+	require.NoError(t, err)
+	_, _, err = buildx.SelectInputFiles(buildx.WithPWD(pwd), buildx.WithIgnoreFile(".fmtignore"))
+	require.EqualError(t, err, `.fmtignore:2: syntax error in pattern: "["`)
+}
+
+func TestFilenameFilter(t *testing.T) {
+	pwd := t.TempDir()
+	for fn, size := range map[string]int{"small.go": 10, "big.go": 1000, "sub/small.json": 20, "sub/big.json": 2000} {
+		err := os.MkdirAll(filepath.Join(pwd, filepath.Dir(fn)), 0700)
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(pwd, fn), bytes.Repeat([]byte("a"), size), 0600)
+		require.NoError(t, err)
+	}
+
+	skipped := make(map[string]string)
+	selectFiles := func(filenames ...string) []string {
+		paths, _, err := buildx.SelectInputFiles(
+			buildx.WithPWD(pwd),
+			buildx.WithFilenames(filenames),
+			buildx.WithUseCurrentDirWhenNoPathsGiven(),
+			buildx.WithFilenameFilter(func(path string, info fs.FileInfo) bool { return info.Size() < 100 }),
+			buildx.WithSkippedFunc(func(fn, reason string) { skipped[fn] = reason }),
+		)
+		require.NoError(t, err)
+		for i := range paths {
+			paths[i], err = filepath.Rel(pwd, paths[i])
+			require.NoError(t, err)
+		}
+		return paths
+	}
+
+	require.Equal(t, []string{"small.go", "sub/small.json"}, selectFiles())
+	require.Equal(t, map[string]string{"big.go": "filtered out", "sub/big.json": "filtered out"}, skipped)
+
+	// Explicit arguments too
+	require.Equal(t, []string{"small.go"}, selectFiles(filepath.Join(pwd, "small.go"), filepath.Join(pwd, "big.go")))
+}
+
+func TestMaxFileSize(t *testing.T) {
+	pwd := t.TempDir()
+	for fn, size := range map[string]int{"under.sql": 1024, "over.sql": 1025, "sub/under.json": 1000, "sub/over.json": 4096} {
+		err := os.MkdirAll(filepath.Join(pwd, filepath.Dir(fn)), 0700)
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(pwd, fn), bytes.Repeat([]byte("a"), size), 0600)
+		require.NoError(t, err)
+	}
+
+	skipped := make(map[string]string)
+	selectFiles := func(max int64, filenames ...string) []string {
+		paths, _, err := buildx.SelectInputFiles(
+			buildx.WithPWD(pwd),
+			buildx.WithFilenames(filenames),
+			buildx.WithUseCurrentDirWhenNoPathsGiven(),
+			buildx.WithMaxFileSize(max),
+			buildx.WithSkippedFunc(func(fn, reason string) { skipped[fn] = reason }),
+		)
+		require.NoError(t, err)
+		for i := range paths {
+			paths[i], err = filepath.Rel(pwd, paths[i])
+			require.NoError(t, err)
+		}
+		return paths
+	}
+
+	require.Equal(t, []string{"over.sql", "sub/over.json", "sub/under.json", "under.sql"}, selectFiles(0))
+	require.Empty(t, skipped)
+
+	require.Equal(t, []string{"sub/under.json", "under.sql"}, selectFiles(1024))
+	require.Equal(t, map[string]string{"over.sql": "larger than 1024 bytes", "sub/over.json": "larger than 1024 bytes"}, skipped)
+
+	// Explicit arguments too
+	require.Equal(t, []string{"under.sql"}, selectFiles(1024, filepath.Join(pwd, "under.sql"), filepath.Join(pwd, "over.sql")))
+}
+
+func TestIncludeHidden(t *testing.T) {
+	pwd := t.TempDir()
+	fns := []string{
+		"main.yml",
+		".gitignore",
+		".github/dependabot.yml",
+		".github/workflows/ci.yml",
+		".github/workflows/.hidden.yml",
+		".git/config.yml",
+		".cache/x.yml",
+		"sub/.github/workflows/ci.yml",
+	}
+	for _, fn := range fns {
+		err := os.MkdirAll(filepath.Join(pwd, filepath.Dir(fn)), 0700)
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(pwd, fn), []byte("a: 1\n"), 0600)
+		require.NoError(t, err)
+	}
+
+	selectFiles := func(patterns ...string) []string {
+		paths, _, err := buildx.SelectInputFiles(
+			buildx.WithPWD(pwd),
+			buildx.WithUseCurrentDirWhenNoPathsGiven(),
+			buildx.WithIncludeHidden(patterns),
+		)
+		require.NoError(t, err)
+		for i := range paths {
+			paths[i], err = filepath.Rel(pwd, paths[i])
+			require.NoError(t, err)
+		}
+		return paths
+	}
+
+	require.Equal(t, []string{"main.yml"}, selectFiles())
+	require.Equal(t, []string{".github/workflows/.hidden.yml", ".github/workflows/ci.yml", "main.yml"},
+		selectFiles(".github/workflows/**"))
+	require.Equal(t, []string{".github/dependabot.yml", ".github/workflows/ci.yml", "main.yml", "sub/.github/workflows/ci.yml"},
+		selectFiles(".github", "!.hidden.yml", "sub/.github/**"))
+	// .git is never walked
+	require.Equal(t, []string{
+		".cache/x.yml",
+		".github/dependabot.yml",
+		".github/workflows/.hidden.yml",
+		".github/workflows/ci.yml",
+		".gitignore",
+		"main.yml",
+		"sub/.github/workflows/ci.yml",
+	}, selectFiles("**"))
+
+	// Paths not on disk
+	for _, patterns := range [][]string{nil, {".github/workflows/**"}, {".github", "!.hidden.yml", "sub/.github/**"}, {"**"}} {
+		walked, err := buildx.IncludeHiddenFunc(patterns)
+		require.NoError(t, err)
+		var paths []string
+		for _, fn := range fns {
+			if walked(fn) {
+				paths = append(paths, fn)
+			}
+		}
+		sort.Strings(paths)
+		require.Equal(t, selectFiles(patterns...), paths, patterns)
+	}
+
+	_, _, err := buildx.SelectInputFiles(
+		buildx.WithPWD(pwd),
+		buildx.WithUseCurrentDirWhenNoPathsGiven(),
+		buildx.WithIncludeHidden([]string{"[.github"}),
+	)
+	require.EqualError(t, err, `bad hidden path pattern "[.github"`)
+}
+
+func TestContextDir(t *testing.T) {
+	exe, state := fakeExecutable(t, `
+echo "$@" >"$STATE"/args
+cat >"$STATE"/Dockerfile
+cat "$STATE"/output.tar
+`)
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "x.go"), []byte("package x"), 0600)
+	require.NoError(t, err)
+	replyWith(t, state, map[string]string{"stdout": "F x.go\n", "b/x.go": "package x\n"})
+
+	var stdout bytes.Buffer
+	formatted := make(map[string]string)
+	err = buildx.New(
+		buildx.WithExecutable(exe),
+		buildx.WithStdout(&stdout),
+		buildx.WithDockerfile(someDockerfile),
+		buildx.WithContextDir(dir),
+		buildx.WithOutputFileFunc(func(filename string, r io.Reader) error {
+			data, err := io.ReadAll(r)
+			formatted[filename] = string(data)
+			return err
+		}),
+	)
+	require.NoError(t, err)
+	args, err := os.ReadFile(filepath.Join(state, "args"))
+	require.NoError(t, err)
+	require.Equal(t, "build --output=- --file=- "+dir+"\n", string(args))
+	dockerfile, err := os.ReadFile(filepath.Join(state, "Dockerfile"))
+	require.NoError(t, err)
+	require.Equal(t, "FROM scratch\n", string(dockerfile))
+	require.Equal(t, "F x.go\n", stdout.String())
+	require.Equal(t, map[string]string{"x.go": "package x\n"}, formatted)
+
+	err = buildx.New(
+		buildx.WithExecutable(exe),
+		buildx.WithDockerfile(someDockerfile),
+		buildx.WithContextDir(dir),
+		buildx.WithInputFile("y.go", []byte("package y")),
+	)
+	require.Equal(t, buildx.ErrContextDirWithInputFiles, err)
+
+	err = buildx.New(buildx.WithContextDir(filepath.Join(dir, "x.go")))
+	require.EqualError(t, err, fmt.Sprintf("context %q is not a directory", filepath.Join(dir, "x.go")))
+}
+
+func TestStderrPrefix(t *testing.T) {
+	exe, _ := fakeExecutable(t, `
+cat >/dev/null
+printf '#1 [internal] load build definition\n#1 DONE 0.0s\n\n#2 partial' >&2
+cat "$STATE"/output.tar
+`)
+
+	var stderr bytes.Buffer
+	err := buildx.New(
+		buildx.WithExecutable(exe),
+		buildx.WithDockerfile(someDockerfile),
+		buildx.WithStderr(&stderr),
+		buildx.WithStderrPrefix("[go] "),
+	)
+	require.NoError(t, err)
+	require.Equal(t, "[go] #1 [internal] load build definition\n[go] #1 DONE 0.0s\n[go] \n[go] #2 partial", stderr.String())
+}
+
+func TestPreserveInputMode(t *testing.T) {
+	pwd := t.TempDir()
+	script, data := filepath.Join(pwd, "run.sh"), filepath.Join(pwd, "data.json")
+	require.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\n"), 0755))
+	require.NoError(t, os.WriteFile(data, []byte("{}"), 0644))
+
+	modes := func(preserve bool) map[string]int64 {
+		exe, state := fakeExecutable(t, captureContext)
+		err := buildx.New(
+			buildx.WithExecutable(exe),
+			buildx.WithDockerfile(someDockerfile),
+			buildx.WithInputFiles(
+				buildx.WithPWD(pwd),
+				buildx.WithFilenames([]string{script, data}),
+				buildx.WithPreserveInputMode(preserve),
+			),
+		)
+		require.NoError(t, err)
+		return contextModes(t, state)
+	}
+
+	got := modes(false)
+	require.Equal(t, int64(0600), got["a/run.sh"])
+	require.Equal(t, int64(0600), got["a/data.json"])
+
+	got = modes(true)
+	require.Equal(t, int64(0755), got["a/run.sh"])
+	require.Equal(t, int64(0644), got["a/data.json"])
+	require.Equal(t, int64(0200), got["Dockerfile"])
+}
+
+func TestFollowDirSymlinks(t *testing.T) {
+	pwd := t.TempDir()
+	outside := t.TempDir()
+	for _, fn := range []string{
+		filepath.Join(pwd, "main.go"),
+		filepath.Join(pwd, "src", "a.go"),
+		filepath.Join(pwd, ".store", "pkg", "p.go"),
+		filepath.Join(outside, "lib.go"),
+	} {
+		err := os.MkdirAll(filepath.Dir(fn), 0700)
+		require.NoError(t, err)
+		err = os.WriteFile(fn, []byte("package p\n"), 0600)
+		require.NoError(t, err)
+	}
+	for link, target := range map[string]string{
+		filepath.Join(pwd, "pkg"):         filepath.Join(".store", "pkg"),
+		filepath.Join(pwd, "linked"):      "src",
+		filepath.Join(pwd, "src", "self"): filepath.Join(pwd, "src"), // a cycle
+		filepath.Join(pwd, "shared"):      outside,
+		filepath.Join(outside, "loop"):    "..",
+		filepath.Join(pwd, "dangling"):    "nowhere",
+	} {
+		err := os.Symlink(target, link)
+		require.NoError(t, err)
+	}
+
+	selectFiles := func(opts ...buildx.InputFilesOption) []string {
+		paths, _, err := buildx.SelectInputFiles(append([]buildx.InputFilesOption{
+			buildx.WithPWD(pwd),
+			buildx.WithUseCurrentDirWhenNoPathsGiven(),
+		}, opts...)...)
+		require.NoError(t, err)
+		for i := range paths {
+			paths[i], err = filepath.Rel(pwd, paths[i])
+			require.NoError(t, err)
+		}
+		return paths
+	}
+
+	require.Equal(t, []string{"main.go", "src/a.go"}, selectFiles())
+	require.Equal(t, []string{"main.go", "pkg/p.go", "src/a.go"},
+		selectFiles(buildx.WithFollowDirSymlinks(true), buildx.WithEnsureUnderPWD(true)))
+	require.Equal(t, []string{"main.go", "pkg/p.go", "shared/lib.go", "src/a.go"},
+		selectFiles(buildx.WithFollowDirSymlinks(true)))
+}
@@ -9,3 +9,16 @@ var ErrNoDocker = errors.New("No docker client found: curl -fsSL https://get.doc
 
 // ErrDockerBuildFailure is returned when docker build failed
 var ErrDockerBuildFailure = errors.New("docker build failed with status 1")
+
+// ErrDuplicateInputFile is returned when the same input file was added more than once
+var ErrDuplicateInputFile = errors.New("duplicate input file")
+
+// ErrBuildkitUnavailable is returned when the Docker client cannot build with BuildKit
+var ErrBuildkitUnavailable = errors.New("Docker cannot build with BuildKit: upgrade to Docker 18.09+ or install the buildx plugin: https://docs.docker.com/build/install-buildx/")
+
+// ErrMissingStdoutFile is returned when the build output lacks the stdout file,
+// e.g. as the Dockerfile does not copy it out
+var ErrMissingStdoutFile = errors.New("build output lacks the stdout file")
+
+// ErrContextDirWithInputFiles is returned when input files are given along WithContextDir.
+var ErrContextDirWithInputFiles = errors.New("input files cannot be given along a context directory")
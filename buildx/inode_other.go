@@ -0,0 +1,11 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package buildx
+
+import "os"
+
+// inode identifies the file behind fi, if it has more than one link.
+func inode(fi os.FileInfo) (key [2]uint64, ok bool) {
+	return
+}
@@ -0,0 +1,18 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package buildx
+
+import (
+	"os"
+	"syscall"
+)
+
+// inode identifies the file behind fi, if it has more than one link.
+func inode(fi os.FileInfo) (key [2]uint64, ok bool) {
+	st, isStat := fi.Sys().(*syscall.Stat_t)
+	if !isStat || st.Nlink < 2 {
+		return
+	}
+	return [2]uint64{uint64(st.Dev), uint64(st.Ino)}, true
+}
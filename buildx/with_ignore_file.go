@@ -0,0 +1,146 @@
+package buildx
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// WithIgnoreFile skips files matching the patterns listed in the file
+// named name at the root of $PWD, if it exists.
+//
+// Each line holds a pattern of $PWD-relative, slash-separated paths
+// made of path.Match patterns and ** (any number of directories).
+// Patterns without a slash match at any depth and patterns matching
+// a directory match everything under it. Blank lines and lines starting
+// with # are ignored. A pattern starting with ! re-includes the files
+// it matches. The last pattern matching a file decides.
+func WithIgnoreFile(name string) InputFilesOption {
+	return func(oo *inputfilesoptions) { oo.ignoreFile = name }
+}
+
+type ignorePattern struct {
+	line     int
+	negate   bool
+	segments []string
+}
+
+// loadIgnoreFile reads the patterns of the ignore file, if any.
+func (oo *inputfilesoptions) loadIgnoreFile() error {
+	oo.ignorePatterns = nil
+	if oo.ignoreFile == "" {
+		return nil
+	}
+	f, err := os.Open(filepath.Join(oo.pwd, oo.ignoreFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	patterns, err := parseIgnorePatterns(f)
+	if err != nil {
+		return fmt.Errorf("%s:%w", oo.ignoreFile, err)
+	}
+	oo.ignorePatterns = patterns
+	return nil
+}
+
+// IgnoreFunc parses the patterns of an ignore file (see WithIgnoreFile) read from r,
+// returning a func telling which of its lines has name be skipped, if any.
+// name is a $PWD-relative, slash-separated path: e.g. that of a file read
+// from Git's objects rather than found on disk.
+func IgnoreFunc(r io.Reader) (func(name string) (line int), error) {
+	patterns, err := parseIgnorePatterns(r)
+	if err != nil {
+		return nil, err
+	}
+	return func(name string) int {
+		if p := lastMatch(patterns, strings.Split(path.Clean(name), "/")); p != nil && !p.negate {
+			return p.line
+		}
+		return 0
+	}, nil
+}
+
+func parseIgnorePatterns(r io.Reader) ([]ignorePattern, error) {
+	var patterns []ignorePattern
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		p := ignorePattern{line: line}
+		if text[0] == '!' {
+			p.negate = true
+			text = text[1:]
+		}
+		text = strings.Trim(text, "/")
+		if text == "" {
+			continue
+		}
+		if !strings.Contains(text, "/") {
+			text = "**/" + text
+		}
+		p.segments = strings.Split(path.Clean(text), "/")
+		for _, segment := range p.segments {
+			if _, err := path.Match(segment, ""); err != nil {
+				return nil, fmt.Errorf("%d: %w: %q", line, err, s.Text())
+			}
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, s.Err()
+}
+
+// ignored tells which line of the ignore file has fn be skipped, if any.
+func (oo *inputfilesoptions) ignored(fn string) (line int) {
+	name := oo.relative(fn)
+	if len(oo.ignorePatterns) == 0 || strings.HasPrefix(name, OutsidePWD) {
+		return 0
+	}
+	segments := strings.Split(path.Clean(filepath.ToSlash(name)), "/")
+	if p := lastMatch(oo.ignorePatterns, segments); p != nil && !p.negate {
+		return p.line
+	}
+	return 0
+}
+
+// lastMatch returns the last of patterns matching the path made of segments
+// or one of its parent directories, if any.
+func lastMatch(patterns []ignorePattern, segments []string) (last *ignorePattern) {
+	for i, p := range patterns {
+		for n := 1; n <= len(segments); n++ {
+			if matchSegments(p.segments, segments[:n]) {
+				last = &patterns[i]
+				break
+			}
+		}
+	}
+	return
+}
+
+func matchSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], segments[0])
+	return ok && matchSegments(pattern[1:], segments[1:])
+}
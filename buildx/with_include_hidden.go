@@ -0,0 +1,89 @@
+package buildx
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// WithIncludeHidden has directory traversal walk the hidden files and directories
+// (named with a leading dot) matching any of the given patterns, which are otherwise skipped,
+// e.g. .github/** for CI workflows. Patterns follow the syntax of WithIgnoreFile
+// and ** includes all hidden files. .git directories are never walked.
+// Each call resets the previous setting.
+func WithIncludeHidden(patterns []string) InputFilesOption {
+	return func(oo *inputfilesoptions) { oo.includeHidden = patterns }
+}
+
+// loadIncludeHidden parses the patterns of WithIncludeHidden.
+func (oo *inputfilesoptions) loadIncludeHidden() error {
+	oo.hiddenPatterns = nil
+	for _, pattern := range oo.includeHidden {
+		patterns, err := parseIgnorePatterns(strings.NewReader(pattern))
+		if err != nil || len(patterns) != 1 {
+			return fmt.Errorf("bad hidden path pattern %q", pattern)
+		}
+		oo.hiddenPatterns = append(oo.hiddenPatterns, patterns[0])
+	}
+	return nil
+}
+
+// IncludeHiddenFunc returns a func telling whether traversal with WithIncludeHidden(patterns)
+// would walk name, a $PWD-relative, slash-separated file path (hidden or not):
+// e.g. that of a file read from Git's objects rather than found on disk.
+func IncludeHiddenFunc(patterns []string) (func(name string) bool, error) {
+	oo := &inputfilesoptions{includeHidden: patterns}
+	if err := oo.loadIncludeHidden(); err != nil {
+		return nil, err
+	}
+	return func(name string) bool {
+		return !hidden(name) || oo.walksHidden(name, false)
+	}, nil
+}
+
+// walksHidden tells whether traversal walks name, a $PWD-relative hidden file
+// or directory or one under a hidden directory.
+func (oo *inputfilesoptions) walksHidden(name string, dir bool) bool {
+	segments := strings.Split(filepath.ToSlash(name), "/")
+	for _, segment := range segments {
+		if segment == ".git" {
+			return false
+		}
+	}
+	if dir {
+		for _, p := range oo.hiddenPatterns {
+			if !p.negate && matchPrefix(p.segments, segments) {
+				return true
+			}
+		}
+		return false
+	}
+	p := lastMatch(oo.hiddenPatterns, segments)
+	return p != nil && !p.negate
+}
+
+// hidden tells whether the $PWD-relative name holds a hidden file or directory.
+func hidden(name string) bool {
+	for _, segment := range strings.Split(filepath.ToSlash(name), "/") {
+		if segment != "." && segment != ".." && strings.HasPrefix(segment, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPrefix tells whether pattern may match segments or paths under them.
+func matchPrefix(pattern, segments []string) bool {
+	if len(segments) == 0 {
+		return true
+	}
+	if len(pattern) == 0 {
+		return false
+	}
+	if pattern[0] == "**" {
+		return true
+	}
+	ok, _ := path.Match(pattern[0], segments[0])
+	return ok && matchPrefix(pattern[1:], segments[1:])
+}
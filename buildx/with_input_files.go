@@ -2,10 +2,13 @@ package buildx
 
 import (
 	"errors"
+	"fmt"
 	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
+	"strings"
 )
 
 // InputFilesOption represents the various arguments WithInputFiles takes.
@@ -55,11 +58,110 @@ func WithEnsureWritable(doensure bool) InputFilesOption {
 	return func(oo *inputfilesoptions) { oo.writable = doensure }
 }
 
+// WithEnsureReadable makes sure selected files are all readable
+func WithEnsureReadable(doensure bool) InputFilesOption {
+	return func(oo *inputfilesoptions) { oo.readable = doensure }
+}
+
+// WithSkipPatterns skips files whose lowercased base name matches any of
+// the given path.Match patterns. Each call resets the previous setting.
+func WithSkipPatterns(patterns []string) InputFilesOption {
+	return func(oo *inputfilesoptions) { oo.skipPatterns = patterns }
+}
+
+// WithSkippedFunc is called with each skipped file and the reason it was skipped.
+func WithSkippedFunc(f func(fn, reason string)) InputFilesOption {
+	return func(oo *inputfilesoptions) { oo.skipped = f }
+}
+
+// WithSkipFunc skips files for which f returns a non-empty reason.
+// Multiple calls add skip functions.
+func WithSkipFunc(f func(fn string) (reason string)) InputFilesOption {
+	return func(oo *inputfilesoptions) { oo.skipFuncs = append(oo.skipFuncs, f) }
+}
+
+// WithCollectSelectionErrors have files that cannot be selected
+// (e.g. missing, not regular, not writable) be left out instead of failing
+// selection right away. Once the build is done these failures are returned
+// as SelectionErrors.
+func WithCollectSelectionErrors(docollect bool) InputFilesOption {
+	return func(oo *inputfilesoptions) { oo.collect = docollect }
+}
+
+// WithPreserveInputMode has the permission bits of the selected files
+// (e.g. an executable bit) carried into the build context.
+// Otherwise input files are read-write to their owner only.
+func WithPreserveInputMode(dopreserve bool) InputFilesOption {
+	return func(oo *inputfilesoptions) { oo.preserveMode = dopreserve }
+}
+
+// WithFilenameFilter keeps only the files for which keep returns true,
+// given their path and information. It runs once files passed all other checks
+// (e.g. regular, under $PWD, writable), both for given and traversed files.
+// Each call resets the previous setting.
+func WithFilenameFilter(keep func(path string, info fs.FileInfo) bool) InputFilesOption {
+	return func(oo *inputfilesoptions) { oo.filter = keep }
+}
+
+// WithMaxFileSize skips files larger than n bytes (e.g. generated data,
+// fixtures, database dumps). 0 means no limit.
+func WithMaxFileSize(n int64) InputFilesOption {
+	return func(oo *inputfilesoptions) { oo.maxSize = n }
+}
+
+// WithFollowDirSymlinks has directory traversal walk the directories symlinks point to
+// (e.g. a shared/ directory linked into the tree), which are otherwise left out.
+// Their files are named after the symlink. Each directory is walked once,
+// preferably through its own path, so symlink cycles end. With WithEnsureUnderPWD symlinks to directories
+// outside $PWD are still left out.
+func WithFollowDirSymlinks(dofollow bool) InputFilesOption {
+	return func(oo *inputfilesoptions) { oo.followDirSymlinks = dofollow }
+}
+
+// WithFileContents has the given file filename, which need not exist, be copied in
+// with data as its contents instead of its own (e.g. an editor's unsaved buffer).
+// It is selected per its name: checks of the file itself (e.g. regular, writable,
+// WithFilenameFilter) are left out. Multiple calls add files.
+func WithFileContents(filename string, data []byte) InputFilesOption {
+	return func(oo *inputfilesoptions) {
+		if oo.contents == nil {
+			oo.contents = make(map[string][]byte)
+		}
+		oo.contents[filename] = data
+	}
+}
+
+// SelectionErrors are the selection failures collected per WithCollectSelectionErrors.
+type SelectionErrors []error
+
+func (errs SelectionErrors) Error() string {
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
 type inputfilesoptions struct {
 	filenames                                  []string
 	emptyusePWD, traversedirs, under, writable bool
+	readable                                   bool
 	errer                                      func(fn string, err error) error
 	pwd                                        string
+	skipPatterns                               []string
+	skipped                                    func(fn, reason string)
+	skipFuncs                                  []func(fn string) string
+	collect                                    bool
+	failures                                   SelectionErrors
+	ignoreFile                                 string
+	ignorePatterns                             []ignorePattern
+	preserveMode                               bool
+	filter                                     func(path string, info fs.FileInfo) bool
+	maxSize                                    int64
+	includeHidden                              []string
+	hiddenPatterns                             []ignorePattern
+	followDirSymlinks                          bool
+	contents                                   map[string][]byte // by filename, see WithFileContents
 }
 
 // ErrEmptyPWDForInputFiles is returned when calling WithInputFiles missing WithPWD(pwd) and pwd != "".
@@ -67,64 +169,204 @@ var ErrEmptyPWDForInputFiles = errors.New("given empty $PWD")
 
 // WithInputFiles have build run with given input files copied in.
 func WithInputFiles(opts ...InputFilesOption) Option {
+	oo := newInputFilesOptions(opts)
+	return func(o *options) error {
+		sources, filenames, traversed, err := oo.selectFiles()
+		if err != nil {
+			return err
+		}
+		o.foundFilenamesByTraversingDirs = traversed
+		if len(oo.failures) != 0 {
+			o.selectionErrs = append(o.selectionErrs, oo.failures...)
+		}
+
+		for _, filename := range filenames {
+			data, given := oo.contents[sources[filename]]
+			if !given {
+				if data, err = os.ReadFile(sources[filename]); err != nil {
+					return oo.errer(filename, err)
+				}
+			}
+			if err := WithInputFile(filename, data)(o); err != nil {
+				return err
+			}
+			if oo.preserveMode && !given {
+				fi, err := os.Stat(sources[filename])
+				if err != nil {
+					return oo.errer(filename, err)
+				}
+				o.ifiles[len(o.ifiles)-1].mode = fi.Mode().Perm()
+			}
+		}
+
+		return nil
+	}
+}
+
+// SelectInputFiles returns the paths of the files WithInputFiles would copy in,
+// sorted by the name they would be given. Files are not read.
+// traversed tells whether some files were found by walking directories.
+// Collected selection failures are returned as SelectionErrors along with paths.
+func SelectInputFiles(opts ...InputFilesOption) (paths []string, traversed bool, err error) {
+	oo := newInputFilesOptions(opts)
+	sources, filenames, traversed, err := oo.selectFiles()
+	if err != nil {
+		return nil, false, err
+	}
+	paths = make([]string, 0, len(filenames))
+	for _, filename := range filenames {
+		paths = append(paths, sources[filename])
+	}
+	if len(oo.failures) != 0 {
+		err = oo.failures
+	}
+	return paths, traversed, err
+}
+
+func newInputFilesOptions(opts []InputFilesOption) *inputfilesoptions {
 	oo := &inputfilesoptions{
 		filenames:    nil,
 		emptyusePWD:  false,
 		traversedirs: false,
 		under:        false,
 		errer:        func(fn string, err error) error { return err },
+		skipPatterns: nil,
+		skipped:      func(fn, reason string) {},
+		skipFuncs:    nil,
+		collect:      false,
+		failures:     nil,
 	}
 	for _, opt := range opts {
 		opt(oo)
 	}
-	return func(o *options) error {
-		if oo.pwd == "" {
-			return ErrEmptyPWDForInputFiles
-		}
+	return oo
+}
 
-		filenames := oo.filenames
-		if oo.emptyusePWD && len(filenames) == 0 {
-			filenames = append(filenames, oo.pwd)
+// selectFiles maps the sorted names of the selected files to their path.
+func (oo *inputfilesoptions) selectFiles() (sources map[string]string, filenames []string, traversed bool, err error) {
+	if oo.pwd == "" {
+		err = ErrEmptyPWDForInputFiles
+		return
+	}
+	for _, pattern := range oo.skipPatterns {
+		if _, err = path.Match(pattern, ""); err != nil {
+			err = fmt.Errorf("%w: %q", err, pattern)
+			return
 		}
+	}
+	if err = oo.loadIgnoreFile(); err != nil {
+		return
+	}
+	if err = oo.loadIncludeHidden(); err != nil {
+		return
+	}
 
-		fns := make([]string, 0, len(filenames))
-		var moreFns []string
-		for _, filename := range filenames {
-			additional, err := oo.ensureRegular(filename)
-			if err != nil {
-				return err
+	filenames = oo.filenames
+	if oo.emptyusePWD && len(filenames) == 0 {
+		filenames = append(filenames, oo.pwd)
+	}
+
+	oo.failures = nil
+	fns := make([]string, 0, len(filenames))
+	var moreFns []string
+	for _, filename := range filenames {
+		_, given := oo.contents[filename]
+		var additional []string
+		if !given {
+			var err error
+			if additional, err = oo.ensureRegular(filename); err != nil {
+				if err = oo.fail(err); err != nil {
+					return nil, nil, false, err
+				}
+				continue
+			}
+		}
+		// A directory, maybe holding nothing to select: it is not itself a file to
+		// select (e.g. running from an empty $PWD selects nothing, without failing)
+		if additional != nil {
+			moreFns = append(moreFns, additional...)
+		} else if !oo.skip(filename) {
+			if oo.under {
+				if err := oo.ensureUnder(filename); err != nil {
+					if err = oo.fail(err); err != nil {
+						return nil, nil, false, err
+					}
+					continue
+				}
 			}
-			if len(additional) != 0 {
-				moreFns = append(moreFns, additional...)
-			} else {
-				fns = append(fns, filename)
-				if oo.under {
-					if err := oo.ensureUnder(filename); err != nil {
-						return err
+			if oo.writable && !given {
+				if err := oo.ensureWritable(filename); err != nil {
+					if err = oo.fail(err); err != nil {
+						return nil, nil, false, err
 					}
+					continue
 				}
-				if oo.writable {
-					if err := oo.ensureWritable(filename); err != nil {
-						return err
+			}
+			if oo.readable && !given {
+				if err := oo.ensureReadable(filename); err != nil {
+					if err = oo.fail(err); err != nil {
+						return nil, nil, false, err
 					}
+					continue
 				}
 			}
+			if oo.filter != nil && !given {
+				keep, err := oo.keep(filename, nil)
+				if err != nil {
+					if err = oo.fail(err); err != nil {
+						return nil, nil, false, err
+					}
+					continue
+				}
+				if !keep {
+					continue
+				}
+			}
+			fns = append(fns, filename)
 		}
-		o.foundFilenamesByTraversingDirs = len(moreFns) != 0
-		filenames = uniqueSorted(append(fns, moreFns...))
+	}
+	traversed = len(moreFns) != 0
+	sources = make(map[string]string, len(fns)+len(moreFns))
+	for _, filename := range append(fns, moreFns...) {
+		sources[oo.relative(filename)] = filename
+	}
+	filenames = make([]string, 0, len(sources))
+	for filename := range sources {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	filenames = oo.dedupHardLinks(sources, filenames)
+	return
+}
 
-		for _, filename := range filenames {
-			data, err := os.ReadFile(filename)
-			if err != nil {
-				return oo.errer(filename, err)
-			}
-			if err := WithInputFile(filename, data)(o); err != nil {
-				return err
+// dedupHardLinks keeps only the first of filenames that are hard links to the
+// same file, so that file is not formatted nor written more than once.
+func (oo *inputfilesoptions) dedupHardLinks(sources map[string]string, filenames []string) []string {
+	firsts := make(map[[2]uint64]string)
+	kept := filenames[:0]
+	for _, filename := range filenames {
+		if fi, err := os.Stat(sources[filename]); err == nil {
+			if key, ok := inode(fi); ok {
+				if first, ok := firsts[key]; ok {
+					oo.skipped(PathOfName(filename), "hard link to "+PathOfName(first))
+					delete(sources, filename)
+					continue
+				}
+				firsts[key] = filename
 			}
 		}
+		kept = append(kept, filename)
+	}
+	return kept
+}
 
-		return nil
+// fail returns err, unless selection failures are to be collected.
+func (oo *inputfilesoptions) fail(err error) error {
+	if !oo.collect {
+		return err
 	}
+	oo.failures = append(oo.failures, err)
+	return nil
 }
 
 func (oo *inputfilesoptions) ensureUnder(fn string) (err error) {
@@ -143,6 +385,98 @@ func (oo *inputfilesoptions) ensureUnder(fn string) (err error) {
 	return
 }
 
+// OutsidePWD prefixes the names files outside $PWD are given in the build
+// context, followed by their absolute path.
+const OutsidePWD = "_outside_pwd_/"
+
+// PathOfName returns the path of the file WithInputFiles named name:
+// name itself unless the file is outside $PWD.
+func PathOfName(name string) string {
+	rest := strings.TrimPrefix(name, OutsidePWD)
+	if rest == name {
+		return name
+	}
+	if path := filepath.FromSlash(rest); filepath.VolumeName(path) != "" {
+		return path
+	}
+	return filepath.FromSlash("/" + rest)
+}
+
+// relative turns absolute paths under $PWD into $PWD-relative ones
+// so they are tarred and written back under their short name.
+// Paths outside $PWD are named after their absolute path, under OutsidePWD.
+func (oo *inputfilesoptions) relative(fn string) string {
+	abs := fn
+	if !filepath.IsAbs(fn) {
+		if clean := filepath.Clean(fn); clean != ".." && !strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+			return clean
+		}
+		var err error
+		if abs, err = filepath.Abs(fn); err != nil {
+			return fn
+		}
+	}
+	rel, err := filepath.Rel(oo.pwd, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return OutsidePWD + strings.TrimPrefix(filepath.ToSlash(abs), "/")
+	}
+	return rel
+}
+
+// skip tells whether fn should be left out, reporting why if so.
+func (oo *inputfilesoptions) skip(fn string) bool {
+	if line := oo.ignored(fn); line != 0 {
+		oo.skipped(PathOfName(oo.relative(fn)), fmt.Sprintf("matches %s:%d", oo.ignoreFile, line))
+		return true
+	}
+	base := strings.ToLower(filepath.Base(fn))
+	for _, pattern := range oo.skipPatterns {
+		if ok, _ := path.Match(pattern, base); ok {
+			oo.skipped(PathOfName(oo.relative(fn)), "matches "+pattern)
+			return true
+		}
+	}
+	for _, f := range oo.skipFuncs {
+		if reason := f(fn); reason != "" {
+			oo.skipped(PathOfName(oo.relative(fn)), reason)
+			return true
+		}
+	}
+	if oo.maxSize > 0 {
+		size := int64(-1)
+		if data, ok := oo.contents[fn]; ok {
+			size = int64(len(data))
+		} else if fi, err := os.Stat(fn); err == nil {
+			size = fi.Size()
+		}
+		if size > oo.maxSize {
+			oo.skipped(PathOfName(oo.relative(fn)), fmt.Sprintf("larger than %d bytes", oo.maxSize))
+			return true
+		}
+	}
+	return false
+}
+
+// keep tells whether the filter of WithFilenameFilter keeps fn, reporting it skipped if not.
+// d is fn's directory entry, if it was traversed.
+func (oo *inputfilesoptions) keep(fn string, d fs.DirEntry) (bool, error) {
+	var info fs.FileInfo
+	var err error
+	if d != nil {
+		info, err = d.Info()
+	} else {
+		info, err = os.Lstat(fn)
+	}
+	if err != nil {
+		return false, oo.errer(fn, err)
+	}
+	if !oo.filter(fn, info) {
+		oo.skipped(PathOfName(oo.relative(fn)), "filtered out")
+		return false, nil
+	}
+	return true, nil
+}
+
 func (oo *inputfilesoptions) ensureWritable(fn string) error {
 	f, err := os.OpenFile(fn, os.O_RDWR, 0200)
 	if err != nil {
@@ -154,47 +488,130 @@ func (oo *inputfilesoptions) ensureWritable(fn string) error {
 	return nil
 }
 
+func (oo *inputfilesoptions) ensureReadable(fn string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return oo.errer(fn, err.(*fs.PathError).Unwrap())
+	}
+	if err := f.Close(); err != nil {
+		return oo.errer(fn, err)
+	}
+	return nil
+}
+
 func (oo *inputfilesoptions) ensureRegular(fn string) ([]string, error) {
 	if fi, err := os.Lstat(fn); err != nil {
 		return nil, oo.errer(fn, err.(*fs.PathError).Unwrap())
 	} else if fi.Mode().IsRegular() {
 		return nil, nil
-	} else if oo.traversedirs && fi.IsDir() {
-		var filenames []string
-		if err := filepath.WalkDir(fn, func(path string, d fs.DirEntry, err error) error {
-			if name := d.Name(); name != "" && name[0] == '.' { // skip hidden files
-				if d.IsDir() {
-					return fs.SkipDir
-				}
-				return nil
-			}
-			if !d.Type().IsRegular() {
-				return nil
+	} else if fi.IsDir() && !oo.traversedirs {
+		return nil, oo.errer(fn, errors.New("is a directory"))
+	} else if fi.IsDir() {
+		if oo.under {
+			if err := oo.ensureUnder(fn); err != nil {
+				return nil, err
 			}
-			if oo.writable {
-				if err := oo.ensureWritable(path); err != nil {
-					return err
+		}
+		filenames := []string{}         // non-nil, for the caller to tell directories apart
+		walked := make(map[string]bool) // real paths of walked directories, per WithFollowDirSymlinks
+		var links []string              // symlinks to directories, walked after the directories themselves
+		var walk func(root string) error
+		walk = func(root string) error {
+			return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+				if name := oo.relative(path); len(oo.hiddenPatterns) != 0 && !strings.HasPrefix(name, OutsidePWD) {
+					if hidden(name) && !oo.walksHidden(name, d.IsDir()) {
+						if d.IsDir() {
+							return fs.SkipDir
+						}
+						return nil
+					}
+				} else if name := d.Name(); name != "" && name[0] == '.' { // skip hidden files
+					if d.IsDir() {
+						return fs.SkipDir
+					}
+					return nil
 				}
-			}
-			filenames = append(filenames, path)
-			return nil
-		}); err != nil {
+				if oo.followDirSymlinks {
+					if d.IsDir() && !walkOnce(path, walked) {
+						return fs.SkipDir
+					}
+					if d.Type()&fs.ModeSymlink != 0 && oo.linksToDir(path) {
+						links = append(links, path)
+						return nil
+					}
+				}
+				if !d.Type().IsRegular() {
+					return nil
+				}
+				if oo.skip(path) {
+					return nil
+				}
+				if oo.writable {
+					if err := oo.ensureWritable(path); err != nil {
+						return oo.fail(err)
+					}
+				}
+				if oo.readable {
+					if err := oo.ensureReadable(path); err != nil {
+						return oo.fail(err)
+					}
+				}
+				if oo.filter != nil {
+					keep, err := oo.keep(path, d)
+					if err != nil {
+						return oo.fail(err)
+					}
+					if !keep {
+						return nil
+					}
+				}
+				filenames = append(filenames, path)
+				return nil
+			})
+		}
+		if err := walk(fn); err != nil {
 			return nil, err
 		}
+		for len(links) != 0 {
+			link := links[0]
+			links = links[1:]
+			// A trailing separator has the symlink be walked as the directory it points to
+			if err := walk(link + string(filepath.Separator)); err != nil {
+				return nil, err
+			}
+		}
 		return filenames, nil
 	}
 	return nil, oo.errer(fn, errors.New("not a regular file"))
 }
 
-func uniqueSorted(xs []string) []string {
-	uniq := make(map[string]struct{}, len(xs))
-	for _, x := range xs {
-		uniq[x] = struct{}{}
+// walkOnce tells whether the directory at path was not walked yet, recording it in walked.
+func walkOnce(path string, walked map[string]bool) bool {
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil || walked[real] {
+		return false
+	}
+	walked[real] = true
+	return true
+}
+
+// linksToDir tells whether the symlink at path points to a directory to walk:
+// one under $PWD with WithEnsureUnderPWD.
+func (oo *inputfilesoptions) linksToDir(path string) bool {
+	if fi, err := os.Stat(path); err != nil || !fi.IsDir() {
+		return false
 	}
-	xs = make([]string, 0, len(uniq))
-	for x := range uniq {
-		xs = append(xs, x)
+	if !oo.under {
+		return true
+	}
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false
+	}
+	pwd, err := filepath.EvalSymlinks(oo.pwd)
+	if err != nil {
+		return false
 	}
-	sort.Strings(xs)
-	return xs
+	rel, err := filepath.Rel(pwd, real)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
 }
@@ -4,28 +4,62 @@ import (
 	"errors"
 	"io"
 	"os"
+	"path/filepath"
 )
 
 // OverwriteFileContents replaces the contents of a file with the data
-// from the given reader. File attributes are not changed except modtime.
-var OverwriteFileContents OutputFileFunc = func(filename string, r io.Reader) error {
-	f, err := os.OpenFile(filename, os.O_RDWR, 0) // already exists
+// from the given reader. Data is first written to a temporary file
+// next to it, which is then renamed over it: readers never see a partially
+// written file and nothing is left behind on failure.
+// The file's permissions are kept, but not its owner.
+// Files with hard links are instead written in place, so all their names
+// keep sharing the new contents.
+var OverwriteFileContents OutputFileFunc = func(filename string, r io.Reader) (err error) {
+	fi, err := os.Stat(filename) // already exists
 	if err != nil {
 		return err
 	}
-	if err := f.Truncate(0); err != nil {
+	if _, linked := inode(fi); linked {
+		return overwriteInPlace(filename, r)
+	}
+	f, err := os.CreateTemp(filepath.Dir(filename), ".fmtd-tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}()
+	if _, err = io.Copy(f, r); err != nil {
+		return err
+	}
+	if err = f.Chmod(fi.Mode().Perm()); err != nil {
 		return err
 	}
-	if _, err := f.Seek(0, 0); err != nil {
+	if err = f.Close(); err != nil {
 		return err
 	}
-	if _, err := io.Copy(f, r); err != nil {
+	return os.Rename(f.Name(), filename)
+}
+
+// overwriteInPlace truncates filename and writes the data from r to it,
+// once all of it is read.
+func overwriteInPlace(filename string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
 		return err
 	}
-	if err := f.Close(); err != nil {
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
 		return err
 	}
-	return nil
+	return f.Close()
 }
 
 // ErrOutputFileFuncSet is returned on multiple calls to WithOutputFileFunc(f) where f != nil
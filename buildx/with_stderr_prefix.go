@@ -0,0 +1,49 @@
+package buildx
+
+import (
+	"bytes"
+	"io"
+)
+
+// WithStderrPrefix have each line the build writes to STDERR start with prefix,
+// telling apart the output of builds sharing a writer.
+func WithStderrPrefix(prefix string) Option {
+	return func(o *options) error {
+		o.stderrPrefix = prefix
+		return nil
+	}
+}
+
+// prefixWriter writes each line to w prefixed, keeping incomplete lines until Flush.
+type prefixWriter struct {
+	w      io.Writer
+	prefix []byte
+	line   []byte
+}
+
+func (pw *prefixWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) != 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i == -1 {
+			pw.line = append(pw.line, p...)
+			break
+		}
+		pw.line = append(pw.line, p[:i+1]...)
+		p = p[i+1:]
+		if err := pw.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// Flush writes the incomplete line, if any.
+func (pw *prefixWriter) Flush() error {
+	if len(pw.line) == 0 {
+		return nil
+	}
+	_, err := pw.w.Write(append(append([]byte{}, pw.prefix...), pw.line...))
+	pw.line = pw.line[:0]
+	return err
+}
@@ -1,9 +1,17 @@
 package buildx
 
 import (
+	"archive/tar"
 	"context"
 	"errors"
+	"fmt"
 	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 // Option represents the various arguments a New takes
@@ -61,6 +69,38 @@ func WithExecutable(exe string) Option {
 	}
 }
 
+// WithBuildkitPreflight have New first check with `docker buildx version`
+// (or else `docker version`, for daemons 18.09 or later) that Docker can build
+// with BuildKit, returning ErrBuildkitUnavailable if not.
+// The check is done once per Docker executable and environment.
+// Defaults to true.
+func WithBuildkitPreflight(docheck bool) Option {
+	return func(o *options) error {
+		o.preflight = docheck
+		return nil
+	}
+}
+
+// ErrNegativeRetries is returned when WithRetries(n, _) was called with n < 0.
+var ErrNegativeRetries = errors.New("negative retries")
+
+// WithRetries have build re-run up to n times when it fails due to
+// a transient network or registry error (e.g. TLS handshake timeout).
+// Waits backoff before the first retry, doubling it each time.
+// Genuine build failures are never retried, nor are builds given input files
+// with WithInputFileFromReader as their readers cannot be read again.
+// Defaults to no retries.
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(o *options) error {
+		if n < 0 {
+			return ErrNegativeRetries
+		}
+		o.retries = n
+		o.backoff = backoff
+		return nil
+	}
+}
+
 // WithBuildArg have build run with given build argument in key=value format.
 // Multiple calls append build args.
 func WithBuildArg(arg string) Option {
@@ -72,10 +112,27 @@ func WithBuildArg(arg string) Option {
 	}
 }
 
+// WithExtraBuildFlags have build run with given raw `docker build` flags
+// (e.g. --no-cache, --add-host=...), appended after the ones New sets
+// and before the trailing `-` reading the context from stdin.
+// Flags are passed as is: ones changing the build's output (e.g. --output,
+// --file, a context path) break how New exchanges files with the build.
+// Multiple calls append flags.
+func WithExtraBuildFlags(flags ...string) Option {
+	return func(o *options) error {
+		o.args = append(o.args, flags...)
+		return nil
+	}
+}
+
 // ErrNoDockerfile is returned when WithDockerfile() wasn't called.
 var ErrNoDockerfile = errors.New("missing Dockerfile")
 
 // WithDockerfile have build run with given Dockerfile.
+// dockerfiler is given details about the build:
+//
+//	"foundFilenamesByTraversingDirs": bool
+//	"inputFileSizes": map[string]int64 of input files to their size
 func WithDockerfile(dockerfiler func(map[interface{}]interface{}) []byte) Option {
 	return func(o *options) error {
 		o.dockerfiler = dockerfiler
@@ -98,6 +155,32 @@ func WithStdoutFile(stdoutf string) Option {
 	}
 }
 
+// ErrEmptySidecarFile is returned when WithSidecarFile("", _) was called.
+var ErrEmptySidecarFile = errors.New("empty sidecar file")
+
+// ErrSidecarFileSet is returned when a sidecar file is captured more than once
+// or is also the stdout file.
+var ErrSidecarFileSet = errors.New("sidecar file already captured")
+
+// WithSidecarFile have build output file name be written to w instead of
+// being given to OutputFileFunc. Unlike the stdout file it is not shown.
+// Multiple calls add sidecar files.
+func WithSidecarFile(name string, w io.Writer) Option {
+	return func(o *options) error {
+		if name == "" {
+			return ErrEmptySidecarFile
+		}
+		if _, ok := o.sidecars[name]; ok {
+			return ErrSidecarFileSet
+		}
+		if o.sidecars == nil {
+			o.sidecars = make(map[string]io.Writer)
+		}
+		o.sidecars[name] = w
+		return nil
+	}
+}
+
 // ErrEmptyDirA is returned when WithDirectoryA("") was called.
 var ErrEmptyDirA = errors.New("empty dir a")
 
@@ -131,6 +214,10 @@ func WithDirectoryB(dirB string) Option {
 type inputfile struct {
 	filename string
 	data     []byte
+	r        io.Reader
+	tar      *inputTar   // streamed from there, per WithInputFilesFromTar
+	size     int64       // with r or tar
+	mode     os.FileMode // 0600 if zero
 }
 
 // WithInputFile have build run with given input file copied in.
@@ -144,3 +231,175 @@ func WithInputFile(relativePath string, data []byte) Option {
 		return nil
 	}
 }
+
+// ErrNegativeInputFileSize is returned when WithInputFileFromReader(_, _, size) was called with size < 0.
+var ErrNegativeInputFileSize = errors.New("negative input file size")
+
+// WithInputFileFromReader have build run with given input file copied in.
+// Exactly size bytes are streamed from r into the build context as Docker reads it,
+// so the file's contents need not be held in memory. Such builds are not retried
+// (see WithRetries).
+// Multiple calls add input files.
+func WithInputFileFromReader(relativePath string, r io.Reader, size int64) Option {
+	return func(o *options) error {
+		if size < 0 {
+			return ErrNegativeInputFileSize
+		}
+		o.ifiles = append(o.ifiles, inputfile{
+			filename: relativePath,
+			r:        r,
+			size:     size,
+		})
+		return nil
+	}
+}
+
+// ErrInputTarEscape is returned when an entry of a tar given to WithInputFilesFromTar
+// would not be under the "a" directory.
+var ErrInputTarEscape = errors.New("tar entry escapes the input directory")
+
+// WithInputFilesFromTar have build run with the regular files of the tar stream r
+// copied in, each at its name in r and with its mode.
+// Other entries (directories, links, ...) are left out.
+// Only the headers of r are read here: files are streamed from r into the build context,
+// which r must then be able to seek back to. Tar streams that cannot seek (e.g. pipes)
+// are first copied to a temporary file, which New removes.
+// Multiple calls add input files.
+func WithInputFilesFromTar(r io.Reader) Option {
+	return func(o *options) error {
+		rs, ok := r.(io.ReadSeeker)
+		if !ok {
+			f, err := os.CreateTemp("", "fmtd-input-*.tar")
+			if err != nil {
+				return err
+			}
+			o.cleanups = append(o.cleanups, func() { _ = f.Close(); _ = os.Remove(f.Name()) })
+			if _, err := io.Copy(f, r); err != nil {
+				return err
+			}
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			rs = f
+		}
+		start, err := rs.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		it := &inputTar{r: rs, start: start}
+		if err := it.rewind(); err != nil {
+			return err
+		}
+		for {
+			hdr, err := it.tr.Next() // skips entries' contents, seeking past them
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if !regularEntry(hdr) {
+				continue
+			}
+			name := path.Clean(strings.ReplaceAll(hdr.Name, "\\", "/"))
+			if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+				return fmt.Errorf("%w: %q", ErrInputTarEscape, hdr.Name)
+			}
+			o.ifiles = append(o.ifiles, inputfile{
+				filename: name,
+				tar:      it,
+				size:     hdr.Size,
+				mode:     hdr.FileInfo().Mode().Perm(),
+			})
+		}
+	}
+}
+
+// inputTar is a tar stream given to WithInputFilesFromTar,
+// read again from its start each time the build context is written.
+type inputTar struct {
+	r     io.ReadSeeker
+	start int64
+	tr    *tar.Reader
+}
+
+func (it *inputTar) rewind() error {
+	if _, err := it.r.Seek(it.start, io.SeekStart); err != nil {
+		return err
+	}
+	it.tr = tar.NewReader(it.r)
+	return nil
+}
+
+// next returns the contents of the next regular file of the stream.
+func (it *inputTar) next() (io.Reader, error) {
+	for {
+		hdr, err := it.tr.Next()
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if regularEntry(hdr) {
+			return it.tr, nil
+		}
+	}
+}
+
+func regularEntry(hdr *tar.Header) bool {
+	return hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA
+}
+
+// WithInputDir have build run with the regular files under localDir copied in,
+// each under tarPrefix at its path relative to localDir.
+// filter is given these slash-separated relative paths and may be nil to keep all files.
+// Multiple calls add input files.
+func WithInputDir(localDir, tarPrefix string, filter func(path string) bool) Option {
+	return func(o *options) error {
+		return filepath.WalkDir(localDir, func(fn string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(localDir, fn)
+			if err != nil {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+			if filter != nil && !filter(rel) {
+				return nil
+			}
+			data, err := os.ReadFile(fn)
+			if err != nil {
+				return err
+			}
+			o.ifiles = append(o.ifiles, inputfile{
+				filename: path.Join(filepath.ToSlash(tarPrefix), rel),
+				data:     data,
+			})
+			return nil
+		})
+	}
+}
+
+// WithContextDir have build run with the local directory dir as its context
+// instead of a tar of the input files synthesized in memory and piped to Docker,
+// the Dockerfile being piped instead. This saves copying the files of huge repos
+// around, but Docker must then run locally (it reads dir itself) and the
+// .dockerignore of dir applies. Input files cannot be given along.
+func WithContextDir(dir string) Option {
+	return func(o *options) error {
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("context %q is not a directory", dir)
+		}
+		o.contextDir = dir
+		return nil
+	}
+}
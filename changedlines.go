@@ -0,0 +1,141 @@
+package fmtd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fenollp/fmtd/buildx"
+)
+
+// WithOnlyChangedLines has only the lines changed since the Git commit base
+// (e.g. HEAD) be formatted, per `git diff` run in $PWD, as `git clang-format` does.
+// Only clang-format formats line ranges: changed files of other languages
+// are formatted whole, with a warning on stderr. Files Git tracks that did not change
+// since base are skipped. Untracked files are formatted whole.
+// An empty base formats whole files, as by default.
+func WithOnlyChangedLines(base string) Option {
+	return func(o *options) error {
+		o.changedSince = base
+		return nil
+	}
+}
+
+// lineRange is a 1-based inclusive range of lines.
+type lineRange struct {
+	first, last int
+}
+
+// linesFunc defines the shell function printing the changed line ranges of "$f",
+// each prefixed with $1 (e.g. --lines=).
+const linesFunc = `lines() { awk -F '\t' -v f="$f" -v p="$1" '$1 == f { n = split($2, r, " "); for (i = 1; i <= n; i++) printf "%s%s ", p, r[i] }' ../lines; }`
+
+// linesFile renders the instruction writing the changed line ranges of files
+// for linesFunc to read, in the product stage.
+func (o *options) linesFile() string {
+	names := make([]string, 0, len(o.changedLines))
+	for name := range o.changedLines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString("COPY <<\"LINES\" /app/lines\n")
+	for _, name := range names {
+		ranges := make([]string, 0, len(o.changedLines[name]))
+		for _, r := range o.changedLines[name] {
+			ranges = append(ranges, fmt.Sprintf("%d:%d", r.first, r.last))
+		}
+		b.WriteString(name + "\t" + strings.Join(ranges, " ") + "\n")
+	}
+	b.WriteString("LINES\n")
+	return b.String()
+}
+
+// onlyChanged leaves out of paths the files that did not change since o.changedSince
+// and records the lines that did for formatters able to format only them.
+func (o *options) onlyChanged(ctx context.Context, pwd string, stderr io.Writer, paths []string) ([]string, error) {
+	diff, err := git(ctx, pwd, nil, "diff", "-U0", "--no-color", "--no-ext-diff", "--relative", o.changedSince, "--")
+	if err != nil {
+		return nil, err
+	}
+	changes, err := parseDiffLines(diff)
+	if err != nil {
+		return nil, err
+	}
+	ls, err := git(ctx, pwd, nil, "ls-files", "-z")
+	if err != nil {
+		return nil, err
+	}
+	tracked := make(map[string]bool)
+	for _, name := range strings.Split(string(ls), "\x00") {
+		tracked[name] = true
+	}
+
+	o.changedLines = make(map[string][]lineRange)
+	warned := make(map[string]bool)
+	kept := make([]string, 0, len(paths))
+	for _, path := range paths {
+		name := nativeName(pwd, path)
+		ranges, changed := changes[name]
+		if !changed && tracked[name] || changed && len(ranges) == 0 {
+			o.skip(buildx.PathOfName(buildName(pwd, path)), "no lines changed since "+o.changedSince)
+			continue
+		}
+		kept = append(kept, path)
+		r := o.ruleFor(path)
+		switch {
+		case r == nil || !changed:
+		case r.lines != "":
+			o.changedLines[name] = ranges
+		case !warned[r.name] && !o.quiet:
+			warned[r.name] = true
+			fmt.Fprintf(stderr, "fmtd: %s files cannot be formatted by line ranges: formatting changed files whole\n", r.name)
+		}
+	}
+	return kept, nil
+}
+
+var hunkHeader = regexp.MustCompile(`^@@ -[0-9]+(?:,[0-9]+)? \+([0-9]+)(?:,([0-9]+))? @@`)
+
+// parseDiffLines maps the names of the files of a `git diff -U0` to the ranges
+// of lines added to them. Files only losing lines map to no ranges.
+func parseDiffLines(diff []byte) (map[string][]lineRange, error) {
+	changes := make(map[string][]lineRange)
+	var name string
+	s := bufio.NewScanner(bytes.NewReader(diff))
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		line := s.Text()
+		switch {
+		case strings.HasPrefix(line, "+++ "):
+			name = ""
+			if target := strings.TrimPrefix(line, "+++ "); target != "/dev/null" {
+				name = strings.TrimPrefix(target, "b/")
+				if unquoted, err := strconv.Unquote(name); err == nil {
+					name = strings.TrimPrefix(unquoted, "b/")
+				}
+				changes[name] = nil
+			}
+		case name != "" && strings.HasPrefix(line, "@@ "):
+			m := hunkHeader.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fmt.Errorf("unexpected git diff hunk %q", line)
+			}
+			first, _ := strconv.Atoi(m[1])
+			count := 1
+			if m[2] != "" {
+				count, _ = strconv.Atoi(m[2])
+			}
+			if count != 0 {
+				changes[name] = append(changes[name], lineRange{first: first, last: first + count - 1})
+			}
+		}
+	}
+	return changes, s.Err()
+}
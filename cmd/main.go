@@ -2,10 +2,16 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/fenollp/fmtd"
 	"github.com/fenollp/fmtd/buildx"
@@ -13,10 +19,189 @@ import (
 
 var dryrun bool
 var withstderr bool
+var versioncheck bool
+var namesfirst bool
+var notraverse bool
+var verbose bool
+var finalnewline bool
+var skip string
+var quiet bool
+var color string
+var jsonout bool
+var requireconfig string
+var batchsize int
+var retries int
+var retrybackoff time.Duration
+var initconfig bool
+var inithook bool
+var force bool
+var keepgoing bool
+var dumpdockerfile string
+var warnunhandled bool
+var universalcleanup bool
+var pull bool
+var allowoutside bool
+var native bool
+var buildargs buildArgs
+var pin bool
+var selftest bool
+var verify bool
+var dprint string
+var skipunavailable bool
+var fromstdin bool
+var nulsep bool
+var onlychangedlines bool
+var timings bool
+var configpath string
+var disable string
+var detect bool
+var containeruser string
+var manifest bool
+var what bool
+var sortcss bool
+var strict bool
+var compilecommands bool
+var failunhandled bool
+var diagnostics bool
+var warningpatterns = patternFlags{patterns: fmtd.DefaultWarningPatterns}
+var maxfilesize string
+var listunhandled bool
+var normalizeeol bool
+var threads int
+var skipgenerated bool
+var generatedpatterns = patternFlags{patterns: fmtd.DefaultGeneratedPatterns}
+var report string
+var includehidden string
+var stdinfilename string
+var followsymlinks bool
+var verifyidempotent bool
+
+// buildArgs collects repeated -arg flags.
+type buildArgs []string
+
+func (a *buildArgs) String() string { return strings.Join(*a, ",") }
+
+func (a *buildArgs) Set(kv string) error {
+	if !strings.Contains(kv, "=") {
+		return fmt.Errorf("expected NAME=VALUE, got %q", kv)
+	}
+	*a = append(*a, kv)
+	return nil
+}
+
+// patternFlags collects repeated regular expression flags.
+// The first one given replaces the defaults; an empty one leaves none.
+type patternFlags struct {
+	patterns []string
+	given    bool
+}
+
+func (p *patternFlags) String() string {
+	if p == nil {
+		return ""
+	}
+	quoted := make([]string, 0, len(p.patterns))
+	for _, pattern := range p.patterns {
+		quoted = append(quoted, strconv.Quote(pattern))
+	}
+	return strings.Join(quoted, " ")
+}
+
+func (p *patternFlags) Set(pattern string) error {
+	if !p.given {
+		p.patterns, p.given = nil, true
+	}
+	if pattern != "" {
+		p.patterns = append(p.patterns, pattern)
+	}
+	return nil
+}
+
+// sizeUnits are the suffixes parseSize accepts, longest first.
+var sizeUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+	{"KB", 1000}, {"MB", 1000 * 1000}, {"GB", 1000 * 1000 * 1000},
+	{"B", 1},
+}
+
+// parseSize parses a size in bytes, e.g. 4096, 500KB or 1MiB.
+func parseSize(s string) (int64, error) {
+	number, unit := s, int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			number, unit = strings.TrimSuffix(s, u.suffix), u.bytes
+			break
+		}
+	}
+	var n int64
+	if _, err := fmt.Sscanf(number, "%d", &n); err != nil || n < 0 || fmt.Sprint(n) != number {
+		return 0, fmt.Errorf("expected a size such as 1MiB, got %q", s)
+	}
+	return n * unit, nil
+}
 
 func init() {
 	flag.BoolVar(&dryrun, "n", false, "dry run: no files will be written")
 	flag.BoolVar(&withstderr, "2", false, "show Docker progress")
+	flag.BoolVar(&versioncheck, "formatter-version-check", false, "list overrides (-arg, ARG_ variables, "+fmtd.ConfigFilename+" args) of preset formatter images and versions")
+	flag.BoolVar(&namesfirst, "names-first", false, "match file names (BUILD, WORKSPACE, ...) before file extensions")
+	flag.BoolVar(&notraverse, "no-traverse", false, "reject directories instead of walking them")
+	flag.BoolVar(&verbose, "v", false, "verbose: show details about the run on stderr")
+	flag.BoolVar(&normalizeeol, "normalize-eol", false, "also write files formatters only changed the line endings of (e.g. CRLF to LF)")
+	flag.BoolVar(&finalnewline, "ensure-final-newline", false, "have changed files end with exactly one newline")
+	flag.BoolVar(&followsymlinks, "follow-symlinks", false, "also walk the directories symlinks found by walking directories point to (under $PWD unless -allow-outside)")
+	flag.StringVar(&includehidden, "include-hidden", "", "comma-separated patterns of hidden paths to walk too (e.g. .github/**), .git aside")
+	flag.StringVar(&skip, "skip", strings.Join(fmtd.DefaultSkipPatterns, ","), "comma-separated patterns of file names to skip")
+	flag.BoolVar(&quiet, "q", false, "quiet: do not list changed files nor warnings")
+	flag.StringVar(&color, "color", "auto", "color output: auto, always or never")
+	flag.BoolVar(&jsonout, "json", false, "list files as JSON objects, one per line")
+	flag.StringVar(&requireconfig, "require-config", "", "comma-separated file extensions only formatted if $PWD has a config file for their formatter")
+	flag.StringVar(&maxfilesize, "max-file-size", "", "skip files larger than this (e.g. 1MiB, 500KB, 4096)")
+	flag.IntVar(&batchsize, "batch-size", 0, "format files by builds of at most this many files (0: a single build)")
+	flag.IntVar(&retries, "retries", 2, "re-run builds failing on a transient network or registry error up to this many times")
+	flag.DurationVar(&retrybackoff, "retry-backoff", 2*time.Second, "with -retries: how long to wait before the first retry, doubling each time")
+	flag.IntVar(&threads, "threads", 0, "threads each formatter honoring it may use, as ARG_FORMATTER_THREADS (0: the preset, 1)")
+	flag.StringVar(&configpath, "config", "", "read the configuration from this file instead of $PWD/"+fmtd.ConfigFilename)
+	flag.BoolVar(&initconfig, "init", false, "write a "+fmtd.ConfigFilename+" enabling the languages found under $PWD")
+	flag.BoolVar(&inithook, "init-hook", false, "with -init: also install a Git pre-commit hook checking staged files are formatted")
+	flag.BoolVar(&force, "force", false, "with -init: overwrite existing files")
+	flag.BoolVar(&keepgoing, "k", false, "keep going: format usable files even if some given files are not")
+	flag.BoolVar(&listunhandled, "list-unhandled", false, "list the extensions of files no formatter handles and how many there are, without formatting files")
+	flag.BoolVar(&what, "what", false, "list which formatter would format each file, without formatting them")
+	flag.BoolVar(&manifest, "manifest", false, "list as JSON the formatter images (and their digest) formatting files would pull, without building")
+	flag.StringVar(&report, "report", "", "write a JSON report of the run (files, results, skipped files, images, duration) to this path, e.g. .fmtd-report.json")
+	flag.StringVar(&dumpdockerfile, "dump-dockerfile", "", "write the Dockerfile that would format files to this path, without building it")
+	flag.BoolVar(&warnunhandled, "warn-unhandled", false, "also report unhandled files found by walking directories")
+	flag.BoolVar(&universalcleanup, "universal-cleanup", false, "strip trailing whitespace off unhandled text files and have them end with a newline")
+	flag.BoolVar(&pull, "pull", false, "always pull formatters' images, refreshing tagged ARG_ overrides")
+	flag.BoolVar(&allowoutside, "allow-outside", false, "format files outside $PWD too")
+	flag.BoolVar(&native, "native", false, "format with formatters found on $PATH (gofmt) instead of Docker when possible")
+	flag.Var(&buildargs, "arg", "override a preset as NAME=VALUE (e.g. GOFMT_IMAGE=golang:1), over ARG_ variables and "+fmtd.ConfigFilename+" (repeatable)")
+	flag.BoolVar(&pin, "pin", false, "pin images overridden with a tag to their current digest, using docker buildx imagetools inspect")
+	flag.BoolVar(&selftest, "selftest", false, "check each enabled formatter works by formatting a sample, and exit")
+	flag.BoolVar(&fromstdin, "from-stdin", false, "read the files to format from stdin, one per line (same as giving -), without walking directories")
+	flag.StringVar(&stdinfilename, "stdin-filename", "", "format stdin as the contents of this file (e.g. an editor's buffer) to stdout, per its name and configuration")
+	flag.BoolVar(&nulsep, "0", false, "with -from-stdin: file names are separated by NUL characters (e.g. git diff -z --name-only)")
+	flag.BoolVar(&onlychangedlines, "only-changed-lines", false, "only format the lines changed since HEAD, per git diff (C, C++, Objective-C: other files are formatted whole)")
+	flag.BoolVar(&timings, "timings", false, "show on stderr how long formatting the slowest files and each formatter took")
+	flag.BoolVar(&skipgenerated, "skip-generated", false, "skip generated files, per -generated-patterns matching one of their first lines")
+	flag.Var(&generatedpatterns, "generated-patterns", "with -skip-generated: a regular expression matching header comments of generated files (repeatable, empty for none)")
+	flag.BoolVar(&skipunavailable, "skip-unavailable", false, "skip files whose formatter image is not available locally instead of pulling it")
+	flag.StringVar(&containeruser, "container-user", "", "run formatters as this UID:GID within Docker instead of root")
+	flag.BoolVar(&detect, "detect", false, "format files without a known name or extension per their shebang line (Python, Shell)")
+	flag.StringVar(&disable, "disable", "", "comma-separated languages not to format (e.g. sql,toml), on top of those disabled in "+fmtd.ConfigFilename)
+	flag.StringVar(&dprint, "dprint", "", "comma-separated languages to format with dprint instead (json, jsonc, toml)")
+	flag.BoolVar(&failunhandled, "fail-unhandled", false, "fail when a given file has no formatter (files found by walking directories are only reported)")
+	flag.BoolVar(&compilecommands, "compile-commands", false, "only format the files $PWD/compile_commands.json lists (C, C++)")
+	flag.BoolVar(&diagnostics, "diagnostics", false, "list what formatters reported about files (e.g. lint warnings) under them, even unchanged ones")
+	flag.BoolVar(&strict, "strict", false, "fail if Docker emitted warnings (per -warning-patterns), even if files were formatted")
+	flag.Var(&warningpatterns, "warning-patterns", "with -strict: a regular expression matching lines of Docker's stderr that are warnings (repeatable, empty for none)")
+	flag.BoolVar(&sortcss, "sort-css-properties", false, "sort the properties of CSS rules, in CSS_PROPERTIES_ORDER: alphabetical (default) or concentric")
+	flag.BoolVar(&verify, "verify", false, "check formatted files still parse before writing them (Go, JSON, Python, Shell, TOML)")
+	flag.BoolVar(&verifyidempotent, "verify-idempotent", false, "format formatted files again and fail those this changes, before writing them")
 	flag.Parse()
 }
 
@@ -33,12 +218,282 @@ func main() {
 		os.Exit(1)
 	}
 
+	if initconfig {
+		config, err := fmtd.DetectConfig(pwd)
+		if err == nil {
+			err = fmtd.WriteConfig(pwd, config, force)
+		}
+		if err == nil && inithook {
+			err = fmtd.WritePreCommitHook(pwd, force)
+		}
+		if err != nil {
+			perr(err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(stdout, "fmtd: wrote %s enabling %s\n", fmtd.ConfigFilename, strings.Join(config.EnabledLanguages(), ", "))
+		return
+	}
+
+	if stdinfilename != "" {
+		if !filepath.IsAbs(stdinfilename) {
+			stdinfilename = filepath.Join(pwd, stdinfilename)
+		}
+		pwd = fmtd.FindWorkspace(pwd, stdinfilename)
+	}
+
+	config, err := fmtd.FindConfig(pwd, configpath)
+	if err != nil {
+		perr(err)
+		os.Exit(1)
+	}
+
 	stderr := ioutil.Discard
 	if withstderr {
 		stderr = os.Stderr
 	}
 
-	switch err := fmtd.Fmt(ctx, pwd, dryrun, stdout, stderr, flag.Args()); err {
+	var colored bool
+	switch color {
+	case "auto":
+		colored = isTerminal(stdout)
+	case "always":
+		colored = true
+	case "never":
+	default:
+		perr(fmt.Errorf("unexpected -color=%q", color))
+		os.Exit(1)
+	}
+
+	var skipPatterns []string
+	if skip != "" {
+		skipPatterns = strings.Split(skip, ",")
+	}
+
+	opts := []fmtd.Option{
+		fmtd.WithNameRulesFirst(namesfirst),
+		fmtd.WithTraverse(!notraverse),
+		fmtd.WithSkipPatterns(skipPatterns),
+		fmtd.WithQuiet(quiet),
+		fmtd.WithColor(colored),
+		fmtd.WithJSON(jsonout),
+		fmtd.WithBatchSize(batchsize),
+		fmtd.WithRetries(retries, retrybackoff),
+		fmtd.WithCollectSelectionErrors(keepgoing),
+		fmtd.WithWarnUnhandled(warnunhandled),
+		fmtd.WithUniversalCleanup(universalcleanup),
+		fmtd.WithPull(pull),
+		fmtd.WithAllowOutside(allowoutside),
+		fmtd.WithNative(native),
+		fmtd.WithVerify(verify),
+		fmtd.WithVerifyIdempotent(verifyidempotent),
+		fmtd.WithSkipUnavailable(skipunavailable),
+		fmtd.WithDetectLanguage(detect),
+		fmtd.WithSortCSSProperties(sortcss),
+		fmtd.WithCompileCommands(compilecommands),
+		fmtd.WithFailUnhandled(failunhandled),
+		fmtd.WithDiagnostics(diagnostics),
+		fmtd.WithNormalizeEOL(normalizeeol),
+		fmtd.WithFollowDirSymlinks(followsymlinks),
+	}
+	if config != nil {
+		opts = append(opts, fmtd.WithConfig(config))
+	}
+	if threads > 0 {
+		opts = append(opts, fmtd.WithBuildArg("FORMATTER_THREADS", fmt.Sprint(threads)))
+	}
+	for _, kv := range buildargs {
+		i := strings.IndexByte(kv, '=')
+		opts = append(opts, fmtd.WithBuildArg(kv[:i], kv[i+1:]))
+	}
+
+	if versioncheck {
+		overrides, err := fmtd.Overrides(opts...)
+		if err != nil {
+			perr(err)
+			os.Exit(1)
+		}
+		for _, o := range overrides {
+			def := o.Default
+			if def == "" {
+				def = "(not a preset)"
+			}
+			fmt.Fprintf(stdout, "%s\n- %s\n+ %s\n", o.Arg, def, o.Value)
+		}
+		if len(overrides) != 0 {
+			os.Exit(2)
+		}
+		return
+	}
+
+	if pin {
+		opts = append(opts, fmtd.WithImageDigestResolution(nil))
+	}
+	if onlychangedlines {
+		opts = append(opts, fmtd.WithOnlyChangedLines("HEAD"))
+	}
+	if containeruser != "" {
+		var uid, gid int
+		if n, err := fmt.Sscanf(containeruser, "%d:%d", &uid, &gid); err != nil || n != 2 {
+			perr(fmt.Errorf("expected -container-user=UID:GID, got %q", containeruser))
+			os.Exit(1)
+		}
+		opts = append(opts, fmtd.WithContainerUser(uid, gid))
+	}
+	if maxfilesize != "" {
+		size, err := parseSize(maxfilesize)
+		if err != nil {
+			perr(err)
+			os.Exit(1)
+		}
+		opts = append(opts, fmtd.WithMaxFileSize(size))
+	}
+	if skipgenerated {
+		opts = append(opts, fmtd.WithSkipGenerated(generatedpatterns.patterns))
+	}
+	if strict {
+		opts = append(opts, fmtd.WithStrict(warningpatterns.patterns))
+	}
+	if disable != "" {
+		opts = append(opts, fmtd.WithDisabledLanguages(strings.Split(disable, ",")))
+	}
+	if dprint != "" {
+		opts = append(opts, fmtd.WithDprint(strings.Split(dprint, ",")))
+	}
+	if includehidden != "" {
+		opts = append(opts, fmtd.WithIncludeHidden(strings.Split(includehidden, ",")))
+	}
+	if requireconfig != "" {
+		opts = append(opts, fmtd.WithRequireConfig(strings.Split(requireconfig, ",")))
+	}
+	if finalnewline {
+		opts = append(opts, fmtd.WithFinalNewline(fmtd.FinalNewlineEnsure))
+	}
+	if verbose {
+		opts = append(opts, fmtd.WithVerbose(os.Stderr))
+	}
+	if timings {
+		opts = append(opts, fmtd.WithTimings(os.Stderr))
+	}
+	if manifest {
+		opts = append(opts, fmtd.WithManifest(stdout))
+	}
+	if dumpdockerfile != "" {
+		f, err := os.Create(dumpdockerfile)
+		if err != nil {
+			perr(err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		opts = append(opts, fmtd.WithDumpDockerfile(f))
+	}
+	if report != "" {
+		f, err := os.Create(report)
+		if err != nil {
+			perr(err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		opts = append(opts, fmtd.WithReport(f))
+	}
+
+	if selftest {
+		results, err := fmtd.SelfTest(ctx, stderr, opts...)
+		w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "FORMATTER\tSTATUS\tDETAIL")
+		failed := false
+		for _, r := range results {
+			status := "ok"
+			if !r.OK {
+				status = "FAIL"
+				failed = true
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", r.Formatter, status, r.Detail)
+		}
+		_ = w.Flush()
+		if err != nil {
+			if err == buildx.ErrDockerBuildFailure && !withstderr {
+				err = fmt.Errorf("%w, maybe retry with flag -2", err)
+			}
+			perr(err)
+		}
+		if failed || err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if stdinfilename != "" {
+		if fromstdin || len(flag.Args()) != 0 {
+			perr(errors.New("-stdin-filename takes no file arguments"))
+			os.Exit(1)
+		}
+		if err := fmtd.FormatContents(ctx, pwd, stdinfilename, os.Stdin, stdout, stderr, opts...); err != nil {
+			perr(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	filenames := flag.Args()
+	if len(filenames) == 1 && filenames[0] == "-" {
+		fromstdin, filenames = true, nil
+	}
+	if fromstdin {
+		if len(filenames) != 0 {
+			perr(errors.New("-from-stdin takes no file arguments"))
+			os.Exit(1)
+		}
+		sep := byte('\n')
+		if nulsep {
+			sep = 0
+		}
+		if filenames, err = fmtd.ReadFilenames(os.Stdin, sep); err != nil {
+			perr(err)
+			os.Exit(1)
+		}
+		opts = append(opts, fmtd.WithTraverse(false))
+	} else if filenames, err = fmtd.ExpandResponseFiles(pwd, filenames); err != nil {
+		perr(err)
+		os.Exit(1)
+	}
+
+	if what {
+		ffs, err := fmtd.What(pwd, filenames, opts...)
+		if err != nil {
+			perr(err)
+			os.Exit(1)
+		}
+		w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+		for _, ff := range ffs {
+			formatter := ff.Formatter
+			if formatter == "" {
+				formatter = "unhandled"
+			}
+			fmt.Fprintf(w, "%s\t%s\n", ff.Path, formatter)
+		}
+		_ = w.Flush()
+		return
+	}
+
+	if listunhandled {
+		exts, err := fmtd.Unhandled(pwd, filenames, opts...)
+		if err != nil {
+			perr(err)
+			os.Exit(1)
+		}
+		w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+		for _, ext := range exts {
+			name := ext.Ext
+			if name == "" {
+				name = "(no extension)"
+			}
+			fmt.Fprintf(w, "%s\t%d\n", name, ext.Files)
+		}
+		_ = w.Flush()
+		return
+	}
+
+	switch err := fmtd.Fmt(ctx, pwd, dryrun, stdout, stderr, filenames, opts...); err {
 	case nil:
 	case fmtd.ErrDryRunFoundFiles:
 		os.Exit(2)
@@ -50,3 +505,8 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
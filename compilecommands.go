@@ -0,0 +1,64 @@
+package fmtd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// CompileCommandsFilename names the compilation database of C and C++ projects.
+const CompileCommandsFilename = "compile_commands.json"
+
+// WithCompileCommands has only the files the compile_commands.json at the root
+// of $PWD lists be formatted, among the given and traversed files:
+// e.g. the translation units of a C++ project, leaving out generated and
+// third-party files. Other files are skipped.
+func WithCompileCommands(douse bool) Option {
+	return func(o *options) error {
+		o.compileCmds = douse
+		return nil
+	}
+}
+
+// compileCommand is an entry of a compilation database.
+type compileCommand struct {
+	Directory string `json:"directory"`
+	File      string `json:"file"`
+}
+
+// loadCompileCommands returns the absolute paths of the files the compilation database of pwd lists.
+func loadCompileCommands(pwd string) (map[string]bool, error) {
+	data, err := os.ReadFile(filepath.Join(pwd, CompileCommandsFilename))
+	if err != nil {
+		return nil, err
+	}
+	var entries []compileCommand
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", CompileCommandsFilename, err)
+	}
+	listed := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		dir := entry.Directory
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(pwd, dir)
+		}
+		file := filepath.FromSlash(entry.File)
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		listed[filepath.Clean(file)] = true
+	}
+	return listed, nil
+}
+
+// notCompiled tells why fn, absolute or relative to pwd, should be skipped for not being listed.
+func notCompiled(pwd string, listed map[string]bool, fn string) string {
+	if !filepath.IsAbs(fn) {
+		fn = filepath.Join(pwd, fn)
+	}
+	if !listed[filepath.Clean(fn)] {
+		return "not in " + CompileCommandsFilename
+	}
+	return ""
+}
@@ -0,0 +1,283 @@
+package fmtd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fenollp/fmtd/buildx"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFilename is the name of the configuration file fmtd looks for in $PWD.
+const ConfigFilename = ".fmtd.yaml"
+
+// IgnoreFilename is the name of the file in $PWD listing paths fmtd never formats.
+// See buildx.WithIgnoreFile for its syntax.
+const IgnoreFilename = ".fmtignore"
+
+// Config is the contents of a configuration file.
+type Config struct {
+	// Languages enables or disables formatters by name (e.g. go, json).
+	// Files of disabled languages are skipped. Unlisted languages are enabled.
+	Languages map[string]bool `yaml:"languages,omitempty"`
+	// Args overrides preset build arguments (e.g. GOFMT_IMAGE),
+	// unless ARG_ environment variables or the command line set them too.
+	Args map[string]string `yaml:"args,omitempty"`
+	// Prepare has shell commands run by name of language (e.g. python),
+	// to set up its formatter (e.g. installing plugins) before any file is formatted.
+	// Only the commands of the languages of the files being formatted are run.
+	Prepare map[string]string `yaml:"prepare,omitempty"`
+}
+
+// LoadConfig reads and parses the configuration file at path.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for language := range c.Languages {
+		if findRule(language) == nil {
+			return nil, fmt.Errorf("parsing %s: unknown language %q", path, language)
+		}
+	}
+	for language := range c.Prepare {
+		if findRule(language) == nil {
+			return nil, fmt.Errorf("parsing %s: unknown language %q to prepare", path, language)
+		}
+	}
+	for name := range c.Args {
+		if !isPreset(name) {
+			return nil, fmt.Errorf("parsing %s: unknown build argument %q", path, name)
+		}
+	}
+	return c, nil
+}
+
+// FindConfig reads the configuration file at path if given,
+// failing if it is missing, or else the ConfigFilename of pwd if any.
+// No configuration file found means a nil Config.
+func FindConfig(pwd, path string) (*Config, error) {
+	if path != "" {
+		c, err := LoadConfig(path)
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no configuration file at %s", path)
+		}
+		return c, err
+	}
+	c, err := LoadConfig(filepath.Join(pwd, ConfigFilename))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return c, err
+}
+
+func isPreset(name string) bool {
+	for _, arg := range allPresets() {
+		if arg.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// WithConfig applies the given configuration.
+func WithConfig(c *Config) Option {
+	return func(o *options) error {
+		o.config = c
+		return nil
+	}
+}
+
+// WithDisabledLanguages has files of the given languages (e.g. sql, toml)
+// be skipped, on top of the languages disabled by WithConfig.
+// Each call resets the previous setting.
+func WithDisabledLanguages(languages []string) Option {
+	return func(o *options) error {
+		o.disabled = make(map[string]bool, len(languages))
+		for _, language := range languages {
+			if findRule(language) == nil {
+				return fmt.Errorf("unknown language %q", language)
+			}
+			o.disabled[language] = true
+		}
+		return nil
+	}
+}
+
+// disabledLanguage tells why fn should be skipped for its language being disabled.
+func (o *options) disabledLanguage(fn string) string {
+	r := o.ruleFor(fn)
+	if r == nil {
+		return ""
+	}
+	if o.disabled[r.name] {
+		return r.name + " disabled"
+	}
+	if !o.languageEnabled(r.name) {
+		if o.config != nil {
+			if _, ok := o.config.Languages[r.name]; ok {
+				return r.name + " disabled in " + ConfigFilename
+			}
+		}
+		return r.name + " not enabled" // see optInLanguages
+	}
+	return ""
+}
+
+// optInLanguages are only formatted once enabled in the configuration
+// (or, for css, with WithSortCSSProperties), as they used to be left alone.
+var optInLanguages = map[string]bool{"css": true}
+
+// languageEnabled tells whether files of the given language are formatted.
+func (o *options) languageEnabled(language string) bool {
+	if o.disabled[language] {
+		return false
+	}
+	if o.config != nil {
+		if enabled, ok := o.config.Languages[language]; ok {
+			return enabled
+		}
+	}
+	return !optInLanguages[language] || language == "css" && o.sortCSS
+}
+
+// prepares renders the instructions running the prepare commands of the needed formatters,
+// in the product stage, as root and before the files to format are copied in.
+func (o *options) prepares(needed map[string]bool) string {
+	if o.config == nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, r := range rules {
+		cmd := strings.TrimSpace(o.config.Prepare[r.name])
+		if cmd == "" || !needed[r.name] {
+			continue
+		}
+		eof := "PREPARE_" + strings.ToUpper(strings.ReplaceAll(r.name, "-", "_"))
+		b.WriteString("# prepare " + r.name + ", per " + ConfigFilename + "\n")
+		b.WriteString("RUN <<\"" + eof + "\"\nset -eux\n" + cmd + "\n" + eof + "\n")
+	}
+	return b.String()
+}
+
+func findRule(name string) *rule {
+	for i := range rules {
+		if rules[i].name == name {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// DetectConfig returns a configuration enabling the languages
+// of the files found under pwd, and disabling all others.
+func DetectConfig(pwd string) (*Config, error) {
+	paths, _, err := buildx.SelectInputFiles(
+		buildx.WithPWD(pwd),
+		buildx.WithUseCurrentDirWhenNoPathsGiven(),
+		buildx.WithSkipPatterns(DefaultSkipPatterns),
+		buildx.WithIgnoreFile(IgnoreFilename),
+	)
+	if err != nil {
+		return nil, err
+	}
+	o := &options{}
+	c := &Config{Languages: make(map[string]bool, len(rules))}
+	for _, r := range rules {
+		c.Languages[r.name] = false
+	}
+	for _, path := range paths {
+		if r := o.ruleFor(path); r != nil {
+			c.Languages[r.name] = true
+		}
+	}
+	return c, nil
+}
+
+// EnabledLanguages lists the languages c enables, sorted.
+func (c *Config) EnabledLanguages() []string {
+	var languages []string
+	for language, enabled := range c.Languages {
+		if enabled {
+			languages = append(languages, language)
+		}
+	}
+	sort.Strings(languages)
+	return languages
+}
+
+// WriteConfig writes c to $PWD's configuration file.
+// An existing file is only overwritten if force is true.
+func WriteConfig(pwd string, c *Config, force bool) error {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	data = append([]byte("# Configuration of https://github.com/fenollp/fmtd\n"), data...)
+	return writeNewFile(filepath.Join(pwd, ConfigFilename), data, 0644, force)
+}
+
+// PreCommitHook is the Git pre-commit hook WritePreCommitHook writes.
+// It fails commits whose staged files are not formatted: the staged contents
+// are checked, not those of the work tree, by checking out the index elsewhere.
+const PreCommitHook = `#!/bin/sh
+# Installed by fmtd -init: fails commits of unformatted files, as staged.
+set -e
+tmp="$(mktemp -d)"
+trap 'rm -rf "$tmp"' EXIT
+git diff --cached --name-only --diff-filter=ACMR -z >"$tmp/staged"
+[ -s "$tmp/staged" ] || exit 0
+git checkout-index -a --prefix="$tmp/index/"
+cd "$tmp/index"
+xargs -0 fmtd -n -no-traverse <"$tmp/staged"
+`
+
+// WritePreCommitHook installs PreCommitHook in the Git repository at pwd,
+// wherever Git looks for its hooks (e.g. core.hooksPath, or the common
+// directory of worktrees and submodules).
+// An existing hook is only overwritten if force is true.
+func WritePreCommitHook(pwd string, force bool) error {
+	out, err := git(context.Background(), pwd, nil, "rev-parse", "--git-path", "hooks")
+	if err != nil {
+		return err
+	}
+	hooks := strings.TrimSpace(string(out))
+	if !filepath.IsAbs(hooks) {
+		hooks = filepath.Join(pwd, hooks)
+	}
+	if err := os.MkdirAll(hooks, 0755); err != nil {
+		return err
+	}
+	return writeNewFile(filepath.Join(hooks, "pre-commit"), []byte(PreCommitHook), 0755, force)
+}
+
+func writeNewFile(path string, data []byte, perm os.FileMode, force bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Chmod(path, perm)
+}
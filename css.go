@@ -0,0 +1,27 @@
+package fmtd
+
+// stylelintVersions are the versions of stylelint and its plugins,
+// sorting CSS properties per WithSortCSSProperties.
+var stylelintVersions = []presetArg{
+	{"STYLELINT_VERSION", "16.9.0"},
+	{"STYLELINT_ORDER_VERSION", "6.0.4"},
+	{"STYLELINT_CONFIG_CONCENTRIC_ORDER_VERSION", "5.2.0"},
+	{"POSTCSS_SCSS_VERSION", "4.0.9"},
+	{"POSTCSS_LESS_VERSION", "6.0.0"},
+}
+
+// sortCSSProperties sorts the properties of ../b/"$f" in place, in $CSS_PROPERTIES_ORDER.
+const sortCSSProperties = `case "$CSS_PROPERTIES_ORDER" in alphabetical|concentric) ;;` +
+	` *) echo "unexpected CSS_PROPERTIES_ORDER=$CSS_PROPERTIES_ORDER" >&2; false ;; esac` +
+	` && (cd ../b && stylelint --config=/opt/stylelint/"$CSS_PROPERTIES_ORDER".json --fix "$f")`
+
+// WithSortCSSProperties has the properties of CSS, SCSS and Less rules be sorted
+// once prettier formatted them, in the order the CSS_PROPERTIES_ORDER build argument
+// names: alphabetical (the default) or concentric (from the outside of the box in).
+// This opts in to formatting these files, unless the configuration disables css.
+func WithSortCSSProperties(dosort bool) Option {
+	return func(o *options) error {
+		o.sortCSS = dosort
+		return nil
+	}
+}
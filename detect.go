@@ -0,0 +1,134 @@
+package fmtd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fenollp/fmtd/buildx"
+)
+
+// WithDetectLanguage has files no formatter matches by name or extension
+// (e.g. a Python script named manage) be formatted per the interpreter
+// their shebang line names (e.g. #!/usr/bin/env python3).
+// Off by default as a misdetected file would be mangled.
+func WithDetectLanguage(dodetect bool) Option {
+	return func(o *options) error {
+		o.detect = dodetect
+		return nil
+	}
+}
+
+// interpreters maps the interpreters of shebang lines, version numbers trimmed,
+// to the formatters of their language.
+var interpreters = map[string]string{
+	"python": "python",
+	"sh":     "shell",
+	"bash":   "shell",
+	"dash":   "shell",
+	"ksh":    "shell",
+	"mksh":   "shell",
+	"bats":   "shell",
+}
+
+// interpreterLanguage returns the formatter of the interpreter line names,
+// or "" if line is not a shebang line or names an unknown interpreter.
+func interpreterLanguage(line string) string {
+	if !strings.HasPrefix(line, "#!") {
+		return ""
+	}
+	fields := strings.Fields(line[2:])
+	if len(fields) == 0 {
+		return ""
+	}
+	interpreter := path.Base(fields[0])
+	if interpreter == "env" {
+		interpreter = ""
+		for _, field := range fields[1:] {
+			if !strings.HasPrefix(field, "-") && !strings.Contains(field, "=") {
+				interpreter = field
+				break
+			}
+		}
+	}
+	return interpreters[strings.TrimRight(interpreter, "0123456789.")]
+}
+
+// detectLanguages records the formatters of the paths no rule matches,
+// per their shebang line.
+func (o *options) detectLanguages(pwd string, paths []string) error {
+	o.detected = make(map[string]*rule)
+	o.detectedNames = nil
+	for _, p := range paths {
+		if o.ruleFor(p) != nil {
+			continue
+		}
+		name := buildName(pwd, p)
+		if strings.Contains(name, "\n") {
+			continue
+		}
+		abs := p
+		if !filepath.IsAbs(abs) {
+			abs = filepath.Join(pwd, abs)
+		}
+		line, err := o.firstLine(abs)
+		if err != nil {
+			return err
+		}
+		r := findRule(interpreterLanguage(line))
+		if r == nil || !o.languageEnabled(r.name) {
+			continue
+		}
+		o.detected[p], o.detected[name] = r, r
+		o.detectedNames = append(o.detectedNames, name)
+		if o.verbose != nil {
+			fmt.Fprintf(o.verbose, "fmtd: detected %s as %s\n", buildx.PathOfName(name), r.name)
+		}
+	}
+	sort.Strings(o.detectedNames)
+	return nil
+}
+
+// firstLine reads the beginning of the first line of the file at path.
+func (o *options) firstLine(path string) (string, error) {
+	f, err := o.open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(io.LimitReader(f, 256)).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return line, nil
+}
+
+// buildName names path the way buildx.WithInputFiles does within the build.
+func buildName(pwd, path string) string {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(pwd, path)
+	}
+	name := nativeName(pwd, path)
+	if filepath.IsAbs(name) {
+		return buildx.OutsidePWD + strings.TrimPrefix(filepath.ToSlash(name), "/")
+	}
+	return filepath.ToSlash(name)
+}
+
+// detectedArm renders the case arm of the files detected as formatted by r, if any.
+func (o *options) detectedArm(r *rule) string {
+	var patterns []string
+	for _, name := range o.detectedNames {
+		if o.detected[name] == r {
+			patterns = append(patterns, `'`+strings.ReplaceAll(strings.ToLower(name), `'`, `'\''`)+`'`)
+		}
+	}
+	if len(patterns) == 0 {
+		return ""
+	}
+	return o.formatter(r).armOf(r.comment+", detected", patterns, o.verify)
+}
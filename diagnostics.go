@@ -0,0 +1,37 @@
+package fmtd
+
+// WithDiagnostics has what formatters write to stderr while formatting
+// a file successfully (e.g. the lint warnings buildifier could not fix)
+// be reported as the Diagnostics of the file's Result.
+// Files left unchanged are then reported too, with StatusDiagnosed.
+func WithDiagnostics(diagnose bool) Option {
+	return func(o *options) error {
+		o.diagnose = diagnose
+		return nil
+	}
+}
+
+// diagnosedFunc defines the shell function recording what the formatter named $1
+// wrote to stderr formatting "$f", in the diagnostics sidecar laid out as the errors one.
+const diagnosedFunc = `diagnosed() { if [ -s ../stderr ]; then echo "$1 $f" >>../diagnostics && sed 's/^/  /' ../stderr >>../diagnostics; fi; }`
+
+// withDiagnostics sets the Diagnostics of rs per the diagnostics sidecar,
+// adding a Result for the files formatters left as is.
+func withDiagnostics(rs []Result, sidecar string) []Result {
+	if sidecar == "" {
+		return rs
+	}
+	byPath := make(map[string]int, len(rs))
+	for i, r := range rs {
+		byPath[r.Path] = i
+	}
+	for _, d := range parseFormatErrors(sidecar) {
+		if i, ok := byPath[d.Path]; ok {
+			rs[i].Diagnostics += d.Stderr
+			continue
+		}
+		byPath[d.Path] = len(rs)
+		rs = append(rs, Result{Path: d.Path, Status: StatusDiagnosed, Formatter: d.Formatter, Diagnostics: d.Stderr})
+	}
+	return rs
+}
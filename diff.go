@@ -0,0 +1,51 @@
+package fmtd
+
+import (
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// WithDiffWriter has dry runs write to w the unified diff of each file
+// that would be modified, as `diff -u` would, ordered by path.
+// Files are labeled a/<path> and b/<path>, as in Git.
+func WithDiffWriter(w io.Writer) Option {
+	return func(o *options) error {
+		o.diff = w
+		return nil
+	}
+}
+
+// writeDiffs writes the unified diffs of the original and formatted contents of files, by path.
+func (o *options) writeDiffs(originals, formatted map[string][]byte) error {
+	paths := make([]string, 0, len(formatted))
+	for path := range formatted {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if err := difflib.WriteUnifiedDiff(o.diff, difflib.UnifiedDiff{
+			A:        diffLines(originals[path]),
+			B:        diffLines(formatted[path]),
+			FromFile: "a/" + path,
+			ToFile:   "b/" + path,
+			Context:  3,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffLines splits data into lines, marking a last line lacking a newline as diff does.
+func diffLines(data []byte) []string {
+	lines := strings.SplitAfter(string(data), "\n")
+	if last := len(lines) - 1; lines[last] == "" {
+		lines = lines[:last]
+	} else {
+		lines[last] += "\n\\ No newline at end of file\n"
+	}
+	return lines
+}
@@ -0,0 +1,92 @@
+package fmtd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/fenollp/fmtd/buildx"
+)
+
+// DigestResolver returns the digest (e.g. sha256:...) of the image ref names:
+// that of its image index for multi-platform images, as presets are pinned to.
+type DigestResolver func(ctx context.Context, ref string) (digest string, err error)
+
+// WithImageDigestResolution has images overridden with a tag (e.g. ARG_GOFMT_IMAGE=golang:1.22)
+// be pinned to the digest resolve returns, for reproducible builds.
+// Each reference is resolved once per run. A nil resolve means DockerManifestDigest.
+func WithImageDigestResolution(resolve DigestResolver) Option {
+	return func(o *options) error {
+		if resolve == nil {
+			resolve = DockerManifestDigest
+		}
+		o.resolveDigest = resolve
+		return nil
+	}
+}
+
+var digestSuffix = regexp.MustCompile(`@sha256:[a-f0-9]{64}$`)
+
+// pinImages substitutes overridden images of presetImages with their digest.
+func (o *options) pinImages(ctx context.Context) error {
+	digests := make(map[string]string)
+	for _, arg := range presetImages {
+		ref, ok := o.buildArgs[arg.name]
+		if !ok || digestSuffix.MatchString(ref) {
+			continue
+		}
+		digest, ok := digests[ref]
+		if !ok {
+			var err error
+			if digest, err = o.resolveDigest(ctx, ref); err != nil {
+				return fmt.Errorf("resolving %s: %w", ref, err)
+			}
+			digests[ref] = digest
+		}
+		pinned := ref + "@" + digest
+		if !imageReference.MatchString(pinned) {
+			return fmt.Errorf("resolving %s: %w: %q", ref, ErrInvalidImageReference, pinned)
+		}
+		o.buildArgs[arg.name] = pinned
+		if o.verbose != nil {
+			fmt.Fprintf(o.verbose, "fmtd: pinned ARG_%s=%s\n", arg.name, pinned)
+		}
+	}
+	return nil
+}
+
+// DockerManifestDigest resolves ref with `docker buildx imagetools inspect`
+// to the digest of its image index, or of its manifest for single-platform images:
+// the pinned reference then resolves to the same images on every platform,
+// whichever the Docker daemon runs.
+func DockerManifestDigest(ctx context.Context, ref string) (string, error) {
+	exe, err := exec.LookPath("docker")
+	if err != nil {
+		return "", buildx.ErrNoDocker
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, exe, "buildx", "imagetools", "inspect", "--format", "{{json .Manifest}}", ref)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%w (%s)", err, msg)
+		}
+		return "", err
+	}
+
+	var m struct {
+		Digest string `json:"digest"`
+	}
+	if err := json.Unmarshal(bytes.TrimSpace(stdout.Bytes()), &m); err != nil {
+		return "", err
+	}
+	if m.Digest == "" {
+		return "", fmt.Errorf("no digest for %s", ref)
+	}
+	return m.Digest, nil
+}
@@ -0,0 +1,331 @@
+package fmtd
+
+import "strings"
+
+// defaultSyntax is the Dockerfile frontend image used to build.
+const defaultSyntax = "docker.io/docker/dockerfile:1@sha256:443aab4ca21183e069e7d8b2dc68006594f40bddf1b15bbd83f5137bd93e80e2"
+
+// failedFunc defines the shell function reporting the formatter named $1 failed on "$f".
+const failedFunc = `failed() { echo "E $f" >>../stdout && echo "$1 $f" >>../errors && sed 's/^/  /' ../stderr >>../errors && rm -f ../b/"$f"; }`
+
+// tool is what formatters need installed in the tool stage.
+type tool struct {
+	name  string
+	from  string      // stage the tool is copied from
+	stage string      // stage building the tool, made of its FROM line,
+	args  []presetArg // the arguments it declares
+	build string      // and its instructions
+	apk   string      // Alpine package
+	pip   []string    // Python packages
+	copy  string      // instructions installing the tool
+}
+
+// tools are installed in this order, when needed.
+var tools = []tool{
+	{
+		name:  "buf",
+		stage: "FROM --platform=$BUILDPLATFORM $BUF_IMAGE AS buf\n",
+		args:  bufVersions,
+		build: `RUN \
+  --mount=type=cache,target=/go/pkg/mod \
+    set -ux \
+ && CGO_ENABLED=0 GOBIN=/usr/local/bin go install github.com/bufbuild/buf/cmd/buf@"$BUF_VERSION"
+`,
+		copy: "COPY --from=buf /usr/local/bin/buf /usr/bin/buf\n",
+	},
+	{
+		name: "buildifier",
+		from: "FROM --platform=$BUILDPLATFORM $BUILDIFIER_IMAGE AS buildifier\n",
+		copy: "COPY --from=buildifier /buildifier /usr/bin/buildifier\n",
+	},
+	{
+		name: "clang-format",
+		from: "FROM --platform=$BUILDPLATFORM $CLANGFORMAT_IMAGE AS clang-format\n",
+		apk:  "clang", // For clang-format
+		copy: "COPY --from=clang-format /usr/bin/clang-format /usr/bin/clang-format\n",
+	},
+	{
+		name:  "dprint",
+		stage: "FROM --platform=$BUILDPLATFORM $DPRINT_IMAGE AS dprint\n",
+		args:  dprintVersions,
+		build: `RUN \
+  --mount=type=cache,target=/usr/local/cargo/registry/index/ \
+  --mount=type=cache,target=/usr/local/cargo/registry/cache/ \
+  --mount=type=cache,target=/usr/local/cargo/git/db/ \
+    set -ux \
+ && rustup target add "$(uname -m)"-unknown-linux-musl \
+ && cargo install --locked --target "$(uname -m)"-unknown-linux-musl dprint --version "$DPRINT_VERSION"
+`,
+		copy: "COPY --from=dprint /usr/local/cargo/bin/dprint /usr/bin/dprint\n",
+	},
+	{
+		name: "gofmt",
+		from: "FROM --platform=$BUILDPLATFORM $GOFMT_IMAGE AS golang\n",
+		copy: "COPY --from=golang /usr/local/go/bin/gofmt /usr/bin/gofmt\n",
+	},
+	{
+		name: "jq",
+		apk:  "jq", // JSON formatter
+	},
+	{
+		name:  "packer",
+		stage: "FROM --platform=$BUILDPLATFORM $PACKER_IMAGE AS packer\n",
+		args:  packerVersions,
+		// Not go install'ed: its go.mod holds replace directives
+		build: `RUN \
+  --mount=type=cache,target=/go/pkg/mod \
+  --mount=type=cache,target=/root/.cache/go-build \
+    set -ux \
+ && git clone --depth=1 --branch="$PACKER_VERSION" https://github.com/hashicorp/packer /src/packer \
+ && cd /src/packer \
+ && CGO_ENABLED=0 go build -trimpath -o /usr/local/bin/packer .
+`,
+		copy: "COPY --from=packer /usr/local/bin/packer /usr/bin/packer\n",
+	},
+	{
+		name: "shfmt",
+		from: "FROM --platform=$BUILDPLATFORM $SHFMT_IMAGE AS shfmt\n",
+		copy: "COPY --from=shfmt /bin/shfmt /usr/bin/shfmt\n",
+	},
+	{
+		name: "sqlformat",
+		apk:  "py3-pip", // For pip3 install
+		pip:  []string{`sqlparse=="$SQLFORMAT_VERSION"`},
+	},
+	{
+		name:  "taplo",
+		stage: "FROM --platform=$BUILDPLATFORM $TOMLFMT_IMAGE AS taplo\n",
+		args:  taploVersions,
+		build: `RUN \
+  --mount=type=cache,target=/usr/local/cargo/registry/index/ \
+  --mount=type=cache,target=/usr/local/cargo/registry/cache/ \
+  --mount=type=cache,target=/usr/local/cargo/git/db/ \
+    set -ux \
+ && rustup target add "$(uname -m)"-unknown-linux-musl \
+ && cargo install --locked --target "$(uname -m)"-unknown-linux-musl taplo-cli --version "$TAPLO_VERSION"
+`,
+		copy: "COPY --from=taplo /usr/local/cargo/bin/taplo /usr/bin/taplo\n",
+	},
+	{
+		name:  "terraform",
+		stage: "FROM --platform=$BUILDPLATFORM $TERRAFORM_IMAGE AS terraform\n",
+		args:  terraformVersions,
+		// Not go install'ed: its go.mod holds replace directives
+		build: `RUN \
+  --mount=type=cache,target=/go/pkg/mod \
+  --mount=type=cache,target=/root/.cache/go-build \
+    set -ux \
+ && git clone --depth=1 --branch="$TERRAFORM_VERSION" https://github.com/hashicorp/terraform /src/terraform \
+ && cd /src/terraform \
+ && CGO_ENABLED=0 go build -trimpath -o /usr/local/bin/terraform .
+`,
+		copy: "COPY --from=terraform /usr/local/bin/terraform /usr/bin/terraform\n",
+	},
+	{
+		name:  "txtpbfmt",
+		stage: "FROM --platform=$BUILDPLATFORM $TXTPBFMT_IMAGE AS txtpbfmt\n",
+		args:  txtpbfmtVersions,
+		build: `RUN \
+  --mount=type=cache,target=/go/pkg/mod \
+    set -ux \
+ && CGO_ENABLED=0 GOBIN=/usr/local/bin go install github.com/protocolbuffers/txtpbfmt/cmd/txtpbfmt@"$TXTPBFMT_VERSION"
+`,
+		copy: "COPY --from=txtpbfmt /usr/local/bin/txtpbfmt /usr/bin/txtpbfmt\n",
+	},
+	{
+		name: "yapf",
+		apk:  "py3-pip", // For pip3 install
+		pip:  []string{`yapf=="$YAPF_VERSION"`},
+	},
+	{
+		name:  "prettier",
+		stage: "FROM alpine AS prettier\n",
+		args:  prettierVersions,
+		build: `RUN \
+  --mount=type=cache,target=/root/.npm \
+  --mount=type=cache,target=/var/cache/apk ln -vs /var/cache/apk /etc/apk/cache && \
+    set -ux \
+ && apk add --no-cache nodejs npm \
+ && npm install --prefix /opt/prettier \
+      prettier@"$PRETTIER_VERSION" \
+      prettier-plugin-svelte@"$PRETTIER_PLUGIN_SVELTE_VERSION"
+`,
+		apk:  "nodejs", // For prettier
+		copy: "COPY --from=prettier /opt/prettier /opt/prettier\nRUN ln -s /opt/prettier/node_modules/.bin/prettier /usr/bin/prettier\n",
+	},
+	{
+		name:  "stylelint",
+		stage: "FROM alpine AS stylelint\n",
+		args:  stylelintVersions,
+		build: `RUN \
+  --mount=type=cache,target=/root/.npm \
+  --mount=type=cache,target=/var/cache/apk ln -vs /var/cache/apk /etc/apk/cache && \
+    set -ux \
+ && apk add --no-cache nodejs npm \
+ && npm install --prefix /opt/stylelint \
+      stylelint@"$STYLELINT_VERSION" \
+      stylelint-order@"$STYLELINT_ORDER_VERSION" \
+      stylelint-config-concentric-order@"$STYLELINT_CONFIG_CONCENTRIC_ORDER_VERSION" \
+      postcss-scss@"$POSTCSS_SCSS_VERSION" \
+      postcss-less@"$POSTCSS_LESS_VERSION"
+COPY <<"ALPHABETICAL_JSON" /opt/stylelint/alphabetical.json
+{"plugins": ["stylelint-order"], "rules": {"order/properties-alphabetical-order": true}, "overrides": [{"files": ["**/*.scss"], "customSyntax": "postcss-scss"}, {"files": ["**/*.less"], "customSyntax": "postcss-less"}]}
+ALPHABETICAL_JSON
+COPY <<"CONCENTRIC_JSON" /opt/stylelint/concentric.json
+{"extends": ["stylelint-config-concentric-order"], "overrides": [{"files": ["**/*.scss"], "customSyntax": "postcss-scss"}, {"files": ["**/*.less"], "customSyntax": "postcss-less"}]}
+CONCENTRIC_JSON
+`,
+		apk:  "nodejs", // For stylelint
+		copy: "COPY --from=stylelint /opt/stylelint /opt/stylelint\nRUN ln -s /opt/stylelint/node_modules/.bin/stylelint /usr/bin/stylelint\n",
+	},
+}
+
+// neededFormatters lists the enabled formatters of filenames, by name.
+func (o *options) neededFormatters(filenames []string) map[string]bool {
+	needed := make(map[string]bool)
+	for _, filename := range filenames {
+		if r := o.ruleFor(filename); r != nil && o.languageEnabled(r.name) {
+			needed[r.name] = true
+		}
+	}
+	return needed
+}
+
+// dockerfile renders the Dockerfile formatting files, with only the stages
+// the needed formatters require. needed == nil means all enabled formatters.
+func (o *options) dockerfile(complain bool, needed map[string]bool) []byte {
+	if needed == nil {
+		needed = make(map[string]bool, len(rules))
+		for _, r := range rules {
+			needed[r.name] = o.languageEnabled(r.name)
+		}
+	}
+	var complaining string
+	if complain {
+		complaining = `echo "! $f" >>../stdout`
+	}
+	otherwise := complaining
+	if o.cleanup {
+		if !complain {
+			complaining = ":"
+		}
+		otherwise = `if grep -Iq . "$f"; then ` + cleanupRule.cmdOrFail() + `; else ` + complaining + `; fi`
+	}
+	syntax := o.syntax
+	if syntax == "" {
+		syntax = defaultSyntax
+	}
+
+	neededTools := make(map[string]bool)
+	for i := range rules {
+		if r := &rules[i]; needed == nil || needed[r.name] {
+			for _, t := range o.formatter(r).tools {
+				neededTools[t] = true
+			}
+		}
+	}
+	var froms, stages, copies strings.Builder
+	var apks, pips []string
+	seenAPK := make(map[string]bool)
+	for _, t := range tools {
+		if !neededTools[t.name] {
+			continue
+		}
+		froms.WriteString(t.from)
+		if t.stage != "" {
+			stages.WriteString("\n" + t.stage + o.presetArgs(t.args) + t.build)
+		}
+		copies.WriteString(t.copy)
+		if t.name == "dprint" {
+			copies.WriteString(o.dprintConfigFile())
+		}
+		if t.name == "taplo" {
+			copies.WriteString(o.taploConfigFile())
+		}
+		if t.apk != "" && !seenAPK[t.apk] {
+			seenAPK[t.apk] = true
+			apks = append(apks, "      "+t.apk+" \\\n")
+		}
+		for _, pip := range t.pip {
+			pips = append(pips, "      "+pip)
+		}
+	}
+	var lines, linesFn string
+	if len(o.changedLines) != 0 {
+		lines, linesFn = o.linesFile(), " \\\n && "+linesFunc
+	}
+
+	var timeStart, timeEnd string
+	if o.timings != nil {
+		timeStart = "\n      " + timingStart + " \\\n      && \\"
+		timeEnd = "\n      " + timingEnd + " \\\n      && \\"
+	}
+
+	sidecars := "/app/stdout /app/errors"
+	var diagnosedFn, copyDiagnostics string
+	if o.diagnose {
+		sidecars += " /app/diagnostics"
+		diagnosedFn = " \\\n && " + diagnosedFunc
+		copyDiagnostics = "COPY --from=product /app/diagnostics /\n"
+	}
+
+	// Bounds the threads of formatters built with Go (e.g. gofmt, shfmt, terraform) and of dprint
+	threads := "ENV GOMAXPROCS=$FORMATTER_THREADS DPRINT_MAX_THREADS=$FORMATTER_THREADS\n"
+
+	var asUser, chown string
+	if o.user != "" {
+		asUser = "RUN chown " + o.user + " /app /app/a /app/b " + sidecars + "\nUSER " + o.user + "\n"
+		chown = "--chown=" + o.user + " "
+	}
+
+	install := ""
+	if len(apks) != 0 {
+		install += " && apk add --no-cache \\\n" + strings.Join(apks, "")
+	}
+	install += " && touch " + sidecars
+	var pipCache string
+	if len(pips) != 0 {
+		// Downloads and wheels survive changes to the tool stage (e.g. a new ALPINE)
+		pipCache = "  --mount=type=cache,target=/root/.cache/pip \\\n"
+		install += " \\\n && pip3 install \\\n" + strings.Join(pips, " \\\n")
+	}
+
+	return []byte(`# syntax=` + syntax + `
+
+` + o.presetArgs(presetImages) + `
+FROM --platform=$BUILDPLATFORM $ALPINE AS alpine
+` + froms.String() + `
+# See https://github.com/Unibeautify/docker-beautifiers
+` + stages.String() + `
+FROM alpine AS tool
+WORKDIR /app/b
+WORKDIR /app/a
+` + o.presetArgs(presetVersions) + `RUN \
+` + pipCache + `  --mount=type=cache,target=/var/cache/apk ln -vs /var/cache/apk /etc/apk/cache && \
+    set -ux \
+` + install + `
+` + copies.String() + `
+FROM tool AS product
+` + o.presetArgs(presetSettings) + threads + lines + o.prepares(needed) + asUser + `COPY ` + chown + `a /app/a/
+RUN \
+    set -ux \
+ && ` + failedFunc + diagnosedFn + linesFn + ` \
+ && while read -r f; do \
+      f=${f#./*} \
+      && \
+      mkdir -p ../b/"$(dirname "$f")" \
+      && \` + timeStart + `
+      case "$(echo "$f" | tr '[:upper:]' '[:lower:]')" in \
+` + o.caseArms(needed) + `        *) ` + otherwise + ` ;; \
+      esac \
+      && \` + timeEnd + `
+      if [ -f ../b/"$f" ]; then if diff -q "$f" ../b/"$f" >/dev/null; then rm ../b/"$f"; else echo "F $f" >>../stdout; fi; fi \
+      ; \
+   done < <(find . -type f)
+
+FROM scratch
+COPY --from=product /app/b/ /
+COPY --from=product /app/stdout /
+COPY --from=product /app/errors /
+` + copyDiagnostics)
+}
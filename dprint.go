@@ -0,0 +1,83 @@
+package fmtd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dprintLanguages are the formatters dprint can stand in for,
+// with the plugin it needs to.
+// TODO: suffix plugins with @ and their checksum, for dprint to verify them.
+var dprintLanguages = map[string]string{
+	"json":  "https://plugins.dprint.dev/json-0.19.3.wasm",
+	"jsonc": "https://plugins.dprint.dev/json-0.19.3.wasm",
+	"toml":  "https://plugins.dprint.dev/toml-0.6.2.wasm",
+}
+
+// dprintConfigs are the dprint configuration files looked for at the root of $PWD, in order.
+var dprintConfigs = []string{"dprint.json", ".dprint.json", "dprint.jsonc", ".dprint.jsonc"}
+
+// dprintRule is how files of languages routed through dprint are formatted.
+var dprintRule = rule{
+	cmd:   `dprint fmt --config=/app/dprint.json --stdin "${f##*.}" <"$f" >../b/"$f"`,
+	tools: []string{"dprint"},
+}
+
+// WithDprint has files of the given languages (e.g. json, toml) be formatted
+// by dprint instead of their usual formatter, pulling a single image for all of them.
+// dprint is configured by the dprint.json at the root of $PWD, if any,
+// and otherwise with just the plugins these languages need.
+// Each call resets the previous setting.
+func WithDprint(languages []string) Option {
+	return func(o *options) error {
+		o.dprint = make(map[string]bool, len(languages))
+		for _, language := range languages {
+			if _, ok := dprintLanguages[language]; !ok {
+				return fmt.Errorf("dprint cannot format %q files", language)
+			}
+			o.dprint[language] = true
+		}
+		return nil
+	}
+}
+
+// loadDprintConfig reads the dprint configuration of pwd, if dprint is used.
+func (o *options) loadDprintConfig(pwd string) error {
+	o.dprintConfig = nil
+	if len(o.dprint) == 0 {
+		return nil
+	}
+	for _, name := range dprintConfigs {
+		data, err := os.ReadFile(filepath.Join(pwd, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		o.dprintConfig = data
+		return nil
+	}
+	return nil
+}
+
+// dprintConfigFile renders the instructions writing dprint's configuration
+// in the tool stage and fetching the plugins it lists.
+func (o *options) dprintConfigFile() string {
+	config := strings.TrimSpace(string(o.dprintConfig))
+	if config == "" {
+		var plugins []string
+		seen := make(map[string]bool)
+		for _, r := range rules {
+			if plugin := dprintLanguages[r.name]; o.dprint[r.name] && !seen[plugin] {
+				seen[plugin] = true
+				plugins = append(plugins, `"`+plugin+`"`)
+			}
+		}
+		config = `{"plugins": [` + strings.Join(plugins, ", ") + `]}`
+	}
+	return "COPY <<\"DPRINT_JSON\" /app/dprint.json\n" + config + "\nDPRINT_JSON\n" +
+		"RUN dprint output-resolved-config --config=/app/dprint.json >/dev/null\n"
+}
@@ -0,0 +1,46 @@
+package fmtd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FormatError is returned when a formatter failed on a file.
+// When formatters failed on multiple files, the first one is returned.
+type FormatError struct {
+	Path      string
+	Formatter string
+	Stderr    string
+}
+
+func (e *FormatError) Error() string {
+	msg := fmt.Sprintf("formatting %q with %s failed", e.Path, e.Formatter)
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		msg += ": " + stderr
+	}
+	return msg
+}
+
+// parseFormatErrors reads the errors sidecar, made of records of a
+// "<formatter> <path>" line followed by the formatter's indented stderr.
+func parseFormatErrors(sidecar string) []*FormatError {
+	var errs []*FormatError
+	for _, line := range strings.SplitAfter(sidecar, "\n") {
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "  ") {
+			if len(errs) != 0 {
+				errs[len(errs)-1].Stderr += line[2:]
+			}
+			continue
+		}
+		line = strings.TrimSuffix(line, "\n")
+		i := strings.IndexByte(line, ' ')
+		if i == -1 {
+			continue
+		}
+		errs = append(errs, &FormatError{Formatter: line[:i], Path: line[i+1:]})
+	}
+	return errs
+}
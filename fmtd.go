@@ -1,13 +1,17 @@
 package fmtd
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/fenollp/fmtd/buildx"
 )
@@ -15,6 +19,10 @@ import (
 // ErrDryRunFoundFiles is returned when a run would have modified files if it weren't for dryrun
 var ErrDryRunFoundFiles = errors.New("unformatted files found")
 
+// ErrOutputOutsidePWD is returned when a build outputs a file outside $PWD
+// (e.g. ../../etc/passwd) while files outside $PWD are not formatted.
+var ErrOutputOutsidePWD = errors.New("formatted file is outside $PWD")
+
 // Fmt formats (any) files below the current directory
 func Fmt(
 	ctx context.Context,
@@ -22,163 +30,573 @@ func Fmt(
 	dryrun bool,
 	stdout, stderr io.Writer,
 	filenames []string,
-) error {
-	exe, err := exec.LookPath("docker")
+	opts ...Option,
+) (err error) {
+	o, err := newOptions(opts)
 	if err != nil {
-		return buildx.ErrNoDocker
+		return err
 	}
 
-	foundFiles := false
+	rep := &Report{Files: []string{}, Results: []Result{}, Images: []ManifestImage{}}
+	images := make(map[string]ManifestImage)
+	if o.report != nil {
+		start := time.Now()
+		defer func() {
+			if rerr := o.writeReport(rep, images, start, err); err == nil {
+				err = rerr
+			}
+		}()
+	}
 
-	options := []buildx.Option{
-		buildx.WithContext(ctx),
-		buildx.WithInputFiles(
-			buildx.WithPWD(pwd),
-			buildx.WithFilenames(filenames),
-			buildx.WithUseCurrentDirWhenNoPathsGiven(),
-			buildx.WithTraverseDirectories(true),
-			buildx.WithEnsureUnderPWD(true),
-			buildx.WithEnsureWritable(!dryrun),
-			buildx.WithSelectionFailureBuilder(func(fn string, err error) error {
-				return fmt.Errorf("unusable file %q (%v)", fn, err)
-			}),
-		),
-		buildx.WithStdout(stdout),
-		buildx.WithStderr(stderr),
-		buildx.WithExecutable(exe),
-		buildx.WithDockerfile(func(m map[interface{}]interface{}) []byte {
-			foundFilenamesByTraversingDirs := m["foundFilenamesByTraversingDirs"].(bool)
-			return dockerfile(!foundFilenamesByTraversingDirs)
-		}),
-		buildx.WithOutputFileFunc(func(filename string, r io.Reader) error {
-			fmt.Fprintf(stdout, "%s\n", filename)
-			foundFiles = true
-			if !dryrun {
-				if err := buildx.OverwriteFileContents(filename, r); err != nil {
-					return err
+	if o.quiet {
+		stdout = io.Discard
+	}
+	var dockerStderr bytes.Buffer
+	if len(o.strict) != 0 {
+		stderr = io.MultiWriter(stderr, &dockerStderr)
+	}
+
+	changed := make(map[string]bool)
+	var sidecar, errs, diagnostics bytes.Buffer
+
+	paths, traversed, err := o.selectFiles(pwd, dryrun, filenames)
+	selectionErrs, _ := err.(buildx.SelectionErrors)
+	if err != nil && selectionErrs == nil {
+		return err
+	}
+
+	sources := o.resolveBuildArgs()
+	if o.verbose != nil {
+		o.printBuildArgs(sources)
+	}
+	if o.resolveDigest != nil {
+		if err := o.pinImages(ctx); err != nil {
+			return err
+		}
+	}
+	if err := o.loadDprintConfig(pwd); err != nil {
+		return err
+	}
+	if err := o.loadTaploConfig(pwd); err != nil {
+		return err
+	}
+	if o.detect {
+		if err := o.detectLanguages(pwd, paths); err != nil {
+			return err
+		}
+	}
+	if o.failUnhandled {
+		if err := o.explicitUnhandled(filenames, paths); err != nil {
+			return err
+		}
+	}
+	if o.changedSince != "" {
+		var err error
+		if paths, err = o.onlyChanged(ctx, pwd, stderr, paths); err != nil {
+			return err
+		}
+	}
+
+	if o.dumpDockerfile != nil {
+		_, err := o.dumpDockerfile.Write(o.dockerfile(!traversed || o.warnUnhandled, o.neededFormatters(paths)))
+		return err
+	}
+	if o.manifest != nil {
+		return o.writeManifest(ctx, o.dockerfile(!traversed || o.warnUnhandled, o.neededFormatters(paths)))
+	}
+
+	blanks, paths, err := o.dropBlank(paths)
+	if err != nil {
+		return err
+	}
+
+	diffing := dryrun && o.diff != nil
+	originals, diffs := make(map[string][]byte), make(map[string][]byte)
+	output := func(filename string, r io.Reader) error {
+		formatted, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		path, err := o.outputPath(pwd, filename)
+		if err != nil {
+			return err
+		}
+		if o.finalNewline != FinalNewlineAsFormatted || len(o.postProcessors) != 0 || diffing {
+			original, err := o.readFile(path)
+			if err != nil {
+				return err
+			}
+			var changes bool
+			if formatted, changes, err = o.finish(buildx.PathOfName(filename), original, formatted); err != nil || !changes {
+				return err
+			}
+			if diffing {
+				originals[buildx.PathOfName(filename)] = original
+				diffs[buildx.PathOfName(filename)] = formatted
+			}
+		} else if !o.normalizeEOL {
+			original, err := o.readFile(path)
+			if err != nil {
+				return err
+			}
+			if onlyEOLs(original, formatted) {
+				return nil
+			}
+		}
+		changed[filename] = true
+		if !dryrun {
+			if err := o.writeFile(path, formatted); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	native, paths := o.splitNative(paths)
+	for _, path := range native {
+		if err := o.fmtNative(ctx, pwd, path, &sidecar, &errs, output); err != nil {
+			return err
+		}
+	}
+
+	sizes := make(map[string]int64, len(paths))
+	if len(paths) != 0 || (len(native) == 0 && len(blanks) == 0) {
+		var exe string
+		if exe, err = exec.LookPath("docker"); err != nil {
+			return buildx.ErrNoDocker
+		}
+		if o.skipMissing {
+			paths = o.dropUnavailable(ctx, exe, pwd, paths)
+		}
+
+		batches := o.batches(paths)
+		var buildStderr bytes.Buffer
+		build := func(i int, batch []string) error {
+			buildStderr.Reset()
+			inputs := []buildx.InputFilesOption{
+				buildx.WithPWD(pwd),
+				buildx.WithFilenames(batch),
+				buildx.WithSelectionFailureBuilder(func(fn string, err error) error {
+					return fmt.Errorf("unusable file %q (%v)", fn, err)
+				}),
+			}
+			if o.buffer != nil {
+				inputs = append(inputs, buildx.WithFileContents(o.buffer.path, o.buffer.data))
+			}
+			options := append(o.buildOptions(ctx, exe, &sidecar, &errs, &diagnostics, io.MultiWriter(stderr, &buildStderr)),
+				buildx.WithInputFiles(inputs...),
+				buildx.WithDockerfile(func(m map[interface{}]interface{}) []byte {
+					filenames := make([]string, 0, len(m["inputFileSizes"].(map[string]int64)))
+					for filename, size := range m["inputFileSizes"].(map[string]int64) {
+						sizes[filename] = size
+						filenames = append(filenames, filename)
+					}
+					dockerfile := o.dockerfile(!traversed || o.warnUnhandled, o.neededFormatters(filenames))
+					o.reportImages(dockerfile, images)
+					return dockerfile
+				}),
+				buildx.WithOutputFileFunc(output),
+			)
+			if len(batches) > 1 {
+				options = append(options, buildx.WithStderrPrefix(fmt.Sprintf("[%d/%d] ", i+1, len(batches))))
+			}
+			return buildx.New(options...)
+		}
+
+		unpulled := make(map[string]bool)
+		for i, batch := range batches {
+			for {
+				if err = build(i, batch); err != buildx.ErrDockerBuildFailure {
+					break
+				}
+				image, reason := pullFailed(buildStderr.Bytes())
+				if image == "" {
+					break
+				}
+				err = fmt.Errorf("%w: %s (%s)", ErrImageUnavailable, image, reason)
+				if !o.skipMissing {
+					break
+				}
+				kept := o.dropImage(pwd, batch, image, unpulled)
+				if len(kept) == len(batch) {
+					break
+				}
+				if batch, err = kept, nil; len(batch) == 0 {
+					break
 				}
 			}
-			return nil
-		}),
+			if err != nil {
+				break
+			}
+		}
+		if len(unpulled) != 0 {
+			kept := paths[:0]
+			for _, path := range paths {
+				if !unpulled[path] {
+					kept = append(kept, path)
+				} else {
+					delete(sizes, buildName(pwd, path))
+				}
+			}
+			paths = kept
+		}
+	}
+	if o.verbose != nil {
+		o.printInputStats(sizes)
+	}
+	if err != nil {
+		return err
 	}
 
-	for _, kv := range os.Environ() {
-		if strings.HasPrefix(kv, "ARG_") {
-			options = append(options, buildx.WithBuildArg(strings.TrimPrefix(kv, "ARG_")))
+	ferrs := parseFormatErrors(errs.String())
+	rs, others := results(sidecar.String(), changed, ferrs)
+	rs = withDiagnostics(rs, diagnostics.String())
+	for _, ferr := range ferrs {
+		ferr.Path = buildx.PathOfName(ferr.Path)
+	}
+	for i := range rs {
+		rs[i].Path = buildx.PathOfName(rs[i].Path)
+	}
+	// Formatters complete in no particular order
+	sort.SliceStable(rs, func(i, j int) bool { return rs[i].Path < rs[j].Path })
+	sort.SliceStable(ferrs, func(i, j int) bool { return ferrs[i].Path < ferrs[j].Path })
+	if o.resultf != nil {
+		for _, r := range rs {
+			o.resultf(r)
+		}
+	}
+	if diffing {
+		if err := o.writeDiffs(originals, diffs); err != nil {
+			return err
 		}
 	}
+	if err := o.printResults(stdout, rs, others); err != nil {
+		return err
+	}
+	files := append(append(blanks, native...), paths...)
+	o.skipUnhandled(pwd, files, rs)
+	summary := o.summarize(files, len(changed), len(ferrs))
+	for _, fn := range files {
+		rep.Files = append(rep.Files, buildx.PathOfName(buildName(pwd, fn)))
+	}
+	sort.Strings(rep.Files)
+	rep.Results = append(rep.Results, rs...)
+	rep.Summary = summary
+	if err := o.printSummary(stdout, stderr, summary); err != nil {
+		return err
+	}
+	if o.timings != nil {
+		o.printTimings(parseTimings(sidecar.String()))
+	}
+
+	if len(ferrs) != 0 {
+		return ferrs[0]
+	}
 
-	if err := buildx.New(options...); err != nil {
+	if err := o.dockerWarning(dockerStderr.Bytes()); err != nil {
 		return err
 	}
 
-	if dryrun && foundFiles {
+	if selectionErrs != nil {
+		return selectionErrs
+	}
+
+	if dryrun && len(changed) != 0 {
 		return ErrDryRunFoundFiles
 	}
 
 	return nil
 }
 
-func dockerfile(complain bool) []byte {
-	var complaining string
-	if complain {
-		complaining = `echo "! $f" >>../stdout`
-	}
-	return []byte(`
-# syntax=docker.io/docker/dockerfile:1@sha256:443aab4ca21183e069e7d8b2dc68006594f40bddf1b15bbd83f5137bd93e80e2
-`[1:] + `
-
-ARG ALPINE=docker.io/library/alpine@sha256:21a3deaa0d32a8057914f36584b5288d2e5ecc984380bc0118285c70fa8c9300
-ARG BUILDIFIER_IMAGE=docker.io/whilp/buildifier@sha256:67da91fdddd40e9947153bc9157ab9103c141fcabcdbf646f040ba7a763bc531
-ARG CLANGFORMAT_IMAGE=docker.io/unibeautify/clang-format@sha256:1b2d3997012ae221c600668802f1b761973d9006d330effa9555516432dea9c1
-ARG GOFMT_IMAGE=docker.io/library/golang:1@sha256:fb249eca1b9172732de4950b0fb0fb5c231b83c2c90952c56d822d8a9de4d64b
-ARG SHFMT_IMAGE=docker.io/mvdan/shfmt@sha256:4564a08dbbc0c4541c182dd28de8ba5dc4a70045a926b4aca2cf76a8f246f28f
-ARG TOMLFMT_IMAGE=docker.io/library/rust:1-slim@sha256:7f959043dd9aac68966ba0d35171073de3e76d917a73c7e237e145cdb86de333
-
-FROM --platform=$BUILDPLATFORM $ALPINE AS alpine
-FROM --platform=$BUILDPLATFORM $BUILDIFIER_IMAGE AS buildifier
-FROM --platform=$BUILDPLATFORM $CLANGFORMAT_IMAGE AS clang-format
-FROM --platform=$BUILDPLATFORM $GOFMT_IMAGE AS golang
-FROM --platform=$BUILDPLATFORM $SHFMT_IMAGE AS shfmt
-FROM --platform=$BUILDPLATFORM $TOMLFMT_IMAGE AS rust
-
-# See https://github.com/Unibeautify/docker-beautifiers
-
-# https://github.com/Unibeautify/docker-beautifiers/issues/63
-FROM rust AS tomlfmt
-RUN \
-  --mount=type=cache,target=/usr/local/cargo/registry/index/ \
-  --mount=type=cache,target=/usr/local/cargo/registry/cache/ \
-  --mount=type=cache,target=/usr/local/cargo/git/db/ \
-    set -ux \
- && rustup target add x86_64-unknown-linux-musl \
-#&& cargo install --target x86_64-unknown-linux-musl --git https://github.com/segeljakt/toml-fmt \
-# TODO: whence https://github.com/segeljakt/toml-fmt/pull/3
- && cargo install --target x86_64-unknown-linux-musl --git https://github.com/fenollp/toml-fmt --branch upupup \
- && [ '[a]' = "$(echo '[a]' | toml-fmt)" ]
-
-FROM alpine AS tool
-WORKDIR /app/b
-WORKDIR /app/a
-ARG YAPF_VERSION=0.32.0
-ARG SQLFORMAT_VERSION=0.4.2
-RUN \
-  --mount=type=cache,target=/var/cache/apk ln -vs /var/cache/apk /etc/apk/cache && \
-    set -ux \
- && apk add --no-cache \
-    # For pip3 install
-      py3-pip \
-    # For clang-format
-      clang \
-    # JSON formatter
-      jq \
- && touch /app/stdout \
- && pip3 install \
-      yapf=="$YAPF_VERSION" \
-      sqlparse=="$SQLFORMAT_VERSION"
-COPY --from=buildifier /buildifier /usr/bin/buildifier
-COPY --from=clang-format /usr/bin/clang-format /usr/bin/clang-format
-COPY --from=golang /usr/local/go/bin/gofmt /usr/bin/gofmt
-COPY --from=shfmt /bin/shfmt /usr/bin/shfmt
-COPY --from=tomlfmt /usr/local/cargo/bin/toml-fmt /usr/bin/toml-fmt
-
-FROM tool AS product
-COPY a /app/a/
-RUN \
-    set -ux \
- && while read -r f; do \
-      f=${f#./*} \
-      && \
-      mkdir -p ../b/"$(dirname "$f")" \
-      && \
-      case "$(echo "$f" | tr '[:upper:]' '[:lower:]')" in \
-      # Bazel / Skylark / Starlark
-        build|*/build|*.build|*.bzl|*.sky|*.star|workspace|*/workspace) cp "$f" ../b/"$f" && buildifier -lint=fix ../b/"$f" ;; \
-      # C / C++ / Protocol Buffers / Objective-C / Objective-C++
-        *.c|*.cc|*.cpp|*.h|*.hh|*.proto|*.m|*.mm) clang-format -style=google -sort-includes "$f" >../b/"$f" ;; \
-      # Erlang TODO: *.erl)
-      # Go
-        *.go) gofmt -s "$f" >../b/"$f" ;; \
-      # JSON
-        *.json) cat "$f" | jq -S --tab . >../b/"$f" ;; \
-      # Python
-        *.py) yapf --style=google "$f" >../b/"$f" ;; \
-      # Shell
-        *.sh) shfmt -s -p -kp "$f" >../b/"$f" ;; \
-      # SQL
-        *.sql) sqlformat --keywords=upper --reindent --reindent_aligned --use_space_around_operators --comma_first True "$f" >../b/"$f" ;; \
-      # TOML
-        *.toml) cat "$f" | toml-fmt >../b/"$f" ;; \
-      # YAML TODO: *.yaml|*.yml)
-        *) ` + complaining + ` ;; \
-      esac \
-      && \
-      if [ -f ../b/"$f" ] && diff -q "$f" ../b/"$f" >/dev/null; then rm ../b/"$f"; fi \
-      ; \
-   done < <(find . -type f)
-
-FROM scratch
-COPY --from=product /app/b/ /
-COPY --from=product /app/stdout /
-`)
+// explicitUnhandled fails on the first of paths no formatter handles
+// that was given explicitly, among filenames, rather than found by walking directories.
+func (o *options) explicitUnhandled(filenames, paths []string) error {
+	given := make(map[string]bool, len(filenames))
+	for _, filename := range filenames {
+		given[filename] = true
+	}
+	for _, path := range paths {
+		if given[path] && !o.cleanup && o.ruleFor(path) == nil {
+			return fmt.Errorf("%w: %q", ErrUnhandledFile, path)
+		}
+	}
+	return nil
+}
+
+// outputPath returns the path of the file a build output as filename,
+// ensuring it is under pwd unless files outside pwd are formatted.
+// Relative names are joined to pwd, which need not be the current directory.
+func (o *options) outputPath(pwd, filename string) (string, error) {
+	path := buildx.PathOfName(filename)
+	if filepath.IsAbs(path) {
+		if !o.allowOutside {
+			return "", fmt.Errorf("%w: %q", ErrOutputOutsidePWD, filename)
+		}
+		return path, nil
+	}
+	path = filepath.Clean(path)
+	if path == ".." || strings.HasPrefix(path, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %q", ErrOutputOutsidePWD, filename)
+	}
+	return filepath.Join(pwd, path), nil
+}
+
+// finish applies finalNewline then postProcessors to what the formatter made of
+// the original contents of the file at path, telling whether this changes the file.
+// Changes to line endings only do not count, unless WithNormalizeEOL.
+func (o *options) finish(path string, original, formatted []byte) (_ []byte, changes bool, err error) {
+	formatted = o.finalNewline.apply(original, formatted)
+	for _, f := range o.postProcessors {
+		if formatted, err = f(path, formatted); err != nil {
+			return nil, false, err
+		}
+	}
+	if !o.normalizeEOL && onlyEOLs(original, formatted) {
+		return original, false, nil
+	}
+	return formatted, !bytes.Equal(original, formatted), nil
+}
+
+// buildOptions are the options of every build: sidecars are written to stdout, errs and diagnostics.
+func (o *options) buildOptions(ctx context.Context, exe string, stdout, errs, diagnostics *bytes.Buffer, stderr io.Writer) []buildx.Option {
+	options := []buildx.Option{
+		buildx.WithContext(ctx),
+		buildx.WithStdout(stdout),
+		buildx.WithSidecarFile("errors", errs),
+		buildx.WithStderr(stderr),
+		buildx.WithExecutable(exe),
+		buildx.WithRetries(o.retries, o.backoff),
+	}
+	if o.diagnose {
+		options = append(options, buildx.WithSidecarFile("diagnostics", diagnostics))
+	}
+	if o.environ != nil {
+		options = append(options, buildx.WithEnviron(o.environ))
+	}
+	if o.pull {
+		options = append(options, buildx.WithExtraBuildFlags("--pull"))
+	}
+	for _, name := range o.buildArgNames() {
+		options = append(options, buildx.WithBuildArg(name+"="+o.buildArgs[name]))
+	}
+	return options
+}
+
+// SelectFiles lists the files Fmt would format given the same arguments,
+// without building anything. Paths are as given or as found walking directories.
+func SelectFiles(pwd string, filenames []string, opts ...Option) ([]string, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	paths, _, err := o.selectFiles(pwd, false, filenames)
+	return paths, err
+}
+
+// ReadFilenames reads a list of file names separated by sep (e.g. '\n' or '\x00'),
+// as output by e.g. `git diff --name-only`. Empty names are left out and
+// with '\n' so are carriage returns ending names.
+func ReadFilenames(r io.Reader, sep byte) ([]string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var filenames []string
+	for _, filename := range strings.Split(string(data), string(sep)) {
+		if sep == '\n' {
+			filename = strings.TrimSuffix(filename, "\r")
+		}
+		if filename != "" {
+			filenames = append(filenames, filename)
+		}
+	}
+	return filenames, nil
+}
+
+// ExpandResponseFiles replaces the arguments of the form @path (e.g. @files.txt)
+// with the newline-separated file names the file at path lists, as build systems
+// pass long lists of files without hitting command line length limits.
+// Relative paths are relative to pwd. File names are cleaned and duplicates dropped.
+// A file whose name starts with @ can still be given as e.g. ./@name.
+func ExpandResponseFiles(pwd string, args []string) ([]string, error) {
+	var filenames []string
+	seen := make(map[string]bool, len(args))
+	add := func(filename string) {
+		if filename != "" {
+			filename = filepath.Clean(filename)
+		}
+		if !seen[filename] {
+			seen[filename] = true
+			filenames = append(filenames, filename)
+		}
+	}
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "@") {
+			add(arg)
+			continue
+		}
+		path := arg[1:]
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(pwd, path)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading response file: %w", err)
+		}
+		listed, err := ReadFilenames(f, '\n')
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading response file: %w", err)
+		}
+		for _, filename := range listed {
+			add(filename)
+		}
+	}
+	return filenames, nil
+}
+
+func newOptions(opts []Option) (*options, error) {
+	o := &options{
+		nameRulesFirst: false,
+		traverse:       true,
+		verbose:        nil,
+		finalNewline:   FinalNewlinePreserve,
+		skipPatterns:   DefaultSkipPatterns,
+		quiet:          false,
+		color:          false,
+		json:           false,
+		resultf:        nil,
+		requireConfig:  nil,
+		batchSize:      0,
+		config:         nil,
+		collectErrs:    false,
+		dumpDockerfile: nil,
+		buildArgs:      nil,
+		warnUnhandled:  false,
+		postProcessors: nil,
+		cleanup:        false,
+		syntax:         "",
+		pull:           false,
+		allowOutside:   false,
+		native:         false,
+		cliArgs:        nil,
+		resolveDigest:  nil,
+		verify:         false,
+		dprint:         nil,
+		dprintConfig:   nil,
+		skipMissing:    false,
+		changedSince:   "",
+		changedLines:   nil,
+		timings:        nil,
+		workspaces:     1,
+		disabled:       nil,
+		detect:         false,
+		detected:       nil,
+		detectedNames:  nil,
+		summaryf:       nil,
+		user:           "",
+		manifest:       nil,
+		taploConfig:    nil,
+		sortCSS:        false,
+		diff:           nil,
+		strict:         nil,
+		compileCmds:    false,
+		failUnhandled:  false,
+		diagnose:       false,
+		cancelFirst:    false,
+		maxFileSize:    0,
+		normalizeEOL:   false,
+		generated:      nil,
+		environ:        nil,
+		skips:          nil,
+		report:         nil,
+		includeHidden:  nil,
+		followSymlinks: false,
+		idempotent:     false,
+		buffer:         nil,
+		retries:        2,
+		backoff:        2 * time.Second,
+	}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, err
+		}
+	}
+	if o.quiet && o.json {
+		return nil, ErrQuietJSON
+	}
+	if o.json {
+		o.color = false
+	}
+	return o, nil
+}
+
+// selectFiles returns the paths of the files to format, sorted.
+// traversed tells whether some were found by walking directories.
+func (o *options) selectFiles(pwd string, dryrun bool, filenames []string) (paths []string, traversed bool, err error) {
+	inputs := []buildx.InputFilesOption{
+		buildx.WithPWD(pwd),
+		buildx.WithFilenames(filenames),
+		buildx.WithEnsureUnderPWD(!o.allowOutside),
+		buildx.WithEnsureWritable(!dryrun),
+		buildx.WithEnsureReadable(dryrun),
+		buildx.WithSkipPatterns(o.skipPatterns),
+		buildx.WithIgnoreFile(IgnoreFilename),
+		buildx.WithIncludeHidden(o.includeHidden),
+		buildx.WithFollowDirSymlinks(o.followSymlinks),
+		buildx.WithMaxFileSize(o.maxFileSize),
+		buildx.WithSkipFunc(func(fn string) string { return o.missingConfig(pwd, fn) }),
+		buildx.WithSkipFunc(o.disabledLanguage),
+		buildx.WithSkippedFunc(o.skip),
+		buildx.WithSelectionFailureBuilder(func(fn string, err error) error {
+			return fmt.Errorf("unusable file %q (%v)", fn, err)
+		}),
+	}
+	if o.buffer != nil {
+		inputs = append(inputs, buildx.WithFileContents(o.buffer.path, o.buffer.data))
+	}
+	if o.compileCmds {
+		listed, err := loadCompileCommands(pwd)
+		if err != nil {
+			return nil, false, err
+		}
+		inputs = append(inputs, buildx.WithSkipFunc(func(fn string) string { return notCompiled(pwd, listed, fn) }))
+	}
+	if len(o.generated) != 0 {
+		inputs = append(inputs, buildx.WithSkipFunc(o.generatedFile))
+	}
+	if o.traverse {
+		inputs = append(inputs, buildx.WithUseCurrentDirWhenNoPathsGiven())
+	}
+	inputs = append(inputs, buildx.WithTraverseDirectories(o.traverse))
+	inputs = append(inputs, buildx.WithCollectSelectionErrors(o.collectErrs))
+	return buildx.SelectInputFiles(inputs...)
+}
+
+// FormatFile formats the file at path in place, reporting whether it changed.
+// path must be a writable regular file under pwd.
+func FormatFile(ctx context.Context, pwd, path string, stderr io.Writer) (changed bool, err error) {
+	err = Fmt(ctx, pwd, false, io.Discard, stderr, []string{path},
+		WithTraverse(false),
+		WithResultFunc(func(r Result) {
+			if r.Status == StatusChanged {
+				changed = true
+			}
+		}),
+	)
+	return
+}
+
+const (
+	green  = "\x1b[32m"
+	yellow = "\x1b[33m"
+	red    = "\x1b[31m"
+	reset  = "\x1b[0m"
+)
+
+func (o *options) paint(color, s string) string {
+	if !o.color {
+		return s
+	}
+	return color + s + reset
 }
@@ -1,16 +1,24 @@
 package fmtd_test
 
 import (
+	"archive/tar"
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"os/exec"
 	"os/user"
+	"path/filepath"
 	"regexp"
+	"runtime"
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/fenollp/fmtd"
 	"github.com/fenollp/fmtd/buildx"
@@ -101,15 +109,6 @@ func maketmpfs(t *testing.T, fs tmpfiles) func() {
 		}
 	}
 
-	if _, ok := fs["testdata/sets_arg.go"]; ok {
-		err := os.Setenv("ARG_GOFMT_IMAGE", "docker.io/library/hello-world")
-		require.NoError(t, err)
-		funcs = append(funcs, func() {
-			err := os.Unsetenv("ARG_GOFMT_IMAGE")
-			require.NoError(t, err)
-		})
-	}
-
 	return func() {
 		for _, f := range funcs {
 			f()
@@ -125,15 +124,154 @@ var toml_unformatted = `
 #
 # See: https://github.com/rust-lang/rust/issues/56068
 # See: https://reviews.llvm.org/D74169#1990180
-rustflags = ["-C", "link-arg=-Wl,--compress-debug-sections=zlib-gabi"]
+rustflags=[ "-C",   "link-arg=-Wl,--compress-debug-sections=zlib-gabi" ]
 `[1:]
 
-var toml_formatted_but_comments_gone = `
+var toml_formatted = `
 [target.x86_64-unknown-linux-gnu]
-rustflags = [
-    '-C',
-    'link-arg=-Wl,--compress-debug-sections=zlib-gabi',
-]
+# Compressing debug information can yield hundreds of megabytes of savings.
+# The Rust toolchain does not currently perform dead code elimination on
+# debug info.
+#
+# See: https://github.com/rust-lang/rust/issues/56068
+# See: https://reviews.llvm.org/D74169#1990180
+rustflags = ["-C", "link-arg=-Wl,--compress-debug-sections=zlib-gabi"]
+`[1:]
+
+var hcl_unformatted = `
+# Kept comment
+job "x" {
+  datacenters=["dc1"]
+  meta {
+    script = <<EOT
+  keep   this
+EOT
+  }
+}
+`[1:]
+
+var hcl_formatted = `
+# Kept comment
+job "x" {
+  datacenters = ["dc1"]
+  meta {
+    script = <<EOT
+  keep   this
+EOT
+  }
+}
+`[1:]
+
+var packer_unformatted = `
+source "null" "x" {
+communicator="none" # kept comment
+}
+`[1:]
+
+var packer_formatted = `
+source "null" "x" {
+  communicator = "none" # kept comment
+}
+`[1:]
+
+var textproto_unformatted = `
+# Kept comment
+name:"x"
+# Fields keep their order
+zeta: 1
+alpha:   2
+items {
+id: 2
+}
+`[1:]
+
+var textproto_formatted = `
+# Kept comment
+name: "x"
+# Fields keep their order
+zeta: 1
+alpha: 2
+items {
+  id: 2
+}
+`[1:]
+
+var proto_unformatted_with_comments = `
+syntax = "proto3";
+
+// Leading comment.
+message   Bla  {
+    // Field comment.
+  int32 f = 42; // Trailing comment.
+  /* Block comment. */
+}
+`[1:]
+
+var proto_formatted_with_comments = `
+syntax = "proto3";
+
+// Leading comment.
+message Bla {
+  // Field comment.
+  int32 f = 42;  // Trailing comment.
+  /* Block comment. */
+}
+`[1:]
+
+var vue_unformatted = `
+<template><p>{{ a }}</p></template>
+
+<script lang="ts">
+const  a:number=1
+</script>
+
+<style lang="scss">
+p{a{color:red}}
+</style>
+`[1:]
+
+var vue_formatted = `
+<template><p>{{ a }}</p></template>
+
+<script lang="ts">
+const a: number = 1;
+</script>
+
+<style lang="scss">
+p {
+  a {
+    color: red;
+  }
+}
+</style>
+`[1:]
+
+var svelte_unformatted = `
+<script lang="ts">
+const  a:number=1
+</script>
+
+<p>{a}</p>
+
+<style lang="scss">
+p{a{color:red}}
+</style>
+`[1:]
+
+var svelte_formatted = `
+<script lang="ts">
+  const a: number = 1;
+</script>
+
+<p>{a}</p>
+
+<style lang="scss">
+  p {
+    a {
+      color: red;
+    }
+  }
+</style>
 `[1:]
 
 func TestFmtd(t *testing.T) {
@@ -171,10 +309,17 @@ func TestFmtd(t *testing.T) {
 		// A Go file using ARG_...: runtime failure
 		{"testdata/sets_arg.go": []byte("package    bla")},
 
+		// A malformed Go file: formatter failure
+		{"testdata/malformed.go": []byte("package")},
+
 		// A formatted and an unformatted file: JSON
 		{"testdata/formatted.json": []byte("{}\n"), "testdata/unformatted.json": []byte("{ }")},
+		// A formatted and an unformatted file: JSON with comments
+		{"testdata/formatted.jsonc": []byte("{\n  // c\n  \"a\": 1\n}\n"), "testdata/unformatted.jsonc": []byte("{// c\n\"a\":1}")},
 		// A formatted and an unformatted file: Protocol Buffers
 		{"testdata/formatted.proto": []byte("message Bla {\n  int32 f = 42;\n}\n"), "testdata/unformatted.proto": []byte("message   Bla  {int32 f = 42;}\n")},
+		// A formatted and an unformatted file: Protocol Buffers, with comments surviving
+		{"testdata/formatted.proto": []byte(proto_formatted_with_comments), "testdata/unformatted.proto": []byte(proto_unformatted_with_comments)},
 		// A formatted and an unformatted file: Starlark
 		{"testdata/formatted.star": []byte("a = 1\n"), "testdata/unformatted.star": []byte("a=1  ")},
 		// A formatted and an unformatted file: Python
@@ -186,7 +331,17 @@ func TestFmtd(t *testing.T) {
 		// A formatted and an unformatted file: Go
 		{"testdata/formatted.go": []byte("package p\n"), "testdata/unformatted.go": []byte("package     p")},
 		// A formatted and an unformatted file: TOML
-		{"testdata/formatted.toml": []byte(toml_formatted_but_comments_gone), "testdata/unformatted.toml": []byte(toml_unformatted)},
+		{"testdata/formatted.toml": []byte(toml_formatted), "testdata/unformatted.toml": []byte(toml_unformatted)},
+		// A formatted and an unformatted file: HCL
+		{"testdata/formatted.hcl": []byte(hcl_formatted), "testdata/unformatted.hcl": []byte(hcl_unformatted)},
+		// A formatted and an unformatted file: Packer
+		{"testdata/formatted.pkr.hcl": []byte(packer_formatted), "testdata/unformatted.pkr.hcl": []byte(packer_unformatted)},
+		// A formatted and an unformatted file: Protocol Buffers text format
+		{"testdata/formatted.textproto": []byte(textproto_formatted), "testdata/unformatted.txtpb": []byte(textproto_unformatted)},
+		// A formatted and an unformatted file: Vue
+		{"testdata/formatted.vue": []byte(vue_formatted), "testdata/unformatted.vue": []byte(vue_unformatted)},
+		// A formatted and an unformatted file: Svelte
+		{"testdata/formatted.svelte": []byte(svelte_formatted), "testdata/unformatted.svelte": []byte(svelte_unformatted)},
 	} {
 		for _, dryrun := range []bool{true, false} {
 			name := fmt.Sprintf("_fns:%s_len:%d_dryrun:%v_", fs, len(fs), dryrun)
@@ -197,7 +352,13 @@ func TestFmtd(t *testing.T) {
 				var stdout, stderr bytes.Buffer
 				bufout := io.MultiWriter(newTestingLogWriter(t, "STDOUT"), &stdout)
 				buferr := io.MultiWriter(newTestingLogWriter(t, "STDERR"), &stderr)
-				err := fmtd.Fmt(ctx, pwd, dryrun, bufout, buferr, fs.Filenames())
+				var results []fmtd.Result
+				resultf := fmtd.WithResultFunc(func(r fmtd.Result) { results = append(results, r) })
+				opts := []fmtd.Option{resultf}
+				if _, ok := fs["testdata/sets_arg.go"]; ok {
+					opts = append(opts, fmtd.WithEnviron(append(os.Environ(), "ARG_GOFMT_IMAGE=docker.io/library/hello-world")))
+				}
+				err := fmtd.Fmt(ctx, pwd, dryrun, bufout, buferr, fs.Filenames(), opts...)
 				switch {
 				case len(fs.Filenames()) == 0:
 					require.NoError(t, err)
@@ -225,7 +386,7 @@ func TestFmtd(t *testing.T) {
 						require.NoError(t, err)
 						fs.Changed(t)
 					}
-					require.Contains(t, stdout.String(), `testdata/unformatted.json`)
+					require.Contains(t, results, fmtd.Result{Path: "testdata/unformatted.json", Status: fmtd.StatusChanged})
 					require.NotEmpty(t, stderr.String())
 
 				case strings.Contains(name, "+testdata/sym_"):
@@ -237,9 +398,11 @@ func TestFmtd(t *testing.T) {
 				case strings.Contains(name, ":testdata/blip+"):
 					if dryrun {
 						require.EqualError(t, err, fmtd.ErrDryRunFoundFiles.Error())
-						require.Contains(t, stdout.String(), `testdata/some.json`)
+						require.Equal(t, []fmtd.Result{
+							{Path: "testdata/blip", Status: fmtd.StatusUnhandled},
+							{Path: "testdata/some.json", Status: fmtd.StatusChanged},
+						}, results)
 						require.NotRegexp(t, regexp.MustCompile("^testdata/blip$"), stdout.String())
-						require.Contains(t, stdout.String(), `! testdata/blip`)
 						require.NotEmpty(t, stderr.String())
 					} else {
 						require.EqualError(t, err, `unusable file "testdata/blip" (permission denied)`)
@@ -256,7 +419,7 @@ func TestFmtd(t *testing.T) {
 
 				case strings.Contains(name, "some.xyz"):
 					require.NoError(t, err)
-					require.Contains(t, stdout.String(), `! testdata/some.xyz`)
+					require.Equal(t, []fmtd.Result{{Path: "testdata/some.xyz", Status: fmtd.StatusUnhandled}}, results)
 					require.NotEmpty(t, stderr.String())
 					fs.Unchanged(t)
 
@@ -266,6 +429,16 @@ func TestFmtd(t *testing.T) {
 					require.NotEmpty(t, stderr.String())
 					fs.Unchanged(t)
 
+				case strings.Contains(name, "/malformed."):
+					var ferr *fmtd.FormatError
+					require.True(t, errors.As(err, &ferr))
+					require.Equal(t, "testdata/malformed.go", ferr.Path)
+					require.Equal(t, "go", ferr.Formatter)
+					require.Contains(t, ferr.Stderr, "testdata/malformed.go:")
+					require.Equal(t, []fmtd.Result{{Path: "testdata/malformed.go", Status: fmtd.StatusFailed, Formatter: "go", Stderr: ferr.Stderr}}, results)
+					require.NotEmpty(t, stderr.String())
+					fs.Unchanged(t)
+
 				case strings.Contains(name, "formatted."):
 					if dryrun {
 						require.EqualError(t, err, fmtd.ErrDryRunFoundFiles.Error())
@@ -274,8 +447,9 @@ func TestFmtd(t *testing.T) {
 						require.NoError(t, err)
 						fs.Changed(t)
 					}
-					require.Contains(t, stdout.String(), `/unformatted.`)
-					require.NotContains(t, stdout.String(), `/formatted.`)
+					require.Len(t, results, 1)
+					require.Contains(t, results[0].Path, `/unformatted.`)
+					require.Equal(t, fmtd.StatusChanged, results[0].Status)
 					require.NotEmpty(t, stderr.String())
 
 				default:
@@ -306,3 +480,2891 @@ func (tlw *tLogWriter) Write(p []byte) (n int, err error) {
 func newTestingLogWriter(t *testing.T, prefix string) io.Writer {
 	return &tLogWriter{prefix, t}
 }
+
+func TestOverrides(t *testing.T) {
+	overrides, err := fmtd.Overrides(fmtd.WithEnviron([]string{}))
+	require.NoError(t, err)
+	require.Empty(t, overrides)
+	overrides, err = fmtd.Overrides(fmtd.WithEnviron([]string{"HOME=/root", "ARG_YAPF_VERSION=0.32.0"}))
+	require.NoError(t, err)
+	require.Empty(t, overrides)
+
+	overrides, err = fmtd.Overrides(
+		fmtd.WithEnviron([]string{
+			"ARG_YAPF_VERSION=0.40.0",
+			"ARG_GOFMT_IMAGE=docker.io/library/golang:1.17",
+			"ARG_GOFTM_IMAGE=docker.io/library/golang:1.17",
+			"ARG_SHFMT_LANG=bash",
+		}),
+		fmtd.WithConfig(&fmtd.Config{Args: map[string]string{"SQL_INDENT_WIDTH": "4", "SHFMT_LANG": "mksh"}}),
+		fmtd.WithBuildArg("YAPF_VERSION", "0.31.0"),
+	)
+	require.NoError(t, err)
+	require.Equal(t, []fmtd.Override{
+		{Arg: "GOFMT_IMAGE", Default: "docker.io/library/golang:1@sha256:fb249eca1b9172732de4950b0fb0fb5c231b83c2c90952c56d822d8a9de4d64b", Value: "docker.io/library/golang:1.17"},
+		{Arg: "GOFTM_IMAGE", Default: "", Value: "docker.io/library/golang:1.17"},
+		{Arg: "SHFMT_LANG", Default: "posix", Value: "bash"},
+		{Arg: "SQL_INDENT_WIDTH", Default: "2", Value: "4"},
+		{Arg: "YAPF_VERSION", Default: "0.32.0", Value: "0.31.0"},
+	}, overrides)
+
+	_, err = fmtd.Overrides(fmtd.WithBuildArg("", "x"))
+	require.ErrorIs(t, err, fmtd.ErrInvalidBuildArg)
+}
+
+// fakeDocker puts on $PATH a docker executable that records the build
+// context it is given and replies with a tar holding the given files.
+// It returns the directory holding the recorded context.tar and args,
+// along with context.<n>.tar for the n-th call.
+func fakeDocker(t *testing.T, output map[string]string) string {
+	state := t.TempDir()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	fns := make([]string, 0, len(output))
+	for fn := range output {
+		fns = append(fns, fn)
+	}
+	sort.Strings(fns)
+	for _, fn := range fns {
+		err := tw.WriteHeader(&tar.Header{Name: fn, Mode: 0600, Size: int64(len(output[fn]))})
+		require.NoError(t, err)
+		_, err = tw.Write([]byte(output[fn]))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	err := os.WriteFile(filepath.Join(state, "output.tar"), buf.Bytes(), 0600)
+	require.NoError(t, err)
+
+	script := "#!/bin/sh\n" +
+		"[ \"$1\" = buildx ] && exit 0\n" +
+		"[ \"$1\" = image ] && { grep -qxF \"$3\" " + state + "/images 2>/dev/null; exit $?; }\n" +
+		"n=$(($(cat " + state + "/count 2>/dev/null || echo 0)+1)) && echo $n >" + state + "/count\n" +
+		"echo \"$@\" >" + state + "/args\n" +
+		"cat >" + state + "/context.tar\n" +
+		"cp " + state + "/context.tar " + state + "/context.$n.tar\n" +
+		"cat " + state + "/output.tar\n"
+	err = os.WriteFile(filepath.Join(state, "docker"), []byte(script), 0700)
+	require.NoError(t, err)
+	t.Setenv("PATH", state+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return state
+}
+
+// contextFiles reads the last build context recorded by fakeDocker.
+func contextFiles(t *testing.T, state string) map[string]string {
+	return contextFilesOf(t, filepath.Join(state, "context.tar"))
+}
+
+func contextFilesOf(t *testing.T, path string) map[string]string {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	files := make(map[string]string)
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		files[hdr.Name] = string(data)
+	}
+	return files
+}
+
+func TestNoTraverse(t *testing.T) {
+	ctx := context.Background()
+	pwd, err := os.Getwd()
+	require.NoError(t, err)
+	state := fakeDocker(t, map[string]string{"stdout": ""})
+
+	cleanup := maketmpfs(t, tmpfiles{"testdata/some.json": []byte("{ }")})
+	defer cleanup()
+
+	var stdout bytes.Buffer
+	err = fmtd.Fmt(ctx, pwd, false, &stdout, io.Discard, []string{"testdata"}, fmtd.WithTraverse(false))
+	require.EqualError(t, err, `unusable file "testdata" (is a directory)`)
+	require.NoFileExists(t, filepath.Join(state, "context.tar"))
+
+	err = fmtd.Fmt(ctx, pwd, false, &stdout, io.Discard, []string{"testdata/some.json"}, fmtd.WithTraverse(false))
+	require.NoError(t, err)
+	files := contextFiles(t, state)
+	require.Contains(t, files, "a/testdata/some.json")
+	require.Len(t, files, 2)
+
+	// No filenames given does not mean the current directory
+	err = fmtd.Fmt(ctx, pwd, false, &stdout, io.Discard, nil, fmtd.WithTraverse(false))
+	require.NoError(t, err)
+	require.Len(t, contextFiles(t, state), 1)
+	require.Empty(t, stdout.String())
+}
+
+func TestVerboseInputStats(t *testing.T) {
+	ctx := context.Background()
+	pwd, err := os.Getwd()
+	require.NoError(t, err)
+	fakeDocker(t, map[string]string{"stdout": ""})
+
+	fs := tmpfiles{
+		"testdata/a.json": []byte("{ }"),
+		"testdata/b.json": []byte("[1,2]"),
+		"testdata/c.go":   []byte("package c"),
+		"testdata/d.xyz":  []byte("bla"),
+	}
+	cleanup := maketmpfs(t, fs)
+	defer cleanup()
+
+	var verbose bytes.Buffer
+	err = fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, fs.Filenames(), fmtd.WithVerbose(&verbose))
+	require.NoError(t, err)
+	require.Equal(t, ""+
+		"fmtd: go: 1 files, 9 bytes\n"+
+		"fmtd: json: 2 files, 8 bytes\n"+
+		"fmtd: unhandled .xyz: 1 files, 3 bytes\n"+
+		"fmtd: all 3 files already formatted\n",
+		verbose.String())
+}
+
+func TestFinalNewline(t *testing.T) {
+	ctx := context.Background()
+	pwd, err := os.Getwd()
+	require.NoError(t, err)
+	fakeDocker(t, map[string]string{
+		"stdout":                  "F testdata/crlf.py\nF testdata/gains.sql\nF testdata/loses.go\nF testdata/many.json\nF testdata/newline.json\n",
+		"b/testdata/gains.sql":    "SELECT a\n\n  FROM b",
+		"b/testdata/loses.go":     "package p\n",
+		"b/testdata/many.json":    "{}\n\n\n",
+		"b/testdata/crlf.py":      "a = 1\r\n\r\n",
+		"b/testdata/newline.json": "{}\n",
+	})
+
+	for policy, expected := range map[fmtd.FinalNewline]tmpfiles{
+		fmtd.FinalNewlineAsFormatted: {
+			"testdata/gains.sql":    []byte("SELECT a\n\n  FROM b"),
+			"testdata/loses.go":     []byte("package p\n"),
+			"testdata/many.json":    []byte("{}\n\n\n"),
+			"testdata/crlf.py":      []byte("a = 1\r\n\r\n"),
+			"testdata/newline.json": []byte("{}\n"),
+		},
+		fmtd.FinalNewlineEnsure: {
+			"testdata/gains.sql":    []byte("SELECT a\n\n  FROM b\n"),
+			"testdata/loses.go":     []byte("package p\n"),
+			"testdata/many.json":    []byte("{}\n"),
+			"testdata/crlf.py":      []byte("a = 1\r\n"),
+			"testdata/newline.json": []byte("{}\n"),
+		},
+		fmtd.FinalNewlinePreserve: {
+			"testdata/gains.sql":    []byte("SELECT a\n\n  FROM b\n"),
+			"testdata/loses.go":     []byte("package p"),
+			"testdata/many.json":    []byte("{}\n"),
+			"testdata/crlf.py":      []byte("a = 1"),
+			"testdata/newline.json": []byte("{}"),
+		},
+	} {
+		originals := tmpfiles{
+			"testdata/gains.sql":    []byte("select a from b\n"),
+			"testdata/loses.go":     []byte("package     p"),
+			"testdata/many.json":    []byte("{ }\n"),
+			"testdata/crlf.py":      []byte("a=1"),
+			"testdata/newline.json": []byte("{}"),
+		}
+		cleanup := maketmpfs(t, originals)
+
+		opts := []fmtd.Option{fmtd.WithFinalNewline(policy)}
+		if policy == fmtd.FinalNewlinePreserve {
+			opts = nil // the default
+		}
+		var stdout bytes.Buffer
+		err := fmtd.Fmt(ctx, pwd, false, &stdout, io.Discard, originals.Filenames(), opts...)
+		require.NoError(t, err)
+		expected.Unchanged(t)
+		if policy == fmtd.FinalNewlinePreserve {
+			require.NotContains(t, stdout.String(), "testdata/newline.json")
+		} else {
+			require.Contains(t, stdout.String(), "testdata/newline.json")
+		}
+		cleanup()
+	}
+}
+
+func TestFormatFile(t *testing.T) {
+	ctx := context.Background()
+	pwd, err := os.Getwd()
+	require.NoError(t, err)
+	u, err := user.Current()
+	require.NoError(t, err)
+	HOME := u.HomeDir
+
+	for _, fs := range []tmpfiles{
+		{"": nil},
+		{"non-existing-file": nil},
+		{"Dtestdata": nil},
+		{"Ltestdata/sym": []byte(".gitkeep")},
+		{"Utestdata/blip": []byte("blop")},
+		{HOME + "/some_outside.yml": []byte("bla:  42")},
+		{"testdata/formatted.json": []byte("{}\n")},
+		{"testdata/unformatted.go": []byte("package     p\n")},
+	} {
+		t.Run(fs.String(), func(t *testing.T) {
+			cleanup := maketmpfs(t, fs)
+			defer cleanup()
+
+			fn := fs.Filenames()[0]
+			if fn == "testdata/blip" && os.Geteuid() == 0 {
+				t.Skip("root can write read-only files")
+			}
+			output := map[string]string{"stdout": ""}
+			if fn == "testdata/unformatted.go" {
+				output["b/"+fn] = "package p\n"
+			}
+			fakeDocker(t, output)
+
+			changed, err := fmtd.FormatFile(ctx, pwd, fn, io.Discard)
+			switch fn {
+			case "":
+				require.EqualError(t, err, `unusable file "" (no such file or directory)`)
+			case "non-existing-file":
+				require.EqualError(t, err, `unusable file "non-existing-file" (no such file or directory)`)
+			case "testdata":
+				require.EqualError(t, err, `unusable file "testdata" (is a directory)`)
+			case "testdata/sym":
+				require.EqualError(t, err, `unusable file "testdata/sym" (not a regular file)`)
+			case "testdata/blip":
+				require.EqualError(t, err, `unusable file "testdata/blip" (permission denied)`)
+			case HOME + "/some_outside.yml":
+				require.EqualError(t, err, `unusable file "`+HOME+`/some_outside.yml" (not under $PWD)`)
+			case "testdata/formatted.json":
+				require.NoError(t, err)
+				require.False(t, changed)
+				fs.Unchanged(t)
+			case "testdata/unformatted.go":
+				require.NoError(t, err)
+				require.True(t, changed)
+				tmpfiles{fn: []byte("package p\n")}.Unchanged(t)
+			default:
+				panic(fn)
+			}
+		})
+	}
+}
+
+func TestSkipPatterns(t *testing.T) {
+	ctx := context.Background()
+	pwd, err := os.Getwd()
+	require.NoError(t, err)
+	state := fakeDocker(t, map[string]string{"stdout": ""})
+
+	fs := tmpfiles{
+		"testdata/bundle.min.js":  []byte("function a(){return 1}"),
+		"testdata/data.MIN.json":  []byte(`{"a":1}`),
+		"testdata/unminified.js":  []byte("function a(){return 1}"),
+		"testdata/unminified.css": []byte("a{color:red}"),
+	}
+	cleanup := maketmpfs(t, fs)
+	defer cleanup()
+
+	css := fmtd.WithConfig(&fmtd.Config{Languages: map[string]bool{"css": true}})
+	var verbose bytes.Buffer
+	for _, filenames := range [][]string{fs.Filenames(), {"testdata"}} {
+		verbose.Reset()
+		err = fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, filenames, css, fmtd.WithVerbose(&verbose))
+		require.NoError(t, err)
+		files := contextFiles(t, state)
+		require.NotContains(t, files, "a/testdata/bundle.min.js")
+		require.NotContains(t, files, "a/testdata/data.MIN.json")
+		require.Contains(t, files, "a/testdata/unminified.js")
+		require.Contains(t, files, "a/testdata/unminified.css")
+		require.Contains(t, verbose.String(), "fmtd: skipped testdata/bundle.min.js (matches *.min.js)\n")
+		require.Contains(t, verbose.String(), "fmtd: skipped testdata/data.MIN.json (matches *.min.json)\n")
+	}
+
+	verbose.Reset()
+	err = fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, fs.Filenames(), css, fmtd.WithVerbose(&verbose), fmtd.WithSkipPatterns(nil))
+	require.NoError(t, err)
+	files := contextFiles(t, state)
+	require.Contains(t, files, "a/testdata/bundle.min.js")
+	require.Contains(t, files, "a/testdata/data.MIN.json")
+	require.NotContains(t, verbose.String(), "skipped")
+
+	err = fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, fs.Filenames(), fmtd.WithSkipPatterns([]string{"[*.min.js"}))
+	require.EqualError(t, err, `syntax error in pattern: "[*.min.js"`)
+}
+
+func TestCSSIsOptIn(t *testing.T) {
+	ctx := context.Background()
+	pwd := t.TempDir()
+	err := os.WriteFile(filepath.Join(pwd, "a.css"), []byte("a{color:red}\n"), 0600)
+	require.NoError(t, err)
+	state := fakeDocker(t, map[string]string{"stdout": ""})
+
+	var summary fmtd.Summary
+	err = fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, nil, fmtd.WithSummaryFunc(func(s fmtd.Summary) { summary = s }))
+	require.NoError(t, err)
+	require.Equal(t, []fmtd.Skipped{{Reason: "css not enabled", Count: 1, Paths: []string{"a.css"}}}, summary.Skipped)
+	require.NotContains(t, contextFiles(t, state), "a/a.css")
+
+	for _, opt := range []fmtd.Option{
+		fmtd.WithSortCSSProperties(true),
+		fmtd.WithConfig(&fmtd.Config{Languages: map[string]bool{"css": true}}),
+	} {
+		err = fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, nil, opt)
+		require.NoError(t, err)
+		require.Contains(t, contextFiles(t, state), "a/a.css")
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	ctx := context.Background()
+	pwd, err := os.Getwd()
+	require.NoError(t, err)
+	fakeDocker(t, map[string]string{
+		"stdout":                    "F testdata/unformatted.go\n! testdata/some.xyz\n",
+		"b/testdata/unformatted.go": "package p\n",
+	})
+
+	fs := tmpfiles{
+		"testdata/unformatted.go": []byte("package     p\n"),
+		"testdata/some.xyz":       []byte("bla"),
+	}
+	cleanup := maketmpfs(t, fs)
+	defer cleanup()
+
+	var stdout bytes.Buffer
+	err = fmtd.Fmt(ctx, pwd, true, &stdout, io.Discard, fs.Filenames(), fmtd.WithQuiet(true))
+	require.EqualError(t, err, fmtd.ErrDryRunFoundFiles.Error())
+	require.Empty(t, stdout.String())
+	fs.Unchanged(t)
+
+	err = fmtd.Fmt(ctx, pwd, true, &stdout, io.Discard, fs.Filenames())
+	require.EqualError(t, err, fmtd.ErrDryRunFoundFiles.Error())
+	require.Equal(t, "! testdata/some.xyz\ntestdata/unformatted.go\n", stdout.String())
+
+	stdout.Reset()
+	err = fmtd.Fmt(ctx, pwd, false, &stdout, io.Discard, fs.Filenames(), fmtd.WithQuiet(true))
+	require.NoError(t, err)
+	require.Empty(t, stdout.String())
+	tmpfiles{"testdata/unformatted.go": []byte("package p\n")}.Unchanged(t)
+}
+
+func TestWhat(t *testing.T) {
+	t.Setenv("PATH", t.TempDir()) // No Docker needed
+	pwd := t.TempDir()
+	for _, fn := range []string{"main.go", "web/tsconfig.json", "data.json", "notes.xyz", "schema.sql", "manage"} {
+		err := os.MkdirAll(filepath.Join(pwd, filepath.Dir(fn)), 0700)
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(pwd, fn), []byte("#!/usr/bin/env python3\n"), 0600)
+		require.NoError(t, err)
+	}
+
+	ffs, err := fmtd.What(pwd, []string{pwd}, fmtd.WithDisabledLanguages([]string{"sql"}))
+	require.NoError(t, err)
+	require.Equal(t, []fmtd.FileFormatter{
+		{Path: "data.json", Formatter: "json"},
+		{Path: "main.go", Formatter: "go"},
+		{Path: "manage"},
+		{Path: "notes.xyz"},
+		{Path: filepath.Join("web", "tsconfig.json"), Formatter: "jsonc"},
+	}, ffs)
+
+	ffs, err = fmtd.What(pwd, []string{filepath.Join(pwd, "manage"), filepath.Join(pwd, "schema.sql")}, fmtd.WithDetectLanguage(true))
+	require.NoError(t, err)
+	require.Equal(t, []fmtd.FileFormatter{
+		{Path: "manage", Formatter: "python"},
+		{Path: "schema.sql", Formatter: "sql"},
+	}, ffs)
+}
+
+func TestUnhandled(t *testing.T) {
+	t.Setenv("PATH", t.TempDir()) // No Docker needed
+	pwd := t.TempDir()
+	for _, fn := range []string{"main.go", "a.xyz", "b.XYZ", "sub/c.xyz", "notes.adoc", "Makefile", "sub/LICENSE", "data.json", "schema.sql"} {
+		err := os.MkdirAll(filepath.Join(pwd, filepath.Dir(fn)), 0700)
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(pwd, fn), []byte("x\n"), 0600)
+		require.NoError(t, err)
+	}
+
+	exts, err := fmtd.Unhandled(pwd, []string{pwd}, fmtd.WithDisabledLanguages([]string{"sql"}))
+	require.NoError(t, err)
+	require.Equal(t, []fmtd.UnhandledExtension{
+		{Ext: ".xyz", Files: 3},
+		{Ext: "", Files: 2},
+		{Ext: ".adoc", Files: 1},
+	}, exts)
+
+	exts, err = fmtd.Unhandled(pwd, []string{filepath.Join(pwd, "main.go"), filepath.Join(pwd, "data.json")})
+	require.NoError(t, err)
+	require.Empty(t, exts)
+}
+
+func TestResultsSortedByPath(t *testing.T) {
+	ctx := context.Background()
+	pwd := t.TempDir()
+	for _, fn := range []string{"c.json", "a.go", "b/x.sql", "b/a.toml", "z.xyz"} {
+		err := os.MkdirAll(filepath.Join(pwd, filepath.Dir(fn)), 0700)
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(pwd, fn), []byte("x"), 0600)
+		require.NoError(t, err)
+	}
+	// Formatters complete in any order
+	fakeDocker(t, map[string]string{
+		"stdout":    "F c.json\nF b/x.sql\n! z.xyz\nE b/a.toml\nF a.go\n",
+		"errors":    "toml b/a.toml\n  bad\n",
+		"b/c.json":  "{}\n",
+		"b/b/x.sql": "SELECT 1\n",
+		"b/a.go":    "package a\n",
+	})
+
+	var stdout bytes.Buffer
+	var paths []string
+	filenames := []string{filepath.Join(pwd, "c.json"), filepath.Join(pwd, "b"), filepath.Join(pwd, "a.go"), filepath.Join(pwd, "z.xyz")}
+	err := fmtd.Fmt(ctx, pwd, true, &stdout, io.Discard, filenames,
+		fmtd.WithResultFunc(func(r fmtd.Result) { paths = append(paths, r.Path) }))
+	require.EqualError(t, err, `formatting "b/a.toml" with toml failed: bad`)
+	require.Equal(t, "a.go\nE b/a.toml\nb/x.sql\nc.json\n! z.xyz\n", stdout.String())
+	require.Equal(t, []string{"a.go", "b/a.toml", "b/x.sql", "c.json", "z.xyz"}, paths)
+}
+
+func TestDiffWriter(t *testing.T) {
+	ctx := context.Background()
+	pwd := t.TempDir()
+	for fn, contents := range map[string]string{"b.go": "package     b\n", "a.json": "{\"a\":1}"} {
+		err := os.WriteFile(filepath.Join(pwd, fn), []byte(contents), 0600)
+		require.NoError(t, err)
+	}
+	fakeDocker(t, map[string]string{
+		"stdout":   "F b.go\nF a.json\n",
+		"b/b.go":   "package b\n",
+		"b/a.json": "{\n\t\"a\": 1\n}\n",
+	})
+
+	var diff bytes.Buffer
+	err := fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, nil, fmtd.WithDiffWriter(&diff))
+	require.Equal(t, fmtd.ErrDryRunFoundFiles, err)
+	require.Equal(t, `--- a/a.json
++++ b/a.json
+@@ -1 +1,3 @@
+-{"a":1}
+\ No newline at end of file
++{
++	"a": 1
++}
+\ No newline at end of file
+--- a/b.go
++++ b/b.go
+@@ -1 +1 @@
+-package     b
++package b
+`, diff.String())
+	for fn, contents := range map[string]string{"b.go": "package     b\n", "a.json": "{\"a\":1}"} {
+		data, err := os.ReadFile(filepath.Join(pwd, fn))
+		require.NoError(t, err)
+		require.Equal(t, contents, string(data))
+	}
+
+	// Only dry runs write diffs
+	diff.Reset()
+	err = fmtd.Fmt(ctx, pwd, false, io.Discard, io.Discard, nil, fmtd.WithDiffWriter(&diff))
+	require.NoError(t, err)
+	require.Empty(t, diff.String())
+}
+
+func TestNormalizeEOL(t *testing.T) {
+	ctx := context.Background()
+	pwd := t.TempDir()
+	// Already formatted but for its line endings, and not formatted
+	for fn, contents := range map[string]string{"a.go": "package a\r\n\r\nfunc f() {}\r\n", "b.go": "package b\r\nfunc   g() {}\r\n"} {
+		err := os.WriteFile(filepath.Join(pwd, fn), []byte(contents), 0600)
+		require.NoError(t, err)
+	}
+	fakeDocker(t, map[string]string{
+		"stdout": "F a.go\nF b.go\n",
+		"b/a.go": "package a\n\nfunc f() {}\n",
+		"b/b.go": "package b\n\nfunc g() {}\n",
+	})
+
+	for _, opts := range [][]fmtd.Option{nil, {fmtd.WithFinalNewline(fmtd.FinalNewlineEnsure)}} {
+		var stdout bytes.Buffer
+		err := fmtd.Fmt(ctx, pwd, true, &stdout, io.Discard, nil, opts...)
+		require.Equal(t, fmtd.ErrDryRunFoundFiles, err)
+		require.Equal(t, "b.go\n", stdout.String())
+	}
+
+	var stdout bytes.Buffer
+	err := fmtd.Fmt(ctx, pwd, false, &stdout, io.Discard, nil)
+	require.NoError(t, err)
+	require.Equal(t, "b.go\n", stdout.String())
+	data, err := os.ReadFile(filepath.Join(pwd, "a.go"))
+	require.NoError(t, err)
+	require.Equal(t, "package a\r\n\r\nfunc f() {}\r\n", string(data))
+
+	stdout.Reset()
+	err = fmtd.Fmt(ctx, pwd, false, &stdout, io.Discard, nil, fmtd.WithNormalizeEOL(true))
+	require.NoError(t, err)
+	require.Equal(t, "a.go\n", stdout.String())
+	data, err = os.ReadFile(filepath.Join(pwd, "a.go"))
+	require.NoError(t, err)
+	require.Equal(t, "package a\n\nfunc f() {}\n", string(data))
+}
+
+func TestStrict(t *testing.T) {
+	ctx := context.Background()
+	pwd := t.TempDir()
+	err := os.WriteFile(filepath.Join(pwd, "a.go"), []byte("package     a\n"), 0600)
+	require.NoError(t, err)
+	state := fakeDocker(t, map[string]string{"stdout": "F a.go\n", "b/a.go": "package a\n"})
+	script, err := os.ReadFile(filepath.Join(state, "docker"))
+	require.NoError(t, err)
+	warning := "WARNING: The requested image's platform (linux/arm64) does not match the detected host platform (linux/amd64)"
+	script = bytes.Replace(script, []byte("#!/bin/sh\n"), []byte("#!/bin/sh\necho \""+warning+"\" >&2\n"), 1)
+	err = os.WriteFile(filepath.Join(state, "docker"), script, 0700)
+	require.NoError(t, err)
+
+	var stdout bytes.Buffer
+	err = fmtd.Fmt(ctx, pwd, false, &stdout, io.Discard, nil)
+	require.NoError(t, err)
+
+	err = fmtd.Fmt(ctx, pwd, false, &stdout, io.Discard, nil, fmtd.WithStrict(fmtd.DefaultWarningPatterns))
+	require.True(t, errors.Is(err, fmtd.ErrDockerWarning))
+	require.EqualError(t, err, "Docker emitted a warning: "+warning)
+	require.Equal(t, "a.go\n", stdout.String())
+
+	err = fmtd.Fmt(ctx, pwd, false, io.Discard, io.Discard, nil, fmtd.WithStrict([]string{"deprecated"}))
+	require.NoError(t, err)
+
+	err = fmtd.Fmt(ctx, pwd, false, io.Discard, io.Discard, nil, fmtd.WithStrict([]string{"("}))
+	require.EqualError(t, err, "bad warning pattern \"(\": error parsing regexp: missing closing ): `(`")
+}
+
+func TestColor(t *testing.T) {
+	ctx := context.Background()
+	pwd, err := os.Getwd()
+	require.NoError(t, err)
+	fakeDocker(t, map[string]string{
+		"stdout":                    "F testdata/unformatted.go\n! testdata/some.xyz\n",
+		"b/testdata/unformatted.go": "package p\n",
+	})
+
+	fs := tmpfiles{
+		"testdata/unformatted.go": []byte("package     p"),
+		"testdata/some.xyz":       []byte("bla"),
+	}
+	cleanup := maketmpfs(t, fs)
+	defer cleanup()
+
+	var stdout bytes.Buffer
+	err = fmtd.Fmt(ctx, pwd, true, &stdout, io.Discard, fs.Filenames(), fmtd.WithColor(true))
+	require.EqualError(t, err, fmtd.ErrDryRunFoundFiles.Error())
+	require.Equal(t, "\x1b[33m! testdata/some.xyz\x1b[0m\n\x1b[32mtestdata/unformatted.go\x1b[0m\n", stdout.String())
+}
+
+func TestFormatError(t *testing.T) {
+	ctx := context.Background()
+	pwd, err := os.Getwd()
+	require.NoError(t, err)
+	fakeDocker(t, map[string]string{
+		"stdout": "F testdata/unformatted.go\nE testdata/malformed.go\nE testdata/malformed.json\n",
+		"errors": "" +
+			"go testdata/malformed.go\n" +
+			"  testdata/malformed.go:1:8: expected 'IDENT', found 'EOF'\n" +
+			"json testdata/malformed.json\n" +
+			"  jq: error (at <stdin>:1): Cannot index\n" +
+			"  jq: 1 compile error\n",
+		"b/testdata/unformatted.go": "package p\n",
+	})
+
+	fs := tmpfiles{
+		"testdata/malformed.go":   []byte("package"),
+		"testdata/malformed.json": []byte("{"),
+		"testdata/unformatted.go": []byte("package     p"),
+	}
+	cleanup := maketmpfs(t, fs)
+	defer cleanup()
+
+	err = fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, fs.Filenames())
+	require.EqualError(t, err, `formatting "testdata/malformed.go" with go failed: testdata/malformed.go:1:8: expected 'IDENT', found 'EOF'`)
+	var ferr *fmtd.FormatError
+	require.True(t, errors.As(err, &ferr))
+	require.Equal(t, &fmtd.FormatError{
+		Path:      "testdata/malformed.go",
+		Formatter: "go",
+		Stderr:    "testdata/malformed.go:1:8: expected 'IDENT', found 'EOF'\n",
+	}, ferr)
+	fs.Unchanged(t)
+}
+
+func TestJSON(t *testing.T) {
+	ctx := context.Background()
+	pwd, err := os.Getwd()
+	require.NoError(t, err)
+	fakeDocker(t, map[string]string{
+		"stdout":                    "F testdata/unformatted.go\n! testdata/some.xyz\nE testdata/malformed.json\n",
+		"errors":                    "json testdata/malformed.json\n  jq: error\n",
+		"b/testdata/unformatted.go": "package p\n",
+	})
+
+	fs := tmpfiles{
+		"testdata/unformatted.go": []byte("package     p"),
+		"testdata/some.xyz":       []byte("bla"),
+		"testdata/malformed.json": []byte("{"),
+	}
+	cleanup := maketmpfs(t, fs)
+	defer cleanup()
+
+	var stdout bytes.Buffer
+	err = fmtd.Fmt(ctx, pwd, true, &stdout, io.Discard, fs.Filenames(), fmtd.WithJSON(true), fmtd.WithColor(true))
+	require.EqualError(t, err, `formatting "testdata/malformed.json" with json failed: jq: error`)
+	require.Equal(t, ""+
+		`{"path":"testdata/malformed.json","status":"failed","formatter":"json","stderr":"jq: error\n"}`+"\n"+
+		`{"path":"testdata/some.xyz","status":"unhandled"}`+"\n"+
+		`{"path":"testdata/unformatted.go","status":"changed"}`+"\n"+
+		`{"summary":{"files":2,"changed":1,"failed":1,"outcome":"failed","skipped":[{"reason":"no formatter","count":1,"paths":["testdata/some.xyz"]}]}}`+"\n",
+		stdout.String())
+
+	stdout.Reset()
+	err = fmtd.Fmt(ctx, pwd, true, &stdout, io.Discard, fs.Filenames())
+	require.Error(t, err)
+	require.Equal(t, "E testdata/malformed.json\n! testdata/some.xyz\ntestdata/unformatted.go\n", stdout.String())
+
+	err = fmtd.Fmt(ctx, pwd, true, &stdout, io.Discard, fs.Filenames(), fmtd.WithJSON(true), fmtd.WithQuiet(true))
+	require.EqualError(t, err, fmtd.ErrQuietJSON.Error())
+}
+
+func TestDiagnostics(t *testing.T) {
+	ctx := context.Background()
+	pwd, err := os.Getwd()
+	require.NoError(t, err)
+	state := fakeDocker(t, map[string]string{
+		"stdout":           "F testdata/BUILD\n",
+		"diagnostics":      "bazel testdata/BUILD\n  ../b/testdata/BUILD:1: load: Loaded symbol \"x\" is unused\nbazel testdata/defs.bzl\n  ../b/testdata/defs.bzl:3: return-value: Some but not all execution paths return a value\n",
+		"b/testdata/BUILD": "load(\":defs.bzl\", \"x\")\n",
+	})
+
+	fs := tmpfiles{
+		"testdata/BUILD":    []byte("load(':defs.bzl','x')"),
+		"testdata/defs.bzl": []byte("def f(x):\n    if x:\n        return 1\n"),
+	}
+	cleanup := maketmpfs(t, fs)
+	defer cleanup()
+
+	var stdout bytes.Buffer
+	err = fmtd.Fmt(ctx, pwd, true, &stdout, io.Discard, fs.Filenames(), fmtd.WithJSON(true), fmtd.WithDiagnostics(true))
+	require.Equal(t, fmtd.ErrDryRunFoundFiles, err)
+	require.Equal(t, ""+
+		`{"path":"testdata/BUILD","status":"changed","diagnostics":"../b/testdata/BUILD:1: load: Loaded symbol \"x\" is unused\n"}`+"\n"+
+		`{"path":"testdata/defs.bzl","status":"diagnosed","formatter":"bazel","diagnostics":"../b/testdata/defs.bzl:3: return-value: Some but not all execution paths return a value\n"}`+"\n"+
+		`{"summary":{"files":2,"changed":1,"failed":0,"outcome":"changed"}}`+"\n",
+		stdout.String())
+	dockerfile := contextFiles(t, state)["Dockerfile"]
+	require.Contains(t, dockerfile, "diagnosed bazel")
+	require.Contains(t, dockerfile, "COPY --from=product /app/diagnostics /\n")
+
+	stdout.Reset()
+	err = fmtd.Fmt(ctx, pwd, true, &stdout, io.Discard, fs.Filenames(), fmtd.WithDiagnostics(true))
+	require.Equal(t, fmtd.ErrDryRunFoundFiles, err)
+	require.Equal(t, ""+
+		"testdata/BUILD\n"+
+		"  ../b/testdata/BUILD:1: load: Loaded symbol \"x\" is unused\n"+
+		"W testdata/defs.bzl\n"+
+		"  ../b/testdata/defs.bzl:3: return-value: Some but not all execution paths return a value\n",
+		stdout.String())
+
+	var dumped bytes.Buffer
+	err = fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, fs.Filenames(), fmtd.WithDumpDockerfile(&dumped))
+	require.NoError(t, err)
+	require.NotContains(t, dumped.String(), "diagnosed")
+	require.NotContains(t, dumped.String(), "/app/diagnostics")
+}
+
+func TestSummary(t *testing.T) {
+	ctx := context.Background()
+	pwd := t.TempDir()
+
+	summarize := func(filenames []string, opts ...fmtd.Option) (fmtd.Summary, string) {
+		var summary fmtd.Summary
+		var verbose bytes.Buffer
+		opts = append(opts, fmtd.WithSummaryFunc(func(s fmtd.Summary) { summary = s }), fmtd.WithVerbose(&verbose))
+		err := fmtd.Fmt(ctx, pwd, false, io.Discard, io.Discard, filenames, opts...)
+		require.NoError(t, err)
+		return summary, verbose.String()
+	}
+
+	fakeDocker(t, map[string]string{"stdout": ""})
+	summary, verbose := summarize(nil)
+	require.Equal(t, fmtd.Summary{Outcome: fmtd.OutcomeNoFiles}, summary)
+	require.Contains(t, verbose, "fmtd: no files to format\n")
+
+	notes := filepath.Join(pwd, "notes.xyz")
+	err := os.WriteFile(notes, []byte("bla\n"), 0600)
+	require.NoError(t, err)
+	summary, _ = summarize([]string{notes})
+	require.Equal(t, fmtd.Summary{Outcome: fmtd.OutcomeNoFiles, Skipped: []fmtd.Skipped{
+		{Reason: fmtd.SkippedNoFormatter, Count: 1, Paths: []string{"notes.xyz"}},
+	}}, summary)
+
+	gofile := filepath.Join(pwd, "main.go")
+	err = os.WriteFile(gofile, []byte("package main\n"), 0600)
+	require.NoError(t, err)
+	summary, verbose = summarize(nil)
+	require.Equal(t, fmtd.Summary{Files: 1, Outcome: fmtd.OutcomeFormatted, Skipped: []fmtd.Skipped{
+		{Reason: fmtd.SkippedNoFormatter, Count: 1, Paths: []string{"notes.xyz"}},
+	}}, summary)
+	require.Contains(t, verbose, "fmtd: all 1 files already formatted\n")
+
+	fakeDocker(t, map[string]string{"stdout": "F main.go\n", "b/main.go": "package  main\n"})
+	var stdout bytes.Buffer
+	err = fmtd.Fmt(ctx, pwd, true, &stdout, io.Discard, nil, fmtd.WithJSON(true))
+	require.Equal(t, fmtd.ErrDryRunFoundFiles, err)
+	require.Equal(t, ""+
+		`{"path":"main.go","status":"changed"}`+"\n"+
+		`{"summary":{"files":1,"changed":1,"failed":0,"outcome":"changed","skipped":[{"reason":"no formatter","count":1,"paths":["notes.xyz"]}]}}`+"\n",
+		stdout.String())
+}
+
+func TestReport(t *testing.T) {
+	ctx := context.Background()
+	pwd := t.TempDir()
+	fakeDocker(t, map[string]string{"stdout": "F main.go\n", "b/main.go": "package  main\n"})
+
+	for fn, data := range map[string]string{
+		"main.go":    "package main\n",
+		"notes.xyz":  "bla\n",
+		"a.min.json": "{}\n",
+	} {
+		err := os.WriteFile(filepath.Join(pwd, fn), []byte(data), 0600)
+		require.NoError(t, err)
+	}
+
+	var report bytes.Buffer
+	err := fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, nil,
+		fmtd.WithReport(&report), fmtd.WithSkipPatterns(fmtd.DefaultSkipPatterns))
+	require.Equal(t, fmtd.ErrDryRunFoundFiles, err)
+
+	var schema map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(report.Bytes(), &schema))
+	var keys []string
+	for key := range schema {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	require.Equal(t, []string{"duration_ms", "error", "files", "images", "results", "summary"}, keys)
+
+	var rep fmtd.Report
+	require.NoError(t, json.Unmarshal(report.Bytes(), &rep))
+	require.Equal(t, []string{"main.go", "notes.xyz"}, rep.Files)
+	require.Equal(t, []fmtd.Result{{Path: "main.go", Status: fmtd.StatusChanged}}, rep.Results)
+	require.Equal(t, fmtd.Summary{Files: 1, Changed: 1, Outcome: fmtd.OutcomeChanged, Skipped: []fmtd.Skipped{
+		{Reason: "matches *.min.json", Count: 1, Paths: []string{"a.min.json"}},
+		{Reason: fmtd.SkippedNoFormatter, Count: 1, Paths: []string{"notes.xyz"}},
+	}}, rep.Summary)
+	var args []string
+	for _, image := range rep.Images {
+		args = append(args, image.Arg)
+		if image.Arg == "ALPINE" {
+			require.True(t, strings.HasPrefix(image.Digest, "sha256:"), image.Digest)
+		}
+	}
+	require.Equal(t, []string{"ALPINE", "GOFMT_IMAGE"}, args)
+	require.Equal(t, fmtd.ErrDryRunFoundFiles.Error(), rep.Error)
+	require.GreaterOrEqual(t, rep.DurationMS, int64(0))
+
+	// Failed runs are reported too
+	t.Setenv("PATH", t.TempDir()) // no docker to be found
+	report.Reset()
+	err = fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, nil, fmtd.WithReport(&report))
+	require.Equal(t, buildx.ErrNoDocker, err)
+	rep = fmtd.Report{}
+	require.NoError(t, json.Unmarshal(report.Bytes(), &rep))
+	require.Equal(t, buildx.ErrNoDocker.Error(), rep.Error)
+	require.Empty(t, rep.Results)
+}
+
+func TestRequireConfig(t *testing.T) {
+	ctx := context.Background()
+	pwd := t.TempDir()
+	state := fakeDocker(t, map[string]string{"stdout": ""})
+
+	vue := filepath.Join(pwd, "App.vue")
+	err := os.WriteFile(vue, []byte("<template><p>hi</p></template>\n"), 0600)
+	require.NoError(t, err)
+	gofile := filepath.Join(pwd, "main.go")
+	err = os.WriteFile(gofile, []byte("package main\n"), 0600)
+	require.NoError(t, err)
+	filenames := []string{vue, gofile}
+
+	var verbose bytes.Buffer
+	err = fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, filenames,
+		fmtd.WithVerbose(&verbose), fmtd.WithRequireConfig([]string{".vue"}))
+	require.NoError(t, err)
+	files := contextFiles(t, state)
+	require.NotContains(t, files, "a/App.vue")
+	require.Contains(t, files, "a/main.go")
+	require.Contains(t, verbose.String(), "fmtd: skipped App.vue (no .prettierrc or similar)\n")
+
+	err = os.WriteFile(filepath.Join(pwd, "prettier.config.js"), []byte("module.exports = {};\n"), 0600)
+	require.NoError(t, err)
+	verbose.Reset()
+	err = fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, filenames,
+		fmtd.WithVerbose(&verbose), fmtd.WithRequireConfig([]string{"vue"}))
+	require.NoError(t, err)
+	files = contextFiles(t, state)
+	require.Contains(t, files, "a/App.vue")
+	require.Contains(t, files, "a/main.go")
+	require.NotContains(t, verbose.String(), "skipped")
+
+	err = fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, filenames, fmtd.WithRequireConfig([]string{".go"}))
+	require.EqualError(t, err, `no configuration file known for ".go" files`)
+}
+
+func TestBatchSize(t *testing.T) {
+	ctx := context.Background()
+	pwd := t.TempDir()
+	state := fakeDocker(t, map[string]string{"stdout": ""})
+
+	var fns []string
+	for i := 0; i < 25; i++ {
+		fn := fmt.Sprintf("%02d.json", i)
+		err := os.WriteFile(filepath.Join(pwd, fn), []byte("{ }"), 0600)
+		require.NoError(t, err)
+		fns = append(fns, fn)
+	}
+
+	err := fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, []string{pwd}, fmtd.WithBatchSize(10))
+	require.NoError(t, err)
+
+	var formatted []string
+	for n, size := range []int{10, 10, 5} {
+		files := contextFilesOf(t, filepath.Join(state, fmt.Sprintf("context.%d.tar", n+1)))
+		require.Contains(t, files, "Dockerfile")
+		delete(files, "Dockerfile")
+		require.Len(t, files, size)
+		for fn := range files {
+			formatted = append(formatted, strings.TrimPrefix(fn, "a/"))
+		}
+	}
+	require.NoFileExists(t, filepath.Join(state, "context.4.tar"))
+	sort.Strings(formatted)
+	require.Equal(t, fns, formatted)
+
+	err = fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, nil, fmtd.WithBatchSize(-1))
+	require.Equal(t, fmtd.ErrNegativeBatchSize, err)
+}
+
+func TestInit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("no git on $PATH")
+	}
+	pwd := t.TempDir()
+	out, err := exec.Command("git", "-C", pwd, "init", "-q").CombinedOutput()
+	require.NoError(t, err, string(out))
+	for fn, contents := range map[string]string{
+		"main.go":         "package main\n",
+		"sub/schema.sql":  "select 1;\n",
+		"sub/notes.txt":   "bla\n",
+		".hidden/some.py": "a=1\n",
+		"vendor.min.json": "{}",
+		"sub/BUILD.bazel": "",
+	} {
+		err := os.MkdirAll(filepath.Join(pwd, filepath.Dir(fn)), 0700)
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(pwd, fn), []byte(contents), 0600)
+		require.NoError(t, err)
+	}
+
+	config, err := fmtd.DetectConfig(pwd)
+	require.NoError(t, err)
+	require.Equal(t, []string{"bazel", "go", "sql"}, config.EnabledLanguages())
+	require.Contains(t, config.Languages, "python")
+	require.False(t, config.Languages["python"])
+
+	err = fmtd.WriteConfig(pwd, config, false)
+	require.NoError(t, err)
+	err = fmtd.WritePreCommitHook(pwd, false)
+	require.NoError(t, err)
+
+	path := filepath.Join(pwd, fmtd.ConfigFilename)
+	loaded, err := fmtd.LoadConfig(path)
+	require.NoError(t, err)
+	require.Equal(t, config, loaded)
+	hook := filepath.Join(pwd, ".git", "hooks", "pre-commit")
+	data, err := os.ReadFile(hook)
+	require.NoError(t, err)
+	require.Equal(t, fmtd.PreCommitHook, string(data))
+	fi, err := os.Stat(hook)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0755), fi.Mode().Perm())
+
+	// Existing files are not overwritten unless forced to
+	err = os.WriteFile(path, []byte("languages: {go: false}\n"), 0644)
+	require.NoError(t, err)
+	err = fmtd.WriteConfig(pwd, config, false)
+	require.True(t, errors.Is(err, fs.ErrExist))
+	err = fmtd.WritePreCommitHook(pwd, false)
+	require.True(t, errors.Is(err, fs.ErrExist))
+	loaded, err = fmtd.LoadConfig(path)
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{"go": false}, loaded.Languages)
+
+	err = fmtd.WriteConfig(pwd, config, true)
+	require.NoError(t, err)
+	loaded, err = fmtd.LoadConfig(path)
+	require.NoError(t, err)
+	require.Equal(t, config, loaded)
+
+	err = os.WriteFile(path, []byte("languages: {cobol: true}\n"), 0644)
+	require.NoError(t, err)
+	_, err = fmtd.LoadConfig(path)
+	require.EqualError(t, err, "parsing "+path+`: unknown language "cobol"`)
+}
+
+func TestFindConfig(t *testing.T) {
+	pwd := t.TempDir()
+	config, err := fmtd.FindConfig(pwd, "")
+	require.NoError(t, err)
+	require.Nil(t, config)
+
+	ci := filepath.Join(t.TempDir(), "ci.yaml")
+	_, err = fmtd.FindConfig(pwd, ci)
+	require.EqualError(t, err, "no configuration file at "+ci)
+
+	err = os.WriteFile(filepath.Join(pwd, fmtd.ConfigFilename), []byte("languages: {go: false}\n"), 0600)
+	require.NoError(t, err)
+	config, err = fmtd.FindConfig(pwd, "")
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{"go": false}, config.Languages)
+
+	// An explicit path wins over $PWD's configuration file
+	err = os.WriteFile(ci, []byte("languages: {sql: false}\n"), 0600)
+	require.NoError(t, err)
+	config, err = fmtd.FindConfig(pwd, ci)
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{"sql": false}, config.Languages)
+
+	err = os.WriteFile(ci, []byte("languages: [sql]\n"), 0600)
+	require.NoError(t, err)
+	_, err = fmtd.FindConfig(pwd, ci)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "parsing "+ci+": ")
+}
+
+func TestConfigDisablesLanguages(t *testing.T) {
+	ctx := context.Background()
+	pwd := t.TempDir()
+	state := fakeDocker(t, map[string]string{"stdout": ""})
+
+	for _, fn := range []string{"main.go", "schema.sql"} {
+		err := os.WriteFile(filepath.Join(pwd, fn), []byte("x\n"), 0600)
+		require.NoError(t, err)
+	}
+
+	var verbose bytes.Buffer
+	config := &fmtd.Config{Languages: map[string]bool{"go": true, "sql": false}}
+	err := fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, []string{pwd},
+		fmtd.WithVerbose(&verbose), fmtd.WithConfig(config))
+	require.NoError(t, err)
+	files := contextFiles(t, state)
+	require.Contains(t, files, "a/main.go")
+	require.NotContains(t, files, "a/schema.sql")
+	require.Contains(t, verbose.String(), "fmtd: skipped schema.sql (sql disabled in .fmtd.yaml)\n")
+}
+
+func TestConfigPrepare(t *testing.T) {
+	ctx := context.Background()
+	pwd := t.TempDir()
+	t.Setenv("PATH", t.TempDir()) // no docker to be found
+
+	path := filepath.Join(pwd, fmtd.ConfigFilename)
+	err := os.WriteFile(path, []byte("prepare:\n  sql: echo prepared sql\n  go: |\n    echo prepared\n    echo go\n"), 0600)
+	require.NoError(t, err)
+	config, err := fmtd.LoadConfig(path)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"sql": "echo prepared sql", "go": "echo prepared\necho go\n"}, config.Prepare)
+
+	main := filepath.Join(pwd, "main.go")
+	err = os.WriteFile(main, []byte("package main\n"), 0600)
+	require.NoError(t, err)
+	var dockerfile bytes.Buffer
+	err = fmtd.Fmt(ctx, pwd, false, io.Discard, io.Discard, []string{main},
+		fmtd.WithConfig(config), fmtd.WithDumpDockerfile(&dockerfile))
+	require.NoError(t, err)
+	require.Contains(t, dockerfile.String(), "\n# prepare go, per .fmtd.yaml\nRUN <<\"PREPARE_GO\"\nset -eux\necho prepared\necho go\nPREPARE_GO\nCOPY a /app/a/\n")
+	require.NotContains(t, dockerfile.String(), "prepared sql")
+
+	// Only run for the languages of the files being formatted
+	dockerfile.Reset()
+	err = fmtd.Fmt(ctx, pwd, false, io.Discard, io.Discard, []string{main},
+		fmtd.WithConfig(&fmtd.Config{Prepare: config.Prepare, Languages: map[string]bool{"go": false}}),
+		fmtd.WithDumpDockerfile(&dockerfile))
+	require.NoError(t, err)
+	require.NotContains(t, dockerfile.String(), "prepare")
+
+	err = os.WriteFile(path, []byte("prepare: {cobol: echo}\n"), 0600)
+	require.NoError(t, err)
+	_, err = fmtd.LoadConfig(path)
+	require.EqualError(t, err, "parsing "+path+`: unknown language "cobol" to prepare`)
+}
+
+func TestSkipGenerated(t *testing.T) {
+	ctx := context.Background()
+	pwd := t.TempDir()
+	state := fakeDocker(t, map[string]string{"stdout": ""})
+
+	for fn, data := range map[string]string{
+		"main.go":     "package main\n" + strings.Repeat("\n", 10) + "// Code generated by hand. DO NOT EDIT.\n", // not a header
+		"api.pb.go":   "// Code generated by protoc-gen-go. DO NOT EDIT.\n// source: api.proto\n\npackage api\n",
+		"schema.json": "{}\n",
+	} {
+		err := os.WriteFile(filepath.Join(pwd, fn), []byte(data), 0600)
+		require.NoError(t, err)
+	}
+
+	var verbose bytes.Buffer
+	err := fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, []string{pwd},
+		fmtd.WithVerbose(&verbose), fmtd.WithSkipGenerated(fmtd.DefaultGeneratedPatterns))
+	require.NoError(t, err)
+	files := contextFiles(t, state)
+	require.Contains(t, files, "a/main.go")
+	require.Contains(t, files, "a/schema.json")
+	require.NotContains(t, files, "a/api.pb.go")
+	require.Contains(t, verbose.String(), "fmtd: skipped api.pb.go (generated, per ^// Code generated .* DO NOT EDIT\\.$)\n")
+
+	// Off by default
+	err = fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, []string{pwd})
+	require.NoError(t, err)
+	require.Contains(t, contextFiles(t, state), "a/api.pb.go")
+
+	err = fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, []string{pwd}, fmtd.WithSkipGenerated([]string{"("}))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `bad generated code pattern "("`)
+}
+
+func TestSkippedSummary(t *testing.T) {
+	ctx := context.Background()
+	pwd := t.TempDir()
+	fakeDocker(t, map[string]string{"stdout": ""})
+
+	for fn, data := range map[string]string{
+		"main.go":     "package main\n",
+		"api.pb.go":   "// Code generated by protoc-gen-go. DO NOT EDIT.\npackage api\n",
+		"a.min.json":  "{}\n",
+		"b.min.json":  "{}\n",
+		"schema.sql":  "select 1\n",
+		"big.json":    strings.Repeat(" ", 100) + "{}\n",
+		"notes.xyz":   "bla\n",
+		"notes2.xyz":  "bla\n",
+		"notes3.xyz":  "bla\n",
+		"Dockerfile2": "FROM x\n",
+	} {
+		err := os.WriteFile(filepath.Join(pwd, fn), []byte(data), 0600)
+		require.NoError(t, err)
+	}
+	opts := []fmtd.Option{
+		fmtd.WithSkipPatterns(fmtd.DefaultSkipPatterns),
+		fmtd.WithSkipGenerated(fmtd.DefaultGeneratedPatterns),
+		fmtd.WithDisabledLanguages([]string{"sql"}),
+		fmtd.WithMaxFileSize(64),
+	}
+
+	var stderr bytes.Buffer
+	err := fmtd.Fmt(ctx, pwd, true, io.Discard, &stderr, []string{pwd}, opts...)
+	require.NoError(t, err)
+	require.Equal(t, ""+
+		"fmtd: skipped 9 files:\n"+
+		"  4 no formatter\n"+
+		"  2 matches *.min.json\n"+
+		"  1 generated, per ^// Code generated .* DO NOT EDIT\\.$\n"+
+		"  1 larger than 64 bytes\n"+
+		"  1 sql disabled\n",
+		stderr.String())
+
+	var stdout bytes.Buffer
+	stderr.Reset()
+	err = fmtd.Fmt(ctx, pwd, true, &stdout, &stderr, []string{pwd}, append(opts, fmtd.WithJSON(true))...)
+	require.NoError(t, err)
+	require.Empty(t, stderr.String())
+	require.Equal(t, `{"summary":{"files":1,"changed":0,"failed":0,"outcome":"formatted","skipped":[`+
+		`{"reason":"no formatter","count":4,"paths":["Dockerfile2","notes.xyz","notes2.xyz","notes3.xyz"]},`+
+		`{"reason":"matches *.min.json","count":2,"paths":["a.min.json","b.min.json"]},`+
+		`{"reason":"generated, per ^// Code generated .* DO NOT EDIT\\.$","count":1,"paths":["api.pb.go"]},`+
+		`{"reason":"larger than 64 bytes","count":1,"paths":["big.json"]},`+
+		`{"reason":"sql disabled","count":1,"paths":["schema.sql"]}]}}`+"\n",
+		stdout.String())
+
+	// Quiet runs report nothing
+	stderr.Reset()
+	err = fmtd.Fmt(ctx, pwd, true, io.Discard, &stderr, []string{pwd}, append(opts, fmtd.WithQuiet(true))...)
+	require.NoError(t, err)
+	require.Empty(t, stderr.String())
+}
+
+func TestIncludeHidden(t *testing.T) {
+	ctx := context.Background()
+	pwd := t.TempDir()
+	state := fakeDocker(t, map[string]string{"stdout": ""})
+
+	for _, fn := range []string{".github/workflows/ci.yml", ".github/renovate.json", ".gitignore", ".git/hooks.json", "main.go"} {
+		err := os.MkdirAll(filepath.Join(pwd, filepath.Dir(fn)), 0700)
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(pwd, fn), []byte("x\n"), 0600)
+		require.NoError(t, err)
+	}
+
+	err := fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, []string{pwd})
+	require.NoError(t, err)
+	files := contextFiles(t, state)
+	require.Contains(t, files, "a/main.go")
+	require.NotContains(t, files, "a/.github/renovate.json")
+
+	err = fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, []string{pwd}, fmtd.WithIncludeHidden([]string{".github/**"}))
+	require.NoError(t, err)
+	files = contextFiles(t, state)
+	require.Contains(t, files, "a/main.go")
+	require.Contains(t, files, "a/.github/renovate.json")
+	require.Contains(t, files, "a/.github/workflows/ci.yml")
+	require.NotContains(t, files, "a/.gitignore")
+	require.NotContains(t, files, "a/.git/hooks.json")
+
+	paths, err := fmtd.SelectFiles(pwd, []string{pwd}, fmtd.WithIncludeHidden([]string{"**"}))
+	require.NoError(t, err)
+	for i := range paths {
+		paths[i], err = filepath.Rel(pwd, paths[i])
+		require.NoError(t, err)
+	}
+	require.Equal(t, []string{".github/renovate.json", ".github/workflows/ci.yml", ".gitignore", "main.go"}, paths)
+}
+
+func TestDisabledLanguages(t *testing.T) {
+	ctx := context.Background()
+	pwd := t.TempDir()
+	state := fakeDocker(t, map[string]string{"stdout": ""})
+
+	for _, fn := range []string{"main.go", "schema.sql", "Cargo.toml"} {
+		err := os.WriteFile(filepath.Join(pwd, fn), []byte("x\n"), 0600)
+		require.NoError(t, err)
+	}
+
+	var verbose bytes.Buffer
+	config := &fmtd.Config{Languages: map[string]bool{"toml": false}}
+	err := fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, []string{pwd},
+		fmtd.WithVerbose(&verbose), fmtd.WithConfig(config), fmtd.WithDisabledLanguages([]string{"sql"}))
+	require.NoError(t, err)
+	files := contextFiles(t, state)
+	require.Contains(t, files, "a/main.go")
+	require.NotContains(t, files, "a/schema.sql")
+	require.NotContains(t, files, "a/Cargo.toml")
+	require.Contains(t, verbose.String(), "fmtd: skipped schema.sql (sql disabled)\n")
+	require.Contains(t, verbose.String(), "fmtd: skipped Cargo.toml (toml disabled in .fmtd.yaml)\n")
+
+	err = fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, nil, fmtd.WithDisabledLanguages([]string{"cobol"}))
+	require.EqualError(t, err, `unknown language "cobol"`)
+}
+
+func TestBlankFilesLeftAlone(t *testing.T) {
+	ctx := context.Background()
+	pwd := t.TempDir()
+	state := fakeDocker(t, map[string]string{"stdout": "F b.go\n", "b/b.go": "package b\n"})
+
+	for fn, contents := range map[string]string{
+		"empty.json":  "",
+		"empty.go":    "",
+		"empty.py":    "",
+		"spaces.go":   " \n\t\r\n\n",
+		"b.go":        "package     b\n",
+		"unknown.xyz": "",
+	} {
+		err := os.WriteFile(filepath.Join(pwd, fn), []byte(contents), 0600)
+		require.NoError(t, err)
+	}
+
+	var stdout bytes.Buffer
+	var results []fmtd.Result
+	var summary fmtd.Summary
+	err := fmtd.Fmt(ctx, pwd, true, &stdout, io.Discard, []string{pwd},
+		fmtd.WithWarnUnhandled(true),
+		fmtd.WithResultFunc(func(r fmtd.Result) { results = append(results, r) }),
+		fmtd.WithSummaryFunc(func(s fmtd.Summary) { summary = s }))
+	require.Equal(t, fmtd.ErrDryRunFoundFiles, err)
+	files := contextFiles(t, state)
+	require.Len(t, files, 3)
+	require.Contains(t, files, "a/b.go")
+	require.Contains(t, files, "a/unknown.xyz")
+	require.Equal(t, []fmtd.Result{{Path: "b.go", Status: fmtd.StatusChanged}}, results)
+	require.Equal(t, "b.go\n", stdout.String())
+	require.Equal(t, 5, summary.Files)
+	require.Equal(t, 1, summary.Changed)
+
+	// No build when all files are blank
+	state = fakeDocker(t, map[string]string{"stdout": ""})
+	err = fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, []string{filepath.Join(pwd, "empty.go"), filepath.Join(pwd, "spaces.go")})
+	require.NoError(t, err)
+	require.NoFileExists(t, filepath.Join(state, "context.tar"))
+}
+
+func TestCompileCommands(t *testing.T) {
+	ctx := context.Background()
+	pwd := t.TempDir()
+	state := fakeDocker(t, map[string]string{"stdout": ""})
+
+	for _, fn := range []string{"src/a.cc", "src/main.cpp", "src/a.h", "gen/g.cc", "third_party/t.cc", "build/x"} {
+		err := os.MkdirAll(filepath.Join(pwd, filepath.Dir(fn)), 0700)
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(pwd, fn), []byte("int  a;\n"), 0600)
+		require.NoError(t, err)
+	}
+	err := fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, []string{pwd}, fmtd.WithCompileCommands(true))
+	require.True(t, errors.Is(err, fs.ErrNotExist))
+
+	db := `[
+  {"directory": "` + filepath.Join(pwd, "build") + `", "file": "../src/a.cc", "command": "c++ -c ../src/a.cc"},
+  {"directory": "` + pwd + `", "file": "` + filepath.Join(pwd, "src", "main.cpp") + `", "arguments": ["c++", "-c", "src/main.cpp"]}
+]`
+	err = os.WriteFile(filepath.Join(pwd, "compile_commands.json"), []byte(db), 0600)
+	require.NoError(t, err)
+
+	var verbose bytes.Buffer
+	err = fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, []string{pwd},
+		fmtd.WithVerbose(&verbose), fmtd.WithCompileCommands(true))
+	require.NoError(t, err)
+	files := contextFiles(t, state)
+	require.Len(t, files, 3)
+	require.Contains(t, files, "a/src/a.cc")
+	require.Contains(t, files, "a/src/main.cpp")
+	require.Contains(t, verbose.String(), "fmtd: skipped gen/g.cc (not in compile_commands.json)\n")
+	require.Contains(t, verbose.String(), "fmtd: skipped third_party/t.cc (not in compile_commands.json)\n")
+
+	// Given files too
+	err = fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard,
+		[]string{filepath.Join(pwd, "src", "a.h"), filepath.Join(pwd, "src", "a.cc")}, fmtd.WithCompileCommands(true))
+	require.NoError(t, err)
+	files = contextFiles(t, state)
+	require.Len(t, files, 2)
+	require.Contains(t, files, "a/src/a.cc")
+}
+
+func TestFailUnhandled(t *testing.T) {
+	ctx := context.Background()
+	pwd := t.TempDir()
+	for _, fn := range []string{"a.go", "notes.xyz", "sub/b.go", "sub/data.xyz"} {
+		err := os.MkdirAll(filepath.Join(pwd, filepath.Dir(fn)), 0700)
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(pwd, fn), []byte("x\n"), 0600)
+		require.NoError(t, err)
+	}
+
+	// Given explicitly
+	state := fakeDocker(t, map[string]string{"stdout": ""})
+	err := fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard,
+		[]string{filepath.Join(pwd, "a.go"), filepath.Join(pwd, "notes.xyz")}, fmtd.WithFailUnhandled(true))
+	require.True(t, errors.Is(err, fmtd.ErrUnhandledFile))
+	require.EqualError(t, err, fmt.Sprintf("no formatter handles file: %q", filepath.Join(pwd, "notes.xyz")))
+	require.NoFileExists(t, filepath.Join(state, "context.tar"))
+
+	// Found by walking directories
+	err = fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard,
+		[]string{filepath.Join(pwd, "a.go"), filepath.Join(pwd, "sub")}, fmtd.WithFailUnhandled(true))
+	require.NoError(t, err)
+	files := contextFiles(t, state)
+	require.Contains(t, files, "a/sub/data.xyz")
+
+	// Only with the option
+	err = fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, []string{filepath.Join(pwd, "notes.xyz")})
+	require.NoError(t, err)
+}
+
+func TestDetectLanguage(t *testing.T) {
+	ctx := context.Background()
+	pwd := t.TempDir()
+
+	for fn, contents := range map[string]string{
+		"manage":        "#!/usr/bin/env python3\nimport sys\n",
+		"bin/Configure": "#!/bin/sh\nset -e\n",
+		"it's":          "#!/bin/bash\n",
+		"NOTES":         "Nothing to see\n",
+		"main.go":       "#!/bin/sh\n",
+	} {
+		err := os.MkdirAll(filepath.Join(pwd, filepath.Dir(fn)), 0700)
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(pwd, fn), []byte(contents), 0600)
+		require.NoError(t, err)
+	}
+
+	state := fakeDocker(t, map[string]string{"stdout": ""})
+	err := fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, nil)
+	require.NoError(t, err)
+	dockerfile := contextFiles(t, state)["Dockerfile"]
+	require.NotContains(t, dockerfile, "detected")
+	require.NotContains(t, dockerfile, "yapf")
+
+	state = fakeDocker(t, map[string]string{"stdout": ""})
+	var verbose bytes.Buffer
+	err = fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, nil, fmtd.WithDetectLanguage(true), fmtd.WithVerbose(&verbose))
+	require.NoError(t, err)
+	dockerfile = contextFiles(t, state)["Dockerfile"]
+	require.Contains(t, dockerfile, "      # Python, detected\n        'manage') { yapf ")
+	require.Contains(t, dockerfile, "      # Shell, detected\n        'bin/configure'|'it'\\''s') { shfmt ")
+	require.Contains(t, dockerfile, "      # Go\n")
+	require.NotContains(t, dockerfile, "notes")
+	require.Contains(t, verbose.String(), "fmtd: detected manage as python\n")
+	require.Contains(t, verbose.String(), "fmtd: detected "+filepath.Join("bin", "Configure")+" as shell\n")
+}
+
+func TestCollectSelectionErrors(t *testing.T) {
+	ctx := context.Background()
+	pwd := t.TempDir()
+	state := fakeDocker(t, map[string]string{"stdout": "F good.json\n", "b/good.json": "{}\n"})
+
+	good := filepath.Join(pwd, "good.json")
+	err := os.WriteFile(good, []byte("{ }\n"), 0600)
+	require.NoError(t, err)
+	filenames := []string{filepath.Join(pwd, "missing.json"), good}
+
+	err = fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, filenames)
+	require.EqualError(t, err, `unusable file "`+filenames[0]+`" (no such file or directory)`)
+	require.NoFileExists(t, filepath.Join(state, "context.tar"))
+
+	var stdout bytes.Buffer
+	err = fmtd.Fmt(ctx, pwd, false, &stdout, io.Discard, filenames, fmtd.WithCollectSelectionErrors(true))
+	require.EqualError(t, err, `unusable file "`+filenames[0]+`" (no such file or directory)`)
+	var errs buildx.SelectionErrors
+	require.True(t, errors.As(err, &errs))
+	require.Equal(t, "good.json\n", stdout.String())
+	data, err := os.ReadFile(good)
+	require.NoError(t, err)
+	require.Equal(t, "{}\n", string(data))
+}
+
+func TestFormatterSettings(t *testing.T) {
+	ctx := context.Background()
+
+	for name, tc := range map[string]struct {
+		env      map[string]string
+		opts     []fmtd.Option
+		filename string
+		contents string
+		check    func(t *testing.T, formatted string)
+	}{
+		"sql_defaults": {
+			filename: "q.sql",
+			contents: "select a, b from t where a = 1\n",
+			check: func(t *testing.T, formatted string) {
+				require.Contains(t, formatted, "SELECT")
+				require.Regexp(t, regexp.MustCompile(`(?m)^\s*, b$`), formatted)
+			},
+		},
+		"sql_comma_last_lowercase": {
+			env:      map[string]string{"ARG_SQL_COMMA_FIRST": "False", "ARG_SQL_KEYWORD_CASE": "lower"},
+			filename: "q.sql",
+			contents: "SELECT a, b FROM t WHERE a = 1\n",
+			check: func(t *testing.T, formatted string) {
+				require.NotContains(t, formatted, "SELECT")
+				require.Contains(t, formatted, "select")
+				require.Regexp(t, regexp.MustCompile(`(?m)a,$`), formatted)
+				require.NotRegexp(t, regexp.MustCompile(`(?m)^\s*,`), formatted)
+			},
+		},
+		"objc_style": {
+			env:      map[string]string{"ARG_OBJC_STYLE": "WebKit"},
+			filename: "x.m",
+			contents: "int f(){if(1){return 1;}return 0;}\n",
+			check: func(t *testing.T, formatted string) {
+				// WebKit indents with 4 spaces and puts function braces on their own line, unlike google
+				require.Contains(t, formatted, "int f()\n{\n")
+				require.Contains(t, formatted, "\n    return 0;\n}\n")
+			},
+		},
+		"c_ignores_objc_style": {
+			env:      map[string]string{"ARG_OBJC_STYLE": "WebKit"},
+			filename: "x.c",
+			contents: "int f(){if(1){return 1;}return 0;}\n",
+			check: func(t *testing.T, formatted string) {
+				require.Contains(t, formatted, "int f() {\n")
+				require.Contains(t, formatted, "\n  return 0;\n}\n")
+			},
+		},
+		"shell_bash_4_spaces": {
+			env:      map[string]string{"ARG_SHFMT_LANG": "bash", "ARG_SHFMT_INDENT": "4"},
+			filename: "s.sh",
+			contents: "if [[ -n $a ]]; then\necho \"$a\"\nfi\n",
+			check: func(t *testing.T, formatted string) {
+				require.Equal(t, "if [[ -n $a ]]; then\n    echo \"$a\"\nfi\n", formatted)
+			},
+		},
+		"shell_keeps_shebang": {
+			filename: "s.sh",
+			contents: "#!/usr/bin/env -S bash -e\na=1;b=2\n",
+			check: func(t *testing.T, formatted string) {
+				require.Equal(t, "#!/usr/bin/env -S bash -e\na=1\nb=2\n", formatted)
+			},
+		},
+		"bazel_module": {
+			filename: "MODULE.bazel",
+			contents: "module(name='x',version='1.0')\nbazel_dep(name = \"rules_go\", version = \"0.50.1\")\n",
+			check: func(t *testing.T, formatted string) {
+				require.Contains(t, formatted, `name = "x"`)
+				require.Contains(t, formatted, `version = "1.0"`)
+				require.Contains(t, formatted, `bazel_dep(name = "rules_go", version = "0.50.1")`)
+			},
+		},
+		"bazel_build": {
+			filename: "BUILD.bazel",
+			contents: "cc_library(name='x',srcs=['b.cc','a.cc'])\n",
+			check: func(t *testing.T, formatted string) {
+				require.Contains(t, formatted, `name = "x"`)
+				require.Regexp(t, regexp.MustCompile(`(?s)"a\.cc",.*"b\.cc"`), formatted)
+			},
+		},
+		"proto_defaults": {
+			filename: "p.proto",
+			contents: "message   Bla  {int32 f = 42;}\n",
+			check: func(t *testing.T, formatted string) {
+				require.Equal(t, "message Bla {\n  int32 f = 42;\n}\n", formatted)
+			},
+		},
+		"proto_4_spaces": {
+			env:      map[string]string{"ARG_PROTO_INDENT": "4"},
+			filename: "p.proto",
+			contents: "message   Bla  {int32 f = 42;}\n",
+			check: func(t *testing.T, formatted string) {
+				require.Equal(t, "message Bla {\n    int32 f = 42;\n}\n", formatted)
+			},
+		},
+		"proto_imports_in_place": {
+			filename: "p.proto",
+			contents: "syntax = \"proto3\";\nimport \"z.proto\";\nimport \"a.proto\";\nmessage   Bla  {int32 f = 42;}\n",
+			check: func(t *testing.T, formatted string) {
+				require.Equal(t, "syntax = \"proto3\";\nimport \"z.proto\";\nimport \"a.proto\";\nmessage Bla {\n  int32 f = 42;\n}\n", formatted)
+			},
+		},
+		"jsonc_tsconfig_keeps_comments": {
+			filename: "tsconfig.json",
+			contents: "{\n  // Compile for modern runtimes\n  \"compilerOptions\": {\"target\":\"es2022\", /* strictly */ \"strict\": true,},\n}\n",
+			check: func(t *testing.T, formatted string) {
+				require.Contains(t, formatted, "// Compile for modern runtimes")
+				require.Contains(t, formatted, "/* strictly */")
+				require.Contains(t, formatted, `"target": "es2022"`)
+			},
+		},
+		"json5_keeps_comments": {
+			filename: "config.json5",
+			contents: "// settings\n{a:1,\n b: 'two', // inline\n}\n",
+			check: func(t *testing.T, formatted string) {
+				require.Contains(t, formatted, "// settings")
+				require.Contains(t, formatted, "// inline")
+			},
+		},
+		"dprint_json": {
+			opts:     []fmtd.Option{fmtd.WithDprint([]string{"json"})},
+			filename: "a.json",
+			contents: `{"b":1,  "a": [1,2]}`,
+			check: func(t *testing.T, formatted string) {
+				require.Contains(t, formatted, `"b": 1,`)
+				require.Contains(t, formatted, `"a": [1, 2]`)
+			},
+		},
+		"dprint_toml": {
+			opts:     []fmtd.Option{fmtd.WithDprint([]string{"toml"})},
+			filename: "a.toml",
+			contents: "[a]\nb=1 # keep me\n",
+			check: func(t *testing.T, formatted string) {
+				require.Contains(t, formatted, "b = 1 # keep me\n")
+			},
+		},
+		"toml_keeps_comments": {
+			filename: "Cargo.toml",
+			contents: "# The package\n[package]\nname=\"x\" # inline\n",
+			check: func(t *testing.T, formatted string) {
+				require.Equal(t, "# The package\n[package]\nname = \"x\" # inline\n", formatted)
+			},
+		},
+		"toml_expands_long_arrays": {
+			filename: "a.toml",
+			contents: "a = [" + strings.Repeat(`"abcdefghij", `, 8) + "]\n",
+			check: func(t *testing.T, formatted string) {
+				require.Contains(t, formatted, "a = [\n  \"abcdefghij\",\n")
+			},
+		},
+		"toml_compact_arrays": {
+			env:      map[string]string{"ARG_TOML_ARRAY_AUTO_EXPAND": "false"},
+			filename: "a.toml",
+			contents: "a = [" + strings.Repeat(`"abcdefghij", `, 8) + "]\n",
+			check: func(t *testing.T, formatted string) {
+				require.Equal(t, "a = ["+strings.TrimSuffix(strings.Repeat(`"abcdefghij", `, 8), ", ")+"]\n", formatted)
+			},
+		},
+		"toml_4_spaces_aligned": {
+			env:      map[string]string{"ARG_TOML_INDENT": "4", "ARG_TOML_ALIGN_ENTRIES": "true"},
+			filename: "a.toml",
+			contents: "a = [" + strings.Repeat(`"abcdefghij", `, 8) + "]\n[t]\nx=1\nlonger=2\n",
+			check: func(t *testing.T, formatted string) {
+				require.Contains(t, formatted, "a = [\n    \"abcdefghij\",\n")
+				require.Contains(t, formatted, "x      = 1\nlonger = 2\n")
+			},
+		},
+		"css_properties_untouched": {
+			opts:     []fmtd.Option{fmtd.WithConfig(&fmtd.Config{Languages: map[string]bool{"css": true}})},
+			filename: "a.css",
+			contents: "a{color:red;background:blue}\n",
+			check: func(t *testing.T, formatted string) {
+				require.Equal(t, "a {\n  color: red;\n  background: blue;\n}\n", formatted)
+			},
+		},
+		"css_properties_alphabetical": {
+			opts:     []fmtd.Option{fmtd.WithSortCSSProperties(true)},
+			filename: "a.scss",
+			contents: "$c: red;\na{color:$c;background:blue;display:block}\n",
+			check: func(t *testing.T, formatted string) {
+				require.Contains(t, formatted, "  background: blue;\n  color: $c;\n  display: block;\n")
+			},
+		},
+		"css_properties_concentric": {
+			env:      map[string]string{"ARG_CSS_PROPERTIES_ORDER": "concentric"},
+			opts:     []fmtd.Option{fmtd.WithSortCSSProperties(true)},
+			filename: "a.css",
+			contents: "a{color:red;background:blue;display:block}\n",
+			check: func(t *testing.T, formatted string) {
+				require.Regexp(t, regexp.MustCompile(`(?s)display: block;.*background: blue;.*color: red;`), formatted)
+			},
+		},
+		"hcl_keeps_heredocs": {
+			filename: "main.tf",
+			contents: "locals {\na=1\n  # why\n  bb = <<-EOT\n    as   is\n  EOT\n}\n",
+			check: func(t *testing.T, formatted string) {
+				require.Equal(t, "locals {\n  a = 1\n  # why\n  bb = <<-EOT\n    as   is\n  EOT\n}\n", formatted)
+			},
+		},
+		"packer_template": {
+			filename: "image.pkr.hcl",
+			contents: "build {\nsources=[\"source.null.x\"]\n}\n",
+			check: func(t *testing.T, formatted string) {
+				require.Equal(t, "build {\n  sources = [\"source.null.x\"]\n}\n", formatted)
+			},
+		},
+		"textproto_keeps_order": {
+			filename: "data.txtpb",
+			contents: "b:1\n# about a\na:  2\nb:3\n",
+			check: func(t *testing.T, formatted string) {
+				require.Equal(t, "b: 1\n# about a\na: 2\nb: 3\n", formatted)
+			},
+		},
+		"cleanup_text": {
+			opts:     []fmtd.Option{fmtd.WithUniversalCleanup(true)},
+			filename: "notes.txt",
+			contents: "some  \r\nnotes\t\n\nend ",
+			check: func(t *testing.T, formatted string) {
+				require.Equal(t, "some  \r\nnotes\n\nend\n", formatted)
+			},
+		},
+		"cleanup_binary": {
+			opts:     []fmtd.Option{fmtd.WithUniversalCleanup(true)},
+			filename: "blob.bin",
+			contents: "\x00\x01 \n\x02 ",
+			check: func(t *testing.T, formatted string) {
+				require.Equal(t, "\x00\x01 \n\x02 ", formatted)
+			},
+		},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			pwd := t.TempDir()
+			path := filepath.Join(pwd, tc.filename)
+			err := os.WriteFile(path, []byte(tc.contents), 0600)
+			require.NoError(t, err)
+
+			err = fmtd.Fmt(ctx, pwd, false, io.Discard, newTestingLogWriter(t, "STDERR"), []string{path}, tc.opts...)
+			require.NoError(t, err)
+			data, err := os.ReadFile(path)
+			require.NoError(t, err)
+			tc.check(t, string(data))
+		})
+	}
+}
+
+func TestDumpDockerfile(t *testing.T) {
+	ctx := context.Background()
+	pwd := t.TempDir()
+	t.Setenv("PATH", t.TempDir()) // no docker to be found
+	t.Setenv("ARG_SQL_COMMA_FIRST", "False")
+	t.Setenv("ARG_FORMATTER_THREADS", "8")
+	t.Setenv("ARG_UNKNOWN", "bla")
+
+	path := filepath.Join(pwd, "q.sql")
+	err := os.WriteFile(path, []byte("select 1\n"), 0600)
+	require.NoError(t, err)
+
+	var dockerfile bytes.Buffer
+	err = fmtd.Fmt(ctx, pwd, false, io.Discard, io.Discard, []string{path}, fmtd.WithDumpDockerfile(&dockerfile))
+	require.NoError(t, err)
+	for _, stage := range []string{"\nFROM alpine AS tool\n", "\nFROM tool AS product\n", "\nFROM scratch\n"} {
+		require.Contains(t, dockerfile.String(), stage)
+	}
+	require.Contains(t, dockerfile.String(), "\nARG SQL_COMMA_FIRST=False\n")
+	require.Contains(t, dockerfile.String(), "\nARG SQL_KEYWORD_CASE=upper\n")
+	require.Contains(t, dockerfile.String(), "\nARG FORMATTER_THREADS=8\nENV GOMAXPROCS=$FORMATTER_THREADS DPRINT_MAX_THREADS=$FORMATTER_THREADS\n")
+	require.NotContains(t, dockerfile.String(), "UNKNOWN")
+	require.Contains(t, dockerfile.String(), `echo "! $f"`)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "select 1\n", string(data))
+}
+
+func TestWarnUnhandled(t *testing.T) {
+	ctx := context.Background()
+	pwd := t.TempDir()
+	path := filepath.Join(pwd, "some.xyz")
+	err := os.WriteFile(path, []byte("bla"), 0600)
+	require.NoError(t, err)
+
+	const complaining = `echo "! $f" >>../stdout`
+	for _, tc := range []struct {
+		filenames []string
+		warn      bool
+		complains bool
+	}{
+		{filenames: []string{path}, warn: false, complains: true},
+		{filenames: []string{path}, warn: true, complains: true},
+		{filenames: []string{pwd}, warn: false, complains: false},
+		{filenames: []string{pwd}, warn: true, complains: true},
+	} {
+		var dockerfile bytes.Buffer
+		err := fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, tc.filenames,
+			fmtd.WithDumpDockerfile(&dockerfile), fmtd.WithWarnUnhandled(tc.warn))
+		require.NoError(t, err)
+		if tc.complains {
+			require.Contains(t, dockerfile.String(), complaining, tc)
+		} else {
+			require.NotContains(t, dockerfile.String(), complaining, tc)
+		}
+	}
+}
+
+func TestPostProcess(t *testing.T) {
+	ctx := context.Background()
+	pwd := t.TempDir()
+	fakeDocker(t, map[string]string{"stdout": "F x.go\n", "b/x.go": "package x"})
+
+	path := filepath.Join(pwd, "x.go")
+	err := os.WriteFile(path, []byte("package    x"), 0600)
+	require.NoError(t, err)
+
+	var seen []string
+	err = fmtd.Fmt(ctx, pwd, false, io.Discard, io.Discard, []string{path},
+		fmtd.WithPostProcess(func(path string, formatted []byte) ([]byte, error) {
+			seen = append(seen, path)
+			return append(formatted, '\n'), nil
+		}),
+		fmtd.WithPostProcess(func(path string, formatted []byte) ([]byte, error) {
+			return append([]byte("// Code owned by us.\n\n"), formatted...), nil
+		}),
+	)
+	require.NoError(t, err)
+	require.Equal(t, []string{"x.go"}, seen)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "// Code owned by us.\n\npackage x\n", string(data))
+
+	err = fmtd.Fmt(ctx, pwd, false, io.Discard, io.Discard, []string{path},
+		fmtd.WithPostProcess(func(path string, formatted []byte) ([]byte, error) {
+			return nil, errors.New("no license header")
+		}),
+	)
+	require.EqualError(t, err, "no license header")
+}
+
+func TestEnsureReadable(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can read unreadable files")
+	}
+	ctx := context.Background()
+	pwd := t.TempDir()
+	state := fakeDocker(t, map[string]string{"stdout": ""})
+
+	path := filepath.Join(pwd, "secret.json")
+	err := os.WriteFile(path, []byte("{ }"), 0000)
+	require.NoError(t, err)
+
+	for _, filenames := range [][]string{{path}, {pwd}} {
+		err = fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, filenames)
+		require.EqualError(t, err, `unusable file "`+path+`" (permission denied)`)
+		require.NoFileExists(t, filepath.Join(state, "context.tar"))
+	}
+}
+
+func TestSyntaxDirective(t *testing.T) {
+	ctx := context.Background()
+	pwd := t.TempDir()
+
+	var dockerfile bytes.Buffer
+	err := fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, nil, fmtd.WithDumpDockerfile(&dockerfile))
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(dockerfile.String(), "# syntax=docker.io/docker/dockerfile:1@sha256:"))
+
+	for _, ref := range []string{
+		"mirror.corp.example:5000/docker/dockerfile:1.4",
+		"docker/dockerfile@sha256:443aab4ca21183e069e7d8b2dc68006594f40bddf1b15bbd83f5137bd93e80e2",
+		"localhost/dockerfile",
+	} {
+		dockerfile.Reset()
+		err = fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, nil,
+			fmtd.WithDumpDockerfile(&dockerfile), fmtd.WithSyntaxDirective(ref))
+		require.NoError(t, err)
+		require.True(t, strings.HasPrefix(dockerfile.String(), "# syntax="+ref+"\n"), ref)
+		require.Equal(t, 1, strings.Count(dockerfile.String(), "# syntax="))
+	}
+
+	for _, ref := range []string{"", "Docker/Dockerfile", "dockerfile:1\nRUN rm -rf /", "a@sha256:42", "a:-tag"} {
+		err = fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, nil, fmtd.WithSyntaxDirective(ref))
+		require.True(t, errors.Is(err, fmtd.ErrInvalidImageReference), ref)
+	}
+}
+
+func TestPull(t *testing.T) {
+	ctx := context.Background()
+	pwd := t.TempDir()
+	state := fakeDocker(t, map[string]string{"stdout": ""})
+
+	for _, pull := range []bool{false, true} {
+		err := fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, nil, fmtd.WithPull(pull))
+		require.NoError(t, err)
+		args, err := os.ReadFile(filepath.Join(state, "args"))
+		require.NoError(t, err)
+		require.Equal(t, pull, strings.Contains(string(args), " --pull "), string(args))
+	}
+}
+
+func TestSelectFiles(t *testing.T) {
+	t.Setenv("PATH", t.TempDir()) // no docker to be found
+	pwd := t.TempDir()
+	for fn, contents := range map[string]string{
+		"a.go":           "package a",
+		"sub/b.json":     "{}",
+		"sub/c.min.js":   "a()",
+		".hidden/d.json": "{}",
+	} {
+		err := os.MkdirAll(filepath.Join(pwd, filepath.Dir(fn)), 0700)
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(pwd, fn), []byte(contents), 0600)
+		require.NoError(t, err)
+	}
+	err := os.Symlink("a.go", filepath.Join(pwd, "sym.go"))
+	require.NoError(t, err)
+	at := func(fn string) string { return filepath.Join(pwd, fn) }
+
+	paths, err := fmtd.SelectFiles(pwd, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{at("a.go"), at("sub/b.json")}, paths)
+
+	paths, err = fmtd.SelectFiles(pwd, []string{at("sub"), at("a.go"), at("sub/b.json")})
+	require.NoError(t, err)
+	require.Equal(t, []string{at("a.go"), at("sub/b.json")}, paths)
+
+	paths, err = fmtd.SelectFiles(pwd, []string{at("sub")}, fmtd.WithSkipPatterns(nil))
+	require.NoError(t, err)
+	require.Equal(t, []string{at("sub/b.json"), at("sub/c.min.js")}, paths)
+
+	paths, err = fmtd.SelectFiles(pwd, nil, fmtd.WithTraverse(false))
+	require.NoError(t, err)
+	require.Empty(t, paths)
+
+	for fn, msg := range map[string]string{
+		at("nope.go"): "no such file or directory",
+		at("sym.go"):  "not a regular file",
+		t.TempDir():   "not under $PWD",
+	} {
+		_, err = fmtd.SelectFiles(pwd, []string{at("a.go"), fn})
+		require.EqualError(t, err, `unusable file "`+fn+`" (`+msg+`)`)
+	}
+	_, err = fmtd.SelectFiles(pwd, []string{at("sub")}, fmtd.WithTraverse(false))
+	require.EqualError(t, err, `unusable file "`+at("sub")+`" (is a directory)`)
+}
+
+func TestAllowOutside(t *testing.T) {
+	ctx := context.Background()
+	pwd := t.TempDir()
+	outside := filepath.Join(t.TempDir(), "x.go")
+	err := os.WriteFile(outside, []byte("package    x\n"), 0600)
+	require.NoError(t, err)
+	name := buildx.OutsidePWD + strings.TrimPrefix(filepath.ToSlash(outside), "/")
+	state := fakeDocker(t, map[string]string{"stdout": "F " + name + "\n", "b/" + name: "package x\n"})
+
+	err = fmtd.Fmt(ctx, pwd, false, io.Discard, io.Discard, []string{outside})
+	require.EqualError(t, err, fmt.Sprintf("unusable file %q (not under $PWD)", outside))
+
+	var rs []fmtd.Result
+	err = fmtd.Fmt(ctx, pwd, false, io.Discard, io.Discard, []string{outside},
+		fmtd.WithAllowOutside(true),
+		fmtd.WithResultFunc(func(r fmtd.Result) { rs = append(rs, r) }),
+	)
+	require.NoError(t, err)
+	require.Equal(t, []fmtd.Result{{Path: outside, Status: fmtd.StatusChanged}}, rs)
+	require.Equal(t, "package    x\n", contextFiles(t, state)["a/"+name])
+	data, err := os.ReadFile(outside)
+	require.NoError(t, err)
+	require.Equal(t, "package x\n", string(data))
+}
+
+func TestOutputUnderPWD(t *testing.T) {
+	ctx := context.Background()
+	pwd := t.TempDir()
+	gofile := filepath.Join(pwd, "main.go")
+	err := os.WriteFile(gofile, []byte("package    main\n"), 0600)
+	require.NoError(t, err)
+
+	// Names in the build output are relative to pwd, not to the current directory
+	fakeDocker(t, map[string]string{"stdout": "F main.go\n", "b/main.go": "package main\n"})
+	err = fmtd.Fmt(ctx, pwd, false, io.Discard, io.Discard, []string{gofile})
+	require.NoError(t, err)
+	data, err := os.ReadFile(gofile)
+	require.NoError(t, err)
+	require.Equal(t, "package main\n", string(data))
+	require.NoFileExists(t, "main.go")
+}
+
+func TestOutputOutsidePWD(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	pwd := filepath.Join(root, "pwd")
+	require.NoError(t, os.Mkdir(pwd, 0700))
+	gofile := filepath.Join(pwd, "main.go")
+	err := os.WriteFile(gofile, []byte("package main\n"), 0600)
+	require.NoError(t, err)
+	outside := filepath.Join(root, "outside.go")
+	name := buildx.OutsidePWD + strings.TrimPrefix(filepath.ToSlash(outside), "/")
+
+	for _, crafted := range []string{"../outside.go", "sub/../../outside.go", name} {
+		fakeDocker(t, map[string]string{"stdout": "F " + crafted + "\n", "b/" + crafted: "package evil\n"})
+		err = fmtd.Fmt(ctx, pwd, false, io.Discard, io.Discard, []string{gofile})
+		require.True(t, errors.Is(err, fmtd.ErrOutputOutsidePWD), crafted)
+		require.EqualError(t, err, fmt.Sprintf("formatted file is outside $PWD: %q", crafted))
+		require.NoFileExists(t, outside)
+	}
+}
+
+func TestNative(t *testing.T) {
+	if _, err := exec.LookPath("gofmt"); err != nil {
+		t.Skip("no gofmt on $PATH")
+	}
+	ctx := context.Background()
+	pwd := t.TempDir()
+	for fn, contents := range map[string]string{
+		"formatted.go":   "package p\n",
+		"unformatted.go": "package     p",
+		"some.json":      "{ }",
+	} {
+		err := os.WriteFile(filepath.Join(pwd, fn), []byte(contents), 0600)
+		require.NoError(t, err)
+	}
+	at := func(fn string) string { return filepath.Join(pwd, fn) }
+	// What the Go formatter replies within Docker
+	dockerOutput := map[string]string{
+		"stdout":           "F some.json\nF unformatted.go\n",
+		"b/some.json":      "{}\n",
+		"b/unformatted.go": "package p\n",
+	}
+
+	for _, native := range []bool{false, true} {
+		require.NoError(t, os.WriteFile(at("unformatted.go"), []byte("package     p\n"), 0600))
+		require.NoError(t, os.WriteFile(at("some.json"), []byte("{ }"), 0600))
+		output := dockerOutput
+		if native {
+			output = map[string]string{"stdout": "F some.json\n", "b/some.json": "{}\n"}
+		}
+		state := fakeDocker(t, output)
+		var rs []fmtd.Result
+		err := fmtd.Fmt(ctx, pwd, false, io.Discard, io.Discard, []string{at("formatted.go"), at("unformatted.go"), at("some.json")},
+			fmtd.WithNative(native),
+			fmtd.WithResultFunc(func(r fmtd.Result) { rs = append(rs, r) }),
+		)
+		require.NoError(t, err)
+		require.ElementsMatch(t, []fmtd.Result{
+			{Path: "some.json", Status: fmtd.StatusChanged},
+			{Path: "unformatted.go", Status: fmtd.StatusChanged},
+		}, rs)
+		data, err := os.ReadFile(at("unformatted.go"))
+		require.NoError(t, err)
+		require.Equal(t, dockerOutput["b/unformatted.go"], string(data))
+
+		sent := contextFiles(t, state)
+		require.Contains(t, sent, "a/some.json")
+		require.Equal(t, !native, contains(sent, "a/unformatted.go"))
+	}
+
+	t.Run("only_Go_files_skip_Docker", func(t *testing.T) {
+		t.Setenv("PATH", filepath.Dir(mustLookPath(t, "gofmt")))
+		require.NoError(t, os.WriteFile(at("malformed.go"), []byte("package"), 0600))
+		var rs []fmtd.Result
+		err := fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, []string{at("formatted.go"), at("malformed.go")},
+			fmtd.WithNative(true),
+			fmtd.WithResultFunc(func(r fmtd.Result) { rs = append(rs, r) }),
+		)
+		var ferr *fmtd.FormatError
+		require.True(t, errors.As(err, &ferr))
+		require.Equal(t, "malformed.go", ferr.Path)
+		require.Equal(t, "go", ferr.Formatter)
+		require.Contains(t, ferr.Stderr, "malformed.go:")
+		require.Equal(t, []fmtd.Result{{Path: "malformed.go", Status: fmtd.StatusFailed, Formatter: "go", Stderr: ferr.Stderr}}, rs)
+	})
+
+	t.Run("no_gofmt_means_Docker", func(t *testing.T) {
+		state := fakeDocker(t, map[string]string{"stdout": ""})
+		t.Setenv("PATH", state+string(os.PathListSeparator)+"/usr/bin"+string(os.PathListSeparator)+"/bin")
+		if _, err := exec.LookPath("gofmt"); err == nil {
+			t.Skip("gofmt is a system executable")
+		}
+		err := fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, []string{at("formatted.go")}, fmtd.WithNative(true))
+		require.NoError(t, err)
+		require.Contains(t, contextFiles(t, state), "a/formatted.go")
+	})
+}
+
+func contains(m map[string]string, key string) bool {
+	_, ok := m[key]
+	return ok
+}
+
+func mustLookPath(t testing.TB, file string) string {
+	path, err := exec.LookPath(file)
+	require.NoError(t, err)
+	return path
+}
+
+func BenchmarkNative(b *testing.B) {
+	ctx := context.Background()
+	pwd := b.TempDir()
+	for i := 0; i < 100; i++ {
+		fn := filepath.Join(pwd, fmt.Sprintf("f%03d.go", i))
+		err := os.WriteFile(fn, []byte(fmt.Sprintf("package    p\nfunc F%d() {  }", i)), 0600)
+		require.NoError(b, err)
+	}
+
+	for _, native := range []bool{true, false} {
+		b.Run(fmt.Sprintf("native:%v", native), func(b *testing.B) {
+			if native {
+				mustLookPath(b, "gofmt")
+			} else if _, err := exec.LookPath("docker"); err != nil {
+				b.Skip("no docker on $PATH")
+			}
+			for i := 0; i < b.N; i++ {
+				err := fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, []string{pwd}, fmtd.WithNative(native))
+				require.ErrorIs(b, err, fmtd.ErrDryRunFoundFiles)
+			}
+		})
+	}
+}
+
+// BenchmarkToolStageRebuild rebuilds the tool stage of Python and SQL formatters
+// as if its layers were invalidated (e.g. by a new ALPINE image),
+// with the pip and apk cache mounts either warm or cold.
+func BenchmarkToolStageRebuild(b *testing.B) {
+	ctx := context.Background()
+	if _, err := exec.LookPath("docker"); err != nil {
+		b.Skip("no docker on $PATH")
+	}
+	pwd := b.TempDir()
+	for fn, contents := range map[string]string{"a.py": "x =  1\n", "a.sql": "select 1\n"} {
+		err := os.WriteFile(filepath.Join(pwd, fn), []byte(contents), 0600)
+		require.NoError(b, err)
+	}
+	var dockerfile bytes.Buffer
+	err := fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, nil, fmtd.WithDumpDockerfile(&dockerfile))
+	require.NoError(b, err)
+
+	build := func(b *testing.B, dockerfile string) {
+		cmd := exec.CommandContext(ctx, "docker", "buildx", "build",
+			"--no-cache-filter=tool", "--target=tool", "--output=type=cacheonly", "-")
+		cmd.Env = append(os.Environ(), "DOCKER_BUILDKIT=1")
+		cmd.Stdin = strings.NewReader(dockerfile)
+		out, err := cmd.CombinedOutput()
+		require.NoError(b, err, string(out))
+	}
+
+	b.Run("warm", func(b *testing.B) {
+		build(b, dockerfile.String())
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			build(b, dockerfile.String())
+		}
+	})
+	b.Run("cold", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			// Fresh cache mounts, as if there were none
+			id := fmt.Sprintf(",id=fmtd-bench-%d-%d", time.Now().UnixNano(), i)
+			cold := strings.NewReplacer(
+				"target=/root/.cache/pip", "target=/root/.cache/pip"+id+"-pip",
+				"target=/var/cache/apk", "target=/var/cache/apk"+id+"-apk",
+			).Replace(dockerfile.String())
+			build(b, cold)
+		}
+	})
+}
+
+func TestBuildArgPrecedence(t *testing.T) {
+	ctx := context.Background()
+	pwd := t.TempDir()
+	t.Setenv("PATH", t.TempDir()) // no docker to be found
+
+	err := os.WriteFile(filepath.Join(pwd, fmtd.ConfigFilename), []byte("args:\n  SHFMT_INDENT: \"2\"\n  SHFMT_LANG: mksh\n  SQL_INDENT_WIDTH: \"8\"\n"), 0600)
+	require.NoError(t, err)
+	config, err := fmtd.LoadConfig(filepath.Join(pwd, fmtd.ConfigFilename))
+	require.NoError(t, err)
+	t.Setenv("ARG_SHFMT_INDENT", "4")
+	t.Setenv("ARG_SHFMT_LANG", "bash")
+
+	var dockerfile, verbose bytes.Buffer
+	err = fmtd.Fmt(ctx, pwd, false, io.Discard, io.Discard, nil,
+		fmtd.WithConfig(config),
+		fmtd.WithBuildArg("SHFMT_LANG", "posix"),
+		fmtd.WithDumpDockerfile(&dockerfile),
+		fmtd.WithVerbose(&verbose),
+	)
+	require.NoError(t, err)
+	for _, expected := range []struct{ arg, source string }{
+		{"SHFMT_LANG=posix", fmtd.ArgFromCLI},
+		{"SHFMT_INDENT=4", fmtd.ArgFromEnv},
+		{"SQL_INDENT_WIDTH=8", fmtd.ArgFromConfig},
+	} {
+		require.Contains(t, dockerfile.String(), "\nARG "+expected.arg+"\n")
+		require.Contains(t, verbose.String(), "fmtd: ARG_"+expected.arg+" ("+expected.source+")\n")
+	}
+	require.Contains(t, dockerfile.String(), "\nARG SQL_KEYWORD_CASE=upper\n")
+	require.NotContains(t, verbose.String(), "SQL_KEYWORD_CASE")
+	require.Equal(t, 1, strings.Count(verbose.String(), "fmtd: ARG_SHFMT_LANG="))
+
+	// Only listed by what builds
+	verbose.Reset()
+	_, err = fmtd.What(pwd, nil, fmtd.WithConfig(config), fmtd.WithVerbose(&verbose))
+	require.NoError(t, err)
+	require.NotContains(t, verbose.String(), "ARG_")
+
+	err = fmtd.Fmt(ctx, pwd, false, io.Discard, io.Discard, nil, fmtd.WithBuildArg("", "bla"))
+	require.ErrorIs(t, err, fmtd.ErrInvalidBuildArg)
+
+	err = os.WriteFile(filepath.Join(pwd, fmtd.ConfigFilename), []byte("args:\n  SHFTM_INDENT: \"2\"\n"), 0600)
+	require.NoError(t, err)
+	_, err = fmtd.LoadConfig(filepath.Join(pwd, fmtd.ConfigFilename))
+	require.EqualError(t, err, "parsing "+filepath.Join(pwd, fmtd.ConfigFilename)+`: unknown build argument "SHFTM_INDENT"`)
+}
+
+func TestEnviron(t *testing.T) {
+	ctx := context.Background()
+	pwd := t.TempDir()
+	t.Setenv("PATH", t.TempDir()) // no docker to be found
+	t.Setenv("ARG_SHFMT_LANG", "bash")
+
+	var dockerfile, verbose bytes.Buffer
+	err := fmtd.Fmt(ctx, pwd, false, io.Discard, io.Discard, nil,
+		fmtd.WithEnviron([]string{"ARG_SHFMT_INDENT=4", "SHFMT_INDENT=8"}),
+		fmtd.WithDumpDockerfile(&dockerfile),
+		fmtd.WithVerbose(&verbose),
+	)
+	require.NoError(t, err)
+	require.Contains(t, dockerfile.String(), "\nARG SHFMT_INDENT=4\n")
+	require.Contains(t, verbose.String(), "fmtd: ARG_SHFMT_INDENT=4 ("+fmtd.ArgFromEnv+")\n")
+	// The process' environment is not looked at
+	require.Contains(t, dockerfile.String(), "\nARG SHFMT_LANG=posix\n")
+	require.NotContains(t, verbose.String(), "SHFMT_LANG")
+}
+
+func TestImageDigestResolution(t *testing.T) {
+	ctx := context.Background()
+	pwd := t.TempDir()
+	t.Setenv("PATH", t.TempDir()) // no docker to be found
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	pinned := "docker.io/library/golang@sha256:" + strings.Repeat("cd", 32)
+	t.Setenv("ARG_GOFMT_IMAGE", "docker.io/library/golang:1.22")
+	t.Setenv("ARG_TOMLFMT_IMAGE", "docker.io/library/golang:1.22")
+	t.Setenv("ARG_SHFMT_IMAGE", pinned)
+	t.Setenv("ARG_SHFMT_LANG", "bash")
+
+	var resolved []string
+	resolve := func(ctx context.Context, ref string) (string, error) {
+		resolved = append(resolved, ref)
+		return digest, nil
+	}
+	var dockerfile bytes.Buffer
+	err := fmtd.Fmt(ctx, pwd, false, io.Discard, io.Discard, nil,
+		fmtd.WithImageDigestResolution(resolve),
+		fmtd.WithDumpDockerfile(&dockerfile),
+	)
+	require.NoError(t, err)
+	require.Equal(t, []string{"docker.io/library/golang:1.22"}, resolved)
+	require.Contains(t, dockerfile.String(), "\nARG GOFMT_IMAGE=docker.io/library/golang:1.22@"+digest+"\n")
+	require.Contains(t, dockerfile.String(), "\nARG TOMLFMT_IMAGE=docker.io/library/golang:1.22@"+digest+"\n")
+	require.Contains(t, dockerfile.String(), "\nARG SHFMT_IMAGE="+pinned+"\n")
+	require.Contains(t, dockerfile.String(), "\nARG SHFMT_LANG=bash\n")
+
+	err = fmtd.Fmt(ctx, pwd, false, io.Discard, io.Discard, nil,
+		fmtd.WithImageDigestResolution(func(ctx context.Context, ref string) (string, error) {
+			return "", errors.New("manifest unknown")
+		}),
+		fmtd.WithDumpDockerfile(io.Discard),
+	)
+	require.EqualError(t, err, "resolving docker.io/library/golang:1.22: manifest unknown")
+}
+
+func TestManifest(t *testing.T) {
+	ctx := context.Background()
+	pwd := t.TempDir()
+	for _, fn := range []string{"main.go", "api.proto", "notes.xyz"} {
+		err := os.WriteFile(filepath.Join(pwd, fn), []byte("\n"), 0600)
+		require.NoError(t, err)
+	}
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	var resolved []string
+	resolve := func(ctx context.Context, ref string) (string, error) {
+		resolved = append(resolved, ref)
+		return digest, nil
+	}
+
+	var manifest bytes.Buffer
+	err := fmtd.Fmt(ctx, pwd, false, io.Discard, io.Discard, nil,
+		fmtd.WithBuildArg("GOFMT_IMAGE", "docker.io/library/golang:1.22"),
+		fmtd.WithImageDigestResolution(resolve),
+		fmtd.WithManifest(&manifest),
+	)
+	require.NoError(t, err)
+	require.Equal(t, []string{"docker.io/library/golang:1.22"}, resolved)
+	var m fmtd.Manifest
+	require.NoError(t, json.Unmarshal(manifest.Bytes(), &m))
+	require.Equal(t, []fmtd.ManifestImage{
+		{Arg: "ALPINE", Ref: "docker.io/library/alpine@sha256:21a3deaa0d32a8057914f36584b5288d2e5ecc984380bc0118285c70fa8c9300", Digest: "sha256:21a3deaa0d32a8057914f36584b5288d2e5ecc984380bc0118285c70fa8c9300"},
+		{Arg: "BUF_IMAGE", Ref: "docker.io/library/golang:1@sha256:fb249eca1b9172732de4950b0fb0fb5c231b83c2c90952c56d822d8a9de4d64b", Digest: "sha256:fb249eca1b9172732de4950b0fb0fb5c231b83c2c90952c56d822d8a9de4d64b"},
+		{Arg: "CLANGFORMAT_IMAGE", Ref: "docker.io/unibeautify/clang-format@sha256:1b2d3997012ae221c600668802f1b761973d9006d330effa9555516432dea9c1", Digest: "sha256:1b2d3997012ae221c600668802f1b761973d9006d330effa9555516432dea9c1"},
+		{Arg: "GOFMT_IMAGE", Ref: "docker.io/library/golang:1.22@" + digest, Digest: digest},
+	}, m.Images)
+
+	// Only Go files: no protobuf formatters
+	manifest.Reset()
+	err = fmtd.Fmt(ctx, pwd, false, io.Discard, io.Discard, []string{filepath.Join(pwd, "main.go")},
+		fmtd.WithImageDigestResolution(resolve),
+		fmtd.WithManifest(&manifest),
+	)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(manifest.Bytes(), &m))
+	var args []string
+	for _, image := range m.Images {
+		args = append(args, image.Arg)
+	}
+	require.Equal(t, []string{"ALPINE", "GOFMT_IMAGE"}, args)
+}
+
+func TestManifestIndexDigests(t *testing.T) {
+	ctx := context.Background()
+	pwd := t.TempDir()
+	err := os.WriteFile(filepath.Join(pwd, "main.go"), []byte("\n"), 0600)
+	require.NoError(t, err)
+	bin := t.TempDir()
+	t.Setenv("PATH", bin)
+	index := "sha256:" + strings.Repeat("cd", 32)
+	script := "#!/bin/sh\n" +
+		`echo '{"mediaType":"application/vnd.oci.image.index.v1+json","digest":"` + index + `","size":10229}'` + "\n"
+	err = os.WriteFile(filepath.Join(bin, "docker"), []byte(script), 0700)
+	require.NoError(t, err)
+
+	var manifest bytes.Buffer
+	err = fmtd.Fmt(ctx, pwd, false, io.Discard, io.Discard, nil,
+		fmtd.WithBuildArg("GOFMT_IMAGE", "docker.io/library/golang:1.22"),
+		fmtd.WithManifest(&manifest),
+	)
+	require.NoError(t, err)
+	var m fmtd.Manifest
+	require.NoError(t, json.Unmarshal(manifest.Bytes(), &m))
+	require.Contains(t, m.Images, fmtd.ManifestImage{Arg: "GOFMT_IMAGE", Ref: "docker.io/library/golang:1.22", Digest: index})
+
+	// The digest a tag resolves to is the one it gets pinned to
+	var verbose bytes.Buffer
+	err = fmtd.Fmt(ctx, pwd, false, io.Discard, io.Discard, nil,
+		fmtd.WithBuildArg("GOFMT_IMAGE", "docker.io/library/golang:1.22"),
+		fmtd.WithImageDigestResolution(nil),
+		fmtd.WithVerbose(&verbose),
+		fmtd.WithDumpDockerfile(io.Discard),
+	)
+	require.NoError(t, err)
+	require.Contains(t, verbose.String(), "fmtd: pinned ARG_GOFMT_IMAGE=docker.io/library/golang:1.22@"+index+"\n")
+}
+
+func TestDockerManifestDigest(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	t.Setenv("PATH", dir)
+	digest := "sha256:" + strings.Repeat("ab", 32)
+
+	script := "#!/bin/sh\n" +
+		`[ "$*" = 'buildx imagetools inspect --format {{json .Manifest}} golang:1.22' ] || exit 3` + "\n" +
+		`echo '{"mediaType":"application/vnd.oci.image.index.v1+json","digest":"` + digest + `","size":10229}'` + "\n"
+	err := os.WriteFile(filepath.Join(dir, "docker"), []byte(script), 0700)
+	require.NoError(t, err)
+	got, err := fmtd.DockerManifestDigest(ctx, "golang:1.22")
+	require.NoError(t, err)
+	require.Equal(t, digest, got)
+
+	script = "#!/bin/sh\necho 'no such manifest: golang:0' >&2\nexit 1\n"
+	err = os.WriteFile(filepath.Join(dir, "docker"), []byte(script), 0700)
+	require.NoError(t, err)
+	_, err = fmtd.DockerManifestDigest(ctx, "golang:0")
+	require.EqualError(t, err, "exit status 1 (no such manifest: golang:0)")
+}
+
+func TestFmtignore(t *testing.T) {
+	pwd := t.TempDir()
+	for fn, contents := range map[string]string{
+		"a.go":              "package a",
+		"vendor/b.go":       "package b",
+		fmtd.IgnoreFilename: "vendor\n",
+	} {
+		err := os.MkdirAll(filepath.Join(pwd, filepath.Dir(fn)), 0700)
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(pwd, fn), []byte(contents), 0600)
+		require.NoError(t, err)
+	}
+	paths, err := fmtd.SelectFiles(pwd, []string{pwd, filepath.Join(pwd, "vendor", "b.go")})
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join(pwd, "a.go")}, paths)
+}
+
+func TestSelfTest(t *testing.T) {
+	ctx := context.Background()
+	fakeDocker(t, map[string]string{
+		"stdout":        "F sample.go\nE sample.sql\nF sample.json\n",
+		"errors":        "sql sample.sql\n  sqlformat: not found\n",
+		"b/sample.go":   "package p\n",
+		"b/sample.json": "{}\n",
+	})
+
+	results, err := fmtd.SelfTest(ctx, io.Discard, fmtd.WithConfig(&fmtd.Config{Languages: map[string]bool{"python": false}}))
+	require.NoError(t, err)
+	byName := make(map[string]fmtd.SelfTestResult)
+	for _, r := range results {
+		byName[r.Formatter] = r
+	}
+	require.Equal(t, fmtd.SelfTestResult{Formatter: "go", OK: true}, byName["go"])
+	require.Equal(t, fmtd.SelfTestResult{Formatter: "json", OK: true}, byName["json"])
+	require.Equal(t, fmtd.SelfTestResult{Formatter: "sql", Detail: "failed: sqlformat: not found"}, byName["sql"])
+	require.Equal(t, fmtd.SelfTestResult{Formatter: "toml", Detail: "left the sample unformatted"}, byName["toml"])
+	require.NotContains(t, byName, "python")
+
+	t.Setenv("PATH", t.TempDir()) // no docker to be found
+	results, err = fmtd.SelfTest(ctx, io.Discard)
+	require.Equal(t, buildx.ErrNoDocker, err)
+	require.NotEmpty(t, results)
+	for _, r := range results {
+		require.False(t, r.OK)
+		require.Equal(t, "build failed", r.Detail)
+	}
+}
+
+func TestPreCommitHook(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("no git on $PATH")
+	}
+	repo := t.TempDir()
+	run := func(args ...string) (string, error) {
+		cmd := exec.Command("git", append([]string{"-C", repo, "-c", "user.name=fmtd", "-c", "user.email=fmtd@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		return strings.TrimSpace(string(out)), err
+	}
+	_, err := run("init", "-q")
+	require.NoError(t, err)
+	_, err = run("config", "core.hooksPath", "githooks")
+	require.NoError(t, err)
+	err = os.MkdirAll(filepath.Join(repo, "sub"), 0700)
+	require.NoError(t, err)
+
+	// Hooks go where Git looks for them
+	err = fmtd.WritePreCommitHook(filepath.Join(repo, "sub"), false)
+	require.NoError(t, err)
+	data, err := os.ReadFile(filepath.Join(repo, "githooks", "pre-commit"))
+	require.NoError(t, err)
+	require.Equal(t, fmtd.PreCommitHook, string(data))
+
+	// Staged contents are checked, not the work tree's
+	bin := t.TempDir()
+	fake := "#!/bin/sh\n" + `shift 2; ! grep -q unformatted "$@"` + "\n"
+	err = os.WriteFile(filepath.Join(bin, "fmtd"), []byte(fake), 0700)
+	require.NoError(t, err)
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	fn := filepath.Join(repo, "sub", "x.go")
+	err = os.WriteFile(fn, []byte("unformatted\n"), 0600)
+	require.NoError(t, err)
+	_, err = run("add", "sub/x.go")
+	require.NoError(t, err)
+	err = os.WriteFile(fn, []byte("formatted\n"), 0600)
+	require.NoError(t, err)
+	out, err := run("commit", "-qm", "x")
+	require.Error(t, err, out)
+
+	_, err = run("add", "sub/x.go")
+	require.NoError(t, err)
+	err = os.WriteFile(fn, []byte("unformatted\n"), 0600)
+	require.NoError(t, err)
+	out, err = run("commit", "-qm", "x")
+	require.NoError(t, err, out)
+}
+
+func TestFmtGitRef(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("no git on $PATH")
+	}
+	ctx := context.Background()
+	repo := t.TempDir()
+	run := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-C", repo, "-c", "user.name=fmtd", "-c", "user.email=fmtd@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+		return strings.TrimSpace(string(out))
+	}
+	run("init", "-q")
+	for fn, contents := range map[string]string{
+		"x.go":          "package     x",
+		"sub/y.json":    "{}\n",
+		"notes.txt":     "some notes",
+		"a.min.js":      "a()",
+		".hidden/z.go":  "package    z",
+		"sub/dir/w.sql": "select 1",
+	} {
+		err := os.MkdirAll(filepath.Join(repo, filepath.Dir(fn)), 0700)
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(repo, fn), []byte(contents), 0600)
+		require.NoError(t, err)
+	}
+	require.NoError(t, os.Symlink("x.go", filepath.Join(repo, "link.go")))
+	run("add", "-A")
+	run("commit", "-q", "-m", "first")
+	commit := run("rev-parse", "HEAD")
+	// The working tree is not looked at
+	require.NoError(t, os.WriteFile(filepath.Join(repo, "x.go"), []byte("package x\n"), 0600))
+	require.NoError(t, os.Remove(filepath.Join(repo, "sub", "y.json")))
+
+	state := fakeDocker(t, map[string]string{
+		"stdout":       "F x.go\n",
+		"b/x.go":       "package x\n",
+		"b/sub/y.json": "{}\n",
+	})
+	changed, err := fmtd.FmtGitRef(ctx, repo, commit)
+	require.NoError(t, err)
+	require.Equal(t, []string{"x.go"}, changed)
+	require.Equal(t, map[string]string{
+		"Dockerfile":      contextFiles(t, state)["Dockerfile"],
+		"a/x.go":          "package     x",
+		"a/sub/y.json":    "{}\n",
+		"a/sub/dir/w.sql": "select 1",
+	}, contextFiles(t, state))
+	data, err := os.ReadFile(filepath.Join(repo, "x.go"))
+	require.NoError(t, err)
+	require.Equal(t, "package x\n", string(data))
+
+	_, err = fmtd.FmtGitRef(ctx, repo, "no-such-ref")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "git ls-tree: exit status 128")
+}
+
+func TestFmtGitRefSelection(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("no git on $PATH")
+	}
+	ctx := context.Background()
+	repo := t.TempDir()
+	run := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", repo, "-c", "user.name=fmtd", "-c", "user.email=fmtd@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+	run("init", "-q")
+	for fn, contents := range map[string]string{
+		"x.go":                   "package     x",
+		".hidden/z.go":           "package    z",
+		".github/workflows/a.go": "package    a",
+		"big.go":                 "package big\n" + strings.Repeat("//\n", 50),
+		"gen.go":                 "// Code generated by hand. DO NOT EDIT.\npackage gen",
+		"vendor/v.go":            "package    v",
+		fmtd.IgnoreFilename:      "vendor\n",
+		"b.cc":                   "int  b;",
+		".clang-format":          "BasedOnStyle: Google\n",
+		"a.py":                   "x  = 1",
+	} {
+		err := os.MkdirAll(filepath.Join(repo, filepath.Dir(fn)), 0700)
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(repo, fn), []byte(contents), 0600)
+		require.NoError(t, err)
+	}
+	run("add", "-A")
+	run("commit", "-q", "-m", "first")
+	// Only the tree at ref is looked at
+	require.NoError(t, os.Remove(filepath.Join(repo, fmtd.IgnoreFilename)))
+	require.NoError(t, os.Remove(filepath.Join(repo, ".clang-format")))
+
+	state := fakeDocker(t, map[string]string{"stdout": ""})
+	changed, err := fmtd.FmtGitRef(ctx, repo, "HEAD",
+		fmtd.WithIncludeHidden([]string{".hidden/**"}),
+		fmtd.WithMaxFileSize(100),
+		fmtd.WithSkipGenerated(fmtd.DefaultGeneratedPatterns),
+		fmtd.WithRequireConfig([]string{".cc", ".py"}),
+	)
+	require.NoError(t, err)
+	require.Empty(t, changed)
+	files := contextFiles(t, state)
+	delete(files, "Dockerfile")
+	require.Equal(t, map[string]string{
+		"a/x.go":         "package     x",
+		"a/.hidden/z.go": "package    z",
+		"a/b.cc":         "int  b;",
+	}, files)
+}
+
+func TestSkipUnavailable(t *testing.T) {
+	ctx := context.Background()
+	state := fakeDocker(t, map[string]string{"stdout": ""})
+	alpineImage := "docker.io/library/alpine:3"
+	t.Setenv("ARG_ALPINE", alpineImage)
+	gofmtImage := "docker.io/library/golang:1.22"
+	t.Setenv("ARG_GOFMT_IMAGE", gofmtImage)
+	t.Setenv("ARG_TXTPBFMT_IMAGE", "docker.io/library/golang:1.23")
+	err := os.WriteFile(filepath.Join(state, "images"), []byte(alpineImage+"\n"+gofmtImage+"\n"), 0600)
+	require.NoError(t, err)
+
+	pwd := t.TempDir()
+	for _, fn := range []string{"a.go", "b.json", "c.sh", "d.txtpb"} {
+		err := os.WriteFile(filepath.Join(pwd, fn), []byte("x"), 0600)
+		require.NoError(t, err)
+	}
+
+	var verbose bytes.Buffer
+	err = fmtd.Fmt(ctx, pwd, false, io.Discard, io.Discard, nil,
+		fmtd.WithSkipUnavailable(true), fmtd.WithVerbose(&verbose))
+	require.NoError(t, err)
+	files := contextFiles(t, state)
+	require.Contains(t, files, "a/a.go")
+	require.Contains(t, files, "a/b.json") // jq is installed with apk, which is not checked
+	require.NotContains(t, files, "a/c.sh")
+	require.NotContains(t, files, "a/d.txtpb") // Built in a stage from TXTPBFMT_IMAGE
+	require.Contains(t, verbose.String(), "fmtd: skipped c.sh (image docker.io/mvdan/shfmt@sha256:")
+	require.Contains(t, verbose.String(), " is not available)\n")
+	require.Contains(t, verbose.String(), "fmtd: skipped d.txtpb (image docker.io/library/golang:1.23 is not available)\n")
+
+	// Without ALPINE no formatter runs
+	err = os.WriteFile(filepath.Join(state, "images"), []byte(gofmtImage+"\n"), 0600)
+	require.NoError(t, err)
+	verbose.Reset()
+	err = fmtd.Fmt(ctx, pwd, false, io.Discard, io.Discard, nil,
+		fmtd.WithSkipUnavailable(true), fmtd.WithVerbose(&verbose))
+	require.NoError(t, err)
+	require.Contains(t, verbose.String(), "fmtd: skipped a.go (image docker.io/library/alpine:3 is not available)\n")
+	require.Contains(t, verbose.String(), "fmtd: skipped b.json (image docker.io/library/alpine:3 is not available)\n")
+
+	err = fmtd.Fmt(ctx, pwd, false, io.Discard, io.Discard, nil)
+	require.NoError(t, err)
+	require.Contains(t, contextFiles(t, state), "a/c.sh")
+}
+
+func TestImagePullFailure(t *testing.T) {
+	ctx := context.Background()
+	state := fakeDocker(t, map[string]string{"stdout": "F a.go\n", "b/a.go": "package a\n"})
+	t.Setenv("ARG_SHFMT_IMAGE", "mvdan/shfmt:v3")
+	// Builds needing shfmt fail pulling it
+	script := "#!/bin/sh\n" +
+		"[ \"$1\" = buildx ] && exit 0\n" +
+		"[ \"$1\" = image ] && exit 0\n" +
+		"n=$(($(cat " + state + "/count 2>/dev/null || echo 0)+1)) && echo $n >" + state + "/count\n" +
+		"cat >" + state + "/context.tar\n" +
+		"if tar -xOf " + state + "/context.tar Dockerfile | grep -q 'SHFMT_IMAGE AS shfmt'; then\n" +
+		"  echo 'ERROR: failed to solve: docker.io/mvdan/shfmt:v3: failed to resolve source metadata for docker.io/mvdan/shfmt:v3: docker.io/mvdan/shfmt:v3: not found' >&2\n" +
+		"  exit 1\n" +
+		"fi\n" +
+		"cat " + state + "/output.tar\n"
+	require.NoError(t, os.WriteFile(filepath.Join(state, "docker"), []byte(script), 0700))
+
+	pwd := t.TempDir()
+	for _, fn := range []string{"a.go", "b.sh"} {
+		err := os.WriteFile(filepath.Join(pwd, fn), []byte("x"), 0600)
+		require.NoError(t, err)
+	}
+
+	err := fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, nil)
+	require.True(t, errors.Is(err, fmtd.ErrImageUnavailable))
+	require.EqualError(t, err, "could not pull image: docker.io/mvdan/shfmt:v3 (docker.io/mvdan/shfmt:v3: not found)")
+
+	require.NoError(t, os.Remove(filepath.Join(state, "count")))
+	var stdout, verbose bytes.Buffer
+	var summary fmtd.Summary
+	err = fmtd.Fmt(ctx, pwd, true, &stdout, io.Discard, nil,
+		fmtd.WithSkipUnavailable(true),
+		fmtd.WithVerbose(&verbose),
+		fmtd.WithSummaryFunc(func(s fmtd.Summary) { summary = s }),
+	)
+	require.Equal(t, fmtd.ErrDryRunFoundFiles, err)
+	require.Equal(t, "a.go\n", stdout.String())
+	require.Contains(t, verbose.String(), "fmtd: skipped b.sh (image docker.io/mvdan/shfmt:v3 could not be pulled)\n")
+	require.Equal(t, 1, summary.Files)
+	require.Equal(t, []fmtd.Skipped{{Reason: "image docker.io/mvdan/shfmt:v3 could not be pulled", Count: 1, Paths: []string{"b.sh"}}}, summary.Skipped)
+	files := contextFiles(t, state)
+	require.Contains(t, files, "a/a.go")
+	require.NotContains(t, files, "a/b.sh")
+	count, err := os.ReadFile(filepath.Join(state, "count"))
+	require.NoError(t, err)
+	require.Equal(t, "2\n", string(count))
+}
+
+func TestRetries(t *testing.T) {
+	ctx := context.Background()
+	state := fakeDocker(t, map[string]string{"stdout": ""})
+	// Every other build fails pulling an image
+	script := "#!/bin/sh\n" +
+		"[ \"$1\" = buildx ] && exit 0\n" +
+		"n=$(($(cat " + state + "/count 2>/dev/null || echo 0)+1)) && echo $n >" + state + "/count\n" +
+		"cat >/dev/null\n" +
+		"if [ $((n%2)) -eq 1 ]; then echo 'ERROR: failed to do request: net/http: TLS handshake timeout' >&2; exit 1; fi\n" +
+		"cat " + state + "/output.tar\n"
+	require.NoError(t, os.WriteFile(filepath.Join(state, "docker"), []byte(script), 0700))
+
+	pwd := t.TempDir()
+	err := os.WriteFile(filepath.Join(pwd, "a.json"), []byte("{}\n"), 0600)
+	require.NoError(t, err)
+
+	err = fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, nil, fmtd.WithRetries(1, time.Millisecond))
+	require.NoError(t, err)
+	count, err := os.ReadFile(filepath.Join(state, "count"))
+	require.NoError(t, err)
+	require.Equal(t, "2\n", string(count))
+
+	err = fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, nil, fmtd.WithRetries(0, time.Millisecond))
+	require.Error(t, err)
+	count, err = os.ReadFile(filepath.Join(state, "count"))
+	require.NoError(t, err)
+	require.Equal(t, "3\n", string(count))
+
+	err = fmtd.Fmt(ctx, pwd, true, io.Discard, io.Discard, nil, fmtd.WithRetries(-1, time.Millisecond))
+	require.Equal(t, buildx.ErrNegativeRetries, err)
+}
+
+func TestExpandResponseFiles(t *testing.T) {
+	pwd := t.TempDir()
+	for _, fn := range []string{"a.go", "b c.json", "sub/d.go"} {
+		err := os.MkdirAll(filepath.Join(pwd, filepath.Dir(fn)), 0700)
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(pwd, fn), []byte("x"), 0600)
+		require.NoError(t, err)
+	}
+	err := os.WriteFile(filepath.Join(pwd, "list.txt"), []byte("a.go\r\nb c.json\n\n./sub/d.go\nsub//d.go\n"), 0600)
+	require.NoError(t, err)
+
+	filenames, err := fmtd.ExpandResponseFiles(pwd, []string{"a.go", "@list.txt", "./@x.go"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a.go", "b c.json", filepath.Join("sub", "d.go"), "@x.go"}, filenames)
+
+	filenames, err = fmtd.ExpandResponseFiles(pwd, []string{"@" + filepath.Join(pwd, "list.txt")})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a.go", "b c.json", filepath.Join("sub", "d.go")}, filenames)
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(pwd))
+	defer func() { require.NoError(t, os.Chdir(wd)) }()
+	paths, err := fmtd.SelectFiles(pwd, filenames, fmtd.WithTraverse(false))
+	require.NoError(t, err)
+	require.Len(t, paths, 3)
+
+	_, err = fmtd.ExpandResponseFiles(pwd, []string{"@missing.txt"})
+	require.True(t, errors.Is(err, fs.ErrNotExist))
+}
+
+func TestReadFilenames(t *testing.T) {
+	pwd := t.TempDir()
+	for _, fn := range []string{"a.go", "b c.json"} {
+		err := os.WriteFile(filepath.Join(pwd, fn), []byte("x"), 0600)
+		require.NoError(t, err)
+	}
+	err := os.Mkdir(filepath.Join(pwd, "dir"), 0700)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(pwd, "dir", "d.go"), []byte("x"), 0600)
+	require.NoError(t, err)
+
+	filenames, err := fmtd.ReadFilenames(strings.NewReader("a.go\r\nb c.json\n\na.go\n./a.go\n"), '\n')
+	require.NoError(t, err)
+	require.Equal(t, []string{"a.go", "b c.json", "a.go", "./a.go"}, filenames)
+
+	// Duplicates are selected once
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(pwd))
+	defer func() { require.NoError(t, os.Chdir(wd)) }()
+	paths, err := fmtd.SelectFiles(pwd, filenames, fmtd.WithTraverse(false))
+	require.NoError(t, err)
+	require.Len(t, paths, 2)
+
+	filenames, err = fmtd.ReadFilenames(strings.NewReader("a.go\x00b\nc.json\x00"), 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a.go", "b\nc.json"}, filenames)
+
+	// Directories are not walked
+	_, err = fmtd.SelectFiles(pwd, []string{"dir"}, fmtd.WithTraverse(false))
+	require.Error(t, err)
+
+	filenames, err = fmtd.ReadFilenames(strings.NewReader(""), '\n')
+	require.NoError(t, err)
+	require.Empty(t, filenames)
+}
+
+func TestOnlyChangedLines(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("no git on $PATH")
+	}
+	ctx := context.Background()
+	repo := t.TempDir()
+	run := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", repo, "-c", "user.name=fmtd", "-c", "user.email=fmtd@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+	write := func(fn, contents string) {
+		err := os.WriteFile(filepath.Join(repo, fn), []byte(contents), 0600)
+		require.NoError(t, err)
+	}
+	run("init", "-q")
+	write("a.c", "int a;\nint  b;\nint c;\nint  d;\n")
+	write("same.c", "int  s;\n")
+	write("x.go", "package    x\n")
+	run("add", "-A")
+	run("commit", "-q", "-m", "first")
+	write("a.c", "int a;\nint  b;\nint  C;\nint  d;\n")
+	write("x.go", "package    x\n\nvar  y = 1\n")
+	write("new.c", "int  n;\n")
+
+	state := fakeDocker(t, map[string]string{"stdout": ""})
+	var stdout, stderr, verbose bytes.Buffer
+	err := fmtd.Fmt(ctx, repo, false, &stdout, &stderr, nil,
+		fmtd.WithOnlyChangedLines("HEAD"), fmtd.WithVerbose(&verbose))
+	require.NoError(t, err)
+
+	files := contextFiles(t, state)
+	require.Contains(t, files, "a/a.c")
+	require.Contains(t, files, "a/new.c")
+	require.Contains(t, files, "a/x.go")
+	require.NotContains(t, files, "a/same.c")
+	require.Contains(t, verbose.String(), "fmtd: skipped same.c (no lines changed since HEAD)\n")
+	require.Contains(t, files["Dockerfile"], "COPY <<\"LINES\" /app/lines\na.c\t3:3\nLINES\n")
+	require.Contains(t, files["Dockerfile"], `clang-format -style="$style" -sort-includes $(lines --lines=) "$f"`)
+	require.Equal(t, ""+
+		"fmtd: go files cannot be formatted by line ranges: formatting changed files whole\n"+
+		"fmtd: skipped 1 files:\n"+
+		"  1 no lines changed since HEAD\n",
+		stderr.String())
+	require.Empty(t, stdout.String())
+}
+
+func TestTimings(t *testing.T) {
+	ctx := context.Background()
+	pwd := t.TempDir()
+	for _, fn := range []string{"a.go", "b.json"} {
+		err := os.WriteFile(filepath.Join(pwd, fn), []byte("x"), 0600)
+		require.NoError(t, err)
+	}
+	state := fakeDocker(t, map[string]string{
+		"stdout": "T 5 a.go\nF a.go\nT 120 b.json\n",
+		"b/a.go": "package a\n",
+	})
+
+	var stdout, timings bytes.Buffer
+	err := fmtd.Fmt(ctx, pwd, true, &stdout, io.Discard, nil, fmtd.WithTimings(&timings))
+	require.Equal(t, fmtd.ErrDryRunFoundFiles, err)
+	require.Equal(t, "a.go\n", stdout.String())
+	require.Equal(t, "fmtd: 120ms b.json (json)\nfmtd: 5ms a.go (go)\nfmtd: go: 1 files in 5ms\nfmtd: json: 1 files in 120ms\n", timings.String())
+	require.Contains(t, contextFiles(t, state)["Dockerfile"], "t0=$(date +%s%N)")
+}
+
+func TestFmtWorkspaces(t *testing.T) {
+	ctx := context.Background()
+	state := fakeDocker(t, map[string]string{
+		"stdout": "F a.go\n",
+		"b/a.go": "package a\n",
+	})
+	var pwds []string
+	for i := 0; i < 2; i++ {
+		pwd := t.TempDir()
+		err := os.WriteFile(filepath.Join(pwd, "a.go"), []byte("package    a\n"), 0600)
+		require.NoError(t, err)
+		pwds = append(pwds, pwd)
+	}
+	specs := []fmtd.WorkspaceSpec{
+		{Pwd: pwds[0], Options: []fmtd.Option{fmtd.WithBuildArg("GOFMT_IMAGE", "docker.io/library/golang:1.21")}},
+		{Pwd: pwds[1], Filenames: []string{filepath.Join(pwds[1], "a.go")}},
+	}
+
+	var stdout bytes.Buffer
+	err := fmtd.FmtWorkspaces(ctx, true, &stdout, io.Discard, specs)
+	require.Equal(t, fmtd.ErrDryRunFoundFiles, err)
+	require.Equal(t, "a.go\na.go\n", stdout.String())
+	first, second := contextFilesOf(t, filepath.Join(state, "context.1.tar")), contextFilesOf(t, filepath.Join(state, "context.2.tar"))
+	require.Contains(t, first, "a/a.go")
+	require.Contains(t, second, "a/a.go")
+	args, err := os.ReadFile(filepath.Join(state, "args"))
+	require.NoError(t, err)
+	require.NotContains(t, string(args), "GOFMT_IMAGE") // only the first workspace overrides it
+
+	stdout.Reset()
+	err = fmtd.FmtWorkspaces(ctx, false, &stdout, io.Discard, specs, fmtd.WithWorkspaceConcurrency(2))
+	require.NoError(t, err)
+	require.Equal(t, "a.go\na.go\n", stdout.String())
+	for _, pwd := range pwds {
+		data, err := os.ReadFile(filepath.Join(pwd, "a.go"))
+		require.NoError(t, err)
+		require.Equal(t, "package a\n", string(data))
+	}
+
+	specs = append(specs, fmtd.WorkspaceSpec{Pwd: pwds[1], Filenames: []string{"missing.go"}})
+	err = fmtd.FmtWorkspaces(ctx, false, io.Discard, io.Discard, specs)
+	var werrs fmtd.WorkspaceErrors
+	require.True(t, errors.As(err, &werrs))
+	require.Len(t, werrs, 1)
+	require.Equal(t, pwds[1], werrs[0].Pwd)
+	require.EqualError(t, err, pwds[1]+`: unusable file "missing.go" (no such file or directory)`)
+}
+
+func TestCancelOnFirstError(t *testing.T) {
+	ctx := context.Background()
+	state := t.TempDir()
+	// Builds given FAIL fail right away, others take their time
+	script := "#!/bin/sh\n" +
+		"[ \"$1\" = buildx ] && exit 0\n" +
+		"cat >/dev/null\n" +
+		"case \"$*\" in *FAIL=1*) echo 'Cannot connect to the Docker daemon' >&2; exit 1 ;; esac\n" +
+		"touch " + state + "/slow\n" +
+		"exec sleep 30\n"
+	require.NoError(t, os.WriteFile(filepath.Join(state, "docker"), []byte(script), 0700))
+	t.Setenv("PATH", state+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	var specs []fmtd.WorkspaceSpec
+	for i := 0; i < 3; i++ {
+		pwd := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(pwd, "a.go"), []byte("package    a"), 0600))
+		specs = append(specs, fmtd.WorkspaceSpec{Pwd: pwd})
+	}
+	specs[1].Options = []fmtd.Option{fmtd.WithBuildArg("FAIL", "1")}
+
+	start := time.Now()
+	err := fmtd.FmtWorkspaces(ctx, true, io.Discard, io.Discard, specs[:2],
+		fmtd.WithWorkspaceConcurrency(2), fmtd.WithCancelOnFirstError(true))
+	require.Less(t, time.Since(start), 10*time.Second)
+	var werr *fmtd.WorkspaceError
+	require.True(t, errors.As(err, &werr))
+	require.Equal(t, specs[1].Pwd, werr.Pwd)
+	require.True(t, errors.Is(err, buildx.ErrDockerBuildFailure))
+
+	// Workspaces after the failure are not formatted
+	require.NoError(t, os.RemoveAll(filepath.Join(state, "slow")))
+	specs[0].Options = specs[1].Options
+	err = fmtd.FmtWorkspaces(ctx, true, io.Discard, io.Discard, specs, fmtd.WithCancelOnFirstError(true))
+	require.True(t, errors.As(err, &werr))
+	require.Equal(t, specs[0].Pwd, werr.Pwd)
+	require.NoFileExists(t, filepath.Join(state, "slow"))
+}
+
+func TestFormatContents(t *testing.T) {
+	ctx := context.Background()
+	pwd := t.TempDir()
+
+	// The formatter is picked per the name of the file, which need not exist
+	for filename, arm := range map[string]string{
+		"src/data.json":            "*.json)",
+		filepath.Join(pwd, "x.go"): "*.go)",
+		"pkg/BUILD.bazel":          "buildifier -lint=fix",
+	} {
+		var dockerfile, w bytes.Buffer
+		err := fmtd.FormatContents(ctx, pwd, filename, strings.NewReader("{ }"), &w, io.Discard,
+			fmtd.WithDumpDockerfile(&dockerfile))
+		require.NoError(t, err, filename)
+		require.Contains(t, dockerfile.String(), arm, filename)
+		require.Equal(t, "{ }", w.String(), filename)
+	}
+
+	fakeDocker(t, map[string]string{"stdout": ""})
+	var w bytes.Buffer
+	err := fmtd.FormatContents(ctx, pwd, "notes.unknown", strings.NewReader("as is \n"), &w, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t, "as is \n", w.String())
+
+	// Formatted under its own name, leaving the file itself untouched
+	saved := filepath.Join(pwd, "src", "data.json")
+	require.NoError(t, os.MkdirAll(filepath.Dir(saved), 0700))
+	require.NoError(t, os.WriteFile(saved, []byte("saved"), 0400))
+	state := fakeDocker(t, map[string]string{"stdout": "F src/data.json\n", "b/src/data.json": "{}\n"})
+	w.Reset()
+	err = fmtd.FormatContents(ctx, pwd, "src/data.json", strings.NewReader("{ }\n"), &w, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t, "{}\n", w.String())
+	require.Equal(t, "{ }\n", contextFiles(t, state)["a/src/data.json"])
+	data, err := os.ReadFile(saved)
+	require.NoError(t, err)
+	require.Equal(t, "saved", string(data))
+
+	// Skipped as the file itself would be
+	fakeDocker(t, map[string]string{"stdout": ""})
+	err = os.WriteFile(filepath.Join(pwd, fmtd.IgnoreFilename), []byte("src/\n"), 0600)
+	require.NoError(t, err)
+	for filename, reason := range map[string]string{
+		"src/data.json": "matches .fmtignore:1",
+		"lib.min.json":  "matches *.min.json",
+		"gen.go":        "generated, per ^// Code generated .* DO NOT EDIT\\.$",
+	} {
+		var verbose bytes.Buffer
+		w.Reset()
+		err := fmtd.FormatContents(ctx, pwd, filename, strings.NewReader("// Code generated by hand. DO NOT EDIT.\n{ }\n"), &w, io.Discard,
+			fmtd.WithVerbose(&verbose), fmtd.WithSkipGenerated(fmtd.DefaultGeneratedPatterns))
+		require.NoError(t, err, filename)
+		require.Equal(t, "// Code generated by hand. DO NOT EDIT.\n{ }\n", w.String(), filename)
+		require.Contains(t, verbose.String(), "fmtd: skipped "+filename+" ("+reason+")\n")
+	}
+
+	if _, err := exec.LookPath("gofmt"); err == nil {
+		w.Reset()
+		err := fmtd.FormatContents(ctx, pwd, "cmd/main.go", strings.NewReader("package     p\n"), &w, io.Discard,
+			fmtd.WithNative(true))
+		require.NoError(t, err)
+		require.Equal(t, "package p\n", w.String())
+	}
+}
+
+func TestFindWorkspace(t *testing.T) {
+	pwd := t.TempDir()
+	err := os.MkdirAll(filepath.Join(pwd, "sub", "deeper"), 0700)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(pwd, "sub", fmtd.ConfigFilename), nil, 0600)
+	require.NoError(t, err)
+
+	require.Equal(t, filepath.Join(pwd, "sub"), fmtd.FindWorkspace(pwd, "sub/deeper/x.go"))
+	require.Equal(t, filepath.Join(pwd, "sub"), fmtd.FindWorkspace(pwd, filepath.Join(pwd, "sub", "x.go")))
+	require.Equal(t, pwd, fmtd.FindWorkspace(pwd, "other/x.go"))
+	require.Equal(t, pwd, fmtd.FindWorkspace(pwd, "x.go"))
+	require.Equal(t, pwd, fmtd.FindWorkspace(pwd, "/elsewhere/sub/x.go"))
+}
+
+func TestHardLinksStayLinked(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("hard links are not deduplicated on " + runtime.GOOS)
+	}
+	ctx := context.Background()
+	pwd := t.TempDir()
+	a, b := filepath.Join(pwd, "a.json"), filepath.Join(pwd, "b.json")
+	err := os.WriteFile(a, []byte("{ }\n"), 0600)
+	require.NoError(t, err)
+	err = os.Link(a, b)
+	require.NoError(t, err)
+	fakeDocker(t, map[string]string{"stdout": "F a.json\n", "b/a.json": "{}\n"})
+
+	err = fmtd.Fmt(ctx, pwd, false, io.Discard, io.Discard, []string{pwd})
+	require.NoError(t, err)
+	for _, fn := range []string{a, b} {
+		data, err := os.ReadFile(fn)
+		require.NoError(t, err)
+		require.Equal(t, "{}\n", string(data), fn)
+	}
+	fia, err := os.Stat(a)
+	require.NoError(t, err)
+	fib, err := os.Stat(b)
+	require.NoError(t, err)
+	require.True(t, os.SameFile(fia, fib))
+}
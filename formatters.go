@@ -0,0 +1,515 @@
+package fmtd
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// clangFormatStyle picks the clang-format style of "$f":
+// OBJC_STYLE for Objective-C and Objective-C++, Google's otherwise.
+const clangFormatStyle = `case "$f" in *.[mM]|*.[mM][mM]) style="$OBJC_STYLE" ;; *) style=google ;; esac && `
+
+// presetArg is a Dockerfile ARG whose value can be overridden
+// by setting the environment variable ARG_<name>.
+type presetArg struct {
+	name, value string
+}
+
+// presetImages are the images formatters are copied from, or built in.
+var presetImages = []presetArg{
+	{"ALPINE", "docker.io/library/alpine@sha256:21a3deaa0d32a8057914f36584b5288d2e5ecc984380bc0118285c70fa8c9300"},
+	{"BUF_IMAGE", "docker.io/library/golang:1@sha256:fb249eca1b9172732de4950b0fb0fb5c231b83c2c90952c56d822d8a9de4d64b"},
+	{"BUILDIFIER_IMAGE", "docker.io/whilp/buildifier@sha256:67da91fdddd40e9947153bc9157ab9103c141fcabcdbf646f040ba7a763bc531"},
+	{"CLANGFORMAT_IMAGE", "docker.io/unibeautify/clang-format@sha256:1b2d3997012ae221c600668802f1b761973d9006d330effa9555516432dea9c1"},
+	{"DPRINT_IMAGE", "docker.io/library/rust:1-slim@sha256:7f959043dd9aac68966ba0d35171073de3e76d917a73c7e237e145cdb86de333"},
+	{"GOFMT_IMAGE", "docker.io/library/golang:1@sha256:fb249eca1b9172732de4950b0fb0fb5c231b83c2c90952c56d822d8a9de4d64b"},
+	{"PACKER_IMAGE", "docker.io/library/golang:1@sha256:fb249eca1b9172732de4950b0fb0fb5c231b83c2c90952c56d822d8a9de4d64b"},
+	{"SHFMT_IMAGE", "docker.io/mvdan/shfmt@sha256:4564a08dbbc0c4541c182dd28de8ba5dc4a70045a926b4aca2cf76a8f246f28f"},
+	{"TERRAFORM_IMAGE", "docker.io/library/golang:1@sha256:fb249eca1b9172732de4950b0fb0fb5c231b83c2c90952c56d822d8a9de4d64b"},
+	{"TOMLFMT_IMAGE", "docker.io/library/rust:1-slim@sha256:7f959043dd9aac68966ba0d35171073de3e76d917a73c7e237e145cdb86de333"},
+	{"TXTPBFMT_IMAGE", "docker.io/library/golang:1@sha256:fb249eca1b9172732de4950b0fb0fb5c231b83c2c90952c56d822d8a9de4d64b"},
+}
+
+// presetVersions are the versions of formatters installed in the tool stage.
+var presetVersions = []presetArg{
+	{"YAPF_VERSION", "0.32.0"},
+	{"SQLFORMAT_VERSION", "0.4.2"},
+}
+
+// prettierVersions are the versions of prettier and its plugins.
+var prettierVersions = []presetArg{
+	{"PRETTIER_VERSION", "3.3.3"},
+	{"PRETTIER_PLUGIN_SVELTE_VERSION", "3.2.6"},
+}
+
+// txtpbfmtVersions are the versions of txtpbfmt, built from source.
+var txtpbfmtVersions = []presetArg{
+	{"TXTPBFMT_VERSION", "v0.0.0-20240823084532-8e6b51fa9bef"},
+}
+
+// bufVersions are the versions of buf, built from source.
+var bufVersions = []presetArg{
+	{"BUF_VERSION", "v1.34.0"},
+}
+
+// packerVersions are the versions of packer, built from source.
+var packerVersions = []presetArg{
+	{"PACKER_VERSION", "v1.11.2"},
+}
+
+// terraformVersions are the versions of terraform, built from source.
+var terraformVersions = []presetArg{
+	{"TERRAFORM_VERSION", "v1.9.5"},
+}
+
+// dprintVersions are the versions of dprint, built from source.
+var dprintVersions = []presetArg{
+	{"DPRINT_VERSION", "0.47.2"},
+}
+
+// taploVersions are the versions of taplo, built from source.
+var taploVersions = []presetArg{
+	{"TAPLO_VERSION", "0.9.3"},
+}
+
+// presetSettings tune how formatters format, in the product stage.
+var presetSettings = []presetArg{
+	{"SQL_KEYWORD_CASE", "upper"},
+	{"SQL_COMMA_FIRST", "True"},
+	{"SQL_INDENT_WIDTH", "2"},
+	{"SHFMT_LANG", "posix"},
+	{"SHFMT_INDENT", "0"},
+	{"SHFMT_BINARY_NEXT_LINE", "false"},
+	{"SHFMT_SWITCH_CASE_INDENT", "false"},
+	{"OBJC_STYLE", "google"},
+	{"PROTO_FORMATTER", "clang-format"},
+	{"PROTO_INDENT", "2"},
+	{"TOML_INDENT", "2"},
+	{"TOML_ARRAY_AUTO_EXPAND", "true"},
+	{"TOML_ALIGN_ENTRIES", "false"},
+	{"CSS_PROPERTIES_ORDER", "alphabetical"},
+	{"FORMATTER_THREADS", "1"},
+}
+
+func allPresets() []presetArg {
+	var all []presetArg
+	for _, args := range [][]presetArg{presetImages, presetVersions, prettierVersions, stylelintVersions, txtpbfmtVersions, bufVersions, packerVersions, terraformVersions, taploVersions, dprintVersions, presetSettings} {
+		all = append(all, args...)
+	}
+	return all
+}
+
+// presetArgs declares args, with their overridden value if any.
+func (o *options) presetArgs(args []presetArg) string {
+	var b strings.Builder
+	for _, arg := range args {
+		value := arg.value
+		if v, ok := o.buildArgs[arg.name]; ok {
+			value = v
+		}
+		if strings.ContainsAny(value, " \t\"'\\$") {
+			value = strconv.Quote(value)
+		}
+		b.WriteString("ARG " + arg.name + "=" + value + "\n")
+	}
+	return b.String()
+}
+
+// Override describes a build argument set through WithBuildArg,
+// an ARG_ environment variable or the configuration file's args.
+// Default is empty for arguments fmtd does not know about.
+type Override struct {
+	Arg, Default, Value string
+}
+
+// Overrides lists the build arguments opts settle on a value differing
+// from fmtd's preset, sorted by name. Values are picked as Fmt would:
+// see WithBuildArg, WithEnviron and WithConfig.
+func Overrides(opts ...Option) ([]Override, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	o.resolveBuildArgs()
+
+	defaults := make(map[string]string)
+	for _, arg := range allPresets() {
+		defaults[arg.name] = arg.value
+	}
+
+	var overrides []Override
+	for name, value := range o.buildArgs {
+		if value != defaults[name] {
+			overrides = append(overrides, Override{Arg: name, Default: defaults[name], Value: value})
+		}
+	}
+	sort.Slice(overrides, func(i, j int) bool { return overrides[i].Arg < overrides[j].Arg })
+	return overrides, nil
+}
+
+// rule routes files to a formatter command.
+// Both names and exts are lowercase: a file matches when its lowercased
+// base name equals one of names or ends with one of exts.
+type rule struct {
+	name    string // identifies the formatter
+	comment string
+	names   []string
+	exts    []string
+	cmd     string   // formats "$f" into ../b/"$f"
+	configs []string // files configuring the formatter
+	tools   []string // tools cmd runs
+	verify  string   // checks ../b/"$f" parses, with -verify
+	lines   string   // formats only the lines of "$f" linesFunc lists, with WithOnlyChangedLines
+
+	diagnose bool // records what cmd writes to stderr on success, see WithDiagnostics
+	again    bool // formats the output once more, see WithVerifyIdempotent
+}
+
+// rules are tried in order and files are formatted by the first match.
+// When name rules take precedence (see WithNameRulesFirst) the names
+// of all rules are tried in order before any extension.
+var rules = []rule{
+	{
+		name:    "bazel",
+		comment: "Bazel / Skylark / Starlark",
+		names:   []string{"build", "build.bazel", "workspace", "workspace.bazel", "module.bazel"},
+		exts:    []string{".bazel", ".build", ".bzl", ".sky", ".star"},
+		cmd: `case "$(basename "$f" | tr '[:upper:]' '[:lower:]')" in` +
+			` module.bazel) t=module ;;` +
+			` workspace|workspace.bazel) t=workspace ;;` +
+			` *.bzl) t=bzl ;;` +
+			` *.sky|*.star) t=default ;;` +
+			` *) t=build ;;` +
+			` esac && cp "$f" ../b/"$f" && buildifier -lint=fix -type="$t" ../b/"$f"`,
+		configs: []string{".buildifier.json"},
+		tools:   []string{"buildifier"},
+	},
+	{
+		name:    "proto",
+		comment: "Protocol Buffers, with either clang-format or buf",
+		exts:    []string{".proto"},
+		cmd: `case "$PROTO_FORMATTER" in` +
+			` clang-format) clang-format -style="{BasedOnStyle: Google, IndentWidth: $PROTO_INDENT}" "$f" ;;` +
+			` buf) buf format "$f" ;;` +
+			` *) echo "unexpected PROTO_FORMATTER=$PROTO_FORMATTER" >&2; false ;;` +
+			` esac >../b/"$f"`,
+		configs: []string{".clang-format", "_clang-format", "buf.yaml"},
+		tools:   []string{"clang-format", "buf"},
+	},
+	{
+		name:    "textproto",
+		comment: "Protocol Buffers text format",
+		exts:    []string{".textproto", ".txtpb"},
+		cmd:     `cp "$f" ../b/"$f" && txtpbfmt ../b/"$f"`,
+		tools:   []string{"txtpbfmt"},
+	},
+	{
+		name:    "clang-format",
+		comment: "C / C++ / Objective-C / Objective-C++",
+		exts:    []string{".c", ".cc", ".cpp", ".h", ".hh", ".m", ".mm"},
+		cmd:     clangFormatStyle + `clang-format -style="$style" -sort-includes "$f" >../b/"$f"`,
+		lines:   clangFormatStyle + `clang-format -style="$style" -sort-includes $(lines --lines=) "$f" >../b/"$f"`,
+		configs: []string{".clang-format", "_clang-format"},
+		tools:   []string{"clang-format"},
+	},
+	// Erlang TODO: *.erl
+	{
+		name:    "go",
+		comment: "Go",
+		exts:    []string{".go"},
+		cmd:     `gofmt -s "$f" >../b/"$f"`,
+		tools:   []string{"gofmt"},
+		verify:  `gofmt -e ../b/"$f" >/dev/null`,
+	},
+	{
+		name:    "jsonc",
+		comment: "JSON with comments (JSONC) and JSON5, keeping comments",
+		names:   []string{"tsconfig.json", "jsconfig.json", "devcontainer.json"},
+		exts:    []string{".jsonc", ".json5"},
+		cmd:     `prettier --parser=json "$f" >../b/"$f"`,
+		configs: prettierConfigs,
+		tools:   []string{"prettier"},
+	},
+	{
+		name:    "json",
+		comment: "JSON",
+		exts:    []string{".json"},
+		cmd:     `cat "$f" | jq -S --tab . >../b/"$f"`,
+		tools:   []string{"jq"},
+		verify:  `jq . ../b/"$f" >/dev/null`,
+	},
+	{
+		name:    "python",
+		comment: "Python",
+		exts:    []string{".py"},
+		cmd:     `yapf --style=google "$f" >../b/"$f"`,
+		configs: []string{".style.yapf", "setup.cfg", "pyproject.toml"},
+		tools:   []string{"yapf"},
+		verify:  `python3 -c 'import ast, sys; ast.parse(open(sys.argv[1]).read(), sys.argv[1])' ../b/"$f"`,
+	},
+	{
+		name:    "shell",
+		comment: "Shell",
+		exts:    []string{".sh"},
+		cmd: `shfmt -s -kp -ln="$SHFMT_LANG" -i="$SHFMT_INDENT"` +
+			` -bn="$SHFMT_BINARY_NEXT_LINE" -ci="$SHFMT_SWITCH_CASE_INDENT" "$f" >../b/"$f"` +
+			` && ` + keepShebang,
+		configs: []string{".editorconfig"},
+		tools:   []string{"shfmt"},
+		verify:  `shfmt -ln="$SHFMT_LANG" ../b/"$f" >/dev/null`,
+	},
+	{
+		name:    "sql",
+		comment: "SQL",
+		exts:    []string{".sql"},
+		cmd:     `sqlformat --keywords="$SQL_KEYWORD_CASE" --reindent --reindent_aligned --use_space_around_operators --indent_width="$SQL_INDENT_WIDTH" $(case "$SQL_COMMA_FIRST" in [Tt]rue) echo --comma_first=True ;; esac) "$f" >../b/"$f"`,
+		tools:   []string{"sqlformat"},
+	},
+	{
+		name:    "toml",
+		comment: "TOML",
+		exts:    []string{".toml"},
+		cmd: `if [ -f /app/taplo.toml ]; then set -- --config=/app/taplo.toml;` +
+			` else set -- --no-auto-config --option=indent_string="$(printf '%*s' "$TOML_INDENT" '')"` +
+			` --option=array_auto_expand="$TOML_ARRAY_AUTO_EXPAND" --option=align_entries="$TOML_ALIGN_ENTRIES"; fi` +
+			` && taplo fmt "$@" --stdin-filepath="$f" - <"$f" >../b/"$f"`,
+		configs: taploConfigs,
+		tools:   []string{"taplo"},
+		verify:  `taplo get --file-path=../b/"$f" --output-format=json >/dev/null`,
+	},
+	{
+		name:    "vue",
+		comment: "Vue single-file components",
+		exts:    []string{".vue"},
+		cmd:     `prettier "$f" >../b/"$f"`,
+		configs: prettierConfigs,
+		tools:   []string{"prettier"},
+	},
+	{
+		name:    "svelte",
+		comment: "Svelte components",
+		exts:    []string{".svelte"},
+		cmd:     `prettier --plugin=/opt/prettier/node_modules/prettier-plugin-svelte/plugin.js "$f" >../b/"$f"`,
+		configs: prettierConfigs,
+		tools:   []string{"prettier"},
+	},
+	{
+		name:    "packer",
+		comment: "Packer templates",
+		exts:    []string{".pkr.hcl", ".pkrvars.hcl"},
+		cmd:     `CHECKPOINT_DISABLE=1 packer fmt - <"$f" >../b/"$f"`,
+		tools:   []string{"packer"},
+	},
+	{
+		name:    "hcl",
+		comment: "HCL: Terraform / Nomad / Terragrunt / ...",
+		exts:    []string{".tf", ".tfvars", ".hcl", ".nomad"},
+		cmd:     `CHECKPOINT_DISABLE=1 terraform fmt -no-color - <"$f" >../b/"$f"`,
+		tools:   []string{"terraform"},
+	},
+	{
+		name:    "css",
+		comment: "CSS / SCSS / Less",
+		exts:    []string{".css", ".scss", ".less"},
+		cmd:     `prettier "$f" >../b/"$f"`,
+		configs: prettierConfigs,
+		tools:   []string{"prettier"},
+	},
+	// YAML TODO: *.yaml|*.yml
+}
+
+// keepShebang restores the shebang line of "$f" byte for byte in ../b/"$f",
+// in case the formatter rewrote it.
+const keepShebang = `if [ "$(head -c2 "$f")" = '#!' ] && [ "$(head -c2 ../b/"$f")" = '#!' ]; then` +
+	` { head -n1 "$f"; tail -n +2 ../b/"$f"; } >../b/"$f".shebang && mv ../b/"$f".shebang ../b/"$f"; fi`
+
+var prettierConfigs = []string{
+	".prettierrc", ".prettierrc.json", ".prettierrc.yaml", ".prettierrc.yml", ".prettierrc.json5",
+	".prettierrc.js", ".prettierrc.cjs", ".prettierrc.mjs", ".prettierrc.toml",
+	"prettier.config.js", "prettier.config.cjs", "prettier.config.mjs",
+}
+
+func (r *rule) matchesName(base string) bool {
+	for _, name := range r.names {
+		if base == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) matchesExt(base string) bool {
+	for _, ext := range r.exts {
+		if strings.HasSuffix(base, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanupRule strips trailing whitespace off text files no rule handles,
+// and has them end with a newline.
+var cleanupRule = rule{
+	name: "cleanup",
+	cmd:  `sed 's/[[:blank:]]*$//' "$f" >../b/"$f" && if [ -n "$(tail -c1 ../b/"$f")" ]; then echo >>../b/"$f"; fi`,
+}
+
+func (r *rule) cmdOrFail() string {
+	if r.diagnose {
+		return "{ " + r.cmd + "; } 2>../stderr && diagnosed " + r.name + " || failed " + r.name
+	}
+	return "{ " + r.cmd + "; } 2>../stderr || failed " + r.name
+}
+
+// verifyOrFail checks the formatted file parses, failing it otherwise
+// so the file is not overwritten.
+func (r *rule) verifyOrFail() string {
+	return `if [ -f ../b/"$f" ]; then { ` + r.verify + `; } 2>../stderr || { echo 'formatted output does not parse' >>../stderr; failed ` + r.name + `; }; fi`
+}
+
+// againOrFail formats the formatted file once more, from ../again laid out as /app
+// along with the files configuring the formatter found next to "$f" or above it,
+// failing it unless this leaves it unchanged so the file is not overwritten.
+func (r *rule) againOrFail() string {
+	var configs string
+	if len(r.configs) != 0 {
+		configs = ` && d="$f" && while [ "$d" != . ]; do d="$(dirname "$d")" && for c in '` + strings.Join(r.configs, `' '`) + `'; do` +
+			` if [ -f "$d/$c" ]; then mkdir -p ../again/a/"$d" && cp "$d/$c" ../again/a/"$d/$c"; fi; done; done`
+	}
+	return `if [ -f ../b/"$f" ]; then` +
+		` mkdir -p ../again/a/"$(dirname "$f")" ../again/b/"$(dirname "$f")" && cp ../b/"$f" ../again/a/"$f"` + configs +
+		` && { (cd ../again/a && { ` + r.cmd + `; }) 2>../stderr || { echo 'formatting the output again failed' >>../stderr; false; }; }` +
+		` && { diff -q ../b/"$f" ../again/b/"$f" >/dev/null || { echo 'formatting the output again changed it' >>../stderr; false; }; }` +
+		` || failed ` + r.name + `; fi`
+}
+
+// arm renders a shell case arm for the given names and extensions.
+func (r *rule) arm(names, exts []string, verify bool) string {
+	patterns := make([]string, 0, 2*len(names)+len(exts))
+	for _, name := range names {
+		patterns = append(patterns, name, "*/"+name)
+	}
+	for _, ext := range exts {
+		patterns = append(patterns, "*"+ext)
+	}
+	return r.armOf(r.comment, patterns, verify)
+}
+
+// armOf renders a shell case arm for the given patterns.
+func (r *rule) armOf(comment string, patterns []string, verify bool) string {
+	cmd := r.cmdOrFail()
+	if verify && r.verify != "" {
+		cmd += "; " + r.verifyOrFail()
+	}
+	if r.again {
+		cmd += "; " + r.againOrFail()
+	}
+	return "      # " + comment + "\n" +
+		"        " + strings.Join(patterns, "|") + ") " + cmd + " ;; \\\n"
+}
+
+// ruleFor returns the rule formatting filename, or nil if none does.
+// This mirrors the case statement rendered by caseArms.
+func (o *options) ruleFor(filename string) *rule {
+	if r, ok := o.detected[filename]; ok {
+		return r
+	}
+	base := strings.ToLower(path.Base(filepath.ToSlash(filename)))
+	if o.nameRulesFirst {
+		for i := range rules {
+			if rules[i].matchesName(base) {
+				return &rules[i]
+			}
+		}
+		for i := range rules {
+			if rules[i].matchesExt(base) {
+				return &rules[i]
+			}
+		}
+		return nil
+	}
+	for i := range rules {
+		if rules[i].matchesName(base) || rules[i].matchesExt(base) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// formatter returns how files r matches are formatted: per r,
+// through dprint (see WithDprint) or by changed lines (see WithOnlyChangedLines).
+func (o *options) formatter(r *rule) *rule {
+	f := *r
+	f.again = o.idempotent
+	switch {
+	case o.dprint[r.name]:
+		f.cmd, f.tools = dprintRule.cmd, dprintRule.tools
+	case o.sortCSS && r.name == "css":
+		f.cmd, f.tools = r.cmd+" && "+sortCSSProperties, append([]string{"stylelint"}, r.tools...)
+	case len(o.changedLines) != 0 && r.lines != "":
+		f.cmd = r.lines
+		f.again = false // the changed lines are those of the original file
+	}
+	f.diagnose = o.diagnose
+	return &f
+}
+
+// caseArms renders the needed rules as arms of the Dockerfile's case statement.
+// needed == nil means all rules.
+func (o *options) caseArms(needed map[string]bool) string {
+	var b strings.Builder
+	for i := range rules {
+		if r := &rules[i]; needed == nil || needed[r.name] {
+			b.WriteString(o.detectedArm(r))
+		}
+	}
+	if o.nameRulesFirst {
+		for i := range rules {
+			if r := &rules[i]; len(r.names) != 0 && (needed == nil || needed[r.name]) {
+				b.WriteString(o.formatter(r).arm(r.names, nil, o.verify))
+			}
+		}
+		for i := range rules {
+			if r := &rules[i]; len(r.exts) != 0 && (needed == nil || needed[r.name]) {
+				b.WriteString(o.formatter(r).arm(nil, r.exts, o.verify))
+			}
+		}
+		return b.String()
+	}
+	for i := range rules {
+		if r := &rules[i]; needed == nil || needed[r.name] {
+			b.WriteString(o.formatter(r).arm(r.names, r.exts, o.verify))
+		}
+	}
+	return b.String()
+}
+
+// printInputStats writes how many files and bytes each formatter is given.
+func (o *options) printInputStats(sizes map[string]int64) {
+	type stat struct {
+		files int
+		bytes int64
+	}
+	stats := make(map[string]*stat)
+	var groups []string
+	for filename, size := range sizes {
+		group := "unhandled " + path.Ext(filepath.ToSlash(filename))
+		if r := o.ruleFor(filename); r != nil {
+			group = r.name
+		}
+		if _, ok := stats[group]; !ok {
+			stats[group] = &stat{}
+			groups = append(groups, group)
+		}
+		stats[group].files++
+		stats[group].bytes += size
+	}
+	sort.Strings(groups)
+	for _, group := range groups {
+		fmt.Fprintf(o.verbose, "fmtd: %s: %d files, %d bytes\n", group, stats[group].files, stats[group].bytes)
+	}
+}
@@ -0,0 +1,709 @@
+package fmtd
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestREADMEMentionsEveryPresetArg(t *testing.T) {
+	data, err := os.ReadFile("README.md")
+	require.NoError(t, err)
+
+	mentioned := make(map[string]string)
+	for _, m := range regexp.MustCompile(`(?m)^export ARG_([A-Z_]+)=(.+)$`).FindAllStringSubmatch(string(data), -1) {
+		mentioned[m[1]] = m[2]
+	}
+
+	presets := make(map[string]string)
+	for _, arg := range allPresets() {
+		if arg.name != "ALPINE" {
+			presets[arg.name] = arg.value
+		}
+	}
+	require.Equal(t, presets, mentioned)
+}
+
+func TestPresetImagesArePinned(t *testing.T) {
+	for _, arg := range presetImages {
+		require.Regexp(t, digestSuffix, arg.value, arg.name)
+	}
+}
+
+func TestRuleFor(t *testing.T) {
+	for _, namesfirst := range []bool{false, true} {
+		o := &options{nameRulesFirst: namesfirst}
+		for filename, expected := range map[string]string{
+			"BUILD.bazel":           "bazel",
+			"sub/BUILD.bazel":       "bazel",
+			"sub/WORKSPACE":         "bazel",
+			"rules.bzl":             "bazel",
+			"MODULE.bazel":          "bazel",
+			"sub/BUILD":             "bazel",
+			"tools/defs.bazel":      "bazel",
+			"schema.proto":          "proto",
+			"api/v1/schema.PROTO":   "proto",
+			"lib.cc":                "clang-format",
+			"main.go":               "go",
+			"some.json":             "json",
+			"tsconfig.json":         "jsonc",
+			"web/tsconfig.json":     "jsonc",
+			"settings.jsonc":        "jsonc",
+			"config.json5":          "jsonc",
+			"testdata/formatted.py": "python",
+			"main.tf":               "hcl",
+			"prod.tfvars":           "hcl",
+			"terragrunt.hcl":        "hcl",
+			"job.nomad":             "hcl",
+			"image.pkr.hcl":         "packer",
+			"vars.pkrvars.hcl":      "packer",
+			"IMAGE.PKR.HCL":         "packer",
+			"config.textproto":      "textproto",
+			"data.txtpb":            "textproto",
+			"some.xyz":              "",
+			"build.bazel.xyz":       "",
+		} {
+			var name string
+			if r := o.ruleFor(filename); r != nil {
+				name = r.name
+			}
+			require.Equal(t, expected, name, filename)
+		}
+	}
+}
+
+func TestInterpreterLanguage(t *testing.T) {
+	for line, expected := range map[string]string{
+		"#!/usr/bin/env python3\n":       "python",
+		"#!/usr/bin/python3.11 -u\n":     "python",
+		"#! /bin/sh\n":                   "shell",
+		"#!/usr/bin/env -S bash -e\n":    "shell",
+		"#!/usr/bin/env LC_ALL=C bash\n": "shell",
+		"#!/bin/ksh93":                   "shell",
+		"#!/usr/bin/env node\n":          "",
+		"#!\n":                           "",
+		"import os\n":                    "",
+		"# !/bin/sh\n":                   "",
+		"#!/usr/local/bin/pythonista\n":  "",
+	} {
+		require.Equal(t, expected, interpreterLanguage(line), line)
+	}
+}
+
+func TestCaseArmsOrdering(t *testing.T) {
+	extsAt := func(arms string) int { return strings.Index(arms, "*.bazel|") }
+	namesAt := func(arms string) int { return strings.Index(arms, "build|*/build|") }
+
+	arms := (&options{nameRulesFirst: false}).caseArms(nil)
+	require.Contains(t, arms, "|module.bazel|*/module.bazel|*.bazel|*.build|")
+	require.Less(t, namesAt(arms), extsAt(arms))
+	require.Less(t, extsAt(arms), strings.Index(arms, "*.proto"))
+
+	arms = (&options{nameRulesFirst: true}).caseArms(nil)
+	require.Less(t, namesAt(arms), strings.Index(arms, "*.proto"))
+	require.Less(t, strings.Index(arms, "*.proto"), strings.Index(arms, "*.go)"))
+	require.Less(t, strings.Index(arms, "module.bazel)"), extsAt(arms))
+}
+
+func TestCaseArmsReportFailures(t *testing.T) {
+	arms := (&options{}).caseArms(nil)
+	require.Contains(t, arms, `*.go) { gofmt -s "$f" >../b/"$f"; } 2>../stderr || failed go ;; \`)
+}
+
+func TestProtoImportsInPlace(t *testing.T) {
+	arms := (&options{}).caseArms(nil)
+	require.Contains(t, arms, `clang-format) clang-format -style="{BasedOnStyle: Google, IndentWidth: $PROTO_INDENT}" "$f" ;;`)
+}
+
+func TestSettingsReachFormatters(t *testing.T) {
+	dockerfile := string((&options{sortCSS: true}).dockerfile(true, nil))
+	product := dockerfile[strings.Index(dockerfile, "FROM tool AS product\n"):]
+	for _, arg := range presetSettings {
+		require.Contains(t, product, "ARG "+arg.name+"="+arg.value+"\n")
+		require.Contains(t, product, "$"+arg.name)
+	}
+}
+
+func TestUniversalCleanup(t *testing.T) {
+	otherwise := func(o *options, complain bool) string {
+		dockerfile := string(o.dockerfile(complain, nil))
+		return dockerfile[strings.Index(dockerfile, "        *) "):]
+	}
+
+	require.True(t, strings.HasPrefix(otherwise(&options{}, true), `        *) echo "! $f" >>../stdout ;;`))
+	require.True(t, strings.HasPrefix(otherwise(&options{}, false), `        *)  ;;`))
+
+	arm := otherwise(&options{cleanup: true}, true)
+	require.True(t, strings.HasPrefix(arm, `        *) if grep -Iq . "$f"; then { sed `), arm)
+	require.Contains(t, arm, `failed cleanup; else echo "! $f" >>../stdout; fi ;;`)
+	arm = otherwise(&options{cleanup: true}, false)
+	require.Contains(t, arm, `failed cleanup; else :; fi ;;`)
+}
+
+func TestSelfTestSamples(t *testing.T) {
+	o := &options{}
+	for _, r := range rules {
+		sample, ok := selfTestSamples[r.name]
+		require.True(t, ok, r.name)
+		require.Equal(t, r.name, o.ruleFor(sample.filename).name)
+	}
+	require.Len(t, selfTestSamples, len(rules))
+}
+
+func TestDockerfileOnlyNeededFormatters(t *testing.T) {
+	o := &options{}
+	all := string(o.dockerfile(true, nil))
+	for _, r := range rules {
+		if optInLanguages[r.name] {
+			require.NotContains(t, all, "      # "+r.comment+"\n")
+			continue
+		}
+		require.Contains(t, all, "      # "+r.comment+"\n")
+	}
+	for _, tool := range tools {
+		if tool.name == "dprint" || tool.name == "stylelint" {
+			continue // Only used with WithDprint or WithSortCSSProperties
+		}
+		require.Contains(t, all, tool.from)
+		require.Contains(t, all, tool.copy)
+		require.Contains(t, all, tool.stage)
+	}
+	require.Contains(t, all, "  --mount=type=cache,target=/root/.cache/pip \\\n")
+
+	goOnly := string(o.dockerfile(true, o.neededFormatters([]string{"a.go", "b/c.go", "some.xyz"})))
+	require.Contains(t, goOnly, "FROM --platform=$BUILDPLATFORM $GOFMT_IMAGE AS golang\n")
+	require.Contains(t, goOnly, "COPY --from=golang ")
+	require.Contains(t, goOnly, "      # Go\n")
+	for _, omitted := range []string{"$TOMLFMT_IMAGE AS", "COPY --from=taplo ", "prettier", "apk add", "pip3", "/root/.cache/pip", "      # JSON\n"} {
+		require.NotContains(t, goOnly, omitted)
+	}
+
+	proto := string(o.dockerfile(true, o.neededFormatters([]string{"a.proto"})))
+	require.Contains(t, proto, "COPY --from=buf ")
+	require.Contains(t, proto, "COPY --from=clang-format ")
+	require.NotContains(t, proto, "      # C / C++")
+}
+
+func TestDockerfileTxtpbfmtStage(t *testing.T) {
+	o := &options{}
+	textproto := string(o.dockerfile(true, o.neededFormatters([]string{"a.textproto"})))
+	require.Contains(t, textproto, "FROM --platform=$BUILDPLATFORM $TXTPBFMT_IMAGE AS txtpbfmt\n"+
+		"ARG TXTPBFMT_VERSION=")
+	require.Contains(t, textproto, "\nRUN \\\n"+
+		"  --mount=type=cache,target=/go/pkg/mod \\\n"+
+		"    set -ux \\\n"+
+		" && CGO_ENABLED=0 GOBIN=/usr/local/bin go install github.com/protocolbuffers/txtpbfmt/cmd/txtpbfmt@\"$TXTPBFMT_VERSION\"\n")
+	require.NotContains(t, textproto, "\\\\")
+	require.Contains(t, textproto, "COPY --from=txtpbfmt /usr/local/bin/txtpbfmt /usr/bin/txtpbfmt\n")
+}
+
+func TestDockerfileHCLStages(t *testing.T) {
+	o := &options{}
+	hcl := string(o.dockerfile(true, o.neededFormatters([]string{"main.tf", "image.pkr.hcl"})))
+	for _, name := range []string{"packer", "terraform"} {
+		up := strings.ToUpper(name)
+		require.Contains(t, hcl, "FROM --platform=$BUILDPLATFORM $"+up+"_IMAGE AS "+name+"\nARG "+up+"_VERSION=v")
+		require.Contains(t, hcl, ` && git clone --depth=1 --branch="$`+up+`_VERSION" https://github.com/hashicorp/`+name+` /src/`+name+` \`)
+		require.Contains(t, hcl, "COPY --from="+name+" /usr/local/bin/"+name+" /usr/bin/"+name+"\n")
+	}
+}
+
+func TestDockerfileOmitsDisabledLanguages(t *testing.T) {
+	o := &options{
+		disabled: map[string]bool{"sql": true},
+		config:   &Config{Languages: map[string]bool{"toml": false, "go": true}},
+	}
+	for _, dockerfile := range []string{
+		string(o.dockerfile(true, nil)),
+		string(o.dockerfile(true, o.neededFormatters([]string{"a.go", "b.sql", "c.toml"}))),
+	} {
+		require.Contains(t, dockerfile, "      # Go\n")
+		require.NotContains(t, dockerfile, "      # SQL\n")
+		require.NotContains(t, dockerfile, "      # TOML\n")
+		require.NotContains(t, dockerfile, "$TOMLFMT_IMAGE AS")
+	}
+}
+
+func TestContainerUser(t *testing.T) {
+	require.NotContains(t, string((&options{}).dockerfile(true, nil)), "USER")
+
+	o := &options{}
+	require.Equal(t, ErrNegativeContainerUser, WithContainerUser(-1, 1000)(o))
+	require.NoError(t, WithContainerUser(1000, 1001)(o))
+	dockerfile := string(o.dockerfile(true, nil))
+	require.Contains(t, dockerfile, "\nFROM tool AS product\n")
+	product := dockerfile[strings.Index(dockerfile, "\nFROM tool AS product\n"):]
+	require.Contains(t, product, "\n"+
+		"RUN chown 1000:1001 /app /app/a /app/b /app/stdout /app/errors\n"+
+		"USER 1000:1001\n"+
+		"COPY --chown=1000:1001 a /app/a/\n"+
+		"RUN \\\n")
+}
+
+// runArm runs the case arm of rule name on a file f holding contents,
+// with the given fake tools on $PATH, the way the Dockerfile would.
+// It returns the directory holding a/, b/ and the sidecar files.
+func runArm(t *testing.T, o *options, name string, fakes map[string]string, f, contents string) string {
+	return runArmWith(t, o, name, fakes, f, map[string]string{f: contents})
+}
+
+// runArmWith is runArm with files (f among them) laid out under a/.
+func runArmWith(t *testing.T, o *options, name string, fakes map[string]string, f string, files map[string]string) string {
+	bin, dir := t.TempDir(), t.TempDir()
+	for tool, script := range fakes {
+		require.NoError(t, os.WriteFile(filepath.Join(bin, tool), []byte(script), 0700))
+	}
+	for _, sub := range []string{"a", "b"} {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, sub), 0700))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "stdout"), nil, 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "errors"), nil, 0600))
+	for fn, contents := range files {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "a", filepath.Dir(fn)), 0700))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "a", fn), []byte(contents), 0600))
+	}
+
+	if len(o.changedLines) != 0 {
+		lines := o.linesFile()
+		lines = strings.TrimSuffix(strings.SplitN(lines, "\n", 2)[1], "LINES\n")
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "lines"), []byte(lines), 0600))
+	}
+
+	r := findRule(name)
+	script := failedFunc + "\n" + diagnosedFunc + "\n" + linesFunc + "\nf=" + f + "\nmkdir -p ../b/\"$(dirname \"$f\")\"\ncase \"$(echo \"$f\" | tr '[:upper:]' '[:lower:]')\" in \\\n" +
+		o.formatter(r).arm(r.names, r.exts, o.verify) + "esac\n"
+	cmd := exec.Command("/bin/sh", "-c", script)
+	cmd.Dir = filepath.Join(dir, "a")
+	cmd.Env = append(os.Environ(), "PATH="+bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+	return dir
+}
+
+func TestVerifyRejectsCorruptOutput(t *testing.T) {
+	require.NotContains(t, (&options{}).caseArms(nil), "does not parse")
+	require.Contains(t, (&options{verify: true}).caseArms(nil), "does not parse")
+
+	// A gofmt that parses fine but formats to garbage
+	gofmt := `#!/bin/sh
+if [ "$1" = -e ]; then
+  grep -q '^package ' "$2" || { echo "$2:1:1: expected 'package', found garbage" >&2; exit 2; }
+  exit 0
+fi
+echo garbage
+`
+	dir := runArm(t, &options{verify: true}, "go", map[string]string{"gofmt": gofmt}, "x.go", "package    p\n")
+
+	require.NoFileExists(t, filepath.Join(dir, "b", "x.go"))
+	stdout, err := os.ReadFile(filepath.Join(dir, "stdout"))
+	require.NoError(t, err)
+	require.Equal(t, "E x.go\n", string(stdout))
+	errs, err := os.ReadFile(filepath.Join(dir, "errors"))
+	require.NoError(t, err)
+	require.Equal(t, "go x.go\n  ../b/x.go:1:1: expected 'package', found garbage\n  formatted output does not parse\n", string(errs))
+}
+
+func TestVerifyIdempotent(t *testing.T) {
+	require.NotContains(t, (&options{}).caseArms(nil), "formatting the output again")
+	require.Contains(t, (&options{idempotent: true}).caseArms(nil), "formatting the output again")
+	o := &options{idempotent: true, changedLines: map[string][]lineRange{"x.c": {{1, 1}}}}
+	require.NotContains(t, o.formatter(findRule("clang-format")).arm(nil, []string{".c"}, false), "formatting the output again")
+
+	// A gofmt squeezing spaces, which is idempotent
+	stable := "#!/bin/sh\nsed 's/  */ /g' \"$2\"\n"
+	dir := runArm(t, &options{idempotent: true}, "go", map[string]string{"gofmt": stable}, "x.go", "package    p\n")
+	formatted, err := os.ReadFile(filepath.Join(dir, "b", "x.go"))
+	require.NoError(t, err)
+	require.Equal(t, "package p\n", string(formatted))
+	errs, err := os.ReadFile(filepath.Join(dir, "errors"))
+	require.NoError(t, err)
+	require.Empty(t, string(errs))
+
+	// A gofmt adding a line each time
+	unstable := "#!/bin/sh\ncat \"$2\" && echo '// again'\n"
+	dir = runArm(t, &options{idempotent: true}, "go", map[string]string{"gofmt": unstable}, "x.go", "package p\n")
+	require.NoFileExists(t, filepath.Join(dir, "b", "x.go"))
+	stdout, err := os.ReadFile(filepath.Join(dir, "stdout"))
+	require.NoError(t, err)
+	require.Equal(t, "E x.go\n", string(stdout))
+	errs, err = os.ReadFile(filepath.Join(dir, "errors"))
+	require.NoError(t, err)
+	require.Equal(t, "go x.go\n  formatting the output again changed it\n", string(errs))
+
+	// A yapf indenting per the setup.cfg closest to the file, if any
+	yapf := `#!/bin/sh
+indent=4 d="$2"
+while [ "$d" != . ]; do d="$(dirname "$d")"; if [ -f "$d/setup.cfg" ]; then indent="$(cat "$d/setup.cfg")"; break; fi; done
+sed "s/^  */$(printf "%${indent}s")/" "$2"
+`
+	dir = runArmWith(t, &options{idempotent: true}, "python", map[string]string{"yapf": yapf}, "pkg/x.py",
+		map[string]string{"pkg/x.py": "def f():\n        return 1\n", "setup.cfg": "2"})
+	formatted, err = os.ReadFile(filepath.Join(dir, "b", "pkg", "x.py"))
+	require.NoError(t, err)
+	require.Equal(t, "def f():\n  return 1\n", string(formatted))
+	errs, err = os.ReadFile(filepath.Join(dir, "errors"))
+	require.NoError(t, err)
+	require.Empty(t, string(errs))
+
+	// Without the option the unstable formatter goes unnoticed
+	dir = runArm(t, &options{}, "go", map[string]string{"gofmt": unstable}, "x.go", "package p\n")
+	require.FileExists(t, filepath.Join(dir, "b", "x.go"))
+}
+
+func TestSQLCommaFirst(t *testing.T) {
+	// A sqlformat listing its --comma_first flags, which it reads as true whatever their value
+	sqlformat := "#!/bin/sh\nfor a; do case \"$a\" in --comma_first*) echo \"$a\" ;; esac; done\n"
+	for value, expected := range map[string]string{
+		"True":  "--comma_first=True\n",
+		"true":  "--comma_first=True\n",
+		"False": "",
+		"false": "",
+	} {
+		t.Setenv("SQL_COMMA_FIRST", value)
+		dir := runArm(t, &options{}, "sql", map[string]string{"sqlformat": sqlformat}, "x.sql", "select 1\n")
+		formatted, err := os.ReadFile(filepath.Join(dir, "b", "x.sql"))
+		require.NoError(t, err)
+		require.Equal(t, expected, string(formatted), value)
+	}
+}
+
+func TestShellKeepsShebang(t *testing.T) {
+	// A shfmt rewriting the shebang line along with the rest
+	shfmt := `#!/bin/sh
+eval "f=\${$#}"
+sed -e '1s/-S bash -e/bash/' -e 's/;  */\n/' "$f"
+`
+	for contents, expected := range map[string]string{
+		"#!/usr/bin/env -S bash -e\na=1;  b=2\n":  "#!/usr/bin/env -S bash -e\na=1\nb=2\n",
+		"# not a shebang -S bash -e\na=1;  b=2\n": "# not a shebang bash\na=1\nb=2\n",
+		"#!/usr/bin/env -S bash -e\n":             "",
+	} {
+		dir := runArm(t, &options{}, "shell", map[string]string{"shfmt": shfmt}, "x.sh", contents)
+		formatted, err := os.ReadFile(filepath.Join(dir, "b", "x.sh"))
+		require.NoError(t, err, contents)
+		if expected == "" {
+			expected = contents
+		}
+		require.Equal(t, expected, string(formatted), contents)
+		require.NoFileExists(t, filepath.Join(dir, "b", "x.sh.shebang"))
+	}
+}
+
+func TestBuildifierType(t *testing.T) {
+	// A buildifier telling which type it was given
+	buildifier := `#!/bin/sh
+echo "$2" >"$3"
+`
+	for f, expected := range map[string]string{
+		"MODULE.bazel":    "-type=module",
+		"BUILD.bazel":     "-type=build",
+		"BUILD":           "-type=build",
+		"defs.bazel":      "-type=build",
+		"WORKSPACE":       "-type=workspace",
+		"WORKSPACE.bazel": "-type=workspace",
+		"rules.bzl":       "-type=bzl",
+		"config.star":     "-type=default",
+	} {
+		dir := runArm(t, &options{}, "bazel", map[string]string{"buildifier": buildifier}, f, "x\n")
+		formatted, err := os.ReadFile(filepath.Join(dir, "b", f))
+		require.NoError(t, err, f)
+		require.Equal(t, expected+"\n", string(formatted), f)
+	}
+}
+
+func TestObjectiveCStyle(t *testing.T) {
+	// A clang-format writing out the style it was given
+	clangFormat := `#!/bin/sh
+echo "$1"
+`
+	t.Setenv("OBJC_STYLE", "WebKit")
+	for f, expected := range map[string]string{
+		"x.c":   "-style=google",
+		"x.cpp": "-style=google",
+		"x.h":   "-style=google",
+		"x.m":   "-style=WebKit",
+		"x.mm":  "-style=WebKit",
+		"X.M":   "-style=WebKit",
+	} {
+		dir := runArm(t, &options{}, "clang-format", map[string]string{"clang-format": clangFormat}, f, "int x;\n")
+		formatted, err := os.ReadFile(filepath.Join(dir, "b", f))
+		require.NoError(t, err, f)
+		require.Equal(t, expected+"\n", string(formatted), f)
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	// A buildifier fixing what it can and warning about the rest
+	buildifier := `#!/bin/sh
+cat "$3" >/dev/null
+echo "$3:1: native-cc: Function \"cc_library\" is not global anymore (https://github.com/bazelbuild/buildtools/blob/main/WARNINGS.md#native-cc)" >&2
+`
+	fakes := map[string]string{"buildifier": buildifier}
+
+	dir := runArm(t, &options{}, "bazel", fakes, "BUILD", "cc_library(name = \"x\")\n")
+	require.NoFileExists(t, filepath.Join(dir, "diagnostics"))
+
+	o := &options{}
+	require.NoError(t, WithDiagnostics(true)(o))
+	dir = runArm(t, o, "bazel", fakes, "BUILD", "cc_library(name = \"x\")\n")
+	diagnostics, err := os.ReadFile(filepath.Join(dir, "diagnostics"))
+	require.NoError(t, err)
+	require.Equal(t, ""+
+		"bazel BUILD\n"+
+		"  ../b/BUILD:1: native-cc: Function \"cc_library\" is not global anymore (https://github.com/bazelbuild/buildtools/blob/main/WARNINGS.md#native-cc)\n",
+		string(diagnostics))
+	errs, err := os.ReadFile(filepath.Join(dir, "errors"))
+	require.NoError(t, err)
+	require.Empty(t, errs)
+	require.FileExists(t, filepath.Join(dir, "b", "BUILD"))
+
+	rs := withDiagnostics([]Result{{Path: "a.go", Status: StatusChanged}}, string(diagnostics))
+	require.Equal(t, []Result{
+		{Path: "a.go", Status: StatusChanged},
+		{
+			Path:        "BUILD",
+			Status:      StatusDiagnosed,
+			Formatter:   "bazel",
+			Diagnostics: "../b/BUILD:1: native-cc: Function \"cc_library\" is not global anymore (https://github.com/bazelbuild/buildtools/blob/main/WARNINGS.md#native-cc)\n",
+		},
+	}, rs)
+
+	var out bytes.Buffer
+	require.NoError(t, (&options{}).printResults(&out, rs, nil))
+	require.Equal(t, ""+
+		"a.go\n"+
+		"W BUILD\n"+
+		"  ../b/BUILD:1: native-cc: Function \"cc_library\" is not global anymore (https://github.com/bazelbuild/buildtools/blob/main/WARNINGS.md#native-cc)\n",
+		out.String())
+}
+
+func TestDprint(t *testing.T) {
+	require.EqualError(t, WithDprint([]string{"go"})(&options{}), `dprint cannot format "go" files`)
+
+	o := &options{}
+	require.NoError(t, WithDprint([]string{"json", "toml"})(o))
+	require.NoError(t, o.loadDprintConfig(t.TempDir()))
+	arms := o.caseArms(nil)
+	require.Contains(t, arms, `*.json) { dprint fmt --config=/app/dprint.json --stdin "${f##*.}" <"$f" >../b/"$f"; } 2>../stderr || failed json ;;`)
+	require.Contains(t, arms, `*.toml) { dprint fmt --config=/app/dprint.json --stdin "${f##*.}" <"$f" >../b/"$f"; } 2>../stderr || failed toml ;;`)
+	require.Contains(t, arms, `*.py) { yapf `)
+	require.NotContains(t, arms, "jq")
+
+	dockerfile := string(o.dockerfile(true, o.neededFormatters([]string{"a.json", "b.toml"})))
+	require.Contains(t, dockerfile, "FROM --platform=$BUILDPLATFORM $DPRINT_IMAGE AS dprint\nARG DPRINT_VERSION=0.47.2\n")
+	require.Contains(t, dockerfile, "COPY --from=dprint /usr/local/cargo/bin/dprint /usr/bin/dprint\n")
+	require.Contains(t, dockerfile, `{"plugins": ["https://plugins.dprint.dev/json-0.19.3.wasm", "https://plugins.dprint.dev/toml-0.6.2.wasm"]}`)
+	for _, omitted := range []string{"jq", "$TOMLFMT_IMAGE AS", "COPY --from=taplo "} {
+		require.NotContains(t, dockerfile, omitted)
+	}
+
+	pwd := t.TempDir()
+	config := `{"indentWidth": 4, "plugins": ["https://plugins.dprint.dev/json-0.19.3.wasm"]}`
+	require.NoError(t, os.WriteFile(filepath.Join(pwd, "dprint.json"), []byte(config+"\n"), 0600))
+	require.NoError(t, o.loadDprintConfig(pwd))
+	dockerfile = string(o.dockerfile(true, o.neededFormatters([]string{"a.json"})))
+	require.Contains(t, dockerfile, "COPY <<\"DPRINT_JSON\" /app/dprint.json\n"+config+"\nDPRINT_JSON\n")
+	require.NotContains(t, dockerfile, "toml-0.6.2.wasm")
+}
+
+func TestTaplo(t *testing.T) {
+	// A taplo recording its arguments
+	taplo := `#!/bin/sh
+for arg in "$@"; do echo "$arg"; done
+`
+	t.Setenv("TOML_INDENT", "4")
+	t.Setenv("TOML_ARRAY_AUTO_EXPAND", "false")
+	t.Setenv("TOML_ALIGN_ENTRIES", "true")
+	dir := runArm(t, &options{}, "toml", map[string]string{"taplo": taplo}, "Cargo.toml", "a=1\n")
+	args, err := os.ReadFile(filepath.Join(dir, "b", "Cargo.toml"))
+	require.NoError(t, err)
+	require.Equal(t, "fmt\n--no-auto-config\n--option=indent_string=    \n--option=array_auto_expand=false\n"+
+		"--option=align_entries=true\n--stdin-filepath=Cargo.toml\n-\n", string(args))
+
+	o := &options{}
+	require.NoError(t, o.loadTaploConfig(t.TempDir()))
+	dockerfile := string(o.dockerfile(true, o.neededFormatters([]string{"Cargo.toml"})))
+	require.Contains(t, dockerfile, "FROM --platform=$BUILDPLATFORM $TOMLFMT_IMAGE AS taplo\nARG TAPLO_VERSION=0.9.3\n")
+	require.Contains(t, dockerfile, "COPY --from=taplo /usr/local/cargo/bin/taplo /usr/bin/taplo\n")
+	require.Contains(t, dockerfile, "\nARG TOML_INDENT=2\n")
+	require.NotContains(t, dockerfile, "TAPLO_TOML")
+
+	pwd := t.TempDir()
+	config := "[formatting]\narray_auto_collapse = false"
+	require.NoError(t, os.WriteFile(filepath.Join(pwd, ".taplo.toml"), []byte(config+"\n"), 0600))
+	require.NoError(t, o.loadTaploConfig(pwd))
+	dockerfile = string(o.dockerfile(true, o.neededFormatters([]string{"Cargo.toml"})))
+	require.Contains(t, dockerfile, "COPY <<\"TAPLO_TOML\" /app/taplo.toml\n"+config+"\nTAPLO_TOML\n")
+	require.NotContains(t, string(o.dockerfile(true, o.neededFormatters([]string{"a.go"}))), "TAPLO_TOML")
+}
+
+func TestSortCSSProperties(t *testing.T) {
+	// A prettier leaving files as is and a stylelint sorting the lines of declarations
+	fakes := map[string]string{
+		"prettier": "#!/bin/sh\ncat \"$1\"\n",
+		"stylelint": `#!/bin/sh
+eval "f=\${$#}"
+{ head -n1 "$f"; sed '1d;$d' "$f" | sort; tail -n1 "$f"; } >"$f".sorted && mv "$f".sorted "$f"
+`,
+	}
+	css := "a {\n  color: red;\n  background: blue;\n}\n"
+
+	dir := runArm(t, &options{}, "css", fakes, "x.css", css)
+	formatted, err := os.ReadFile(filepath.Join(dir, "b", "x.css"))
+	require.NoError(t, err)
+	require.Equal(t, css, string(formatted))
+
+	t.Setenv("CSS_PROPERTIES_ORDER", "alphabetical")
+	dir = runArm(t, &options{sortCSS: true}, "css", fakes, "x.css", css)
+	formatted, err = os.ReadFile(filepath.Join(dir, "b", "x.css"))
+	require.NoError(t, err)
+	require.Equal(t, "a {\n  background: blue;\n  color: red;\n}\n", string(formatted))
+
+	t.Setenv("CSS_PROPERTIES_ORDER", "random")
+	dir = runArm(t, &options{sortCSS: true}, "css", fakes, "x.css", css)
+	require.NoFileExists(t, filepath.Join(dir, "b", "x.css"))
+	errs, err := os.ReadFile(filepath.Join(dir, "errors"))
+	require.NoError(t, err)
+	require.Equal(t, "css x.css\n  unexpected CSS_PROPERTIES_ORDER=random\n", string(errs))
+
+	o := &options{}
+	require.NotContains(t, string(o.dockerfile(true, o.neededFormatters([]string{"x.css"}))), "stylelint")
+	o.sortCSS = true
+	dockerfile := string(o.dockerfile(true, o.neededFormatters([]string{"x.css"})))
+	require.Contains(t, dockerfile, "COPY --from=stylelint /opt/stylelint /opt/stylelint\n")
+	require.NotContains(t, string(o.dockerfile(true, o.neededFormatters([]string{"x.vue"}))), "stylelint")
+}
+
+func TestClangFormatChangedLines(t *testing.T) {
+	// A clang-format recording its arguments
+	clangFormat := `#!/bin/sh
+echo "$@"
+`
+	o := &options{changedLines: map[string][]lineRange{
+		"x.c":     {{3, 3}, {7, 9}},
+		"other.c": {{1, 1}},
+	}}
+	dir := runArm(t, o, "clang-format", map[string]string{"clang-format": clangFormat}, "x.c", "int  main(){}\n")
+	formatted, err := os.ReadFile(filepath.Join(dir, "b", "x.c"))
+	require.NoError(t, err)
+	require.Equal(t, "-style=google -sort-includes --lines=3:3 --lines=7:9 x.c\n", string(formatted))
+
+	// Files without changed lines listed are formatted whole
+	dir = runArm(t, o, "clang-format", map[string]string{"clang-format": clangFormat}, "new.c", "int  main(){}\n")
+	formatted, err = os.ReadFile(filepath.Join(dir, "b", "new.c"))
+	require.NoError(t, err)
+	require.Equal(t, "-style=google -sort-includes new.c\n", string(formatted))
+
+	dockerfile := string(o.dockerfile(true, nil))
+	require.Contains(t, dockerfile, "COPY <<\"LINES\" /app/lines\nother.c\t1:1\nx.c\t3:3 7:9\nLINES\nCOPY a /app/a/\n")
+	require.Contains(t, dockerfile, " && "+linesFunc+" \\\n")
+	require.Contains(t, dockerfile, `*.c|*.cc|*.cpp|*.h|*.hh|*.m|*.mm) { case "$f" in *.[mM]|*.[mM][mM]) style="$OBJC_STYLE" ;; *) style=google ;; esac && clang-format -style="$style" -sort-includes $(lines --lines=) "$f"`)
+	require.NotContains(t, string((&options{}).dockerfile(true, nil)), "lines")
+}
+
+func TestParseDiffLines(t *testing.T) {
+	diff := `diff --git a/a.c b/a.c
+index 1111111..2222222 100644
+--- a/a.c
++++ b/a.c
+@@ -3 +3 @@ int a;
+-int  b;
++int b;
+@@ -10,0 +11,2 @@ int c;
++int d;
++int e;
+@@ -20,2 +21,0 @@ int f;
+-int g;
+-int h;
+diff --git a/gone.c b/gone.c
+deleted file mode 100644
+--- a/gone.c
++++ /dev/null
+@@ -1 +0,0 @@
+-int x;
+diff --git a/shrunk.c b/shrunk.c
+--- a/shrunk.c
++++ b/shrunk.c
+@@ -1 +0,0 @@
+-int y;
+diff --git "a/sp\303\251cial.c" "b/sp\303\251cial.c"
+--- "a/sp\303\251cial.c"
++++ "b/sp\303\251cial.c"
+@@ -1 +1 @@
+-int  z;
++int z;
+`
+	changes, err := parseDiffLines([]byte(diff))
+	require.NoError(t, err)
+	require.Equal(t, map[string][]lineRange{
+		"a.c":       {{3, 3}, {11, 12}},
+		"shrunk.c":  nil,
+		"spécial.c": {{1, 1}},
+	}, changes)
+}
+
+func TestTimings(t *testing.T) {
+	require.NotContains(t, string((&options{}).dockerfile(true, nil)), timingStart)
+
+	var summary strings.Builder
+	o := &options{timings: &summary}
+	dockerfile := string(o.dockerfile(true, nil))
+	require.Contains(t, dockerfile, "      "+timingStart+" \\\n      && \\\n      case ")
+	require.Contains(t, dockerfile, "      esac \\\n      && \\\n      "+timingEnd+" \\\n")
+
+	// The loop's instructions produce timing lines
+	dir := t.TempDir()
+	script := "f=x.go && " + timingStart + " && sleep 0.01 && " + timingEnd
+	cmd := exec.Command("/bin/sh", "-c", script)
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "a"), 0700))
+	cmd.Dir = filepath.Join(dir, "a")
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+	sidecar, err := os.ReadFile(filepath.Join(dir, "stdout"))
+	require.NoError(t, err)
+	require.Regexp(t, regexp.MustCompile(`^T [0-9]+ x.go\n$`), string(sidecar))
+
+	timings := parseTimings("F a.go\nT 12 a.go\n! c.xyz\nT 3 b.json\nT 40 c.go\nT x bad\n")
+	require.Equal(t, []timing{{"a.go", 12 * time.Millisecond}, {"b.json", 3 * time.Millisecond}, {"c.go", 40 * time.Millisecond}}, timings)
+	o.printTimings(timings)
+	require.Equal(t, `fmtd: 40ms c.go (go)
+fmtd: 12ms a.go (go)
+fmtd: 3ms b.json (json)
+fmtd: go: 2 files in 52ms
+fmtd: json: 1 files in 3ms
+`, summary.String())
+
+	rs, others := results("T 12 a.go\nF a.go\n", map[string]bool{"a.go": true}, nil)
+	require.Equal(t, []Result{{Path: "a.go", Status: StatusChanged}}, rs)
+	require.Empty(t, others)
+}
+
+func TestCanonicalImage(t *testing.T) {
+	for image, expected := range map[string]string{
+		"golang:1":                          "docker.io/library/golang:1",
+		"golang":                            "docker.io/library/golang",
+		"mvdan/shfmt:v3":                    "docker.io/mvdan/shfmt:v3",
+		"docker.io/mvdan/shfmt@sha256:1234": "docker.io/mvdan/shfmt@sha256:1234",
+		"ghcr.io/dprint/dprint:0.47.2":      "ghcr.io/dprint/dprint:0.47.2",
+		"localhost:5000/shfmt:v3":           "localhost:5000/shfmt:v3",
+		"localhost/shfmt":                   "localhost/shfmt",
+	} {
+		require.Equal(t, expected, canonicalImage(image), image)
+	}
+}
+
+func TestNotCompiled(t *testing.T) {
+	pwd := t.TempDir()
+	listed := map[string]bool{filepath.Join(pwd, "src", "a.cc"): true}
+	// Relative names are relative to pwd, not to the current directory
+	require.Empty(t, notCompiled(pwd, listed, filepath.Join("src", "a.cc")))
+	require.Empty(t, notCompiled(pwd, listed, filepath.Join(pwd, "src", "a.cc")))
+	require.Equal(t, "not in compile_commands.json", notCompiled(pwd, listed, filepath.Join("src", "b.cc")))
+}
@@ -0,0 +1,62 @@
+package fmtd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+)
+
+// DefaultGeneratedPatterns match the header comments of generated files,
+// e.g. Go's "// Code generated by protoc-gen-go. DO NOT EDIT."
+var DefaultGeneratedPatterns = []string{
+	`^// Code generated .* DO NOT EDIT\.$`,
+	`@generated\b`,
+	`(?i)\bgenerated by .*\bdo not edit\b`,
+}
+
+// generatedHeaderLines is how many of their first lines are read of files checked for being generated.
+const generatedHeaderLines = 10
+
+// WithSkipGenerated has files be skipped if one of their first lines
+// matches any of the given regular expressions, so generated code is left as generated.
+// Use DefaultGeneratedPatterns to catch the usual headers. Off when patterns is empty.
+// Each call resets the previous setting.
+func WithSkipGenerated(patterns []string) Option {
+	return func(o *options) error {
+		o.generated = make([]*regexp.Regexp, 0, len(patterns))
+		for _, pattern := range patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("bad generated code pattern %q: %w", pattern, err)
+			}
+			o.generated = append(o.generated, re)
+		}
+		return nil
+	}
+}
+
+// generatedFile tells why fn should be skipped for being generated,
+// the same for all files a pattern matches so they are reported together.
+// Files that cannot be read are left for selection to reject.
+func (o *options) generatedFile(fn string) string {
+	f, err := o.open(fn)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	return o.generatedHeader(f)
+}
+
+// generatedHeader tells why the file read from r should be skipped for being generated.
+func (o *options) generatedHeader(r io.Reader) string {
+	s := bufio.NewScanner(io.LimitReader(r, 64<<10))
+	for i := 0; i < generatedHeaderLines && s.Scan(); i++ {
+		for _, re := range o.generated {
+			if re.Match(s.Bytes()) {
+				return "generated, per " + re.String()
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,240 @@
+package fmtd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fenollp/fmtd/buildx"
+)
+
+// FmtGitRef lists the files of the Git tree at ref (e.g. HEAD, a commit hash)
+// in the repository at repoDir that formatters would change, sorted.
+// Files are read from Git's objects: nothing is checked out nor written.
+// They are selected as Fmt selects files, per the same options (e.g. WithIncludeHidden,
+// WithMaxFileSize, WithRequireConfig, WithSkipGenerated) and with the ignore file and
+// configuration files of the tree at ref. Symlinks and submodules are left out.
+func FmtGitRef(ctx context.Context, repoDir, ref string, opts ...Option) ([]string, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	sources := o.resolveBuildArgs()
+	if o.verbose != nil {
+		o.printBuildArgs(sources)
+	}
+	if err := o.loadDprintConfig(repoDir); err != nil {
+		return nil, err
+	}
+	if err := o.loadTaploConfig(repoDir); err != nil {
+		return nil, err
+	}
+
+	blobs, err := o.gitBlobs(ctx, repoDir, ref)
+	if err != nil || len(blobs) == 0 {
+		return nil, err
+	}
+	contents, err := gitCatBlobs(ctx, repoDir, blobs)
+	if err != nil {
+		return nil, err
+	}
+	if len(o.generated) != 0 {
+		kept := blobs[:0]
+		for _, blob := range blobs {
+			if o.generatedHeader(bytes.NewReader(contents[blob.path])) == "" {
+				kept = append(kept, blob)
+			}
+		}
+		if blobs = kept; len(blobs) == 0 {
+			return nil, nil
+		}
+	}
+
+	exe, err := exec.LookPath("docker")
+	if err != nil {
+		return nil, buildx.ErrNoDocker
+	}
+
+	var stderr io.Writer = io.Discard
+	if o.verbose != nil {
+		stderr = o.verbose
+	}
+	var sidecar, errs, diagnostics bytes.Buffer
+	var changed []string
+	options := o.buildOptions(ctx, exe, &sidecar, &errs, &diagnostics, stderr)
+	filenames := make([]string, 0, len(blobs))
+	for _, blob := range blobs {
+		filenames = append(filenames, blob.path)
+		options = append(options, buildx.WithInputFile(blob.path, contents[blob.path]))
+	}
+	options = append(options,
+		buildx.WithDockerfile(func(map[interface{}]interface{}) []byte {
+			return o.dockerfile(false, o.neededFormatters(filenames))
+		}),
+		buildx.WithOutputFileFunc(func(filename string, r io.Reader) error {
+			formatted, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			if _, changes, err := o.finish(filename, contents[filename], formatted); err != nil || !changes {
+				return err
+			}
+			changed = append(changed, filename)
+			return nil
+		}),
+	)
+	if err := buildx.New(options...); err != nil {
+		return nil, err
+	}
+
+	if ferrs := parseFormatErrors(errs.String()); len(ferrs) != 0 {
+		return nil, ferrs[0]
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+type gitBlob struct {
+	object, path string
+	size         int64
+}
+
+// gitBlobs lists the regular files of the tree at ref that should be formatted.
+func (o *options) gitBlobs(ctx context.Context, repoDir, ref string) ([]gitBlob, error) {
+	out, err := git(ctx, repoDir, nil, "ls-tree", "-r", "-z", "-l", "--full-tree", ref)
+	if err != nil {
+		return nil, err
+	}
+	tree := make(map[string]gitBlob)
+	var files []gitBlob
+	for _, entry := range strings.Split(string(out), "\x00") {
+		// <mode> SP <type> SP <object> SP+ <size> TAB <path>
+		tab := strings.IndexByte(entry, '\t')
+		if tab == -1 {
+			continue
+		}
+		fields := strings.Fields(entry[:tab])
+		if len(fields) != 4 || fields[1] != "blob" {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected git ls-tree output %q", entry)
+		}
+		blob := gitBlob{object: fields[2], path: entry[tab+1:], size: size}
+		tree[blob.path] = blob
+		if fields[0] != "120000" {
+			files = append(files, blob)
+		}
+	}
+
+	wanted, err := o.gitBlobWanted(ctx, repoDir, tree)
+	if err != nil {
+		return nil, err
+	}
+	var blobs []gitBlob
+	for _, blob := range files {
+		if wanted(blob) {
+			blobs = append(blobs, blob)
+		}
+	}
+	return blobs, nil
+}
+
+// gitBlobWanted returns a func telling whether Fmt would select a file of tree
+// were it on disk, reading the ignore file and looking for configuration files in tree.
+func (o *options) gitBlobWanted(ctx context.Context, repoDir string, tree map[string]gitBlob) (func(gitBlob) bool, error) {
+	walked, err := buildx.IncludeHiddenFunc(o.includeHidden)
+	if err != nil {
+		return nil, err
+	}
+	ignored := func(string) int { return 0 }
+	if blob, ok := tree[IgnoreFilename]; ok {
+		contents, err := gitCatBlobs(ctx, repoDir, []gitBlob{blob})
+		if err != nil {
+			return nil, err
+		}
+		if ignored, err = buildx.IgnoreFunc(bytes.NewReader(contents[blob.path])); err != nil {
+			return nil, fmt.Errorf("%s:%w", IgnoreFilename, err)
+		}
+	}
+	exists := func(config string) bool {
+		_, ok := tree[config]
+		return ok
+	}
+
+	return func(blob gitBlob) bool {
+		p := blob.path
+		if !walked(p) || ignored(p) != 0 {
+			return false
+		}
+		if o.maxFileSize > 0 && blob.size > o.maxFileSize {
+			return false
+		}
+		base := strings.ToLower(path.Base(p))
+		for _, pattern := range o.skipPatterns {
+			if ok, _ := path.Match(pattern, base); ok {
+				return false
+			}
+		}
+		return o.ruleFor(p) != nil && o.disabledLanguage(p) == "" && o.lackingConfig(p, exists) == ""
+	}, nil
+}
+
+// gitCatBlobs reads the contents of blobs, by path.
+func gitCatBlobs(ctx context.Context, repoDir string, blobs []gitBlob) (map[string][]byte, error) {
+	var objects bytes.Buffer
+	for _, blob := range blobs {
+		objects.WriteString(blob.object + "\n")
+	}
+	out, err := git(ctx, repoDir, &objects, "cat-file", "--batch")
+	if err != nil {
+		return nil, err
+	}
+	contents := make(map[string][]byte, len(blobs))
+	r := bufio.NewReader(bytes.NewReader(out))
+	for _, blob := range blobs {
+		// <object> SP <type> SP <size> LF <contents> LF
+		header, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		fields := strings.Fields(header)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected git cat-file output %q", header)
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size+1)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		contents[blob.path] = data[:size]
+	}
+	return contents, nil
+}
+
+func git(ctx context.Context, repoDir string, stdin io.Reader, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", repoDir}, args...)...)
+	cmd.Stdin = stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("git %s: %w (%s)", args[0], err, msg)
+		}
+		return nil, fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,76 @@
+package fmtd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Manifest lists the images a run pulls, for security tooling to vet them ahead of time.
+type Manifest struct {
+	Images []ManifestImage `json:"images"`
+}
+
+// ManifestImage is an image a run pulls, as set by a preset build argument.
+type ManifestImage struct {
+	Arg    string `json:"arg"`              // e.g. GOFMT_IMAGE
+	Ref    string `json:"ref"`              // overrides included
+	Digest string `json:"digest,omitempty"` // of the image index for multi-platform images, e.g. sha256:...
+}
+
+// WithManifest has the Manifest of the images formatting given files
+// be written to w as JSON instead of files being formatted.
+// Digests of references not pinned to one are resolved as
+// WithImageDigestResolution would, by default with DockerManifestDigest,
+// so that each is the digest the reference is (or would be) pinned to.
+func WithManifest(w io.Writer) Option {
+	return func(o *options) error {
+		o.manifest = w
+		return nil
+	}
+}
+
+var fromArg = regexp.MustCompile(`(?m)^FROM (?:--platform=\S+ )?\$([A-Z][A-Z0-9_]*)\b`)
+
+// manifestImage is the image arg sets, with its digest if pinned to one.
+func (o *options) manifestImage(arg string) ManifestImage {
+	image := ManifestImage{Arg: arg, Ref: o.presetValue(presetImages, arg)}
+	if i := strings.LastIndex(image.Ref, "@"); i != -1 && digestSuffix.MatchString(image.Ref) {
+		image.Digest = image.Ref[i+1:]
+	}
+	return image
+}
+
+// writeManifest writes the Manifest of the images dockerfile pulls.
+func (o *options) writeManifest(ctx context.Context, dockerfile []byte) error {
+	resolve := o.resolveDigest
+	if resolve == nil {
+		resolve = DockerManifestDigest
+	}
+	m := Manifest{Images: []ManifestImage{}}
+	seen := make(map[string]bool)
+	for _, match := range fromArg.FindAllSubmatch(dockerfile, -1) {
+		arg := string(match[1])
+		if seen[arg] {
+			continue
+		}
+		seen[arg] = true
+		image := o.manifestImage(arg)
+		if image.Digest == "" {
+			digest, err := resolve(ctx, image.Ref)
+			if err != nil {
+				return fmt.Errorf("resolving %s: %w", image.Ref, err)
+			}
+			image.Digest = digest
+		}
+		m.Images = append(m.Images, image)
+	}
+	sort.Slice(m.Images, func(i, j int) bool { return m.Images[i].Arg < m.Images[j].Arg })
+	enc := json.NewEncoder(o.manifest)
+	enc.SetIndent("", "  ")
+	return enc.Encode(m)
+}
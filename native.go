@@ -0,0 +1,114 @@
+package fmtd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fenollp/fmtd/buildx"
+)
+
+// nativeFormatters are the commands formatting a file to stdout outside of Docker,
+// by formatter name. The file's path is appended to the command, or its contents
+// given on stdin when they are FormatContents'.
+var nativeFormatters = map[string][]string{
+	"go": {"gofmt", "-s"},
+}
+
+// WithNative has files be formatted by formatters installed locally, when found on $PATH,
+// instead of within Docker. Other files are still formatted within Docker,
+// which is not run at all if no files are left. Only gofmt is run natively for now.
+func WithNative(donative bool) Option {
+	return func(o *options) error {
+		o.native = donative
+		return nil
+	}
+}
+
+// splitNative separates the paths of files a local formatter handles from the others.
+func (o *options) splitNative(paths []string) (native, rest []string) {
+	if !o.native {
+		return nil, paths
+	}
+	exes := make(map[string]string)
+	for _, path := range paths {
+		r := o.ruleFor(path)
+		if r == nil || nativeFormatters[r.name] == nil {
+			rest = append(rest, path)
+			continue
+		}
+		exe, ok := exes[r.name]
+		if !ok {
+			exe, _ = exec.LookPath(nativeFormatters[r.name][0])
+			exes[r.name] = exe
+		}
+		if exe == "" {
+			rest = append(rest, path)
+			continue
+		}
+		native = append(native, path)
+	}
+	return
+}
+
+// fmtNative formats the file at path with a local formatter, filling the sidecars
+// and calling output the way a build would.
+func (o *options) fmtNative(ctx context.Context, pwd, path string, sidecar, errs *bytes.Buffer, output buildx.OutputFileFunc) error {
+	name := nativeName(pwd, path)
+	r := o.ruleFor(path)
+	argv := nativeFormatters[r.name]
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, argv[0], append(argv[1:], path)...)
+	if data, ok := o.contentsOf(path); ok {
+		cmd = exec.CommandContext(ctx, argv[0], argv[1:]...)
+		cmd.Stdin = bytes.NewReader(data)
+	}
+	cmd.Env = o.environ
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	start := time.Now()
+	err := cmd.Run()
+	if o.timings != nil {
+		fmt.Fprintf(sidecar, "%s%d %s\n", prefixTiming, time.Since(start).Milliseconds(), name)
+	}
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return err
+		}
+		fmt.Fprintf(sidecar, "%s%s\n", prefixFailed, name)
+		fmt.Fprintf(errs, "%s %s\n", r.name, name)
+		for _, line := range strings.SplitAfter(stderr.String(), "\n") {
+			if line != "" {
+				errs.WriteString("  " + strings.TrimSuffix(line, "\n") + "\n")
+			}
+		}
+		return nil
+	}
+
+	original, err := o.readFile(path)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(original, stdout.Bytes()) {
+		return nil
+	}
+	fmt.Fprintf(sidecar, "%s%s\n", prefixFormatted, name)
+	return output(name, &stdout)
+}
+
+// nativeName names path the way the build would: relative to pwd when under it.
+func nativeName(pwd, path string) string {
+	if !filepath.IsAbs(path) {
+		return path
+	}
+	rel, err := filepath.Rel(pwd, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return path
+	}
+	return rel
+}
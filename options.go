@@ -0,0 +1,528 @@
+package fmtd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fenollp/fmtd/buildx"
+)
+
+// Option represents the various arguments Fmt takes
+type Option func(*options) error
+
+type options struct {
+	nameRulesFirst bool
+	traverse       bool
+	verbose        io.Writer
+	finalNewline   FinalNewline
+	skipPatterns   []string
+	quiet          bool
+	color          bool
+	json           bool
+	resultf        func(Result)
+	requireConfig  map[string]*rule
+	batchSize      int
+	config         *Config
+	collectErrs    bool
+	dumpDockerfile io.Writer
+	buildArgs      map[string]string // overrides of presets, see resolveBuildArgs
+	warnUnhandled  bool
+	postProcessors []func(path string, formatted []byte) ([]byte, error)
+	cleanup        bool
+	syntax         string
+	pull           bool
+	allowOutside   bool
+	native         bool
+	cliArgs        map[string]string
+	resolveDigest  DigestResolver
+	verify         bool
+	dprint         map[string]bool
+	dprintConfig   []byte
+	skipMissing    bool
+	changedSince   string
+	changedLines   map[string][]lineRange // by name, see onlyChanged
+	timings        io.Writer
+	workspaces     int // formatted at once by FmtWorkspaces
+	disabled       map[string]bool
+	detect         bool
+	detected       map[string]*rule // by path and build name, see detectLanguages
+	detectedNames  []string
+	summaryf       func(Summary)
+	user           string // uid:gid formatters run as, root if empty
+	manifest       io.Writer
+	taploConfig    []byte
+	sortCSS        bool
+	diff           io.Writer
+	strict         []*regexp.Regexp // warning patterns
+	compileCmds    bool
+	failUnhandled  bool
+	diagnose       bool
+	cancelFirst    bool
+	maxFileSize    int64
+	normalizeEOL   bool
+	generated      []*regexp.Regexp    // generated code patterns
+	environ        []string            // os.Environ() if nil
+	skips          map[string][]string // skipped paths, by reason
+	report         io.Writer
+	includeHidden  []string
+	followSymlinks bool
+	idempotent     bool
+	buffer         *buffer // see FormatContents
+	retries        int
+	backoff        time.Duration
+}
+
+// WithNameRulesFirst have files matched against every formatter's file
+// names (e.g. BUILD, WORKSPACE) before any formatter's file extensions.
+// By default formatters are tried in a fixed order, names and extensions alike.
+func WithNameRulesFirst(namesfirst bool) Option {
+	return func(o *options) error {
+		o.nameRulesFirst = namesfirst
+		return nil
+	}
+}
+
+// WithTraverse have directories given as filenames be walked for files to format,
+// and the current directory be used when no filenames are given.
+// Otherwise directories are rejected and no filenames means no files.
+// Defaults to true.
+func WithTraverse(dotraverse bool) Option {
+	return func(o *options) error {
+		o.traverse = dotraverse
+		return nil
+	}
+}
+
+// WithVerbose have details about the run written to w.
+func WithVerbose(w io.Writer) Option {
+	return func(o *options) error {
+		o.verbose = w
+		return nil
+	}
+}
+
+// FinalNewline is a policy on line endings at the end of formatted files.
+type FinalNewline int
+
+const (
+	// FinalNewlineAsFormatted leaves formatters' output untouched.
+	FinalNewlineAsFormatted FinalNewline = iota
+	// FinalNewlineEnsure have formatted files end with exactly one line ending.
+	FinalNewlineEnsure
+	// FinalNewlinePreserve have formatted files end with a line ending
+	// only if the original file did.
+	FinalNewlinePreserve
+)
+
+// ErrUnknownFinalNewline is returned when WithFinalNewline is given an unknown policy.
+var ErrUnknownFinalNewline = errors.New("unknown final newline policy")
+
+// WithFinalNewline applies given policy to files the formatters changed.
+// Files only differing from the original in their final line ending
+// are then no longer reported nor written.
+// Defaults to FinalNewlinePreserve, so that formatters adding or dropping
+// final newlines do not have otherwise formatted files reported as changed.
+func WithFinalNewline(policy FinalNewline) Option {
+	return func(o *options) error {
+		switch policy {
+		case FinalNewlineAsFormatted, FinalNewlineEnsure, FinalNewlinePreserve:
+		default:
+			return ErrUnknownFinalNewline
+		}
+		o.finalNewline = policy
+		return nil
+	}
+}
+
+// WithNormalizeEOL has files formatters only changed the line endings of
+// (e.g. CRLF to LF) be written. By default they are left as is, so that
+// teams on mixed platforms do not churn each other's files.
+func WithNormalizeEOL(donormalize bool) Option {
+	return func(o *options) error {
+		o.normalizeEOL = donormalize
+		return nil
+	}
+}
+
+// onlyEOLs tells whether original and formatted differ, but only by their line endings.
+func onlyEOLs(original, formatted []byte) bool {
+	crlf, lf := []byte("\r\n"), []byte("\n")
+	return !bytes.Equal(original, formatted) &&
+		bytes.Equal(bytes.ReplaceAll(original, crlf, lf), bytes.ReplaceAll(formatted, crlf, lf))
+}
+
+func (policy FinalNewline) apply(original, formatted []byte) []byte {
+	switch policy {
+	case FinalNewlineEnsure:
+		if len(formatted) == 0 {
+			return formatted
+		}
+		trimmed, eol := trimEOLs(formatted)
+		if eol == "" {
+			eol = "\n"
+		}
+		return append(trimmed, eol...)
+	case FinalNewlinePreserve:
+		trimmed, eol := trimEOLs(formatted)
+		if _, originalEOL := trimEOLs(original); originalEOL != "" {
+			if eol == "" {
+				eol = originalEOL
+			}
+			return append(trimmed, eol...)
+		}
+		return trimmed
+	default:
+		return formatted
+	}
+}
+
+// trimEOLs strips all trailing line endings, returning the last one stripped.
+func trimEOLs(data []byte) (trimmed []byte, eol string) {
+	trimmed = data
+	for {
+		switch {
+		case bytes.HasSuffix(trimmed, []byte("\r\n")):
+			if eol == "" {
+				eol = "\r\n"
+			}
+			trimmed = trimmed[:len(trimmed)-2]
+		case bytes.HasSuffix(trimmed, []byte("\n")):
+			if eol == "" {
+				eol = "\n"
+			}
+			trimmed = trimmed[:len(trimmed)-1]
+		default:
+			return trimmed[:len(trimmed):len(trimmed)], eol
+		}
+	}
+}
+
+// DefaultSkipPatterns match minified files, which are best left alone.
+var DefaultSkipPatterns = []string{"*.min.json", "*.min.js", "*.min.css"}
+
+// WithSkipPatterns have files whose lowercased base name matches any of the
+// given path.Match patterns be skipped. Skipped files are listed in verbose mode.
+// Defaults to DefaultSkipPatterns.
+func WithSkipPatterns(patterns []string) Option {
+	return func(o *options) error {
+		o.skipPatterns = patterns
+		return nil
+	}
+}
+
+// WithIncludeHidden has the hidden files and directories matching any of the given
+// patterns (e.g. .github/**) be walked, which are otherwise skipped when walking directories.
+// See buildx.WithIncludeHidden for their syntax. .git directories are never walked.
+func WithIncludeHidden(patterns []string) Option {
+	return func(o *options) error {
+		o.includeHidden = patterns
+		return nil
+	}
+}
+
+// WithFollowDirSymlinks has the directories symlinks found when walking directories point to
+// (e.g. a shared/ directory linked into the tree) be walked too, each directory once.
+// See buildx.WithFollowDirSymlinks.
+func WithFollowDirSymlinks(dofollow bool) Option {
+	return func(o *options) error {
+		o.followSymlinks = dofollow
+		return nil
+	}
+}
+
+// WithQuiet have changed files and warnings not be listed on stdout.
+// Files are still written and errors returned as usual.
+func WithQuiet(quiet bool) Option {
+	return func(o *options) error {
+		o.quiet = quiet
+		return nil
+	}
+}
+
+// WithColor have changed files be listed in green and warnings in yellow.
+func WithColor(color bool) Option {
+	return func(o *options) error {
+		o.color = color
+		return nil
+	}
+}
+
+// ErrQuietJSON is returned when both WithQuiet(true) and WithJSON(true) are given.
+var ErrQuietJSON = errors.New("quiet and JSON outputs are mutually exclusive")
+
+// WithJSON have files be listed on stdout as JSON Results, one per line.
+// This disables colors.
+func WithJSON(json bool) Option {
+	return func(o *options) error {
+		o.json = json
+		return nil
+	}
+}
+
+// WithResultFunc have f called with each file's Result.
+func WithResultFunc(f func(Result)) Option {
+	return func(o *options) error {
+		o.resultf = f
+		return nil
+	}
+}
+
+// WithRequireConfig have files with given extensions (e.g. ".vue") be skipped
+// unless $PWD holds a configuration file for their formatter (e.g. .prettierrc).
+// Each call resets the previous setting.
+func WithRequireConfig(exts []string) Option {
+	return func(o *options) error {
+		o.requireConfig = make(map[string]*rule, len(exts))
+		for _, ext := range exts {
+			ext = strings.ToLower(ext)
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			r := o.ruleFor("a" + ext)
+			if r == nil || len(r.configs) == 0 {
+				return fmt.Errorf("no configuration file known for %q files", ext)
+			}
+			o.requireConfig[ext] = r
+		}
+		return nil
+	}
+}
+
+// missingConfig tells why fn should be skipped for lack of a configuration file in pwd.
+func (o *options) missingConfig(pwd, fn string) string {
+	return o.lackingConfig(fn, func(config string) bool {
+		_, err := os.Stat(filepath.Join(pwd, config))
+		return err == nil
+	})
+}
+
+// lackingConfig tells why fn should be skipped for lack of a configuration file,
+// exists telling whether there is one at the given root-relative path.
+func (o *options) lackingConfig(fn string, exists func(config string) bool) string {
+	r, ok := o.requireConfig[strings.ToLower(filepath.Ext(fn))]
+	if !ok {
+		return ""
+	}
+	for _, config := range r.configs {
+		if exists(config) {
+			return ""
+		}
+	}
+	return "no " + r.configs[0] + " or similar"
+}
+
+// ErrNegativeBatchSize is returned when WithBatchSize is given a negative size.
+var ErrNegativeBatchSize = errors.New("batch size must not be negative")
+
+// WithBatchSize have files be formatted by builds of at most n files each,
+// so that huge file counts do not end up in a single build context.
+// Defaults to 0: all files are formatted by one build.
+func WithBatchSize(n int) Option {
+	return func(o *options) error {
+		if n < 0 {
+			return ErrNegativeBatchSize
+		}
+		o.batchSize = n
+		return nil
+	}
+}
+
+// WithRetries have builds re-run up to n times when they fail due to a transient
+// network or registry error (e.g. a flaky image pull), waiting backoff before
+// the first retry and doubling it each time. Formatting failures are never retried.
+// Defaults to 2 retries, 2 seconds apart. A negative n is buildx.ErrNegativeRetries.
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(o *options) error {
+		if n < 0 {
+			return buildx.ErrNegativeRetries
+		}
+		o.retries = n
+		o.backoff = backoff
+		return nil
+	}
+}
+
+// ErrNegativeMaxFileSize is returned when WithMaxFileSize is given a negative size.
+var ErrNegativeMaxFileSize = errors.New("maximum file size must not be negative")
+
+// WithMaxFileSize skips files larger than n bytes, so that e.g. a checked-in
+// database dump does not dominate a build. Defaults to 0: no limit.
+func WithMaxFileSize(n int64) Option {
+	return func(o *options) error {
+		if n < 0 {
+			return ErrNegativeMaxFileSize
+		}
+		o.maxFileSize = n
+		return nil
+	}
+}
+
+// ErrNegativeContainerUser is returned when WithContainerUser is given a negative ID.
+var ErrNegativeContainerUser = errors.New("container user and group IDs must not be negative")
+
+// WithContainerUser have formatters run as the given user and group IDs
+// within the build, for environments forbidding root in containers.
+// Formatted files are still written back on the host by the calling user.
+// Defaults to root.
+func WithContainerUser(uid, gid int) Option {
+	return func(o *options) error {
+		if uid < 0 || gid < 0 {
+			return ErrNegativeContainerUser
+		}
+		o.user = fmt.Sprintf("%d:%d", uid, gid)
+		return nil
+	}
+}
+
+// batches splits paths per the batch size. There is always at least one batch.
+func (o *options) batches(paths []string) [][]string {
+	if o.batchSize == 0 || len(paths) <= o.batchSize {
+		return [][]string{paths}
+	}
+	var batches [][]string
+	for len(paths) > o.batchSize {
+		batches = append(batches, paths[:o.batchSize])
+		paths = paths[o.batchSize:]
+	}
+	return append(batches, paths)
+}
+
+// WithCollectSelectionErrors have files that cannot be formatted
+// (e.g. missing, not writable) be left out while the others are formatted.
+// Their failures are then returned as a buildx.SelectionErrors.
+func WithCollectSelectionErrors(docollect bool) Option {
+	return func(o *options) error {
+		o.collectErrs = docollect
+		return nil
+	}
+}
+
+func (o *options) buildArgNames() []string {
+	names := make([]string, 0, len(o.buildArgs))
+	for name := range o.buildArgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WithDumpDockerfile have the Dockerfile formatting given files be written to w
+// instead of being built. Preset build arguments there carry their overridden value.
+func WithDumpDockerfile(w io.Writer) Option {
+	return func(o *options) error {
+		o.dumpDockerfile = w
+		return nil
+	}
+}
+
+// WithWarnUnhandled have files no formatter handles be reported even when
+// they were found by walking directories. By default only unhandled files
+// that were explicitly given are reported.
+func WithWarnUnhandled(dowarn bool) Option {
+	return func(o *options) error {
+		o.warnUnhandled = dowarn
+		return nil
+	}
+}
+
+// ErrUnhandledFile is returned when a file given explicitly has no formatter, per WithFailUnhandled.
+var ErrUnhandledFile = errors.New("no formatter handles file")
+
+// WithFailUnhandled has Fmt fail with ErrUnhandledFile before formatting anything
+// when a file given explicitly has no formatter, as that is likely a mistake.
+// Unhandled files found by walking directories are expected: they are only reported.
+func WithFailUnhandled(dofail bool) Option {
+	return func(o *options) error {
+		o.failUnhandled = dofail
+		return nil
+	}
+}
+
+// WithPostProcess have f transform the contents of files formatters changed,
+// before they are written. path is relative to $PWD.
+// Multiple calls chain post-processors, in order.
+func WithPostProcess(f func(path string, formatted []byte) ([]byte, error)) Option {
+	return func(o *options) error {
+		o.postProcessors = append(o.postProcessors, f)
+		return nil
+	}
+}
+
+// WithUniversalCleanup have text files no formatter handles be stripped
+// of trailing whitespace and end with a newline. Binary files are left alone.
+func WithUniversalCleanup(docleanup bool) Option {
+	return func(o *options) error {
+		o.cleanup = docleanup
+		return nil
+	}
+}
+
+// ErrInvalidImageReference is returned when given a malformed image reference.
+var ErrInvalidImageReference = errors.New("invalid image reference")
+
+// imageReference matches [registry[:port]/]name[:tag][@digest]
+var imageReference = regexp.MustCompile(`^` +
+	`(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*(?::[0-9]+)?/)?` +
+	`[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*` +
+	`(?::[a-zA-Z0-9_][a-zA-Z0-9_.-]{0,127})?` +
+	`(?:@sha256:[a-f0-9]{64})?$`)
+
+// WithSyntaxDirective have the Dockerfile built with the frontend image ref
+// (e.g. a mirror of docker.io/docker/dockerfile:1) instead of fmtd's pinned one.
+func WithSyntaxDirective(ref string) Option {
+	return func(o *options) error {
+		if !imageReference.MatchString(ref) {
+			return fmt.Errorf("%w: %q", ErrInvalidImageReference, ref)
+		}
+		o.syntax = ref
+		return nil
+	}
+}
+
+// WithPull have the images formatters come from always be pulled, so that
+// images overridden with a tag (e.g. ARG_GOFMT_IMAGE=golang:1) are up to date.
+// This makes no difference for images pinned with a digest.
+func WithPull(dopull bool) Option {
+	return func(o *options) error {
+		o.pull = dopull
+		return nil
+	}
+}
+
+// WithAllowOutside have files outside $PWD be formatted too,
+// instead of being rejected.
+func WithAllowOutside(doallow bool) Option {
+	return func(o *options) error {
+		o.allowOutside = doallow
+		return nil
+	}
+}
+
+// WithVerifyIdempotent has formatted files be formatted once more, to check formatters
+// are idempotent. Files this changes again, or that then fail to format, are
+// reported as failed and left untouched. Files formatted natively (see WithNative)
+// or by changed lines (see WithOnlyChangedLines) are not checked.
+func WithVerifyIdempotent(doverify bool) Option {
+	return func(o *options) error {
+		o.idempotent = doverify
+		return nil
+	}
+}
+
+// WithVerify have formatted files be checked to still parse, for formatters
+// that come with a parser (e.g. Go, JSON, Python). Files that do not are
+// reported as failed and left untouched.
+func WithVerify(doverify bool) Option {
+	return func(o *options) error {
+		o.verify = doverify
+		return nil
+	}
+}
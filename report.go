@@ -0,0 +1,50 @@
+package fmtd
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"time"
+)
+
+// Report describes a run, for archival e.g. as a CI artifact. See WithReport.
+type Report struct {
+	Files      []string        `json:"files"` // handled or not, as in Result.Path
+	Results    []Result        `json:"results"`
+	Summary    Summary         `json:"summary"` // skipped files included
+	Images     []ManifestImage `json:"images"`  // digests of pinned images only
+	Error      string          `json:"error,omitempty"`
+	DurationMS int64           `json:"duration_ms"`
+}
+
+// WithReport has a Report of the run be written to w as JSON once it is done,
+// whether it failed or not. This is the durable counterpart of WithJSON.
+func WithReport(w io.Writer) Option {
+	return func(o *options) error {
+		o.report = w
+		return nil
+	}
+}
+
+// reportImages records the images dockerfile pulls in images, by build argument.
+func (o *options) reportImages(dockerfile []byte, images map[string]ManifestImage) {
+	for _, match := range fromArg.FindAllSubmatch(dockerfile, -1) {
+		arg := string(match[1])
+		images[arg] = o.manifestImage(arg)
+	}
+}
+
+// writeReport completes rep with the images used, how long the run took and err, then writes it.
+func (o *options) writeReport(rep *Report, images map[string]ManifestImage, start time.Time, err error) error {
+	for _, image := range images {
+		rep.Images = append(rep.Images, image)
+	}
+	sort.Slice(rep.Images, func(i, j int) bool { return rep.Images[i].Arg < rep.Images[j].Arg })
+	if err != nil {
+		rep.Error = err.Error()
+	}
+	rep.DurationMS = time.Since(start).Milliseconds()
+	enc := json.NewEncoder(o.report)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rep)
+}
@@ -0,0 +1,191 @@
+package fmtd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Statuses of files in a Result.
+const (
+	StatusChanged   = "changed"
+	StatusUnhandled = "unhandled"
+	StatusFailed    = "failed"
+	StatusDiagnosed = "diagnosed" // left as is, see WithDiagnostics
+)
+
+// Result describes what happened to a file.
+type Result struct {
+	Path      string `json:"path"`
+	Status    string `json:"status"`
+	Formatter string `json:"formatter,omitempty"`
+	Stderr    string `json:"stderr,omitempty"`
+
+	Diagnostics string `json:"diagnostics,omitempty"` // see WithDiagnostics
+}
+
+// Outcomes of a run in a Summary.
+const (
+	OutcomeNoFiles   = "no-files"  // no files a formatter handles were found
+	OutcomeFormatted = "formatted" // all files were already formatted
+	OutcomeChanged   = "changed"   // some files were changed, or would be with dry run
+	OutcomeFailed    = "failed"    // formatters failed on some files
+)
+
+// Summary describes the outcome of a run, telling apart runs that found
+// no files to format from runs where all files were already formatted.
+type Summary struct {
+	Files   int    `json:"files"` // handled by a formatter
+	Changed int    `json:"changed"`
+	Failed  int    `json:"failed"`
+	Outcome string `json:"outcome"`
+
+	Skipped []Skipped `json:"skipped,omitempty"` // by reason, the most common first
+}
+
+// WithSummaryFunc have f called with the Summary of the run.
+func WithSummaryFunc(f func(Summary)) Option {
+	return func(o *options) error {
+		o.summaryf = f
+		return nil
+	}
+}
+
+// summarize tells the outcome of formatting files, of which some changed or failed.
+func (o *options) summarize(files []string, changed int, failed int) Summary {
+	s := Summary{Changed: changed, Failed: failed, Skipped: o.skipped()}
+	for _, fn := range files {
+		if o.cleanup || o.ruleFor(fn) != nil {
+			s.Files++
+		}
+	}
+	switch {
+	case failed != 0:
+		s.Outcome = OutcomeFailed
+	case changed != 0:
+		s.Outcome = OutcomeChanged
+	case s.Files == 0:
+		s.Outcome = OutcomeNoFiles
+	default:
+		s.Outcome = OutcomeFormatted
+	}
+	return s
+}
+
+// printSummary reports s on w with -json, and in verbose mode.
+// Skipped files are otherwise reported on stderr, unless quiet.
+func (o *options) printSummary(w, stderr io.Writer, s Summary) error {
+	if o.summaryf != nil {
+		o.summaryf(s)
+	}
+	if o.verbose != nil {
+		switch s.Outcome {
+		case OutcomeNoFiles:
+			fmt.Fprintln(o.verbose, "fmtd: no files to format")
+		case OutcomeFormatted:
+			fmt.Fprintf(o.verbose, "fmtd: all %d files already formatted\n", s.Files)
+		default:
+			fmt.Fprintf(o.verbose, "fmtd: %d of %d files changed, %d failed\n", s.Changed, s.Files, s.Failed)
+		}
+	}
+	if !o.json {
+		if !o.quiet {
+			printSkipped(stderr, s)
+		}
+		return nil
+	}
+	return json.NewEncoder(w).Encode(struct {
+		Summary Summary `json:"summary"`
+	}{s})
+}
+
+// The build's stdout sidecar holds one line per file of interest,
+// made of one of these prefixes followed by the file's path.
+const (
+	prefixFormatted = "F "
+	prefixUnhandled = "! "
+	prefixFailed    = "E "
+	prefixTiming    = "T " // followed by milliseconds then a space, see WithTimings
+	prefixDiagnosed = "W " // only printed, for files listed for their Diagnostics alone
+)
+
+// results classifies the lines of the stdout sidecar.
+// Only files in changed are reported as changed, as some files the
+// formatters changed may have been left alone afterwards.
+// Lines that follow no protocol are returned as is.
+func results(sidecar string, changed map[string]bool, ferrs []*FormatError) (rs []Result, others []string) {
+	failures := make(map[string]*FormatError, len(ferrs))
+	for _, ferr := range ferrs {
+		failures[ferr.Path] = ferr
+	}
+
+	seen := make(map[string]bool, len(changed))
+	for _, line := range strings.Split(sidecar, "\n") {
+		switch {
+		case line == "", strings.HasPrefix(line, prefixTiming):
+		case strings.HasPrefix(line, prefixFormatted):
+			fn := strings.TrimPrefix(line, prefixFormatted)
+			if changed[fn] {
+				seen[fn] = true
+				rs = append(rs, Result{Path: fn, Status: StatusChanged})
+			}
+		case strings.HasPrefix(line, prefixUnhandled):
+			rs = append(rs, Result{Path: strings.TrimPrefix(line, prefixUnhandled), Status: StatusUnhandled})
+		case strings.HasPrefix(line, prefixFailed):
+			r := Result{Path: strings.TrimPrefix(line, prefixFailed), Status: StatusFailed}
+			if ferr, ok := failures[r.Path]; ok {
+				r.Formatter, r.Stderr = ferr.Formatter, ferr.Stderr
+			}
+			rs = append(rs, r)
+		default:
+			others = append(others, line)
+		}
+	}
+
+	var unseen []string
+	for fn := range changed {
+		if !seen[fn] {
+			unseen = append(unseen, fn)
+		}
+	}
+	sort.Strings(unseen)
+	for _, fn := range unseen {
+		rs = append(rs, Result{Path: fn, Status: StatusChanged})
+	}
+	return
+}
+
+func (o *options) printResults(w io.Writer, rs []Result, others []string) error {
+	if o.json {
+		enc := json.NewEncoder(w)
+		for _, r := range rs {
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, r := range rs {
+		switch r.Status {
+		case StatusChanged:
+			fmt.Fprintln(w, o.paint(green, r.Path))
+		case StatusUnhandled:
+			fmt.Fprintln(w, o.paint(yellow, prefixUnhandled+r.Path))
+		case StatusFailed:
+			fmt.Fprintln(w, o.paint(red, prefixFailed+r.Path))
+		case StatusDiagnosed:
+			fmt.Fprintln(w, o.paint(yellow, prefixDiagnosed+r.Path))
+		}
+		for _, line := range strings.SplitAfter(r.Diagnostics, "\n") {
+			if line != "" {
+				fmt.Fprint(w, "  "+line)
+			}
+		}
+	}
+	for _, line := range others {
+		fmt.Fprintln(w, line)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package fmtd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// selfTestSamples are unformatted files each formatter should change, by formatter name.
+var selfTestSamples = map[string]struct{ filename, contents string }{
+	"bazel":        {"sample.star", "a=1  "},
+	"proto":        {"sample.proto", "message   Bla  {int32 f = 42;}"},
+	"clang-format": {"sample.c", "int  main(){return 0;}"},
+	"go":           {"sample.go", "package     p"},
+	"jsonc":        {"sample.jsonc", "{ // comment\n\"a\":1}"},
+	"json":         {"sample.json", "{ }"},
+	"python":       {"sample.py", "a=1"},
+	"shell":        {"sample.sh", "a=1;b=2"},
+	"sql":          {"sample.sql", "select     a FROM  b"},
+	"toml":         {"sample.toml", "a=1"},
+	"vue":          {"sample.vue", "<template><div>hi</div></template>"},
+	"svelte":       {"sample.svelte", "<p>hi</p>"},
+	"css":          {"sample.css", "a{color:red}"},
+	"packer":       {"sample.pkr.hcl", "a=1"},
+	"hcl":          {"sample.tf", "a=1"},
+	"textproto":    {"sample.textproto", "a:1"},
+}
+
+// SelfTestResult tells whether a formatter works.
+type SelfTestResult struct {
+	Formatter string
+	OK        bool
+	Detail    string // why it does not work
+}
+
+// SelfTest has each enabled formatter format a small unformatted sample,
+// all within a single build, and reports which formatters work.
+// The error is non-nil when the build itself failed (e.g. Docker is unusable
+// or an image could not be pulled): then no formatter is reported as working.
+func SelfTest(ctx context.Context, stderr io.Writer, opts ...Option) ([]SelfTestResult, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	pwd, err := os.MkdirTemp("", "fmtd-selftest-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(pwd)
+
+	var names, filenames []string
+	for _, r := range rules {
+		sample := selfTestSamples[r.name]
+		path := filepath.Join(pwd, sample.filename)
+		if o.disabledLanguage(path) != "" {
+			continue
+		}
+		if err := os.WriteFile(path, []byte(sample.contents), 0600); err != nil {
+			return nil, err
+		}
+		names = append(names, r.name)
+		filenames = append(filenames, path)
+	}
+
+	got := make(map[string]Result, len(names))
+	opts = append(opts,
+		WithTraverse(false),
+		WithRequireConfig(nil),
+		WithResultFunc(func(r Result) { got[r.Path] = r }),
+	)
+	err = Fmt(ctx, pwd, true, io.Discard, stderr, filenames, opts...)
+	var ferr *FormatError
+	if err == ErrDryRunFoundFiles || errors.As(err, &ferr) {
+		err = nil
+	}
+
+	results := make([]SelfTestResult, 0, len(names))
+	for _, name := range names {
+		r := got[selfTestSamples[name].filename]
+		result := SelfTestResult{Formatter: name}
+		switch {
+		case err != nil:
+			result.Detail = "build failed"
+		case r.Status == StatusChanged:
+			result.OK = true
+		case r.Status == StatusFailed:
+			result.Detail = "failed"
+			if stderr := strings.TrimSpace(r.Stderr); stderr != "" {
+				result.Detail += ": " + strings.SplitN(stderr, "\n", 2)[0]
+			}
+		default:
+			result.Detail = "left the sample unformatted"
+		}
+		results = append(results, result)
+	}
+	return results, err
+}
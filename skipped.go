@@ -0,0 +1,90 @@
+package fmtd
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/fenollp/fmtd/buildx"
+)
+
+// Reasons files a formatter could not handle are skipped for, in a Summary.
+const (
+	SkippedNoFormatter = "no formatter"
+	SkippedBinary      = "not text" // with WithUniversalCleanup
+)
+
+// Skipped lists the files a run skipped for the same reason.
+type Skipped struct {
+	Reason string   `json:"reason"` // e.g. "matches *.min.js", "larger than 1024 bytes"
+	Count  int      `json:"count"`
+	Paths  []string `json:"paths"`
+}
+
+// skip records that path was skipped for reason, listing it in verbose mode.
+func (o *options) skip(path, reason string) {
+	if o.verbose != nil {
+		fmt.Fprintf(o.verbose, "fmtd: skipped %s (%s)\n", path, reason)
+	}
+	if o.skips == nil {
+		o.skips = make(map[string][]string)
+	}
+	o.skips[reason] = append(o.skips[reason], path)
+}
+
+// skipUnhandled records the files no formatter handles as skipped:
+// those universal cleanup left alone for not being text, or else all of them.
+func (o *options) skipUnhandled(pwd string, files []string, rs []Result) {
+	if o.skips == nil {
+		o.skips = make(map[string][]string)
+	}
+	if o.cleanup {
+		for _, r := range rs {
+			if r.Status == StatusUnhandled {
+				o.skips[SkippedBinary] = append(o.skips[SkippedBinary], r.Path)
+			}
+		}
+		return
+	}
+	for _, fn := range files {
+		if o.ruleFor(fn) == nil {
+			name := buildx.PathOfName(buildName(pwd, fn))
+			o.skips[SkippedNoFormatter] = append(o.skips[SkippedNoFormatter], name)
+		}
+	}
+}
+
+// skipped groups the skipped files by reason, the most common first.
+func (o *options) skipped() []Skipped {
+	var ss []Skipped
+	for reason, paths := range o.skips {
+		if len(paths) == 0 {
+			continue
+		}
+		paths = append([]string{}, paths...)
+		sort.Strings(paths)
+		ss = append(ss, Skipped{Reason: reason, Count: len(paths), Paths: paths})
+	}
+	sort.Slice(ss, func(i, j int) bool {
+		if ss[i].Count != ss[j].Count {
+			return ss[i].Count > ss[j].Count
+		}
+		return ss[i].Reason < ss[j].Reason
+	})
+	return ss
+}
+
+// printSkipped reports the skipped files of s on w, by reason.
+func printSkipped(w io.Writer, s Summary) {
+	total := 0
+	for _, skipped := range s.Skipped {
+		total += skipped.Count
+	}
+	if total == 0 {
+		return
+	}
+	fmt.Fprintf(w, "fmtd: skipped %d files:\n", total)
+	for _, skipped := range s.Skipped {
+		fmt.Fprintf(w, "  %d %s\n", skipped.Count, skipped.Reason)
+	}
+}
@@ -0,0 +1,104 @@
+package fmtd
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fenollp/fmtd/buildx"
+)
+
+// FormatContents formats what r reads as the contents of the file filename
+// (e.g. an editor's unsaved buffer) and writes them, formatted, to w.
+// filename, absolute or relative to pwd, need not exist: its name or extension
+// picks the formatter, as with prettier --stdin-filepath. It is formatted under
+// that name, so IgnoreFilename, skip patterns and configuration apply as they
+// would to the file itself, which is left untouched. Contents no formatter
+// handles, or skipped, are written as is. See FindWorkspace for a pwd to format filename from.
+func FormatContents(ctx context.Context, pwd, filename string, r io.Reader, w, stderr io.Writer, opts ...Option) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	path := filename
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(pwd, path)
+	}
+	b := &buffer{path: filepath.Clean(path), data: data, formatted: data}
+
+	opts = append(append([]Option{}, opts...), WithTraverse(false), WithAllowOutside(true),
+		func(o *options) error {
+			o.buffer = b
+			return nil
+		})
+	if err := Fmt(ctx, pwd, false, io.Discard, stderr, []string{b.path}, opts...); err != nil {
+		return err
+	}
+	_, err = w.Write(b.formatted)
+	return err
+}
+
+// buffer holds the contents FormatContents formats as those of the file at path.
+type buffer struct {
+	path      string // absolute
+	data      []byte
+	formatted []byte
+}
+
+// contentsOf returns the contents FormatContents was given for the file at path, if any.
+func (o *options) contentsOf(path string) ([]byte, bool) {
+	if o.buffer == nil || filepath.Clean(path) != o.buffer.path {
+		return nil, false
+	}
+	return o.buffer.data, true
+}
+
+// open opens the file at path, or the contents FormatContents was given for it.
+func (o *options) open(path string) (io.ReadCloser, error) {
+	if data, ok := o.contentsOf(path); ok {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	return os.Open(path)
+}
+
+// readFile reads the file at path, or the contents FormatContents was given for it.
+func (o *options) readFile(path string) ([]byte, error) {
+	if data, ok := o.contentsOf(path); ok {
+		return data, nil
+	}
+	return os.ReadFile(path)
+}
+
+// writeFile overwrites the file at path with data, unless FormatContents
+// was given its contents: data is then what it writes.
+func (o *options) writeFile(path string, data []byte) error {
+	if _, ok := o.contentsOf(path); ok {
+		o.buffer.formatted = data
+		return nil
+	}
+	return buildx.OverwriteFileContents(path, bytes.NewReader(data))
+}
+
+// FindWorkspace returns the directory to format filename from, for its configuration
+// to be found the way formatters look for theirs: the closest directory holding filename,
+// up to pwd, that has a ConfigFilename. Otherwise pwd.
+func FindWorkspace(pwd, filename string) string {
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Join(pwd, filename)
+	}
+	for dir := filepath.Dir(filename); ; dir = filepath.Dir(dir) {
+		rel, err := filepath.Rel(pwd, dir)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return pwd
+		}
+		if _, err := os.Stat(filepath.Join(dir, ConfigFilename)); err == nil {
+			return dir
+		}
+		if rel == "." {
+			return pwd
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package fmtd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ErrDockerWarning is returned by strict runs when Docker emitted a warning.
+var ErrDockerWarning = errors.New("Docker emitted a warning")
+
+// DefaultWarningPatterns match the warnings Docker and BuildKit emit,
+// e.g. about the requested image platform not matching the host's.
+var DefaultWarningPatterns = []string{`(?i)^\s*WARN(ING)?\b`, `\b\d+ warnings? found\b`}
+
+// WithStrict has runs fail with ErrDockerWarning if a line of Docker's stderr
+// matches any of the given regular expressions, even if files were formatted.
+// Use DefaultWarningPatterns to catch the usual warnings. Off when patterns is empty.
+// Each call resets the previous setting.
+func WithStrict(patterns []string) Option {
+	return func(o *options) error {
+		o.strict = make([]*regexp.Regexp, 0, len(patterns))
+		for _, pattern := range patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("bad warning pattern %q: %w", pattern, err)
+			}
+			o.strict = append(o.strict, re)
+		}
+		return nil
+	}
+}
+
+// dockerWarning returns an error about the first line of stderr matching a warning pattern, if any.
+func (o *options) dockerWarning(stderr []byte) error {
+	s := bufio.NewScanner(bytes.NewReader(stderr))
+	for s.Scan() {
+		line := s.Text()
+		for _, re := range o.strict {
+			if re.MatchString(line) {
+				return fmt.Errorf("%w: %s", ErrDockerWarning, strings.TrimSpace(line))
+			}
+		}
+	}
+	return nil
+}
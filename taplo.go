@@ -0,0 +1,38 @@
+package fmtd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// taploConfigs are the taplo configuration files looked for at the root of $PWD, in order.
+var taploConfigs = []string{"taplo.toml", ".taplo.toml"}
+
+// loadTaploConfig reads the taplo configuration of pwd, if any.
+func (o *options) loadTaploConfig(pwd string) error {
+	o.taploConfig = nil
+	for _, name := range taploConfigs {
+		data, err := os.ReadFile(filepath.Join(pwd, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		o.taploConfig = data
+		return nil
+	}
+	return nil
+}
+
+// taploConfigFile renders the instructions writing taplo's configuration
+// in the tool stage, if $PWD holds one. Otherwise taplo is configured
+// by the TOML_* build arguments.
+func (o *options) taploConfigFile() string {
+	config := strings.TrimSpace(string(o.taploConfig))
+	if config == "" {
+		return ""
+	}
+	return "COPY <<\"TAPLO_TOML\" /app/taplo.toml\n" + config + "\nTAPLO_TOML\n"
+}
@@ -0,0 +1,80 @@
+package fmtd
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fenollp/fmtd/buildx"
+)
+
+// slowestFiles is how many of the slowest files WithTimings lists.
+const slowestFiles = 10
+
+// WithTimings has how long formatting each file took be measured and
+// a summary of the slowest files and of each formatter be written to w.
+func WithTimings(w io.Writer) Option {
+	return func(o *options) error {
+		o.timings = w
+		return nil
+	}
+}
+
+// Shell snippets timing the formatting of "$f", see WithTimings.
+const (
+	timingStart = `t0=$(date +%s%N)`
+	timingEnd   = `echo "T $(( ($(date +%s%N) - t0) / 1000000 )) $f" >>../stdout`
+)
+
+type timing struct {
+	name string
+	took time.Duration
+}
+
+// parseTimings reads the timing lines of the stdout sidecar.
+func parseTimings(sidecar string) (timings []timing) {
+	for _, line := range strings.Split(sidecar, "\n") {
+		if !strings.HasPrefix(line, prefixTiming) {
+			continue
+		}
+		fields := strings.SplitN(strings.TrimPrefix(line, prefixTiming), " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		ms, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		timings = append(timings, timing{name: buildx.PathOfName(fields[1]), took: time.Duration(ms) * time.Millisecond})
+	}
+	return
+}
+
+// printTimings writes the slowest files then the time each formatter took.
+func (o *options) printTimings(timings []timing) {
+	sort.SliceStable(timings, func(i, j int) bool { return timings[i].took > timings[j].took })
+	totals := make(map[string]time.Duration)
+	counts := make(map[string]int)
+	var formatters []string
+	for i, t := range timings {
+		formatter := "unhandled"
+		if r := o.ruleFor(t.name); r != nil {
+			formatter = r.name
+		}
+		if i < slowestFiles {
+			fmt.Fprintf(o.timings, "fmtd: %s %s (%s)\n", t.took, t.name, formatter)
+		}
+		if _, ok := totals[formatter]; !ok {
+			formatters = append(formatters, formatter)
+		}
+		totals[formatter] += t.took
+		counts[formatter]++
+	}
+	sort.Strings(formatters)
+	for _, formatter := range formatters {
+		fmt.Fprintf(o.timings, "fmtd: %s: %d files in %s\n", formatter, counts[formatter], totals[formatter])
+	}
+}
@@ -0,0 +1,149 @@
+package fmtd
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/fenollp/fmtd/buildx"
+)
+
+// WithSkipUnavailable has files be skipped when an image their formatter
+// is built from is not available locally (per `docker image inspect`),
+// instead of having the build fail trying to pull it.
+// Should the build still fail pulling an image (see ErrImageUnavailable),
+// the files needing it are skipped and the others formatted by a new build.
+// Handy in air-gapped CI where not all images are mirrored.
+// Packages installed by apk, pip or npm are not checked: formatters needing
+// them (e.g. jq, yapf, prettier) still need a package mirror.
+func WithSkipUnavailable(doskip bool) Option {
+	return func(o *options) error {
+		o.skipMissing = doskip
+		return nil
+	}
+}
+
+var imageArg = regexp.MustCompile(`\$([A-Z][A-Z0-9_]*_IMAGE)\b`)
+
+// formatterImages lists the images the formatter of r is built from:
+// ALPINE, which formatters run on, then those its tools are copied or built from.
+func (o *options) formatterImages(r *rule) []string {
+	images := []string{o.presetValue(presetImages, "ALPINE")}
+	for _, name := range o.formatter(r).tools {
+		for _, t := range tools {
+			if t.name != name {
+				continue
+			}
+			for _, m := range imageArg.FindAllStringSubmatch(t.from+t.stage, -1) {
+				images = append(images, o.presetValue(presetImages, m[1]))
+			}
+		}
+	}
+	return images
+}
+
+// presetValue returns the value of the preset named name, overrides included.
+func (o *options) presetValue(args []presetArg, name string) string {
+	if v, ok := o.buildArgs[name]; ok {
+		return v
+	}
+	for _, arg := range args {
+		if arg.name == name {
+			return arg.value
+		}
+	}
+	return ""
+}
+
+// dropUnavailable leaves out paths whose formatter needs an image Docker does not have.
+func (o *options) dropUnavailable(ctx context.Context, exe, pwd string, paths []string) []string {
+	available := make(map[string]bool)
+	kept := make([]string, 0, len(paths))
+	for _, path := range paths {
+		r := o.ruleFor(path)
+		if r == nil {
+			kept = append(kept, path)
+			continue
+		}
+		missing := ""
+		for _, image := range o.formatterImages(r) {
+			ok, checked := available[image]
+			if !checked {
+				cmd := exec.CommandContext(ctx, exe, "image", "inspect", image)
+				cmd.Env = o.environ
+				ok = cmd.Run() == nil
+				available[image] = ok
+			}
+			if !ok {
+				missing = image
+				break
+			}
+		}
+		if missing == "" {
+			kept = append(kept, path)
+			continue
+		}
+		o.skip(buildx.PathOfName(buildName(pwd, path)), "image "+missing+" is not available")
+	}
+	return kept
+}
+
+// ErrImageUnavailable is returned when a build failed pulling the image of a formatter.
+var ErrImageUnavailable = errors.New("could not pull image")
+
+var pullFailure = regexp.MustCompile(`failed to resolve source metadata for (\S+): (.+)`)
+
+// pullFailed returns the image a build failed pulling and why, per its stderr,
+// or "" if it did not fail pulling an image.
+func pullFailed(stderr []byte) (image, reason string) {
+	m := pullFailure.FindSubmatch(stderr)
+	if m == nil {
+		return "", ""
+	}
+	return string(m[1]), strings.TrimSpace(string(m[2]))
+}
+
+// dropImage leaves out paths whose formatter needs image, recording them in dropped.
+func (o *options) dropImage(pwd string, paths []string, image string, dropped map[string]bool) []string {
+	kept := make([]string, 0, len(paths))
+	for _, path := range paths {
+		r := o.ruleFor(path)
+		if r == nil || !needsImage(o.formatterImages(r), image) {
+			kept = append(kept, path)
+			continue
+		}
+		dropped[path] = true
+		o.skip(buildx.PathOfName(buildName(pwd, path)), "image "+image+" could not be pulled")
+	}
+	return kept
+}
+
+// needsImage tells whether image, as Docker names it, is among images.
+func needsImage(images []string, image string) bool {
+	for _, i := range images {
+		if canonicalImage(i) == canonicalImage(image) {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalImage names image the way Docker does, e.g. golang:1 as docker.io/library/golang:1.
+func canonicalImage(image string) string {
+	name := image
+	if i := strings.IndexByte(name, '@'); i != -1 {
+		name = name[:i]
+	}
+	if i := strings.LastIndexByte(name, ':'); i > strings.LastIndexByte(name, '/') {
+		name = name[:i]
+	}
+	if !strings.Contains(name, "/") {
+		return "docker.io/library/" + image
+	}
+	if domain := strings.SplitN(name, "/", 2)[0]; !strings.ContainsAny(domain, ".:") && domain != "localhost" {
+		return "docker.io/" + image
+	}
+	return image
+}
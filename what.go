@@ -0,0 +1,76 @@
+package fmtd
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fenollp/fmtd/buildx"
+)
+
+// FileFormatter tells which formatter formats a file.
+type FileFormatter struct {
+	Path      string
+	Formatter string // e.g. go, json. Empty when no formatter handles the file.
+}
+
+// What tells which formatter Fmt would format each file with, given the same
+// arguments, without running Docker nor changing any file.
+// Files Fmt would skip are not listed.
+func What(pwd string, filenames []string, opts ...Option) ([]FileFormatter, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	paths, _, err := o.selectFiles(pwd, true, filenames)
+	if err != nil {
+		return nil, err
+	}
+	if o.detect {
+		if err := o.detectLanguages(pwd, paths); err != nil {
+			return nil, err
+		}
+	}
+	ffs := make([]FileFormatter, 0, len(paths))
+	for _, path := range paths {
+		ff := FileFormatter{Path: buildx.PathOfName(buildName(pwd, path))}
+		if r := o.ruleFor(path); r != nil {
+			ff.Formatter = r.name
+		}
+		ffs = append(ffs, ff)
+	}
+	return ffs, nil
+}
+
+// UnhandledExtension counts the files with an extension no formatter handles.
+type UnhandledExtension struct {
+	Ext   string // lowercased, e.g. .xyz. Empty for files without an extension.
+	Files int
+}
+
+// Unhandled lists the extensions of the files Fmt would leave alone as no
+// formatter handles them, given the same arguments, the most common first.
+// As with What, Docker is not run.
+func Unhandled(pwd string, filenames []string, opts ...Option) ([]UnhandledExtension, error) {
+	ffs, err := What(pwd, filenames, opts...)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for _, ff := range ffs {
+		if ff.Formatter == "" {
+			counts[strings.ToLower(filepath.Ext(ff.Path))]++
+		}
+	}
+	exts := make([]UnhandledExtension, 0, len(counts))
+	for ext, n := range counts {
+		exts = append(exts, UnhandledExtension{Ext: ext, Files: n})
+	}
+	sort.Slice(exts, func(i, j int) bool {
+		if exts[i].Files != exts[j].Files {
+			return exts[i].Files > exts[j].Files
+		}
+		return exts[i].Ext < exts[j].Ext
+	})
+	return exts, nil
+}
@@ -0,0 +1,171 @@
+package fmtd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/fenollp/fmtd/buildx"
+)
+
+// WorkspaceSpec describes one of the workspaces FmtWorkspaces formats:
+// Fmt is run with Pwd and Filenames, with Options on top of the shared ones.
+type WorkspaceSpec struct {
+	Pwd       string
+	Filenames []string
+	Options   []Option // e.g. WithConfig, WithBuildArg
+}
+
+// WorkspaceError is the failure of formatting the workspace at Pwd.
+type WorkspaceError struct {
+	Pwd string
+	Err error
+}
+
+func (e *WorkspaceError) Error() string { return e.Pwd + ": " + e.Err.Error() }
+
+// Unwrap returns the error Fmt returned.
+func (e *WorkspaceError) Unwrap() error { return e.Err }
+
+// WorkspaceErrors are the failures of FmtWorkspaces, in the order of its specs.
+type WorkspaceErrors []*WorkspaceError
+
+func (errs WorkspaceErrors) Error() string {
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// WithWorkspaceConcurrency has FmtWorkspaces format up to n workspaces at once.
+// Defaults to 1: workspaces are formatted one after the other.
+// Otherwise writers and functions given as options (e.g. WithResultFunc)
+// must be safe for concurrent use. Fmt ignores this option.
+func WithWorkspaceConcurrency(n int) Option {
+	return func(o *options) error {
+		if n < 1 {
+			n = 1
+		}
+		o.workspaces = n
+		return nil
+	}
+}
+
+// WithCancelOnFirstError has FmtWorkspaces stop on the first workspace Fmt fails
+// on for another reason than files failing to format or being unusable
+// (e.g. the Docker daemon being down): builds under way are torn down,
+// no other workspace is formatted and this first error is returned.
+// Fmt ignores this option.
+func WithCancelOnFirstError(cancel bool) Option {
+	return func(o *options) error {
+		o.cancelFirst = cancel
+		return nil
+	}
+}
+
+// fatal tells whether Fmt failing with err is more than
+// some of the workspace's files failing to format or being unusable.
+func fatal(err error) bool {
+	var ferr *FormatError
+	var serrs buildx.SelectionErrors
+	return err != nil && err != ErrDryRunFoundFiles && !errors.As(err, &ferr) && !errors.As(err, &serrs)
+}
+
+// FmtWorkspaces formats several workspaces (e.g. the sub-projects of a monorepo)
+// each with its own $PWD, files and options, as Fmt would.
+// opts apply to all workspaces. Each workspace's stdout is written in the order
+// of specs, files being listed relative to their workspace.
+// All workspaces are formatted even if some fail (see WithCancelOnFirstError):
+// their failures are returned as WorkspaceErrors. Otherwise ErrDryRunFoundFiles is returned if
+// any workspace would have had files modified.
+func FmtWorkspaces(
+	ctx context.Context,
+	dryrun bool,
+	stdout, stderr io.Writer,
+	specs []WorkspaceSpec,
+	opts ...Option,
+) error {
+	o, err := newOptions(opts)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var mu sync.Mutex
+	var first *WorkspaceError // fatal, with WithCancelOnFirstError
+	stopped := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return first != nil
+	}
+
+	stderr = &lockedWriter{w: stderr}
+	outs := make([]bytes.Buffer, len(specs))
+	errs := make([]error, len(specs))
+	sem := make(chan struct{}, o.workspaces)
+	var wg sync.WaitGroup
+	for i := range specs {
+		sem <- struct{}{}
+		if stopped() {
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+			spec := specs[i]
+			wsopts := append(append([]Option{}, opts...), spec.Options...)
+			errs[i] = Fmt(ctx, spec.Pwd, dryrun, &outs[i], stderr, spec.Filenames, wsopts...)
+			if o.cancelFirst && fatal(errs[i]) {
+				mu.Lock()
+				defer mu.Unlock()
+				if first == nil {
+					first = &WorkspaceError{Pwd: spec.Pwd, Err: errs[i]}
+					cancel()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if first != nil {
+		return first
+	}
+
+	var failures WorkspaceErrors
+	found := false
+	for i := range specs {
+		if _, err := outs[i].WriteTo(stdout); err != nil {
+			return err
+		}
+		switch errs[i] {
+		case nil:
+		case ErrDryRunFoundFiles:
+			found = true
+		default:
+			failures = append(failures, &WorkspaceError{Pwd: specs[i].Pwd, Err: errs[i]})
+		}
+	}
+	if len(failures) != 0 {
+		return failures
+	}
+	if found {
+		return ErrDryRunFoundFiles
+	}
+	return nil
+}
+
+// lockedWriter serializes writes to w.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.w.Write(p)
+}